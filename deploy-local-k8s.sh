@@ -167,6 +167,8 @@ DATABASE_URL="postgres://$DB_USER:$DB_PASSWORD@$DB_HOST:5432/$DB_NAME?sslmode=re
 
 # Generate random API token if not exists
 ADMIN_API_TOKEN=$(openssl rand -hex 32 2>/dev/null || echo "change-this-to-secure-token-$(date +%s)")
+# Shared by every engine replica to sign and verify download URLs
+DOWNLOAD_URL_SECRET=$(openssl rand -hex 32 2>/dev/null || echo "change-this-to-secure-secret-$(date +%s)")
 
 kubectl delete secret app-secrets -n crisp-game --ignore-not-found=true
 
@@ -175,6 +177,7 @@ kubectl create secret generic app-secrets -n crisp-game \
   --from-literal=AZURE_STORAGE_ACCOUNT="$STORAGE_ACCOUNT" \
   --from-literal=AZURE_STORAGE_KEY="$STORAGE_KEY" \
   --from-literal=ADMIN_API_TOKEN="$ADMIN_API_TOKEN" \
+  --from-literal=DOWNLOAD_URL_SECRET="$DOWNLOAD_URL_SECRET" \
   --from-literal=APPINSIGHTS_INSTRUMENTATIONKEY="$APPINSIGHTS_KEY"
 
 echo "✓ Secrets created"
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"time"
+
+	"embed"
+	"os"
+
+	"github.com/pressly/goose/v3"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/core"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/fota"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/fsck"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/mqtt"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/storage"
+)
+
+//go:embed migrations
+var embedMigrations embed.FS
+
+func main() {
+	config := core.LoadConfig()
+	db := core.ConnectDB()
+
+	// Handle database migrations
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		goose.SetBaseFS(embedMigrations)
+		if err := goose.Up(db, "migrations"); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// Check storage against the database
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(runFsck(db, os.Args[2:]))
+	}
+
+	// Move firmware stored before content addressing to SHA-256 blobs
+	if len(os.Args) > 1 && os.Args[1] == "rehash" {
+		os.Exit(runRehash(db, config))
+	}
+
+	go mqtt.StartWorker(db, config.MQTTBroker)
+
+	// Initialize storage
+	stor, err := storage.NewStorage(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	defer stor.Close()
+
+	notifier := mqtt.NewNotifier(config.MQTTBroker)
+
+	fotaHandler, err := fota.NewHandler(db, stor, notifier, config)
+	if err != nil {
+		log.Fatalf("Failed to create FOTA handler: %v", err)
+	}
+
+	go fotaHandler.CollectUploadSessions(context.Background(), 15*time.Minute)
+	go fotaHandler.AnnounceScheduledReleases(context.Background(), time.Minute)
+
+	http.HandleFunc("/api/fota/check", fotaHandler.CheckUpdate)
+	http.HandleFunc("/api/fota/download", fotaHandler.DownloadBin)
+	http.HandleFunc("/api/fota/upload", fotaHandler.UploadBin)
+	http.HandleFunc("/api/fota/upload/bundle", fotaHandler.UploadBundle)
+	http.HandleFunc("/api/fota/uploads", fotaHandler.UploadSessions)
+	http.HandleFunc("/api/fota/uploads/chunk", fotaHandler.UploadChunk)
+	http.HandleFunc("/api/fota/uploads/finalize", fotaHandler.FinalizeUpload)
+	http.HandleFunc("/api/fota/games", fotaHandler.Games)
+	http.HandleFunc("/api/fota/boards", fotaHandler.Boards)
+	http.HandleFunc("/api/fota/devices/channel", fotaHandler.DeviceChannels)
+	http.HandleFunc("/api/fota/rollout/ramp", fotaHandler.RampRollout)
+	http.HandleFunc("/api/fota/rollout/pause", fotaHandler.PauseRollout)
+	http.HandleFunc("/api/fota/rollout/resume", fotaHandler.ResumeRollout)
+	http.HandleFunc("/api/fota/webflash/manifest.json", fotaHandler.WebFlashManifest)
+	http.HandleFunc("/api/fota/keys", fotaHandler.SigningKeys)
+	http.HandleFunc("/api/fota/encryption/keys", fotaHandler.EncryptionKeys)
+	http.HandleFunc("/api/fota/releases", fotaHandler.Releases)
+	http.HandleFunc("/api/fota/releases/deactivate", fotaHandler.DeactivateRelease)
+	http.HandleFunc("/api/fota/releases/reactivate", fotaHandler.ReactivateRelease)
+	http.HandleFunc("/api/fota/releases/promote", fotaHandler.PromoteRelease)
+	http.HandleFunc("/api/fota/releases/unpromote", fotaHandler.UnpromoteRelease)
+	http.HandleFunc("/api/fota/releases/schedule", fotaHandler.ScheduleRelease)
+	http.HandleFunc("/api/fota/releases/recall", fotaHandler.RecallRelease)
+	http.HandleFunc("/api/fota/releases/unrecall", fotaHandler.UnrecallRelease)
+	http.HandleFunc("/api/fota/groups", fotaHandler.Groups)
+	http.HandleFunc("/api/fota/groups/members", fotaHandler.GroupMembers)
+	http.HandleFunc("/api/fota/groups/windows", fotaHandler.GroupWindows)
+	http.HandleFunc("/api/fota/pins", fotaHandler.Pins)
+	http.HandleFunc("/api/fota/report", fotaHandler.ReportUpdate)
+	http.HandleFunc("/api/fota/report/outcomes", fotaHandler.UpdateOutcomes)
+	http.HandleFunc("/api/fota/devices/history", fotaHandler.DeviceUpdateHistory)
+	http.HandleFunc("/api/fota/stats", fotaHandler.ReleaseStatistics)
+
+	port := config.Port
+	if port == "" {
+		port = "8081"
+	}
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Ready"))
+	})
+
+	log.Printf("Engine starting on port %s", port)
+	if err := http.ListenAndServe(":"+port, nil); err != nil {
+		log.Fatalf("Server failed: %v", err)
+	}
+}
+
+// runFsck reports blobs that are missing, differ from the database or are
+// referenced by nothing, and returns the process exit code: 1 when problems
+// remain, 2 when the check could not run.
+func runFsck(db *sql.DB, args []string) int {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	verify := flags.Bool("verify-checksums", false, "download and re-hash every referenced blob")
+	deleteOrphans := flags.Bool("delete-orphans", false, "delete unreferenced blobs older than -grace")
+	grace := flags.Duration("grace", 72*time.Hour, "minimum age of orphans deleted by -delete-orphans")
+	flags.Parse(args)
+
+	stor, err := storage.NewStorage(context.Background())
+	if err != nil {
+		log.Printf("Failed to initialize storage: %v", err)
+		return 2
+	}
+	defer stor.Close()
+
+	report, err := fsck.Run(context.Background(), db, stor, fsck.Options{
+		VerifyChecksums: *verify,
+		DeleteOrphans:   *deleteOrphans,
+		GracePeriod:     *grace,
+	})
+	if err != nil {
+		log.Printf("Consistency check failed: %v", err)
+		return 2
+	}
+
+	for _, issue := range report.Issues {
+		log.Printf("%s: %s %s %s", issue.Kind, issue.BlobName, issue.Owner, issue.Detail)
+	}
+	log.Printf("Checked %d references against %d blobs (%d re-hashed): %d problems, %d orphans deleted",
+		report.References, report.Blobs, report.Verified, report.Problems(), report.OrphansDeleted)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+
+	if report.Problems() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runRehash re-hashes firmware stored before content addressing and returns
+// the process exit code: 1 when some rows could not be migrated.
+func runRehash(db *sql.DB, config *core.Config) int {
+	stor, err := storage.NewStorage(context.Background())
+	if err != nil {
+		log.Printf("Failed to initialize storage: %v", err)
+		return 2
+	}
+	defer stor.Close()
+
+	fotaHandler, err := fota.NewHandler(db, stor, nil, config)
+	if err != nil {
+		log.Printf("Failed to create FOTA handler: %v", err)
+		return 2
+	}
+
+	result, err := fotaHandler.RehashFirmware(context.Background())
+	if err != nil {
+		log.Printf("Rehash failed: %v", err)
+		return 2
+	}
+
+	log.Printf("Rehashed %d firmware images, %d failed", result.Migrated, result.Failed)
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
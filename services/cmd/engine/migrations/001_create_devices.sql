@@ -0,0 +1,16 @@
+-- +goose Up
+-- Create devices table
+CREATE TABLE IF NOT EXISTS devices (
+    id VARCHAR(50) PRIMARY KEY,
+    user_id INTEGER,
+    firmware_ver VARCHAR(20),
+    last_seen TIMESTAMP,
+    is_banned BOOLEAN DEFAULT FALSE
+);
+
+-- Create indexes
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices(user_id);
+CREATE INDEX IF NOT EXISTS idx_devices_last_seen ON devices(last_seen DESC);
+
+-- +goose Down
+DROP TABLE IF EXISTS devices CASCADE;
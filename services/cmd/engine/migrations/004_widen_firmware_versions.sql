@@ -0,0 +1,8 @@
+-- +goose Up
+-- Semver strings with pre-release and build metadata do not fit in 20 chars
+ALTER TABLE firmwares ALTER COLUMN version TYPE VARCHAR(64);
+ALTER TABLE devices ALTER COLUMN firmware_ver TYPE VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE devices ALTER COLUMN firmware_ver TYPE VARCHAR(20);
+ALTER TABLE firmwares ALTER COLUMN version TYPE VARCHAR(20);
@@ -0,0 +1,41 @@
+-- +goose Up
+-- Create games catalog
+CREATE TABLE IF NOT EXISTS games (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) NOT NULL UNIQUE,
+    title VARCHAR(100) NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Firmwares uploaded before the catalog existed belong to the original title
+INSERT INTO games (code, title, description)
+VALUES ('crisp-games', 'Crisp Games', 'Original crisp-game-lib collection')
+ON CONFLICT (code) DO NOTHING;
+
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS game_id INTEGER REFERENCES games(id);
+UPDATE firmwares SET game_id = (SELECT id FROM games WHERE code = 'crisp-games') WHERE game_id IS NULL;
+ALTER TABLE firmwares ALTER COLUMN game_id SET NOT NULL;
+
+-- Versions are unique per game, not globally
+ALTER TABLE firmwares DROP CONSTRAINT IF EXISTS firmwares_version_key;
+ALTER TABLE firmwares ADD CONSTRAINT firmwares_game_version_key UNIQUE (game_id, version);
+
+DROP INDEX IF EXISTS idx_firmwares_is_active;
+CREATE INDEX IF NOT EXISTS idx_firmwares_game_active ON firmwares(game_id, is_active);
+
+-- Game the device currently runs, used when a check request omits it
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS game_code VARCHAR(50);
+UPDATE devices SET game_code = 'crisp-games' WHERE game_code IS NULL;
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS game_code;
+
+DROP INDEX IF EXISTS idx_firmwares_game_active;
+CREATE INDEX IF NOT EXISTS idx_firmwares_is_active ON firmwares(is_active, created_at DESC);
+
+ALTER TABLE firmwares DROP CONSTRAINT IF EXISTS firmwares_game_version_key;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS game_id;
+ALTER TABLE firmwares ADD CONSTRAINT firmwares_version_key UNIQUE (version);
+
+DROP TABLE IF EXISTS games CASCADE;
@@ -0,0 +1,13 @@
+-- +goose Up
+-- Release channel of each firmware and the channel each device follows
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS channel VARCHAR(20) NOT NULL DEFAULT 'stable'
+    CHECK (channel IN ('stable', 'beta', 'nightly'));
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS fota_channel VARCHAR(20) NOT NULL DEFAULT 'stable'
+    CHECK (fota_channel IN ('stable', 'beta', 'nightly'));
+
+CREATE INDEX IF NOT EXISTS idx_devices_fota_channel ON devices(fota_channel);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_devices_fota_channel;
+ALTER TABLE devices DROP COLUMN IF EXISTS fota_channel;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS channel;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- Staged rollout state of each firmware release
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS rollout_percent SMALLINT NOT NULL DEFAULT 100
+    CHECK (rollout_percent BETWEEN 0 AND 100);
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS rollout_paused BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- +goose Down
+ALTER TABLE firmwares DROP COLUMN IF EXISTS rollout_paused;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS rollout_percent;
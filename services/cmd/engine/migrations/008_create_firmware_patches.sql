@@ -0,0 +1,16 @@
+-- +goose Up
+-- Binary patches from earlier versions to a firmware release
+CREATE TABLE IF NOT EXISTS firmware_patches (
+    id SERIAL PRIMARY KEY,
+    firmware_id INTEGER NOT NULL REFERENCES firmwares(id) ON DELETE CASCADE,
+    from_version VARCHAR(64) NOT NULL,
+    blob_name VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT firmware_patches_firmware_from_key UNIQUE (firmware_id, from_version)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS firmware_patches CASCADE;
@@ -0,0 +1,10 @@
+-- +goose Up
+-- SHA-256 digest of each image and its Ed25519 signature
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS sha256 VARCHAR(64);
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS signature TEXT;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS signing_key_id VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE firmwares DROP COLUMN IF EXISTS signing_key_id;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS signature;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS sha256;
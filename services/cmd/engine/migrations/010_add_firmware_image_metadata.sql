@@ -0,0 +1,22 @@
+-- +goose Up
+-- Metadata extracted from the ESP-IDF image header and esp_app_desc_t
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS chip_id INTEGER;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS min_chip_rev INTEGER;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS max_chip_rev INTEGER;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS flash_size_mb INTEGER;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS app_project_name VARCHAR(32);
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS app_version VARCHAR(32);
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS idf_version VARCHAR(32);
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS app_build_date VARCHAR(32);
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS app_elf_sha256 VARCHAR(64);
+
+-- +goose Down
+ALTER TABLE firmwares DROP COLUMN IF EXISTS app_elf_sha256;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS app_build_date;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS idf_version;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS app_version;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS app_project_name;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS flash_size_mb;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS max_chip_rev;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS min_chip_rev;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS chip_id;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- Update outcomes reported by devices, one row per install attempt
+CREATE TABLE IF NOT EXISTS update_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    device_id VARCHAR(50) NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    game_id INTEGER NOT NULL REFERENCES games(id) ON DELETE CASCADE,
+    firmware_id INTEGER REFERENCES firmwares(id) ON DELETE SET NULL,
+    from_version VARCHAR(64),
+    target_version VARCHAR(64) NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    error_code INTEGER,
+    error_message TEXT,
+    started_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    finished_at TIMESTAMP,
+
+    CONSTRAINT update_attempts_status_check CHECK (status IN ('downloading', 'installed', 'failed', 'rolled_back'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_update_attempts_device ON update_attempts(device_id, started_at DESC);
+CREATE INDEX IF NOT EXISTS idx_update_attempts_firmware ON update_attempts(firmware_id, status);
+
+-- +goose Down
+DROP TABLE IF EXISTS update_attempts CASCADE;
@@ -0,0 +1,9 @@
+-- +goose Up
+-- A promoted release is served as the latest of its channel regardless of
+-- newer uploads, at most one per game and channel
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS is_promoted BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_firmwares_promoted ON firmwares(game_id, channel) WHERE is_promoted;
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_firmwares_promoted;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS is_promoted;
@@ -0,0 +1,38 @@
+-- +goose Up
+-- Named groups of devices, e.g. demo units or a partner's fleet
+CREATE TABLE IF NOT EXISTS device_groups (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS device_group_members (
+    group_id INTEGER NOT NULL REFERENCES device_groups(id) ON DELETE CASCADE,
+    device_id VARCHAR(50) NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    added_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (group_id, device_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_group_members_device ON device_group_members(device_id);
+
+-- Pins hold a device or every device of a group on an exact version of a game
+CREATE TABLE IF NOT EXISTS firmware_pins (
+    id SERIAL PRIMARY KEY,
+    game_id INTEGER NOT NULL REFERENCES games(id) ON DELETE CASCADE,
+    device_id VARCHAR(50) REFERENCES devices(id) ON DELETE CASCADE,
+    group_id INTEGER REFERENCES device_groups(id) ON DELETE CASCADE,
+    version VARCHAR(64) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT firmware_pins_target_check CHECK ((device_id IS NULL) <> (group_id IS NULL)),
+    CONSTRAINT firmware_pins_game_device_key UNIQUE (game_id, device_id),
+    CONSTRAINT firmware_pins_game_group_key UNIQUE (game_id, group_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS firmware_pins CASCADE;
+DROP TABLE IF EXISTS device_group_members CASCADE;
+DROP TABLE IF EXISTS device_groups CASCADE;
@@ -0,0 +1,47 @@
+-- +goose Up
+-- Hardware the firmware is built for. chip_id is the ESP image header chip
+-- ID and flash_size_mb the flash fitted to the board.
+CREATE TABLE IF NOT EXISTS boards (
+    id SERIAL PRIMARY KEY,
+    code VARCHAR(50) NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    chip_id INTEGER NOT NULL,
+    flash_size_mb INTEGER NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+-- Every firmware so far was built for the M5StickC Plus
+INSERT INTO boards (code, name, chip_id, flash_size_mb, description)
+VALUES ('m5stickc-plus', 'M5StickC Plus', 0, 4, 'M5Stack M5StickC Plus (ESP32-PICO-D4)')
+ON CONFLICT (code) DO NOTHING;
+
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS board_id INTEGER REFERENCES boards(id);
+UPDATE firmwares SET board_id = (SELECT id FROM boards WHERE code = 'm5stickc-plus') WHERE board_id IS NULL;
+ALTER TABLE firmwares ALTER COLUMN board_id SET NOT NULL;
+
+-- The same version can be built for several boards
+ALTER TABLE firmwares DROP CONSTRAINT IF EXISTS firmwares_game_version_key;
+ALTER TABLE firmwares ADD CONSTRAINT firmwares_game_board_version_key UNIQUE (game_id, board_id, version);
+
+DROP INDEX IF EXISTS idx_firmwares_promoted;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_firmwares_promoted ON firmwares(game_id, board_id, channel) WHERE is_promoted;
+
+-- Hardware reported by devices in check requests
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS board_code VARCHAR(50);
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS chip_rev INTEGER;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS flash_size_mb INTEGER;
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS flash_size_mb;
+ALTER TABLE devices DROP COLUMN IF EXISTS chip_rev;
+ALTER TABLE devices DROP COLUMN IF EXISTS board_code;
+
+DROP INDEX IF EXISTS idx_firmwares_promoted;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_firmwares_promoted ON firmwares(game_id, channel) WHERE is_promoted;
+
+ALTER TABLE firmwares DROP CONSTRAINT IF EXISTS firmwares_game_board_version_key;
+ALTER TABLE firmwares ADD CONSTRAINT firmwares_game_version_key UNIQUE (game_id, version);
+ALTER TABLE firmwares DROP COLUMN IF EXISTS board_id;
+
+DROP TABLE IF EXISTS boards CASCADE;
@@ -0,0 +1,24 @@
+-- +goose Up
+-- A release is only offered between publish_at and unpublish_at; NULL leaves
+-- that side open
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS publish_at TIMESTAMPTZ;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS unpublish_at TIMESTAMPTZ;
+
+-- Daily time-of-day ranges in which members of a group may update. A range
+-- with start_time after end_time wraps past midnight.
+CREATE TABLE IF NOT EXISTS update_windows (
+    id SERIAL PRIMARY KEY,
+    group_id INTEGER NOT NULL REFERENCES device_groups(id) ON DELETE CASCADE,
+    start_time TIME NOT NULL,
+    end_time TIME NOT NULL,
+    time_zone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_update_windows_group_id ON update_windows(group_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS update_windows CASCADE;
+
+ALTER TABLE firmwares DROP COLUMN IF EXISTS unpublish_at;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS publish_at;
@@ -0,0 +1,16 @@
+-- +goose Up
+-- Builds below a game's minimum supported version must update and may not
+-- submit scores
+ALTER TABLE games ADD COLUMN IF NOT EXISTS min_supported_version VARCHAR(64);
+
+-- Recalled releases are never offered; devices running one must update
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS is_recalled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS recall_reason TEXT;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS recalled_at TIMESTAMP;
+
+-- +goose Down
+ALTER TABLE firmwares DROP COLUMN IF EXISTS recalled_at;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS recall_reason;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS is_recalled;
+
+ALTER TABLE games DROP COLUMN IF EXISTS min_supported_version;
@@ -0,0 +1,28 @@
+-- +goose Up
+-- Audit log of update checks and firmware downloads served by the engine
+CREATE TABLE IF NOT EXISTS fota_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_type VARCHAR(20) NOT NULL CHECK (event_type IN ('check', 'download')),
+    device_id VARCHAR(50),
+    game_id INTEGER NOT NULL REFERENCES games(id) ON DELETE CASCADE,
+    firmware_id INTEGER REFERENCES firmwares(id) ON DELETE SET NULL,
+    board_code VARCHAR(50),
+    from_version VARCHAR(64),
+    to_version VARCHAR(64),
+    -- check: update_available, no_update; download: completed, aborted, or
+    -- issued for a storage-signed URL handed out by a check
+    outcome VARCHAR(20) NOT NULL,
+    is_patch BOOLEAN NOT NULL DEFAULT FALSE,
+    bytes_served BIGINT NOT NULL DEFAULT 0,
+    bytes_expected BIGINT NOT NULL DEFAULT 0,
+    duration_ms INTEGER NOT NULL DEFAULT 0,
+    client_ip VARCHAR(45),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_fota_events_firmware_id ON fota_events(firmware_id, event_type);
+CREATE INDEX IF NOT EXISTS idx_fota_events_device_id ON fota_events(device_id, created_at DESC);
+CREATE INDEX IF NOT EXISTS idx_fota_events_created_at ON fota_events(created_at DESC);
+
+-- +goose Down
+DROP TABLE IF EXISTS fota_events CASCADE;
@@ -0,0 +1,33 @@
+-- +goose Up
+-- Resumable chunked uploads. Chunks are stored as blobs under
+-- _uploads/<session id>/ until the session is finalized or expires.
+CREATE TABLE IF NOT EXISTS upload_sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    game_id INTEGER NOT NULL REFERENCES games(id),
+    board_id INTEGER NOT NULL REFERENCES boards(id),
+    version VARCHAR(64) NOT NULL,
+    channel VARCHAR(20) NOT NULL,
+    description TEXT,
+    rollout_percent INTEGER NOT NULL,
+    publish_at TIMESTAMPTZ,
+    unpublish_at TIMESTAMPTZ,
+    received BIGINT NOT NULL DEFAULT 0,
+    status VARCHAR(20) NOT NULL DEFAULT 'open' CHECK (status IN ('open', 'finalizing')),
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_upload_sessions_expires_at ON upload_sessions(expires_at);
+
+CREATE TABLE IF NOT EXISTS upload_chunks (
+    session_id VARCHAR(64) NOT NULL REFERENCES upload_sessions(id) ON DELETE CASCADE,
+    chunk_offset BIGINT NOT NULL,
+    size BIGINT NOT NULL,
+    blob_name VARCHAR(255) NOT NULL,
+    PRIMARY KEY (session_id, chunk_offset)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS upload_chunks CASCADE;
+DROP TABLE IF EXISTS upload_sessions CASCADE;
@@ -0,0 +1,8 @@
+-- +goose Up
+-- Firmware images are stored under their SHA-256 digest and shared by every
+-- release with the same content. Rows uploaded earlier keep their blob until
+-- "engine-app rehash" moves them.
+CREATE INDEX IF NOT EXISTS idx_firmwares_blob_name ON firmwares(blob_name);
+
+-- +goose Down
+DROP INDEX IF EXISTS idx_firmwares_blob_name;
@@ -0,0 +1,41 @@
+-- +goose Up
+-- RSA-3072 public keys for esp_encrypted_img artifacts, held per board or
+-- per device group. Devices keep the private key in their firmware.
+CREATE TABLE IF NOT EXISTS encryption_keys (
+    id SERIAL PRIMARY KEY,
+    key_id VARCHAR(64) NOT NULL UNIQUE,
+    board_id INTEGER REFERENCES boards(id) ON DELETE CASCADE,
+    group_id INTEGER REFERENCES device_groups(id) ON DELETE CASCADE,
+    public_key TEXT NOT NULL,
+    fingerprint VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT encryption_keys_target_check CHECK ((board_id IS NULL) <> (group_id IS NULL)),
+    CONSTRAINT encryption_keys_board_key UNIQUE (board_id),
+    CONSTRAINT encryption_keys_group_key UNIQUE (group_id)
+);
+
+-- Releases uploaded with encrypt=true get an artifact per applicable key
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS encrypt BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE upload_sessions ADD COLUMN IF NOT EXISTS encrypt BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS firmware_encrypted (
+    firmware_id INTEGER NOT NULL REFERENCES firmwares(id) ON DELETE CASCADE,
+    encryption_key_id INTEGER NOT NULL REFERENCES encryption_keys(id) ON DELETE CASCADE,
+    blob_name VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (firmware_id, encryption_key_id)
+);
+
+-- Devices report whether they can install pre-encrypted images
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS supports_encrypted_ota BOOLEAN;
+
+-- +goose Down
+ALTER TABLE devices DROP COLUMN IF EXISTS supports_encrypted_ota;
+DROP TABLE IF EXISTS firmware_encrypted CASCADE;
+ALTER TABLE upload_sessions DROP COLUMN IF EXISTS encrypt;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS encrypt;
+DROP TABLE IF EXISTS encryption_keys CASCADE;
@@ -0,0 +1,28 @@
+-- +goose Up
+-- Extra flash images shipped with a release by a bundle upload: bootloader,
+-- partition table and data partitions (SPIFFS/LittleFS assets, ...). The
+-- app image itself stays the firmwares row. Images are content-addressed
+-- like firmware and may be shared between releases.
+CREATE TABLE IF NOT EXISTS firmware_partitions (
+    id SERIAL PRIMARY KEY,
+    firmware_id INTEGER NOT NULL REFERENCES firmwares(id) ON DELETE CASCADE,
+    label VARCHAR(16) NOT NULL,
+    part_type VARCHAR(16) NOT NULL,
+    flash_offset BIGINT,
+    blob_name VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    CONSTRAINT firmware_partitions_label UNIQUE (firmware_id, label)
+);
+
+CREATE INDEX IF NOT EXISTS idx_firmware_partitions_blob_name ON firmware_partitions(blob_name);
+
+-- Downloads of a bundle's other images are audited apart from the app image
+ALTER TABLE fota_events ADD COLUMN IF NOT EXISTS partition_label VARCHAR(16);
+
+-- +goose Down
+ALTER TABLE fota_events DROP COLUMN IF EXISTS partition_label;
+DROP TABLE IF EXISTS firmware_partitions CASCADE;
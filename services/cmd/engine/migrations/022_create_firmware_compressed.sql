@@ -0,0 +1,26 @@
+-- +goose Up
+-- Compressed copies of release images, made after upload for devices that
+-- inflate while writing to flash. A copy is only kept when it is smaller
+-- than the image; checksum and sha256 describe the compressed bytes.
+CREATE TABLE IF NOT EXISTS firmware_compressed (
+    firmware_id INTEGER NOT NULL REFERENCES firmwares(id) ON DELETE CASCADE,
+    encoding VARCHAR(16) NOT NULL,
+    blob_name VARCHAR(255) NOT NULL,
+    file_size BIGINT NOT NULL,
+    checksum VARCHAR(64) NOT NULL,
+    sha256 VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (firmware_id, encoding)
+);
+
+-- Devices report the encodings they can inflate
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS ota_encodings TEXT[];
+
+-- Downloads record the encoding they were served with
+ALTER TABLE fota_events ADD COLUMN IF NOT EXISTS content_encoding VARCHAR(16);
+
+-- +goose Down
+ALTER TABLE fota_events DROP COLUMN IF EXISTS content_encoding;
+ALTER TABLE devices DROP COLUMN IF EXISTS ota_encodings;
+DROP TABLE IF EXISTS firmware_compressed CASCADE;
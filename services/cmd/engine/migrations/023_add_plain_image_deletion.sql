@@ -0,0 +1,11 @@
+-- +goose Up
+-- The plain image of an encrypt release is deleted once every key has its
+-- encrypted artifact; the row keeps describing the image. The escrow copy,
+-- the image sealed with the engine's escrow key, is kept so keys set later
+-- can still be applied.
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS plain_deleted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS escrow_blob_name VARCHAR(255);
+
+-- +goose Down
+ALTER TABLE firmwares DROP COLUMN IF EXISTS escrow_blob_name;
+ALTER TABLE firmwares DROP COLUMN IF EXISTS plain_deleted;
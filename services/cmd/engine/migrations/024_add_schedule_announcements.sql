@@ -0,0 +1,8 @@
+-- +goose Up
+-- When the engine last announced a release's publish_at or unpublish_at
+-- passing. Releases already live are treated as announced.
+ALTER TABLE firmwares ADD COLUMN IF NOT EXISTS schedule_announced_at TIMESTAMPTZ;
+UPDATE firmwares SET schedule_announced_at = NOW() WHERE schedule_announced_at IS NULL;
+
+-- +goose Down
+ALTER TABLE firmwares DROP COLUMN IF EXISTS schedule_announced_at;
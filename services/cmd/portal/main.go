@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/core"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/portal/handlers"
+	"github.com/gin-gonic/gin"
+)
+
+func main() {
+	config := core.LoadConfig()
+	db := core.ConnectDB()
+
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.Default()
+
+	r.LoadHTMLGlob("internal/portal/templates/*.html")
+
+	h := handlers.NewHandler(db, config.EnginePublicURL)
+
+	r.GET("/health", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ok"})
+	})
+
+	r.GET("/ready", func(c *gin.Context) {
+		c.JSON(200, gin.H{"status": "ready"})
+	})
+
+	r.GET("/", h.ShowDevices)
+	r.GET("/device/:id", h.ShowDeviceDetail)
+	r.GET("/games", h.ShowGames)
+	r.GET("/leaderboard/:game", h.ShowLeaderboard)
+	r.GET("/firmware", h.ShowFirmware)
+	r.GET("/install", h.ShowInstall)
+
+	log.Printf("Portal starting on port %s", config.Port)
+	if err := r.Run(":" + config.Port); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games
 go 1.24.0
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/gin-gonic/gin v1.11.0
 	github.com/lib/pq v1.10.9
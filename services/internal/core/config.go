@@ -14,6 +14,19 @@ type Config struct {
 	StorageType         string
 	LocalStoragePath    string
 	AdminAPIToken       string
+	SigningKey          string
+	SigningKeyID        string
+	VerificationKeys    string
+	ManifestTTL         string
+	MaxFirmwareSize     string
+	DownloadURLSecret   string
+	DownloadURLTTL      string
+	NotifyDevices       string
+	UploadChunkSize     string
+	UploadSessionTTL    string
+	EnginePublicURL     string
+	EscrowKey           string
+	TrustedProxies      string
 }
 
 func LoadConfig() *Config {
@@ -27,6 +40,19 @@ func LoadConfig() *Config {
 		StorageType:         getEnv("STORAGE_TYPE", ""),
 		LocalStoragePath:    getEnv("LOCAL_STORAGE_PATH", "./firmware_storage"),
 		AdminAPIToken:       getEnv("ADMIN_API_TOKEN", ""),
+		SigningKey:          getEnv("FOTA_SIGNING_KEY", ""),
+		SigningKeyID:        getEnv("FOTA_SIGNING_KEY_ID", "default"),
+		VerificationKeys:    getEnv("FOTA_VERIFICATION_KEYS", ""),
+		ManifestTTL:         getEnv("FOTA_MANIFEST_TTL", "1h"),
+		MaxFirmwareSize:     getEnv("FOTA_MAX_FIRMWARE_SIZE", "16777216"),
+		DownloadURLSecret:   getEnv("DOWNLOAD_URL_SECRET", ""),
+		DownloadURLTTL:      getEnv("DOWNLOAD_URL_TTL", "15m"),
+		NotifyDevices:       getEnv("FOTA_NOTIFY_DEVICES", "false"),
+		UploadChunkSize:     getEnv("FOTA_UPLOAD_CHUNK_SIZE", "8388608"),
+		UploadSessionTTL:    getEnv("FOTA_UPLOAD_SESSION_TTL", "24h"),
+		EnginePublicURL:     getEnv("ENGINE_PUBLIC_URL", ""),
+		EscrowKey:           getEnv("FOTA_ESCROW_KEY", ""),
+		TrustedProxies:      getEnv("TRUSTED_PROXIES", ""),
 	}
 }
 
@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type Board struct {
+	ID          int64     `db:"id"`
+	Code        string    `db:"code"`
+	Name        string    `db:"name"`
+	ChipID      int       `db:"chip_id"`
+	FlashSizeMB int       `db:"flash_size_mb"`
+	Description *string   `db:"description"`
+	CreatedAt   time.Time `db:"created_at"`
+}
@@ -8,4 +8,11 @@ type Device struct {
     FirmwareVer string
     LastSeen    time.Time
     IsBanned    bool
+    GameCode    string
+    FotaChannel string
+    BoardCode   string
+    ChipRev     int
+    FlashSizeMB int
+    SupportsEncryptedOTA *bool
+    OTAEncodings []string
 }
\ No newline at end of file
@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+type DeviceGroup struct {
+	ID          int64     `db:"id"`
+	Name        string    `db:"name"`
+	Description *string   `db:"description"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type DeviceGroupMember struct {
+	GroupID  int64     `db:"group_id"`
+	DeviceID string    `db:"device_id"`
+	AddedAt  time.Time `db:"added_at"`
+}
+
+type FirmwarePin struct {
+	ID        int64     `db:"id"`
+	GameID    int64     `db:"game_id"`
+	DeviceID  *string   `db:"device_id"`
+	GroupID   *int64    `db:"group_id"`
+	Version   string    `db:"version"`
+	Reason    *string   `db:"reason"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type UpdateWindow struct {
+	ID        int64     `db:"id"`
+	GroupID   int64     `db:"group_id"`
+	StartTime string    `db:"start_time"`
+	EndTime   string    `db:"end_time"`
+	TimeZone  string    `db:"time_zone"`
+	CreatedAt time.Time `db:"created_at"`
+}
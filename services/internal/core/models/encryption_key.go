@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+type EncryptionKey struct {
+	ID          int64     `db:"id"`
+	KeyID       string    `db:"key_id"`
+	BoardID     *int64    `db:"board_id"`
+	GroupID     *int64    `db:"group_id"`
+	PublicKey   string    `db:"public_key"`
+	Fingerprint string    `db:"fingerprint"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type FirmwareEncrypted struct {
+	FirmwareID      int64     `db:"firmware_id"`
+	EncryptionKeyID int64     `db:"encryption_key_id"`
+	BlobName        string    `db:"blob_name"`
+	FileSize        int64     `db:"file_size"`
+	SHA256          string    `db:"sha256"`
+	CreatedAt       time.Time `db:"created_at"`
+}
@@ -3,12 +3,37 @@ package models
 import "time"
 
 type Firmware struct {
-	ID          int64     `db:"id"`
-	Version     string    `db:"version"`
-	FilePath    string    `db:"file_path"`
-	Description string    `db:"description"`
-	FileSize    int64     `db:"file_size"`
-	Checksum    string    `db:"checksum"`
-	CreatedAt   time.Time `db:"created_at"`
-	IsActive    bool      `db:"is_active"`
+	ID             int64      `db:"id"`
+	GameID         int64      `db:"game_id"`
+	BoardID        int64      `db:"board_id"`
+	Version        string     `db:"version"`
+	FilePath       string     `db:"file_path"`
+	Description    string     `db:"description"`
+	FileSize       int64      `db:"file_size"`
+	Checksum       string     `db:"checksum"`
+	CreatedAt      time.Time  `db:"created_at"`
+	IsActive       bool       `db:"is_active"`
+	IsPromoted     bool       `db:"is_promoted"`
+	IsRecalled     bool       `db:"is_recalled"`
+	RecallReason   *string    `db:"recall_reason"`
+	RecalledAt     *time.Time `db:"recalled_at"`
+	Channel        string     `db:"channel"`
+	RolloutPercent int        `db:"rollout_percent"`
+	RolloutPaused  bool       `db:"rollout_paused"`
+	PublishAt      *time.Time `db:"publish_at"`
+	UnpublishAt    *time.Time `db:"unpublish_at"`
+	SHA256         *string    `db:"sha256"`
+	Signature      *string    `db:"signature"`
+	SigningKeyID   *string    `db:"signing_key_id"`
+	ChipID         *int       `db:"chip_id"`
+	MinChipRev     *int       `db:"min_chip_rev"`
+	MaxChipRev     *int       `db:"max_chip_rev"`
+	FlashSizeMB    *int       `db:"flash_size_mb"`
+	AppProjectName *string    `db:"app_project_name"`
+	AppVersion     *string    `db:"app_version"`
+	IDFVersion     *string    `db:"idf_version"`
+	AppBuildDate   *string    `db:"app_build_date"`
+	AppELFSHA256   *string    `db:"app_elf_sha256"`
+	Encrypt        bool       `db:"encrypt"`
+	PlainDeleted   bool       `db:"plain_deleted"`
 }
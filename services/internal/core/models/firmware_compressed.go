@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type FirmwareCompressed struct {
+	FirmwareID int64     `db:"firmware_id"`
+	Encoding   string    `db:"encoding"`
+	BlobName   string    `db:"blob_name"`
+	FileSize   int64     `db:"file_size"`
+	Checksum   string    `db:"checksum"`
+	SHA256     string    `db:"sha256"`
+	CreatedAt  time.Time `db:"created_at"`
+}
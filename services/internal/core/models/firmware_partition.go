@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type FirmwarePartition struct {
+	ID          int64     `db:"id"`
+	FirmwareID  int64     `db:"firmware_id"`
+	Label       string    `db:"label"`
+	PartType    string    `db:"part_type"`
+	FlashOffset *int64    `db:"flash_offset"`
+	BlobName    string    `db:"blob_name"`
+	FileSize    int64     `db:"file_size"`
+	Checksum    string    `db:"checksum"`
+	SHA256      string    `db:"sha256"`
+	CreatedAt   time.Time `db:"created_at"`
+}
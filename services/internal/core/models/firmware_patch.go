@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+type FirmwarePatch struct {
+	ID          int64     `db:"id"`
+	FirmwareID  int64     `db:"firmware_id"`
+	FromVersion string    `db:"from_version"`
+	BlobName    string    `db:"blob_name"`
+	FileSize    int64     `db:"file_size"`
+	Checksum    string    `db:"checksum"`
+	CreatedAt   time.Time `db:"created_at"`
+}
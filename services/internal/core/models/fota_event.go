@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+type FotaEvent struct {
+	ID            int64     `db:"id"`
+	EventType     string    `db:"event_type"`
+	DeviceID      *string   `db:"device_id"`
+	GameID        int64     `db:"game_id"`
+	FirmwareID    *int64    `db:"firmware_id"`
+	BoardCode     *string   `db:"board_code"`
+	FromVersion   *string   `db:"from_version"`
+	ToVersion     *string   `db:"to_version"`
+	Outcome       string    `db:"outcome"`
+	IsPatch       bool      `db:"is_patch"`
+	Partition     *string   `db:"partition_label"`
+	Encoding      *string   `db:"content_encoding"`
+	BytesServed   int64     `db:"bytes_served"`
+	BytesExpected int64     `db:"bytes_expected"`
+	DurationMS    int       `db:"duration_ms"`
+	ClientIP      *string   `db:"client_ip"`
+	CreatedAt     time.Time `db:"created_at"`
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+type Game struct {
+	ID                  int64     `db:"id"`
+	Code                string    `db:"code"`
+	Title               string    `db:"title"`
+	Description         string    `db:"description"`
+	MinSupportedVersion *string   `db:"min_supported_version"`
+	CreatedAt           time.Time `db:"created_at"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type UpdateAttempt struct {
+	ID            int64      `db:"id"`
+	DeviceID      string     `db:"device_id"`
+	GameID        int64      `db:"game_id"`
+	FirmwareID    *int64     `db:"firmware_id"`
+	FromVersion   *string    `db:"from_version"`
+	TargetVersion string     `db:"target_version"`
+	Status        string     `db:"status"`
+	ErrorCode     *int       `db:"error_code"`
+	ErrorMessage  *string    `db:"error_message"`
+	StartedAt     time.Time  `db:"started_at"`
+	UpdatedAt     time.Time  `db:"updated_at"`
+	FinishedAt    *time.Time `db:"finished_at"`
+}
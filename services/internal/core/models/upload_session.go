@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+type UploadSession struct {
+	ID             string     `db:"id"`
+	GameID         int64      `db:"game_id"`
+	BoardID        int64      `db:"board_id"`
+	Version        string     `db:"version"`
+	Channel        string     `db:"channel"`
+	Description    *string    `db:"description"`
+	RolloutPercent int        `db:"rollout_percent"`
+	PublishAt      *time.Time `db:"publish_at"`
+	UnpublishAt    *time.Time `db:"unpublish_at"`
+	Encrypt        bool       `db:"encrypt"`
+	Received       int64      `db:"received"`
+	Status         string     `db:"status"`
+	CreatedAt      time.Time  `db:"created_at"`
+	UpdatedAt      time.Time  `db:"updated_at"`
+	ExpiresAt      time.Time  `db:"expires_at"`
+}
+
+type UploadChunk struct {
+	SessionID   string `db:"session_id"`
+	ChunkOffset int64  `db:"chunk_offset"`
+	Size        int64  `db:"size"`
+	BlobName    string `db:"blob_name"`
+}
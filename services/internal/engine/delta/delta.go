@@ -0,0 +1,408 @@
+// Package delta creates and applies binary patches between firmware images.
+//
+// The algorithm is Colin Percival's bsdiff. Patches use the single-stream
+// layout of the ENDSLEY/BSDIFF43 format, but the stream is zlib-compressed
+// instead of bzip2 so an ESP32 can inflate it with the ROM miniz decoder
+// while writing the new image to flash:
+//
+//	offset 0   8 bytes  magic "CRISPDLT"
+//	offset 8   8 bytes  new image size, little endian
+//	offset 16  zlib stream of repeated blocks:
+//	             24 bytes control: diff length, extra length, old seek
+//	                      (int64, sign-magnitude, little endian)
+//	             diff bytes  (added to the old image bytes)
+//	             extra bytes (copied verbatim)
+package delta
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Format names the patch format advertised to devices
+const Format = "bsdiff-zlib"
+
+const (
+	magic      = "CRISPDLT"
+	headerSize = 16
+)
+
+var ErrCorruptPatch = errors.New("corrupt patch")
+
+// Diff returns a patch that turns oldData into newData
+func Diff(oldData, newData []byte) ([]byte, error) {
+	var out bytes.Buffer
+	out.WriteString(magic)
+	binary.Write(&out, binary.LittleEndian, uint64(len(newData)))
+
+	zw, err := zlib.NewWriterLevel(&out, zlib.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := diff(oldData, newData, zw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// Patch applies a patch produced by Diff to oldData
+func Patch(oldData, patch []byte) ([]byte, error) {
+	if len(patch) < headerSize || string(patch[:len(magic)]) != magic {
+		return nil, ErrCorruptPatch
+	}
+
+	newSize := binary.LittleEndian.Uint64(patch[len(magic):headerSize])
+	if newSize > 1<<31 {
+		return nil, ErrCorruptPatch
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(patch[headerSize:]))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptPatch, err)
+	}
+	defer zr.Close()
+
+	newData := make([]byte, newSize)
+	var ctrl [24]byte
+	var oldPos, newPos int64
+	for newPos < int64(newSize) {
+		if _, err := io.ReadFull(zr, ctrl[:]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptPatch, err)
+		}
+		diffLen := offtin(ctrl[0:8])
+		extraLen := offtin(ctrl[8:16])
+		seek := offtin(ctrl[16:24])
+
+		if diffLen < 0 || extraLen < 0 || newPos+diffLen+extraLen > int64(newSize) {
+			return nil, ErrCorruptPatch
+		}
+
+		chunk := newData[newPos : newPos+diffLen]
+		if _, err := io.ReadFull(zr, chunk); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptPatch, err)
+		}
+		for i := range chunk {
+			if p := oldPos + int64(i); p >= 0 && p < int64(len(oldData)) {
+				chunk[i] += oldData[p]
+			}
+		}
+		newPos += diffLen
+		oldPos += diffLen
+
+		if _, err := io.ReadFull(zr, newData[newPos:newPos+extraLen]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptPatch, err)
+		}
+		newPos += extraLen
+		oldPos += seek
+	}
+
+	return newData, nil
+}
+
+func diff(oldData, newData []byte, w io.Writer) error {
+	oldSize, newSize := len(oldData), len(newData)
+
+	I := make([]int, oldSize+1)
+	V := make([]int, oldSize+1)
+	qsufsort(I, V, oldData)
+
+	var ctrl [24]byte
+	var scan, pos, length int
+	var lastScan, lastPos, lastOffset int
+	for scan < newSize {
+		oldScore := 0
+
+		scan += length
+		for scsc := scan; scan < newSize; scan++ {
+			length, pos = search(I, oldData, newData[scan:], 0, oldSize)
+
+			for ; scsc < scan+length; scsc++ {
+				if scsc+lastOffset < oldSize && oldData[scsc+lastOffset] == newData[scsc] {
+					oldScore++
+				}
+			}
+
+			if (length == oldScore && length != 0) || length > oldScore+8 {
+				break
+			}
+
+			if scan+lastOffset < oldSize && oldData[scan+lastOffset] == newData[scan] {
+				oldScore--
+			}
+		}
+
+		if length == oldScore && scan != newSize {
+			continue
+		}
+
+		// Extend the previous match forwards...
+		s, sf, lenF := 0, 0, 0
+		for i := 0; lastScan+i < scan && lastPos+i < oldSize; {
+			if oldData[lastPos+i] == newData[lastScan+i] {
+				s++
+			}
+			i++
+			if s*2-i > sf*2-lenF {
+				sf = s
+				lenF = i
+			}
+		}
+
+		// ...and the current match backwards
+		lenB := 0
+		if scan < newSize {
+			s, sb := 0, 0
+			for i := 1; scan >= lastScan+i && pos >= i; i++ {
+				if oldData[pos-i] == newData[scan-i] {
+					s++
+				}
+				if s*2-i > sb*2-lenB {
+					sb = s
+					lenB = i
+				}
+			}
+		}
+
+		// Split any overlap between the two extensions
+		if lastScan+lenF > scan-lenB {
+			overlap := (lastScan + lenF) - (scan - lenB)
+			s, ss, lenS := 0, 0, 0
+			for i := 0; i < overlap; i++ {
+				if newData[lastScan+lenF-overlap+i] == oldData[lastPos+lenF-overlap+i] {
+					s++
+				}
+				if newData[scan-lenB+i] == oldData[pos-lenB+i] {
+					s--
+				}
+				if s > ss {
+					ss = s
+					lenS = i + 1
+				}
+			}
+			lenF += lenS - overlap
+			lenB -= lenS
+		}
+
+		extraLen := (scan - lenB) - (lastScan + lenF)
+		offtout(int64(lenF), ctrl[0:8])
+		offtout(int64(extraLen), ctrl[8:16])
+		offtout(int64((pos-lenB)-(lastPos+lenF)), ctrl[16:24])
+		if _, err := w.Write(ctrl[:]); err != nil {
+			return err
+		}
+
+		db := make([]byte, lenF)
+		for i := range db {
+			db[i] = newData[lastScan+i] - oldData[lastPos+i]
+		}
+		if _, err := w.Write(db); err != nil {
+			return err
+		}
+		if _, err := w.Write(newData[lastScan+lenF : scan-lenB]); err != nil {
+			return err
+		}
+
+		lastScan = scan - lenB
+		lastPos = pos - lenB
+		lastOffset = pos - scan
+	}
+
+	return nil
+}
+
+// search finds the longest prefix of target present in oldData using the
+// suffix array I, returning the match length and its position
+func search(I []int, oldData, target []byte, st, en int) (int, int) {
+	for en-st >= 2 {
+		x := st + (en-st)/2
+		suffix := oldData[I[x]:]
+		n := min(len(suffix), len(target))
+		if bytes.Compare(suffix[:n], target[:n]) < 0 {
+			st = x
+		} else {
+			en = x
+		}
+	}
+
+	x := matchLen(oldData[I[st]:], target)
+	y := matchLen(oldData[I[en]:], target)
+	if x > y {
+		return x, I[st]
+	}
+	return y, I[en]
+}
+
+func matchLen(a, b []byte) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// qsufsort builds the suffix array of buf into I using Larsson-Sadakane
+// prefix doubling, with V as the inverse/group array
+func qsufsort(I, V []int, buf []byte) {
+	var buckets [256]int
+	n := len(buf)
+
+	for _, c := range buf {
+		buckets[c]++
+	}
+	for i := 1; i < 256; i++ {
+		buckets[i] += buckets[i-1]
+	}
+	for i := 255; i > 0; i-- {
+		buckets[i] = buckets[i-1]
+	}
+	buckets[0] = 0
+
+	for i, c := range buf {
+		buckets[c]++
+		I[buckets[c]] = i
+	}
+	I[0] = n
+	for i, c := range buf {
+		V[i] = buckets[c]
+	}
+	V[n] = 0
+	for i := 1; i < 256; i++ {
+		if buckets[i] == buckets[i-1]+1 {
+			I[buckets[i]] = -1
+		}
+	}
+	I[0] = -1
+
+	for h := 1; I[0] != -(n + 1); h += h {
+		length := 0
+		i := 0
+		for i < n+1 {
+			if I[i] < 0 {
+				length -= I[i]
+				i -= I[i]
+			} else {
+				if length != 0 {
+					I[i-length] = -length
+				}
+				length = V[I[i]] + 1 - i
+				split(I, V, i, length, h)
+				i += length
+				length = 0
+			}
+		}
+		if length != 0 {
+			I[i-length] = -length
+		}
+	}
+
+	for i := 0; i < n+1; i++ {
+		I[V[i]] = i
+	}
+}
+
+func split(I, V []int, start, length, h int) {
+	if length < 16 {
+		for k := start; k < start+length; {
+			j := 1
+			x := V[I[k]+h]
+			for i := 1; k+i < start+length; i++ {
+				if V[I[k+i]+h] < x {
+					x = V[I[k+i]+h]
+					j = 0
+				}
+				if V[I[k+i]+h] == x {
+					I[k+j], I[k+i] = I[k+i], I[k+j]
+					j++
+				}
+			}
+			for i := 0; i < j; i++ {
+				V[I[k+i]] = k + j - 1
+			}
+			if j == 1 {
+				I[k] = -1
+			}
+			k += j
+		}
+		return
+	}
+
+	x := V[I[start+length/2]+h]
+	jj, kk := 0, 0
+	for i := start; i < start+length; i++ {
+		if V[I[i]+h] < x {
+			jj++
+		}
+		if V[I[i]+h] == x {
+			kk++
+		}
+	}
+	jj += start
+	kk += jj
+
+	i, j, k := start, 0, 0
+	for i < jj {
+		switch {
+		case V[I[i]+h] < x:
+			i++
+		case V[I[i]+h] == x:
+			I[i], I[jj+j] = I[jj+j], I[i]
+			j++
+		default:
+			I[i], I[kk+k] = I[kk+k], I[i]
+			k++
+		}
+	}
+
+	for jj+j < kk {
+		if V[I[jj+j]+h] == x {
+			j++
+		} else {
+			I[jj+j], I[kk+k] = I[kk+k], I[jj+j]
+			k++
+		}
+	}
+
+	if jj > start {
+		split(I, V, start, jj-start, h)
+	}
+
+	for i := 0; i < kk-jj; i++ {
+		V[I[jj+i]] = kk - 1
+	}
+	if jj == kk-1 {
+		I[jj] = -1
+	}
+
+	if start+length > kk {
+		split(I, V, kk, start+length-kk, h)
+	}
+}
+
+// offtout encodes x as 8-byte sign-magnitude little endian
+func offtout(x int64, buf []byte) {
+	neg := x < 0
+	if neg {
+		x = -x
+	}
+	binary.LittleEndian.PutUint64(buf, uint64(x))
+	if neg {
+		buf[7] |= 0x80
+	}
+}
+
+func offtin(buf []byte) int64 {
+	y := int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+	if buf[7]&0x80 != 0 {
+		y = -y
+	}
+	return y
+}
@@ -0,0 +1,139 @@
+package delta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+// image returns deterministic pseudo-random bytes standing in for firmware
+func image(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func edited(data []byte, edits map[int]byte) []byte {
+	out := bytes.Clone(data)
+	for offset, b := range edits {
+		out[offset] = b
+	}
+	return out
+}
+
+func TestRoundTrip(t *testing.T) {
+	base := image(1, 64<<10)
+
+	tests := []struct {
+		name     string
+		old, new []byte
+		// smaller requires the patch to be well below the new image
+		smaller bool
+	}{
+		{name: "both empty", old: nil, new: nil},
+		{name: "from empty", old: nil, new: []byte("hello, stick")},
+		{name: "to empty", old: []byte("hello, stick"), new: nil},
+		{name: "identical", old: base, new: base, smaller: true},
+		{name: "scattered edits", old: base, new: edited(base, map[int]byte{10: 0, 4096: 1, 30000: 2, 65000: 3}), smaller: true},
+		{name: "insertion", old: base, new: append(append(bytes.Clone(base[:20000]), []byte("new level data")...), base[20000:]...), smaller: true},
+		{name: "deletion", old: base, new: append(bytes.Clone(base[:10000]), base[12000:]...), smaller: true},
+		{name: "appended", old: base, new: append(bytes.Clone(base), image(2, 4096)...), smaller: true},
+		{name: "shrunk", old: base, new: base[:32<<10], smaller: true},
+		{name: "moved blocks", old: base, new: append(bytes.Clone(base[32<<10:]), base[:32<<10]...), smaller: true},
+		{name: "unrelated", old: base, new: image(3, 64<<10)},
+		{name: "repetitive", old: bytes.Repeat([]byte{0xff}, 8192), new: append(bytes.Repeat([]byte{0xff}, 8000), bytes.Repeat([]byte{0x00}, 300)...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := Diff(tt.old, tt.new)
+			if err != nil {
+				t.Fatalf("Diff: %v", err)
+			}
+
+			got, err := Patch(tt.old, patch)
+			if err != nil {
+				t.Fatalf("Patch: %v", err)
+			}
+			if !bytes.Equal(got, tt.new) {
+				t.Fatalf("Patch rebuilt %d bytes that differ from the %d byte image", len(got), len(tt.new))
+			}
+
+			if tt.smaller && len(patch) > len(tt.new)/4 {
+				t.Errorf("patch is %d bytes for a %d byte image", len(patch), len(tt.new))
+			}
+		})
+	}
+}
+
+func TestPatchHeader(t *testing.T) {
+	patch, err := Diff([]byte("old"), []byte("new image"))
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	if got := string(patch[:len(magic)]); got != magic {
+		t.Errorf("magic = %q, want %q", got, magic)
+	}
+	if got := binary.LittleEndian.Uint64(patch[len(magic):headerSize]); got != uint64(len("new image")) {
+		t.Errorf("new size = %d, want %d", got, len("new image"))
+	}
+}
+
+func TestPatchRejectsCorruptPatches(t *testing.T) {
+	old := image(1, 4096)
+	valid, err := Diff(old, edited(old, map[int]byte{100: 0}))
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	oversized := bytes.Clone(valid)
+	binary.LittleEndian.PutUint64(oversized[len(magic):], 1<<32)
+
+	tests := []struct {
+		name  string
+		patch []byte
+	}{
+		{name: "empty", patch: nil},
+		{name: "short header", patch: valid[:headerSize-1]},
+		{name: "bad magic", patch: append([]byte("BSDIFF40"), valid[len(magic):]...)},
+		{name: "oversized image", patch: oversized},
+		{name: "no stream", patch: valid[:headerSize]},
+		{name: "truncated stream", patch: valid[:len(valid)-8]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Patch(old, tt.patch); !errors.Is(err, ErrCorruptPatch) {
+				t.Errorf("Patch() error = %v, want ErrCorruptPatch", err)
+			}
+		})
+	}
+}
+
+func TestOffsetEncoding(t *testing.T) {
+	tests := []struct {
+		x    int64
+		want [8]byte
+	}{
+		{0, [8]byte{}},
+		{1, [8]byte{1}},
+		{-1, [8]byte{1, 0, 0, 0, 0, 0, 0, 0x80}},
+		{0x0102, [8]byte{0x02, 0x01}},
+		{-0x0102, [8]byte{0x02, 0x01, 0, 0, 0, 0, 0, 0x80}},
+		{1<<63 - 1, [8]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+	}
+
+	for _, tt := range tests {
+		var buf [8]byte
+		offtout(tt.x, buf[:])
+		if buf != tt.want {
+			t.Errorf("offtout(%d) = % x, want % x", tt.x, buf, tt.want)
+		}
+		if got := offtin(buf[:]); got != tt.x {
+			t.Errorf("offtin(% x) = %d, want %d", buf, got, tt.x)
+		}
+	}
+}
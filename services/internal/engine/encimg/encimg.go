@@ -0,0 +1,134 @@
+// Package encimg produces pre-encrypted OTA images in the format read by
+// the ESP-IDF esp_encrypted_img component, so devices decrypt them with the
+// RSA private key embedded in their firmware while writing to flash.
+//
+// The image is encrypted with AES-256-GCM under a random key, which is
+// wrapped with the device's RSA-3072 public key (OAEP, SHA-256). The
+// artifact is a 512 byte header followed by the ciphertext:
+//
+//	offset 0    4 bytes    magic 0x0788b6cf, little endian
+//	offset 4    384 bytes  RSA-OAEP encrypted AES key
+//	offset 388  16 bytes   GCM IV
+//	offset 404  4 bytes    plaintext size, little endian
+//	offset 408  16 bytes   GCM authentication tag
+//	offset 424  88 bytes   reserved, zero
+package encimg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Format names the artifact format advertised to devices
+const Format = "esp_encrypted_img"
+
+const (
+	Magic      = 0x0788b6cf
+	HeaderSize = 512
+
+	// KeyBits is the only RSA key size esp_encrypted_img accepts
+	KeyBits = 3072
+
+	aesKeySize = 32
+	ivSize     = 16
+	tagSize    = 16
+)
+
+var ErrInvalidKey = errors.New("invalid encryption key")
+
+// ParsePublicKey reads an RSA-3072 public key from PEM, either a PKIX
+// "PUBLIC KEY" or a PKCS #1 "RSA PUBLIC KEY" block
+func ParsePublicKey(pemData []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM block found", ErrInvalidKey)
+	}
+
+	var pub *rsa.PublicKey
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%w: not an RSA key", ErrInvalidKey)
+		}
+		pub = rsaKey
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKey, err)
+		}
+		pub = key
+	default:
+		return nil, fmt.Errorf("%w: unexpected PEM block %q", ErrInvalidKey, block.Type)
+	}
+
+	if pub.N.BitLen() != KeyBits {
+		return nil, fmt.Errorf("%w: key is %d bits, esp_encrypted_img requires %d", ErrInvalidKey, pub.N.BitLen(), KeyBits)
+	}
+	return pub, nil
+}
+
+// Fingerprint is the hex SHA-256 of the key's PKIX encoding
+func Fingerprint(pub *rsa.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(der))
+}
+
+// Encrypt returns the pre-encrypted artifact of an image for pub
+func Encrypt(image []byte, pub *rsa.PublicKey) ([]byte, error) {
+	if len(image) > math.MaxUint32 {
+		return nil, fmt.Errorf("image too large: %d bytes", len(image))
+	}
+
+	key := make([]byte, aesKeySize)
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap key: %w", err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, ivSize)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, HeaderSize, HeaderSize+len(image)+tagSize)
+	binary.LittleEndian.PutUint32(out[0:4], Magic)
+	copy(out[4:4+len(wrappedKey)], wrappedKey)
+	copy(out[388:404], iv)
+	binary.LittleEndian.PutUint32(out[404:408], uint32(len(image)))
+
+	// Seal appends the tag to the ciphertext; the format keeps it in the
+	// header instead
+	out = gcm.Seal(out, iv, image, nil)
+	tag := out[len(out)-tagSize:]
+	copy(out[408:424], tag)
+	return out[:len(out)-tagSize], nil
+}
@@ -0,0 +1,233 @@
+package encimg
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"testing"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// deviceKey returns an RSA-3072 key shared by the tests, as generating one
+// takes a while
+func deviceKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, KeyBits)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		testKey = key
+	})
+	return testKey
+}
+
+// decrypt reads an artifact the way esp_encrypted_img does
+func decrypt(t *testing.T, artifact []byte, priv *rsa.PrivateKey) []byte {
+	t.Helper()
+
+	if len(artifact) < HeaderSize {
+		t.Fatalf("artifact is %d bytes, shorter than the header", len(artifact))
+	}
+	if got := binary.LittleEndian.Uint32(artifact[0:4]); got != Magic {
+		t.Fatalf("magic = 0x%08x, want 0x%08x", got, Magic)
+	}
+	if !bytes.Equal(artifact[424:HeaderSize], make([]byte, HeaderSize-424)) {
+		t.Errorf("reserved header bytes are not zero")
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, artifact[4:388], nil)
+	if err != nil {
+		t.Fatalf("failed to unwrap key: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCMWithNonceSize(block, ivSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := binary.LittleEndian.Uint32(artifact[404:408])
+	if int(size) != len(artifact)-HeaderSize {
+		t.Errorf("size field = %d, want %d", size, len(artifact)-HeaderSize)
+	}
+
+	sealed := append(bytes.Clone(artifact[HeaderSize:]), artifact[408:424]...)
+	image, err := gcm.Open(nil, artifact[388:404], sealed, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt: %v", err)
+	}
+	return image
+}
+
+func TestEncrypt(t *testing.T) {
+	priv := deviceKey(t)
+
+	tests := []struct {
+		name  string
+		image []byte
+	}{
+		{name: "empty", image: []byte{}},
+		{name: "small", image: []byte("crisp-games 1.4.0")},
+		{name: "image", image: bytes.Repeat([]byte{0xE9, 0x05, 0x02, 0x20}, 64<<10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			artifact, err := Encrypt(tt.image, &priv.PublicKey)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if len(artifact) != HeaderSize+len(tt.image) {
+				t.Errorf("artifact is %d bytes, want %d", len(artifact), HeaderSize+len(tt.image))
+			}
+			if got := decrypt(t, artifact, priv); !bytes.Equal(got, tt.image) {
+				t.Errorf("decrypted %d bytes that differ from the %d byte image", len(got), len(tt.image))
+			}
+		})
+	}
+}
+
+func TestEncryptUsesFreshKeys(t *testing.T) {
+	priv := deviceKey(t)
+	image := []byte("crisp-games 1.4.0")
+
+	a, err := Encrypt(image, &priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	b, err := Encrypt(image, &priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	if bytes.Equal(a[4:388], b[4:388]) || bytes.Equal(a[388:404], b[388:404]) || bytes.Equal(a[HeaderSize:], b[HeaderSize:]) {
+		t.Errorf("two encryptions of the same image share key, IV or ciphertext")
+	}
+}
+
+func TestEncryptTamperedArtifact(t *testing.T) {
+	priv := deviceKey(t)
+
+	artifact, err := Encrypt([]byte("crisp-games 1.4.0"), &priv.PublicKey)
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	artifact[HeaderSize] ^= 0x01
+
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, artifact[4:388], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCMWithNonceSize(block, ivSize)
+	sealed := append(bytes.Clone(artifact[HeaderSize:]), artifact[408:424]...)
+	if _, err := gcm.Open(nil, artifact[388:404], sealed, nil); err == nil {
+		t.Errorf("a tampered artifact passed authentication")
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	priv := deviceKey(t)
+
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallPKIX, err := x509.MarshalPKIXPublicKey(&small.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPKIX, err := x509.MarshalPKIXPublicKey(&ec.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encode := func(blockType string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	}
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr bool
+	}{
+		{name: "PKIX", pem: encode("PUBLIC KEY", pkix)},
+		{name: "PKCS #1", pem: encode("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&priv.PublicKey))},
+		{name: "2048-bit key", pem: encode("PUBLIC KEY", smallPKIX), wantErr: true},
+		{name: "EC key", pem: encode("PUBLIC KEY", ecPKIX), wantErr: true},
+		{name: "private key", pem: encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(priv)), wantErr: true},
+		{name: "corrupt DER", pem: encode("PUBLIC KEY", pkix[:len(pkix)/2]), wantErr: true},
+		{name: "not PEM", pem: []byte("ssh-rsa AAAAB3NzaC1yc2E"), wantErr: true},
+		{name: "empty", pem: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := ParsePublicKey(tt.pem)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("ParsePublicKey() error = %v, want ErrInvalidKey", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePublicKey: %v", err)
+			}
+			if !pub.Equal(&priv.PublicKey) {
+				t.Errorf("ParsePublicKey() returned a different key")
+			}
+		})
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	priv := deviceKey(t)
+
+	pkix, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sha256.Sum256(pkix)
+
+	// Both PEM encodings of a key have the same fingerprint
+	fromPKIX, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromPKCS1, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&priv.PublicKey)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pub := range []*rsa.PublicKey{fromPKIX, fromPKCS1} {
+		if got := Fingerprint(pub); got != hex.EncodeToString(want[:]) {
+			t.Errorf("Fingerprint() = %s, want %x", got, want)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package espimage parses ESP-IDF application images (the .bin produced by
+// esptool elf2image) and validates their structure before they are served
+// to devices.
+package espimage
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	imageMagic    = 0xE9
+	appDescMagic  = 0xABCD5432
+	headerSize    = 24
+	segHeaderSize = 8
+	maxSegments   = 16
+	appDescSize   = 256
+	checksumSeed  = 0xEF
+)
+
+var ErrInvalidImage = errors.New("invalid ESP32 application image")
+
+// Chip IDs from esp_image_header_t.chip_id
+var chipNames = map[uint16]string{
+	0x0000: "ESP32",
+	0x0002: "ESP32-S2",
+	0x0005: "ESP32-C3",
+	0x0009: "ESP32-S3",
+	0x000C: "ESP32-C2",
+	0x000D: "ESP32-C6",
+	0x0010: "ESP32-H2",
+}
+
+// KnownChip reports whether chipID is a chip this package can validate
+func KnownChip(chipID uint16) bool {
+	_, ok := chipNames[chipID]
+	return ok
+}
+
+// ChipName returns the chip's name as used by esptool, or "" if unknown
+func ChipName(chipID uint16) string {
+	return chipNames[chipID]
+}
+
+// Flash sizes encoded in the high nibble of spi_speed_size, in MB
+var flashSizes = map[byte]int{0: 1, 1: 2, 2: 4, 3: 8, 4: 16, 5: 32, 6: 64, 7: 128}
+
+// Image is the metadata extracted from a valid application image
+type Image struct {
+	ChipID         uint16 `json:"chip_id"`
+	Chip           string `json:"chip"`
+	MinChipRevFull uint16 `json:"min_chip_rev_full"`
+	MaxChipRevFull uint16 `json:"max_chip_rev_full"`
+	FlashSizeMB    int    `json:"flash_size_mb"`
+	SegmentCount   int    `json:"segment_count"`
+	EntryAddr      uint32 `json:"entry_addr"`
+	HashAppended   bool   `json:"hash_appended"`
+
+	// Fields from esp_app_desc_t
+	ProjectName   string `json:"project_name"`
+	Version       string `json:"version"`
+	IDFVersion    string `json:"idf_version"`
+	BuildDate     string `json:"build_date"`
+	BuildTime     string `json:"build_time"`
+	SecureVersion uint32 `json:"secure_version"`
+	ELFSHA256     string `json:"elf_sha256"`
+
+	// Size is the number of bytes the image structure occupies
+	Size int64 `json:"size"`
+}
+
+// Parse reads an application image sequentially from r, verifying the
+// segment checksum and the appended SHA-256 when present. It stops reading
+// at the end of the image, so it can consume a stream as it is uploaded.
+func Parse(r io.Reader) (*Image, error) {
+	br := bufio.NewReader(r)
+	digest := sha256.New()
+	cr := &countingReader{r: io.TeeReader(br, digest)}
+
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(cr, hdr[:]); err != nil {
+		return nil, fmt.Errorf("%w: truncated header", ErrInvalidImage)
+	}
+	if hdr[0] != imageMagic {
+		return nil, fmt.Errorf("%w: bad magic 0x%02X", ErrInvalidImage, hdr[0])
+	}
+
+	img := &Image{
+		SegmentCount:   int(hdr[1]),
+		EntryAddr:      binary.LittleEndian.Uint32(hdr[4:8]),
+		ChipID:         binary.LittleEndian.Uint16(hdr[12:14]),
+		MinChipRevFull: binary.LittleEndian.Uint16(hdr[15:17]),
+		MaxChipRevFull: binary.LittleEndian.Uint16(hdr[17:19]),
+		HashAppended:   hdr[23] == 1,
+	}
+	img.Chip = chipNames[img.ChipID]
+	if img.Chip == "" {
+		return nil, fmt.Errorf("%w: unknown chip ID 0x%04X", ErrInvalidImage, img.ChipID)
+	}
+	img.FlashSizeMB = flashSizes[hdr[3]>>4]
+	if img.SegmentCount == 0 || img.SegmentCount > maxSegments {
+		return nil, fmt.Errorf("%w: segment count %d", ErrInvalidImage, img.SegmentCount)
+	}
+
+	checksum := byte(checksumSeed)
+	for i := 0; i < img.SegmentCount; i++ {
+		var seg [segHeaderSize]byte
+		if _, err := io.ReadFull(cr, seg[:]); err != nil {
+			return nil, fmt.Errorf("%w: truncated segment %d header", ErrInvalidImage, i)
+		}
+		length := binary.LittleEndian.Uint32(seg[4:8])
+		if length%4 != 0 || length > 16<<20 {
+			return nil, fmt.Errorf("%w: segment %d length %d", ErrInvalidImage, i, length)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(cr, data); err != nil {
+			return nil, fmt.Errorf("%w: truncated segment %d", ErrInvalidImage, i)
+		}
+		for _, b := range data {
+			checksum ^= b
+		}
+
+		// The application description sits at the start of the first segment
+		if i == 0 {
+			if err := parseAppDesc(img, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Zero padding up to a 16-byte boundary, the last byte being the checksum
+	pad := 15 - cr.n%16
+	trailer := make([]byte, pad+1)
+	if _, err := io.ReadFull(cr, trailer); err != nil {
+		return nil, fmt.Errorf("%w: missing checksum", ErrInvalidImage)
+	}
+	if trailer[pad] != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch (expected 0x%02X, got 0x%02X)", ErrInvalidImage, checksum, trailer[pad])
+	}
+
+	if img.HashAppended {
+		computed := digest.Sum(nil)
+		var appended [sha256.Size]byte
+		if _, err := io.ReadFull(br, appended[:]); err != nil {
+			return nil, fmt.Errorf("%w: missing appended SHA-256", ErrInvalidImage)
+		}
+		if !bytes.Equal(computed, appended[:]) {
+			return nil, fmt.Errorf("%w: appended SHA-256 mismatch", ErrInvalidImage)
+		}
+		cr.n += sha256.Size
+	}
+
+	img.Size = cr.n
+	return img, nil
+}
+
+func parseAppDesc(img *Image, seg []byte) error {
+	if len(seg) < appDescSize || binary.LittleEndian.Uint32(seg[0:4]) != appDescMagic {
+		return fmt.Errorf("%w: missing esp_app_desc_t", ErrInvalidImage)
+	}
+
+	img.SecureVersion = binary.LittleEndian.Uint32(seg[4:8])
+	img.Version = cString(seg[16:48])
+	img.ProjectName = cString(seg[48:80])
+	img.BuildTime = cString(seg[80:96])
+	img.BuildDate = cString(seg[96:112])
+	img.IDFVersion = cString(seg[112:144])
+	img.ELFSHA256 = fmt.Sprintf("%x", seg[144:176])
+	return nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,242 @@
+package espimage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testImage describes an application image built by build
+type testImage struct {
+	chipID       uint16
+	flashSize    byte
+	minRev       uint16
+	maxRev       uint16
+	hashAppended bool
+	segments     [][]byte
+}
+
+// appDesc returns an esp_app_desc_t segment padded to length
+func appDesc(length int) []byte {
+	seg := make([]byte, length)
+	binary.LittleEndian.PutUint32(seg[0:4], appDescMagic)
+	binary.LittleEndian.PutUint32(seg[4:8], 3)
+	copy(seg[16:48], "1.4.0")
+	copy(seg[48:80], "crisp-games")
+	copy(seg[80:96], "10:00:00")
+	copy(seg[96:112], "Jun 14 2025")
+	copy(seg[112:144], "v5.1.2")
+	for i := range seg[144:176] {
+		seg[144+i] = byte(i)
+	}
+	return seg
+}
+
+func validImage() testImage {
+	return testImage{
+		chipID:       0x0000,
+		flashSize:    2,
+		minRev:       0,
+		maxRev:       399,
+		hashAppended: true,
+		segments:     [][]byte{appDesc(256), bytes.Repeat([]byte{0xA5, 0x5A, 0x01, 0x02}, 64)},
+	}
+}
+
+func (ti testImage) build() []byte {
+	var buf bytes.Buffer
+
+	hdr := make([]byte, headerSize)
+	hdr[0] = imageMagic
+	hdr[1] = byte(len(ti.segments))
+	hdr[3] = ti.flashSize << 4
+	binary.LittleEndian.PutUint32(hdr[4:8], 0x40080000)
+	binary.LittleEndian.PutUint16(hdr[12:14], ti.chipID)
+	binary.LittleEndian.PutUint16(hdr[15:17], ti.minRev)
+	binary.LittleEndian.PutUint16(hdr[17:19], ti.maxRev)
+	if ti.hashAppended {
+		hdr[23] = 1
+	}
+	buf.Write(hdr)
+
+	checksum := byte(checksumSeed)
+	for i, data := range ti.segments {
+		var seg [segHeaderSize]byte
+		binary.LittleEndian.PutUint32(seg[0:4], 0x3F400000+uint32(i)<<16)
+		binary.LittleEndian.PutUint32(seg[4:8], uint32(len(data)))
+		buf.Write(seg[:])
+		buf.Write(data)
+		for _, b := range data {
+			checksum ^= b
+		}
+	}
+
+	buf.Write(make([]byte, 15-buf.Len()%16))
+	buf.WriteByte(checksum)
+
+	if ti.hashAppended {
+		digest := sha256.Sum256(buf.Bytes())
+		buf.Write(digest[:])
+	}
+	return buf.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	data := validImage().build()
+
+	img, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	want := Image{
+		ChipID:         0x0000,
+		Chip:           "ESP32",
+		MinChipRevFull: 0,
+		MaxChipRevFull: 399,
+		FlashSizeMB:    4,
+		SegmentCount:   2,
+		EntryAddr:      0x40080000,
+		HashAppended:   true,
+		ProjectName:    "crisp-games",
+		Version:        "1.4.0",
+		IDFVersion:     "v5.1.2",
+		BuildDate:      "Jun 14 2025",
+		BuildTime:      "10:00:00",
+		SecureVersion:  3,
+		ELFSHA256:      "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+		Size:           int64(len(data)),
+	}
+	if *img != want {
+		t.Errorf("Parse() = %+v\nwant %+v", *img, want)
+	}
+}
+
+func TestParseStopsAtImageEnd(t *testing.T) {
+	tests := []struct {
+		name string
+		ti   testImage
+	}{
+		{name: "with appended SHA-256", ti: validImage()},
+		{name: "without appended SHA-256", ti: func() testImage {
+			ti := validImage()
+			ti.hashAppended = false
+			return ti
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := tt.ti.build()
+			padded := append(bytes.Clone(data), bytes.Repeat([]byte{0xFF}, 4096)...)
+
+			img, err := Parse(bytes.NewReader(padded))
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if img.Size != int64(len(data)) {
+				t.Errorf("Size = %d, want %d", img.Size, len(data))
+			}
+		})
+	}
+}
+
+func TestParseFlashSizes(t *testing.T) {
+	for nibble, mb := range flashSizes {
+		ti := validImage()
+		ti.flashSize = nibble
+
+		img, err := Parse(bytes.NewReader(ti.build()))
+		if err != nil {
+			t.Fatalf("Parse with flash size %d: %v", nibble, err)
+		}
+		if img.FlashSizeMB != mb {
+			t.Errorf("flash size nibble %d = %d MB, want %d MB", nibble, img.FlashSizeMB, mb)
+		}
+	}
+}
+
+func TestParseRejectsInvalidImages(t *testing.T) {
+	valid := validImage().build()
+
+	// corrupt returns the valid image with one byte changed
+	corrupt := func(offset int, b byte) []byte {
+		data := bytes.Clone(valid)
+		data[offset] = b
+		return data
+	}
+	with := func(change func(*testImage)) []byte {
+		ti := validImage()
+		change(&ti)
+		return ti.build()
+	}
+
+	checksumOffset := len(valid) - sha256.Size - 1
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "empty", data: nil, want: "truncated header"},
+		{name: "short header", data: valid[:headerSize-1], want: "truncated header"},
+		{name: "bad magic", data: corrupt(0, 0xE8), want: "bad magic"},
+		{name: "unknown chip", data: with(func(ti *testImage) { ti.chipID = 0x0001 }), want: "unknown chip"},
+		{name: "no segments", data: with(func(ti *testImage) { ti.segments = nil }), want: "segment count 0"},
+		{name: "too many segments", data: corrupt(1, maxSegments+1), want: "segment count 17"},
+		{name: "unaligned segment", data: with(func(ti *testImage) { ti.segments[1] = ti.segments[1][:255] }), want: "segment 1 length 255"},
+		{name: "truncated segment header", data: valid[:headerSize+4], want: "truncated segment 0 header"},
+		{name: "truncated segment", data: valid[:headerSize+segHeaderSize+100], want: "truncated segment 0"},
+		{name: "missing app description", data: with(func(ti *testImage) { ti.segments[0] = make([]byte, 256) }), want: "missing esp_app_desc_t"},
+		{name: "short app description", data: with(func(ti *testImage) { ti.segments[0] = appDesc(252) }), want: "missing esp_app_desc_t"},
+		{name: "missing checksum", data: valid[:checksumOffset], want: "missing checksum"},
+		{name: "checksum mismatch", data: corrupt(checksumOffset, valid[checksumOffset]^0xFF), want: "checksum mismatch"},
+		{name: "segment data changed", data: corrupt(headerSize+segHeaderSize+200, valid[headerSize+segHeaderSize+200]^0x01), want: "checksum mismatch"},
+		{name: "missing appended SHA-256", data: valid[:len(valid)-1], want: "missing appended SHA-256"},
+		{name: "appended SHA-256 mismatch", data: corrupt(len(valid)-1, valid[len(valid)-1]^0xFF), want: "appended SHA-256 mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(bytes.NewReader(tt.data))
+			if !errors.Is(err, ErrInvalidImage) {
+				t.Fatalf("Parse() error = %v, want ErrInvalidImage", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %q, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestChipNames(t *testing.T) {
+	tests := []struct {
+		chipID uint16
+		name   string
+	}{
+		{0x0000, "ESP32"},
+		{0x0002, "ESP32-S2"},
+		{0x0005, "ESP32-C3"},
+		{0x0009, "ESP32-S3"},
+		{0x000C, "ESP32-C2"},
+		{0x000D, "ESP32-C6"},
+		{0x0010, "ESP32-H2"},
+		{0x0001, ""},
+		{0xFFFF, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("0x%04X", tt.chipID), func(t *testing.T) {
+			if got := ChipName(tt.chipID); got != tt.name {
+				t.Errorf("ChipName() = %q, want %q", got, tt.name)
+			}
+			if got := KnownChip(tt.chipID); got != (tt.name != "") {
+				t.Errorf("KnownChip() = %v, want %v", got, tt.name != "")
+			}
+		})
+	}
+}
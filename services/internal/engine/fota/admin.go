@@ -0,0 +1,135 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// authorizeAdmin checks the admin API token from X-API-Token or a Bearer
+// Authorization header. It writes the error response and returns false when
+// the request must not proceed.
+func (h *Handler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get("X-API-Token")
+	if token == "" {
+		token = r.Header.Get("Authorization")
+		if len(token) > 7 && token[:7] == "Bearer " {
+			token = token[7:]
+		}
+	}
+
+	if h.adminAPIToken == "" {
+		log.Printf("Warning: ADMIN_API_TOKEN not configured, %s is unprotected!", r.URL.Path)
+		return true
+	}
+
+	if token != h.adminAPIToken {
+		log.Printf("Unauthorized admin request to %s", r.URL.Path)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// releaseRequest identifies a firmware release in admin request bodies.
+// Board may be omitted while the version has been built for a single board.
+type releaseRequest struct {
+	Game    string `json:"game"`
+	Board   string `json:"board,omitempty"`
+	Version string `json:"version"`
+}
+
+// errAmbiguousRelease means a version exists for several boards and the
+// request did not say which one it meant
+var errAmbiguousRelease = errors.New("release exists for several boards")
+
+// findRelease returns the firmware ID of a release, sql.ErrNoRows when it
+// does not exist or errAmbiguousRelease
+func (h *Handler) findRelease(gameCode, version, board string) (int64, error) {
+	// Release rows store normalized semver
+	if v, err := ParseVersion(version); err == nil {
+		version = v.String()
+	}
+
+	rows, err := h.db.Query(`
+		SELECT f.id
+		FROM firmwares f
+		JOIN games g ON g.id = f.game_id
+		JOIN boards b ON b.id = f.board_id
+		WHERE g.code = $1 AND f.version = $2 AND ($3 = '' OR b.code = $3)
+	`, gameCode, version, board)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	switch len(ids) {
+	case 0:
+		return 0, sql.ErrNoRows
+	case 1:
+		return ids[0], nil
+	default:
+		return 0, errAmbiguousRelease
+	}
+}
+
+// writeReleaseError maps findRelease errors to HTTP responses
+func writeReleaseError(w http.ResponseWriter, err error) {
+	switch err {
+	case sql.ErrNoRows:
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+	case errAmbiguousRelease:
+		http.Error(w, "Version exists for several boards, board is required", http.StatusBadRequest)
+	default:
+		log.Printf("Failed to query firmware: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// decodeReleaseRequest decodes the JSON body into req and resolves the
+// release it names. It writes the error response and returns false on failure.
+func (h *Handler) decodeReleaseRequest(w http.ResponseWriter, r *http.Request, req interface{}, rel *releaseRequest) (int64, bool) {
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return 0, false
+	}
+
+	if rel.Game == "" || rel.Version == "" {
+		http.Error(w, "game and version are required", http.StatusBadRequest)
+		return 0, false
+	}
+
+	// Release rows store normalized semver
+	if v, err := ParseVersion(rel.Version); err == nil {
+		rel.Version = v.String()
+	}
+
+	firmwareID, err := h.findRelease(rel.Game, rel.Version, rel.Board)
+	if err != nil {
+		writeReleaseError(w, err)
+		return 0, false
+	}
+
+	return firmwareID, true
+}
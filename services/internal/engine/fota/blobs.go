@@ -0,0 +1,221 @@
+package fota
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+// Firmware images are stored once per content under their SHA-256 digest,
+// shared by every release with the same bytes. Uploads land under
+// stagingPrefix first since the digest is only known once they are read.
+const (
+	contentPrefix = "_sha256/"
+	stagingPrefix = "_staging/"
+)
+
+// contentBlobName is the blob holding the image with the given digest
+func contentBlobName(sha256Hex string) string {
+	return contentPrefix + sha256Hex + ".bin"
+}
+
+func stagingBlobName() (string, error) {
+	suffix := make([]byte, 16)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	return stagingPrefix + hex.EncodeToString(suffix) + ".bin", nil
+}
+
+// lockBlob serializes the transactions that add or drop references to a
+// content blob, so a blob is never deleted while a release is recorded
+// against it
+func lockBlob(tx *sql.Tx, blobName string) error {
+	_, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, blobName)
+	return err
+}
+
+// storeContent makes sure the content blob for a digest exists, copying it
+// from src when it does not. The caller holds the blob's lock.
+func (h *Handler) storeContent(ctx context.Context, src, sha256Hex string) (blobName, blobURL string, err error) {
+	blobName = contentBlobName(sha256Hex)
+
+	exists, err := h.storage.Exists(ctx, blobName)
+	if err != nil {
+		return "", "", err
+	}
+	if exists {
+		log.Printf("Firmware content %s already stored, deduplicated", blobName)
+	} else if err := h.storage.Copy(ctx, blobName, src); err != nil {
+		return "", "", err
+	}
+
+	blobURL, err = h.storage.GetURL(ctx, blobName)
+	return blobName, blobURL, err
+}
+
+// releaseBlob deletes a firmware or partition blob once no release
+// references it. Patch blobs are never shared and are always deleted.
+func (h *Handler) releaseBlob(ctx context.Context, blobName string) (bool, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if err := lockBlob(tx, blobName); err != nil {
+		return false, err
+	}
+
+	var referenced bool
+	err = tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM firmwares WHERE blob_name = $1 AND NOT plain_deleted)
+			OR EXISTS (SELECT 1 FROM firmware_partitions WHERE blob_name = $1)
+	`, blobName).Scan(&referenced)
+	if err != nil || referenced {
+		return false, err
+	}
+
+	// Plain images of encrypted releases may be gone already
+	exists, err := h.storage.Exists(ctx, blobName)
+	if err != nil || !exists {
+		return false, err
+	}
+
+	// Deleted under the lock, so an upload of the same content waits and
+	// then stores it again
+	if err := h.storage.Delete(ctx, blobName); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// RehashResult summarizes a RehashFirmware run
+type RehashResult struct {
+	Migrated int `json:"migrated"`
+	Failed   int `json:"failed"`
+}
+
+// RehashFirmware moves firmware rows stored before content addressing to
+// their SHA-256 blob. Each stored image is re-hashed and checked against the
+// recorded MD5 (and SHA-256, if any) first; rows that do not match are
+// logged and left alone. Missing signatures are added when a signing key is
+// configured. It is safe to run repeatedly and alongside the engine.
+func (h *Handler) RehashFirmware(ctx context.Context) (RehashResult, error) {
+	var result RehashResult
+
+	rows, err := h.db.Query(`
+		SELECT id, blob_name, checksum, COALESCE(sha256, '')
+		FROM firmwares
+		WHERE sha256 IS NULL OR left(blob_name, length($1)) <> $1
+		ORDER BY id
+	`, contentPrefix)
+	if err != nil {
+		return result, err
+	}
+
+	type legacyRow struct {
+		ID       int64
+		BlobName string
+		Checksum string
+		SHA256   string
+	}
+	var legacy []legacyRow
+	for rows.Next() {
+		var row legacyRow
+		if err := rows.Scan(&row.ID, &row.BlobName, &row.Checksum, &row.SHA256); err != nil {
+			rows.Close()
+			return result, err
+		}
+		legacy = append(legacy, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	for _, row := range legacy {
+		if err := h.rehashRow(ctx, row.ID, row.BlobName, row.Checksum, row.SHA256); err != nil {
+			log.Printf("Failed to rehash firmware %d (%s): %v", row.ID, row.BlobName, err)
+			result.Failed++
+			continue
+		}
+		result.Migrated++
+	}
+
+	return result, nil
+}
+
+func (h *Handler) rehashRow(ctx context.Context, firmwareID int64, blobName, checksum, recordedSHA256 string) error {
+	reader, err := h.storage.Download(ctx, blobName)
+	if err != nil {
+		return err
+	}
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	_, err = io.Copy(io.MultiWriter(md5Hash, sha256Hash), reader)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	if actual := fmt.Sprintf("%x", md5Hash.Sum(nil)); actual != checksum {
+		return fmt.Errorf("stored MD5 %s does not match the recorded %s", actual, checksum)
+	}
+	digest := sha256Hash.Sum(nil)
+	sha256Hex := fmt.Sprintf("%x", digest)
+	if recordedSHA256 != "" && !strings.EqualFold(recordedSHA256, sha256Hex) {
+		return fmt.Errorf("stored SHA-256 %s does not match the recorded %s", sha256Hex, recordedSHA256)
+	}
+
+	var signature, signingKeyID sql.NullString
+	if h.signer != nil {
+		sig := h.signer.Sign(digest)
+		signature = sql.NullString{String: sig.Value, Valid: true}
+		signingKeyID = sql.NullString{String: sig.KeyID, Valid: true}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockBlob(tx, contentBlobName(sha256Hex)); err != nil {
+		return err
+	}
+	newBlob, newURL, err := h.storeContent(ctx, blobName, sha256Hex)
+	if err != nil {
+		return err
+	}
+
+	// Only rows still pointing at the blob that was hashed are moved
+	res, err := tx.Exec(`
+		UPDATE firmwares
+		SET blob_name = $3, blob_url = $4, sha256 = $5,
+			signature = COALESCE(signature, $6), signing_key_id = CASE WHEN signature IS NULL THEN $7 ELSE signing_key_id END
+		WHERE id = $1 AND blob_name = $2
+	`, firmwareID, blobName, newBlob, newURL, sha256Hex, signature, signingKeyID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 || newBlob == blobName {
+		return nil
+	}
+
+	log.Printf("Firmware %d moved from %s to %s", firmwareID, blobName, newBlob)
+
+	if _, err := h.releaseBlob(ctx, blobName); err != nil {
+		log.Printf("Failed to delete legacy blob %s: %v", blobName, err)
+	}
+	return nil
+}
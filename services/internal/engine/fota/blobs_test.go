@@ -0,0 +1,178 @@
+package fota
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func readBlob(t *testing.T, h *Handler, blobName string) string {
+	t.Helper()
+	reader, err := h.storage.Download(context.Background(), blobName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStoreContentDeduplicates(t *testing.T) {
+	h, _ := testHandler(t)
+	ctx := context.Background()
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte("image")))
+
+	putBlob(t, h, stagingPrefix+"first.bin", []byte("image"))
+	blobName, _, err := h.storeContent(ctx, stagingPrefix+"first.bin", digest)
+	if err != nil {
+		t.Fatalf("storeContent: %v", err)
+	}
+	if blobName != contentPrefix+digest+".bin" || readBlob(t, h, blobName) != "image" {
+		t.Fatalf("storeContent() = %s, want the image under its digest", blobName)
+	}
+
+	// The same content uploaded again is not copied over the stored blob
+	putBlob(t, h, stagingPrefix+"second.bin", []byte("other bytes"))
+	again, _, err := h.storeContent(ctx, stagingPrefix+"second.bin", digest)
+	if err != nil {
+		t.Fatalf("storeContent: %v", err)
+	}
+	if again != blobName || readBlob(t, h, blobName) != "image" {
+		t.Errorf("second storeContent() = %s holding %q, want the first blob unchanged", again, readBlob(t, h, again))
+	}
+	if blobs := listBlobs(t, h, contentPrefix); len(blobs) != 1 {
+		t.Errorf("content blobs = %v, want one", blobs)
+	}
+}
+
+func TestReleaseBlob(t *testing.T) {
+	const blobName = contentPrefix + "abc.bin"
+
+	t.Run("still referenced", func(t *testing.T) {
+		h, mock := testHandler(t)
+		putBlob(t, h, blobName, []byte("image"))
+		expectReleaseBlob(mock, blobName, true)
+
+		deleted, err := h.releaseBlob(context.Background(), blobName)
+		if err != nil || deleted || !blobExists(t, h, blobName) {
+			t.Errorf("releaseBlob() = %t, %v; want a shared blob kept", deleted, err)
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("last reference", func(t *testing.T) {
+		h, mock := testHandler(t)
+		putBlob(t, h, blobName, []byte("image"))
+		expectReleaseBlob(mock, blobName, false)
+
+		deleted, err := h.releaseBlob(context.Background(), blobName)
+		if err != nil || !deleted || blobExists(t, h, blobName) {
+			t.Errorf("releaseBlob() = %t, %v; want the blob deleted", deleted, err)
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("already gone", func(t *testing.T) {
+		h, mock := testHandler(t)
+		mock.ExpectBegin()
+		mock.ExpectExec(`pg_advisory_xact_lock`).WithArgs(blobName).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SELECT EXISTS`).WithArgs(blobName).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+		mock.ExpectRollback()
+
+		deleted, err := h.releaseBlob(context.Background(), blobName)
+		if err != nil || deleted {
+			t.Errorf("releaseBlob() = %t, %v; want nothing deleted", deleted, err)
+		}
+		expectationsMet(t, mock)
+	})
+}
+
+func TestRehashFirmware(t *testing.T) {
+	h, mock := testHandler(t)
+	image := []byte("legacy image")
+	md5Hex := fmt.Sprintf("%x", md5.Sum(image))
+	sha256Hex := fmt.Sprintf("%x", sha256.Sum256(image))
+	content := contentBlobName(sha256Hex)
+
+	putBlob(t, h, "crisp-games/firmware_v1.0.0.bin", image)
+	putBlob(t, h, "crisp-games/firmware_v0.9.0.bin", []byte("corrupted"))
+
+	mock.ExpectQuery(`WHERE sha256 IS NULL OR left\(blob_name, length\(\$1\)\) <> \$1`).WithArgs(contentPrefix).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "blob_name", "checksum", "sha256"}).
+			AddRow(1, "crisp-games/firmware_v1.0.0.bin", md5Hex, "").
+			AddRow(2, "crisp-games/firmware_v0.9.0.bin", "md5-of-the-original", ""))
+
+	// The verified image moves to its content blob and the legacy blob is
+	// deleted once nothing references it
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WithArgs(content).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`UPDATE firmwares\s+SET blob_name = \$3`).
+		WithArgs(1, "crisp-games/firmware_v1.0.0.bin", content, sqlmock.AnyArg(), sha256Hex, nil, nil).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectReleaseBlob(mock, "crisp-games/firmware_v1.0.0.bin", false)
+
+	result, err := h.RehashFirmware(context.Background())
+	if err != nil {
+		t.Fatalf("RehashFirmware: %v", err)
+	}
+	// The row whose stored bytes do not match its MD5 is left alone
+	if result != (RehashResult{Migrated: 1, Failed: 1}) {
+		t.Errorf("RehashFirmware() = %+v, want 1 migrated and 1 failed", result)
+	}
+	if readBlob(t, h, content) != string(image) {
+		t.Error("content blob does not hold the legacy image")
+	}
+	if blobExists(t, h, "crisp-games/firmware_v1.0.0.bin") || !blobExists(t, h, "crisp-games/firmware_v0.9.0.bin") {
+		t.Error("want only the migrated legacy blob deleted")
+	}
+	expectationsMet(t, mock)
+}
+
+func TestDownloadChecksumHeaders(t *testing.T) {
+	tests := []struct {
+		name         string
+		sha256       string
+		wantChecksum string
+	}{
+		{name: "content addressed", sha256: "sha256-1.0.0", wantChecksum: "sha256-1.0.0"},
+		// Rows not rehashed yet only have their MD5
+		{name: "legacy", sha256: "", wantChecksum: "md5-1.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := testHandler(t)
+			expectTestGame(mock)
+			mock.ExpectQuery(`SELECT id, blob_name, blob_url, file_size, checksum`).WithArgs(1, "1.0.0", DefaultBoard).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "blob_name", "blob_url", "file_size", "checksum", "sha256", "encrypt"}).
+					AddRow(1, "_sha256/abc.bin", "", 1024, "md5-1.0.0", tt.sha256, false))
+
+			link := h.engineDownloadURL(downloadParams("crisp-games", DefaultBoard, "1.0.0", "", "stick-1"), time.Now().Add(time.Minute))
+			w := serve(h.DownloadBin, adminRequest(http.MethodHead, link, ""))
+			if w.Code != http.StatusOK {
+				t.Fatalf("download = %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("X-Firmware-Checksum"); got != tt.wantChecksum {
+				t.Errorf("X-Firmware-Checksum = %q, want %q", got, tt.wantChecksum)
+			}
+			if got := w.Header().Get("X-Firmware-MD5"); got != "md5-1.0.0" {
+				t.Errorf("X-Firmware-MD5 = %q, want md5-1.0.0", got)
+			}
+			if got := w.Header().Get("ETag"); got != `"`+tt.wantChecksum+`"` {
+				t.Errorf("ETag = %s, want the image checksum", got)
+			}
+			expectationsMet(t, mock)
+		})
+	}
+}
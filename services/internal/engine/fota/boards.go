@@ -0,0 +1,265 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/espimage"
+	"github.com/lib/pq"
+)
+
+// DefaultBoard is assumed for uploads and devices that name no board, which
+// is every stick flashed before boards existed
+const DefaultBoard = "m5stickc-plus"
+
+// Board is an entry of the hardware registry
+type Board struct {
+	Code        string    `json:"code"`
+	Name        string    `json:"name"`
+	ChipID      int       `json:"chip_id"`
+	FlashSizeMB int       `json:"flash_size_mb"`
+	Description string    `json:"description"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// boardRef identifies the board a release targets
+type boardRef struct {
+	ID          int64
+	Code        string
+	ChipID      int
+	FlashSizeMB int
+}
+
+// deviceHardware is what a device reported about itself. ChipRev uses the
+// ESP-IDF full revision encoding (major * 100 + minor).
+type deviceHardware struct {
+	Board       string
+	ChipRev     *int
+	FlashSizeMB *int
+	// EncryptedOTA is set when the device can install esp_encrypted_img
+	// artifacts
+	EncryptedOTA *bool
+	// Encodings lists the compressed encodings the device can inflate while
+	// writing to flash; nil when it never said
+	Encodings []string
+}
+
+// lookupBoard returns sql.ErrNoRows for unknown board codes
+func (h *Handler) lookupBoard(code string) (boardRef, error) {
+	board := boardRef{Code: code}
+	err := h.db.QueryRow(`SELECT id, chip_id, flash_size_mb FROM boards WHERE code = $1`, code).
+		Scan(&board.ID, &board.ChipID, &board.FlashSizeMB)
+	return board, err
+}
+
+// checkImage rejects images built for another chip or for more flash than
+// the board has
+func (b boardRef) checkImage(img *espimage.Image) error {
+	if int(img.ChipID) != b.ChipID {
+		return fmt.Errorf("image is built for %s (chip ID %d) but board %s has chip ID %d", img.Chip, img.ChipID, b.Code, b.ChipID)
+	}
+	if img.FlashSizeMB > b.FlashSizeMB {
+		return fmt.Errorf("image expects %d MB flash but board %s has %d MB", img.FlashSizeMB, b.Code, b.FlashSizeMB)
+	}
+	return nil
+}
+
+// compatible reports whether a release can run on the reported hardware.
+// Unreported properties are not checked; releases are already filtered to
+// the device's board.
+func (hw deviceHardware) compatible(rel firmwareRelease) bool {
+	if hw.ChipRev != nil {
+		if rel.MinChipRev != nil && *hw.ChipRev < *rel.MinChipRev {
+			return false
+		}
+		// 0 and 0xFFFF in the image header mean no upper bound
+		if rel.MaxChipRev != nil && *rel.MaxChipRev != 0 && *rel.MaxChipRev != 0xFFFF && *hw.ChipRev > *rel.MaxChipRev {
+			return false
+		}
+	}
+	if hw.FlashSizeMB != nil && rel.FlashSizeMB != nil && *rel.FlashSizeMB > *hw.FlashSizeMB {
+		return false
+	}
+	return true
+}
+
+// compatibleReleases filters releases down to those the hardware can run
+func compatibleReleases(releases []firmwareRelease, hw deviceHardware) []firmwareRelease {
+	var compatible []firmwareRelease
+	for _, rel := range releases {
+		if hw.compatible(rel) {
+			compatible = append(compatible, rel)
+		}
+	}
+	return compatible
+}
+
+// Boards lists the hardware registry (GET) or creates/updates a board
+// (POST, admin only)
+func (h *Handler) Boards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listBoards(w, r)
+	case http.MethodPost:
+		if !h.authorizeAdmin(w, r) {
+			return
+		}
+		h.saveBoard(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listBoards(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT code, name, chip_id, flash_size_mb, COALESCE(description, ''), created_at
+		FROM boards
+		ORDER BY code
+	`)
+	if err != nil {
+		log.Printf("Failed to query boards: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	boards := []Board{}
+	for rows.Next() {
+		var b Board
+		if err := rows.Scan(&b.Code, &b.Name, &b.ChipID, &b.FlashSizeMB, &b.Description, &b.CreatedAt); err != nil {
+			log.Printf("Failed to scan board: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		boards = append(boards, b)
+	}
+
+	writeJSON(w, http.StatusOK, boards)
+}
+
+func (h *Handler) saveBoard(w http.ResponseWriter, r *http.Request) {
+	var b Board
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	// Board codes end up in blob names like game codes
+	if !gameCodePattern.MatchString(b.Code) {
+		http.Error(w, "Board code must be 1-50 lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if b.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if !espimage.KnownChip(uint16(b.ChipID)) {
+		http.Error(w, "Unknown chip_id", http.StatusBadRequest)
+		return
+	}
+	if b.FlashSizeMB <= 0 {
+		http.Error(w, "flash_size_mb is required", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		INSERT INTO boards (code, name, chip_id, flash_size_mb, description)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (code) DO UPDATE
+		SET name = EXCLUDED.name,
+			chip_id = EXCLUDED.chip_id,
+			flash_size_mb = EXCLUDED.flash_size_mb,
+			description = EXCLUDED.description
+		RETURNING created_at
+	`
+
+	err := h.db.QueryRow(query, b.Code, b.Name, b.ChipID, b.FlashSizeMB, b.Description).Scan(&b.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to save board %s: %v", b.Code, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Board %s saved", b.Code)
+
+	writeJSON(w, http.StatusOK, b)
+}
+
+// parseHardware reads the hardware a device reports in a check request
+func parseHardware(r *http.Request) (deviceHardware, error) {
+	hw := deviceHardware{Board: r.URL.Query().Get("board")}
+
+	var err error
+	if hw.ChipRev, err = optionalInt(r.URL.Query().Get("chip_rev")); err != nil {
+		return hw, fmt.Errorf("chip_rev must be an integer")
+	}
+	if hw.FlashSizeMB, err = optionalInt(r.URL.Query().Get("flash_size")); err != nil {
+		return hw, fmt.Errorf("flash_size must be an integer")
+	}
+	if v := r.URL.Query().Get("encrypted_ota"); v != "" {
+		supported, err := strconv.ParseBool(v)
+		if err != nil {
+			return hw, fmt.Errorf("encrypted_ota must be true or false")
+		}
+		hw.EncryptedOTA = &supported
+	}
+	if r.URL.Query().Has("compression") {
+		hw.Encodings = parseEncodings(r.URL.Query().Get("compression"))
+	}
+	return hw, nil
+}
+
+// withStoredHardware fills what a device left out of a request with what it
+// reported before, defaulting the board to DefaultBoard
+func (h *Handler) withStoredHardware(hw deviceHardware, deviceID string) (deviceHardware, error) {
+	if deviceID != "" {
+		var board sql.NullString
+		var chipRev, flashSize sql.NullInt64
+		var encryptedOTA sql.NullBool
+		var encodings pq.StringArray
+		err := h.db.QueryRow(`SELECT board_code, chip_rev, flash_size_mb, supports_encrypted_ota, ota_encodings FROM devices WHERE id = $1`, deviceID).
+			Scan(&board, &chipRev, &flashSize, &encryptedOTA, &encodings)
+		if err != nil && err != sql.ErrNoRows {
+			return hw, err
+		}
+		if hw.Board == "" {
+			hw.Board = board.String
+		}
+		if hw.ChipRev == nil && chipRev.Valid {
+			v := int(chipRev.Int64)
+			hw.ChipRev = &v
+		}
+		if hw.FlashSizeMB == nil && flashSize.Valid {
+			v := int(flashSize.Int64)
+			hw.FlashSizeMB = &v
+		}
+		if hw.EncryptedOTA == nil && encryptedOTA.Valid {
+			v := encryptedOTA.Bool
+			hw.EncryptedOTA = &v
+		}
+		if hw.Encodings == nil && encodings != nil {
+			hw.Encodings = encodings
+		}
+	}
+
+	if hw.Board == "" {
+		hw.Board = DefaultBoard
+	}
+	return hw, nil
+}
+
+func optionalInt(s string) (*int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
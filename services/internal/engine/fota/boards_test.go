@@ -0,0 +1,180 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+)
+
+func TestCompatibleReleases(t *testing.T) {
+	releases := []firmwareRelease{
+		{Version: "1.0.0"},
+		{Version: "1.1.0", MinChipRev: intPtr(300)},
+		{Version: "1.2.0", MaxChipRev: intPtr(100)},
+		{Version: "1.3.0", MaxChipRev: intPtr(0xFFFF), MinChipRev: intPtr(0)},
+		{Version: "1.4.0", FlashSizeMB: intPtr(8)},
+	}
+
+	tests := []struct {
+		name string
+		hw   deviceHardware
+		want string
+	}{
+		{"nothing reported", deviceHardware{}, "1.0.0,1.1.0,1.2.0,1.3.0,1.4.0"},
+		{"revision 1.0", deviceHardware{ChipRev: intPtr(100)}, "1.0.0,1.2.0,1.3.0,1.4.0"},
+		{"revision 3.1", deviceHardware{ChipRev: intPtr(301)}, "1.0.0,1.1.0,1.3.0,1.4.0"},
+		{"4 MB flash", deviceHardware{FlashSizeMB: intPtr(4)}, "1.0.0,1.1.0,1.2.0,1.3.0"},
+		{"8 MB flash", deviceHardware{FlashSizeMB: intPtr(8)}, "1.0.0,1.1.0,1.2.0,1.3.0,1.4.0"},
+	}
+
+	for _, tt := range tests {
+		var got []string
+		for _, rel := range compatibleReleases(releases, tt.hw) {
+			got = append(got, rel.Version)
+		}
+		if strings.Join(got, ",") != tt.want {
+			t.Errorf("compatibleReleases() for %s = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	h, _ := testHandler(t)
+	image := appImage("1.0.0", 64)
+
+	tests := []struct {
+		board   boardRef
+		wantErr bool
+	}{
+		{testBoard, false},
+		{boardRef{Code: "m5stickc-plus-8mb", ChipID: 0, FlashSizeMB: 8}, false},
+		{boardRef{Code: "m5stickc-plus-2mb", ChipID: 0, FlashSizeMB: 2}, true},
+		{boardRef{Code: "esp32-s3", ChipID: 9, FlashSizeMB: 8}, true},
+	}
+
+	for _, tt := range tests {
+		staged, err := h.stageFirmware(context.Background(), uploadMeta{Board: tt.board, Version: "1.0.0"}, bytes.NewReader(image))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("image on board %s: error = %v, want error %t", tt.board.Code, err, tt.wantErr)
+		}
+		if staged != nil {
+			h.deleteStaged(staged)
+		}
+	}
+}
+
+func TestParseHardware(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/api/fota/check?board=m5stickc-plus&chip_rev=301&flash_size=4&encrypted_ota=true", nil)
+	hw, err := parseHardware(r)
+	if err != nil {
+		t.Fatalf("parseHardware: %v", err)
+	}
+	if hw.Board != DefaultBoard || *hw.ChipRev != 301 || *hw.FlashSizeMB != 4 || !*hw.EncryptedOTA || hw.Encodings != nil {
+		t.Errorf("parseHardware() = %+v", hw)
+	}
+
+	for _, query := range []string{"chip_rev=v3", "flash_size=4MB", "encrypted_ota=maybe"} {
+		if _, err := parseHardware(httptest.NewRequest(http.MethodGet, "/api/fota/check?"+query, nil)); err == nil {
+			t.Errorf("parseHardware(%s) accepted the request", query)
+		}
+	}
+}
+
+func TestWithStoredHardware(t *testing.T) {
+	h, mock := testHandler(t)
+	columns := []string{"board_code", "chip_rev", "flash_size_mb", "supports_encrypted_ota", "ota_encodings"}
+
+	// What the device leaves out comes from its last check
+	mock.ExpectQuery(`SELECT board_code, chip_rev`).WithArgs("stick-1").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("m5stickc-plus2", 300, 8, true, pq.StringArray{"gzip"}))
+	hw, err := h.withStoredHardware(deviceHardware{ChipRev: intPtr(301)}, "stick-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%s %d %d %t %v", hw.Board, *hw.ChipRev, *hw.FlashSizeMB, *hw.EncryptedOTA, hw.Encodings); got != "m5stickc-plus2 301 8 true [gzip]" {
+		t.Errorf("withStoredHardware() = %s", got)
+	}
+
+	// Unknown and anonymous devices default to the original board
+	mock.ExpectQuery(`SELECT board_code, chip_rev`).WithArgs("stick-2").WillReturnError(sql.ErrNoRows)
+	for _, deviceID := range []string{"stick-2", ""} {
+		hw, err := h.withStoredHardware(deviceHardware{}, deviceID)
+		if err != nil || hw.Board != DefaultBoard || hw.ChipRev != nil {
+			t.Errorf("withStoredHardware(%q) = %+v, %v", deviceID, hw, err)
+		}
+	}
+	expectationsMet(t, mock)
+}
+
+func TestResolveUpdateSkipsIncompatibleRelease(t *testing.T) {
+	h, mock := testHandler(t)
+	newest := testRelease(4, "1.4.0")
+	newest.FlashSizeMB = intPtr(8)
+
+	// The newest build needs more flash than the device has, so it gets the
+	// newest build it can run
+	expectSupported(mock)
+	expectNoWindows(mock, "stick-1")
+	expectNoPin(mock, "stick-1")
+	mock.ExpectQuery(`channel IN \(\$3, 'stable'\)`).WithArgs(1, DefaultBoard, ChannelStable).
+		WillReturnRows(releaseRows(testRelease(3, "1.3.0"), newest))
+	expectOffer(mock, 3)
+
+	response, err := h.resolveUpdate(context.Background(), updateQuery{
+		Game:           testGame,
+		DeviceID:       "stick-1",
+		CurrentVersion: "1.2.0",
+		Hardware:       deviceHardware{Board: DefaultBoard, FlashSizeMB: intPtr(4)},
+		Channel:        ChannelStable,
+	})
+	if err != nil {
+		t.Fatalf("resolveUpdate: %v", err)
+	}
+	if response.Version != "1.3.0" || response.Board != DefaultBoard {
+		t.Errorf("resolveUpdate() = %s %s for %s, want 1.3.0", response.Status, response.Version, response.Board)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestSaveBoard(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid code", `{"code": "M5 Stick", "name": "M5Stick", "chip_id": 0, "flash_size_mb": 4}`},
+		{"no name", `{"code": "m5stick", "chip_id": 0, "flash_size_mb": 4}`},
+		{"unknown chip", `{"code": "m5stick", "name": "M5Stick", "chip_id": 4242, "flash_size_mb": 4}`},
+		{"no flash size", `{"code": "m5stick", "name": "M5Stick", "chip_id": 0}`},
+	}
+	for _, tt := range tests {
+		h, mock := testHandler(t)
+		if w := serve(h.Boards, adminRequest(http.MethodPost, "/api/fota/boards", tt.body)); w.Code != http.StatusBadRequest {
+			t.Errorf("board with %s = %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+		expectationsMet(t, mock)
+	}
+
+	h, mock := testHandler(t)
+	body := `{"code": "m5stickc-plus2", "name": "M5StickC Plus2", "chip_id": 0, "flash_size_mb": 8}`
+	r := adminRequest(http.MethodPost, "/api/fota/boards", body)
+	r.Header.Del("X-API-Token")
+	if w := serve(h.Boards, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("board without a token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	mock.ExpectQuery(`INSERT INTO boards`).WithArgs("m5stickc-plus2", "M5StickC Plus2", 0, 8, "").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	if w := serve(h.Boards, adminRequest(http.MethodPost, "/api/fota/boards", body)); w.Code != http.StatusOK {
+		t.Errorf("board = %d: %s", w.Code, w.Body)
+	}
+	expectationsMet(t, mock)
+}
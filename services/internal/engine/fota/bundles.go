@@ -0,0 +1,455 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/parttable"
+)
+
+// Partition types of a bundle. The app image is the release's firmware
+// and is written to the next OTA slot; the others go to fixed offsets or to
+// the data partition with their label.
+const (
+	PartBootloader     = "bootloader"
+	PartPartitionTable = "partition_table"
+	PartApp            = "app"
+	PartData           = "data"
+)
+
+// maxBundleParts bounds the images of a bundle besides the app
+const maxBundleParts = 8
+
+// Data partitions are erased in 4 KB sectors
+const dataPartitionAlign = 0x1000
+
+var partitionLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,16}$`)
+
+// PartitionInfo describes one image of a bundle release
+type PartitionInfo struct {
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	// Offset is the flash address the image is written to, when fixed
+	Offset      *int64 `json:"offset,omitempty"`
+	FileSize    int64  `json:"file_size"`
+	Checksum    string `json:"checksum"`
+	SHA256      string `json:"sha256"`
+	DownloadURL string `json:"download_url,omitempty"`
+}
+
+// bundlePart is an image of a bundle upload besides the app
+type bundlePart struct {
+	Label  string
+	Type   string
+	Offset *int64
+	Staged *stagedImage
+	// table is the parsed image of a partition_table part
+	table *parttable.Table
+}
+
+func (p bundlePart) info() PartitionInfo {
+	return PartitionInfo{
+		Label:    p.Label,
+		Type:     p.Type,
+		Offset:   p.Offset,
+		FileSize: p.Staged.Size,
+		Checksum: p.Staged.MD5,
+		SHA256:   p.Staged.SHA256,
+	}
+}
+
+// firmwarePartition is a stored firmware_partitions row
+type firmwarePartition struct {
+	Label    string
+	Type     string
+	Offset   *int64
+	BlobName string
+	FileSize int64
+	Checksum string
+	SHA256   string
+}
+
+func (p firmwarePartition) info() PartitionInfo {
+	return PartitionInfo{
+		Label:    p.Label,
+		Type:     p.Type,
+		Offset:   p.Offset,
+		FileSize: p.FileSize,
+		Checksum: p.Checksum,
+		SHA256:   p.SHA256,
+	}
+}
+
+// parseBundlePartitions validates the partitions field of a bundle upload,
+// a JSON array of {"label", "type", "offset"}
+func parseBundlePartitions(value string) ([]bundlePart, error) {
+	if value == "" {
+		return nil, badUpload("partitions is required")
+	}
+
+	var entries []struct {
+		Label  string `json:"label"`
+		Type   string `json:"type"`
+		Offset *int64 `json:"offset"`
+	}
+	if err := json.Unmarshal([]byte(value), &entries); err != nil {
+		return nil, badUpload("partitions must be a JSON array of {label, type, offset}")
+	}
+	if len(entries) == 0 {
+		return nil, badUpload("partitions is required")
+	}
+	if len(entries) > maxBundleParts {
+		return nil, badUpload("A bundle may have at most %d partitions besides the app", maxBundleParts)
+	}
+
+	parts := make([]bundlePart, 0, len(entries))
+	labels, types := make(map[string]bool), make(map[string]bool)
+	for _, e := range entries {
+		part := bundlePart{Label: e.Label, Type: e.Type, Offset: e.Offset}
+
+		switch part.Type {
+		case PartBootloader, PartPartitionTable:
+			if part.Label == "" {
+				part.Label = part.Type
+			}
+			if part.Offset == nil {
+				return nil, badUpload("The %s needs an offset", part.Type)
+			}
+		case PartData:
+			if part.Label == "" {
+				return nil, badUpload("Data partitions need a label")
+			}
+		case PartApp:
+			return nil, badUpload("The app image is uploaded as the firmware file, not listed in partitions")
+		default:
+			return nil, badUpload("Partition type must be one of bootloader, partition_table, data")
+		}
+
+		if !partitionLabelPattern.MatchString(part.Label) || part.Label == "firmware" {
+			return nil, badUpload("Invalid partition label %q", part.Label)
+		}
+		if labels[part.Label] || (part.Type != PartData && types[part.Type]) {
+			return nil, badUpload("Duplicate partition %q", part.Label)
+		}
+		labels[part.Label] = true
+		types[part.Type] = true
+
+		if part.Offset != nil {
+			if *part.Offset < 0 || *part.Offset > math.MaxUint32 {
+				return nil, badUpload("Offset of partition %q is out of range", part.Label)
+			}
+			if part.Type == PartData && *part.Offset%dataPartitionAlign != 0 {
+				return nil, badUpload("Offset of partition %q must be a multiple of 0x%x", part.Label, dataPartitionAlign)
+			}
+		}
+
+		parts = append(parts, part)
+	}
+
+	return parts, nil
+}
+
+// stagePartition copies an image of a bundle into a staging blob while
+// hashing it. Partition tables are parsed first.
+func (h *Handler) stagePartition(ctx context.Context, part *bundlePart, src io.Reader) (*stagedImage, error) {
+	if part.Type == PartPartitionTable {
+		data, err := io.ReadAll(io.LimitReader(src, parttable.MaxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		part.table, err = parttable.Parse(data)
+		if err != nil {
+			return nil, badUpload("%v", err)
+		}
+		src = bytes.NewReader(data)
+	}
+
+	stagingBlob, err := stagingBlobName()
+	if err != nil {
+		return nil, err
+	}
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	body := &countingReader{r: io.TeeReader(io.LimitReader(src, h.maxFirmwareSize+1), io.MultiWriter(md5Hash, sha256Hash))}
+	if _, err := h.storage.Upload(ctx, stagingBlob, body, "application/octet-stream"); err != nil {
+		return nil, err
+	}
+
+	digest := sha256Hash.Sum(nil)
+	staged := &stagedImage{
+		BlobName: stagingBlob,
+		Size:     body.n,
+		MD5:      fmt.Sprintf("%x", md5Hash.Sum(nil)),
+		SHA256:   fmt.Sprintf("%x", digest),
+		Digest:   digest,
+	}
+
+	switch {
+	case staged.Size > h.maxFirmwareSize:
+		h.deleteStaged(staged)
+		return nil, &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Partition %q exceeds the maximum size of %d bytes", part.Label, h.maxFirmwareSize),
+		}
+	case staged.Size == 0:
+		h.deleteStaged(staged)
+		return nil, badUpload("Partition %q is empty", part.Label)
+	}
+
+	return staged, nil
+}
+
+// validateBundle checks the images of a bundle against each other and, when
+// the bundle ships a partition table, against that table. Offsets of data
+// partitions left out are taken from the table.
+func validateBundle(app *stagedImage, parts []bundlePart) error {
+	var table *parttable.Table
+	for _, part := range parts {
+		if part.table != nil {
+			table = part.table
+		}
+	}
+
+	if table != nil {
+		slots := table.OTASlots()
+		if len(slots) == 0 {
+			return badUpload("The partition table has no OTA app partitions")
+		}
+		for _, slot := range slots {
+			if int64(slot.Size) < app.Size {
+				return badUpload("The app image (%d bytes) does not fit OTA partition %q (%d bytes)", app.Size, slot.Label, slot.Size)
+			}
+		}
+
+		for i := range parts {
+			part := &parts[i]
+			if part.Type != PartData {
+				continue
+			}
+
+			p, ok := table.Find(part.Label)
+			if !ok {
+				return badUpload("Partition %q is not in the partition table", part.Label)
+			}
+			if p.Type == parttable.TypeApp {
+				return badUpload("Partition %q is an app partition", part.Label)
+			}
+			if part.Offset == nil {
+				offset := int64(p.Offset)
+				part.Offset = &offset
+			} else if *part.Offset != int64(p.Offset) {
+				return badUpload("Partition %q is at offset 0x%x in the partition table, not 0x%x", part.Label, p.Offset, *part.Offset)
+			}
+			if part.Staged.Size > int64(p.Size) {
+				return badUpload("The image of partition %q (%d bytes) exceeds its %d bytes", part.Label, part.Staged.Size, p.Size)
+			}
+		}
+	}
+
+	// Images written to fixed offsets must not overlap
+	var placed []bundlePart
+	for _, part := range parts {
+		if part.Offset != nil {
+			placed = append(placed, part)
+		}
+	}
+	sort.Slice(placed, func(i, j int) bool { return *placed[i].Offset < *placed[j].Offset })
+	for i := 1; i < len(placed); i++ {
+		prev := placed[i-1]
+		if *prev.Offset+prev.Staged.Size > *placed[i].Offset {
+			return badUpload("Partitions %q and %q overlap", prev.Label, placed[i].Label)
+		}
+	}
+
+	return nil
+}
+
+// UploadBundle uploads a release made of several flash images: the app
+// image as the "firmware" file plus the bootloader, partition table or data
+// partitions described by the "partitions" field, each sent as a file named
+// after its label. Text fields must precede the files. Admin only.
+func (h *Handler) UploadBundle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, (maxBundleParts+1)*h.maxFirmwareSize+1<<20)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	fields := make(map[string]string)
+	var meta uploadMeta
+	var parts []bundlePart
+	var app *stagedImage
+	var staged []*stagedImage
+	defer func() {
+		for _, s := range staged {
+			h.deleteStaged(s)
+		}
+	}()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeUploadError(w, badUpload("Failed to parse multipart form"))
+			return
+		}
+
+		if part.FileName() == "" {
+			if parts != nil {
+				writeUploadError(w, badUpload("Text fields must precede the images"))
+				return
+			}
+			value, err := readUploadField(part)
+			if err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			fields[part.FormName()] = value
+			continue
+		}
+
+		if parts == nil {
+			if err := checkFieldsBeforeImage(fields); err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			if meta, err = h.parseUploadMeta(fields); err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			if parts, err = parseBundlePartitions(fields["partitions"]); err != nil {
+				writeUploadError(w, err)
+				return
+			}
+		}
+
+		if part.FormName() == "firmware" {
+			if app != nil {
+				writeUploadError(w, badUpload("Duplicate firmware file"))
+				return
+			}
+			if app, err = h.stageFirmware(ctx, meta, part); err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			staged = append(staged, app)
+			continue
+		}
+
+		i := bundlePartIndex(parts, part.FormName())
+		if i < 0 {
+			writeUploadError(w, badUpload("Image %q is not listed in partitions", part.FormName()))
+			return
+		}
+		if parts[i].Staged != nil {
+			writeUploadError(w, badUpload("Duplicate image for partition %q", parts[i].Label))
+			return
+		}
+		if parts[i].Staged, err = h.stagePartition(ctx, &parts[i], part); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		staged = append(staged, parts[i].Staged)
+	}
+
+	if app == nil {
+		http.Error(w, "Firmware file is required", http.StatusBadRequest)
+		return
+	}
+	for _, part := range parts {
+		if part.Staged == nil {
+			writeUploadError(w, badUpload("Missing image for partition %q", part.Label))
+			return
+		}
+	}
+	if err := validateBundle(app, parts); err != nil {
+		log.Printf("Rejected bundle %s %s for %s: %v", meta.Game.Code, meta.Version, meta.Board.Code, err)
+		writeUploadError(w, err)
+		return
+	}
+
+	result, err := h.publishRelease(ctx, meta, app, parts)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, result)
+}
+
+func bundlePartIndex(parts []bundlePart, label string) int {
+	for i, part := range parts {
+		if part.Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+// releasePartitions loads the images a bundle release ships besides the
+// app, in flash order
+func (h *Handler) releasePartitions(firmwareID int64) ([]firmwarePartition, error) {
+	rows, err := h.db.Query(`
+		SELECT label, part_type, flash_offset, blob_name, file_size, checksum, sha256
+		FROM firmware_partitions
+		WHERE firmware_id = $1
+		ORDER BY flash_offset NULLS LAST, label
+	`, firmwareID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var partitions []firmwarePartition
+	for rows.Next() {
+		var p firmwarePartition
+		if err := rows.Scan(&p.Label, &p.Type, &p.Offset, &p.BlobName, &p.FileSize, &p.Checksum, &p.SHA256); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, rows.Err()
+}
+
+// lookupPartition returns nil when the release has no partition with the
+// label
+func (h *Handler) lookupPartition(firmwareID int64, label string) (*firmwarePartition, error) {
+	var p firmwarePartition
+	err := h.db.QueryRow(`
+		SELECT label, part_type, flash_offset, blob_name, file_size, checksum, sha256
+		FROM firmware_partitions
+		WHERE firmware_id = $1 AND label = $2
+	`, firmwareID, label).Scan(&p.Label, &p.Type, &p.Offset, &p.BlobName, &p.FileSize, &p.Checksum, &p.SHA256)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,192 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/parttable"
+)
+
+// partitionTable encodes a binary partition table without the MD5 entry
+func partitionTable(parts []parttable.Partition) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		e := make([]byte, 32)
+		e[0], e[1] = 0xAA, 0x50
+		e[2], e[3] = p.Type, p.Subtype
+		binary.LittleEndian.PutUint32(e[4:8], p.Offset)
+		binary.LittleEndian.PutUint32(e[8:12], p.Size)
+		copy(e[12:28], p.Label)
+		buf.Write(e)
+	}
+	buf.Write(bytes.Repeat([]byte{0xFF}, parttable.MaxSize-buf.Len()))
+	return buf.Bytes()
+}
+
+// otaLayout is the two-slot layout of the M5StickC Plus builds
+var otaLayout = []parttable.Partition{
+	{Label: "nvs", Type: parttable.TypeData, Subtype: 0x02, Offset: 0x9000, Size: 0x5000},
+	{Label: "otadata", Type: parttable.TypeData, Subtype: 0x00, Offset: 0xE000, Size: 0x2000},
+	{Label: "app0", Type: parttable.TypeApp, Subtype: parttable.SubtypeOTAMin, Offset: 0x10000, Size: 0x140000},
+	{Label: "app1", Type: parttable.TypeApp, Subtype: parttable.SubtypeOTAMin + 1, Offset: 0x150000, Size: 0x140000},
+	{Label: "spiffs", Type: parttable.TypeData, Subtype: 0x82, Offset: 0x290000, Size: 0x160000},
+}
+
+func offset(v int64) *int64 {
+	return &v
+}
+
+func TestParseBundlePartitions(t *testing.T) {
+	parts, err := parseBundlePartitions(`[
+		{"type": "bootloader", "offset": 4096},
+		{"type": "partition_table", "offset": 32768},
+		{"label": "spiffs", "type": "data"}
+	]`)
+	if err != nil {
+		t.Fatalf("parseBundlePartitions: %v", err)
+	}
+	// Bootloader and partition table are labelled after their type
+	var got []string
+	for _, p := range parts {
+		got = append(got, fmt.Sprintf("%s/%s", p.Label, p.Type))
+	}
+	if strings.Join(got, " ") != "bootloader/bootloader partition_table/partition_table spiffs/data" {
+		t.Errorf("parseBundlePartitions() = %v", got)
+	}
+	if *parts[0].Offset != 0x1000 || parts[2].Offset != nil {
+		t.Errorf("offsets = %v, %v; want 0x1000 and none", *parts[0].Offset, parts[2].Offset)
+	}
+
+	tooMany := make([]string, maxBundleParts+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf(`{"label": "data%d", "type": "data"}`, i)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "missing", value: "", want: "partitions is required"},
+		{name: "empty", value: "[]", want: "partitions is required"},
+		{name: "not JSON", value: "bootloader", want: "partitions must be a JSON array of {label, type, offset}"},
+		{name: "too many", value: "[" + strings.Join(tooMany, ",") + "]", want: "A bundle may have at most 8 partitions besides the app"},
+		{name: "app", value: `[{"type": "app", "offset": 65536}]`, want: "The app image is uploaded as the firmware file, not listed in partitions"},
+		{name: "unknown type", value: `[{"label": "x", "type": "firmware"}]`, want: "Partition type must be one of bootloader, partition_table, data"},
+		{name: "bootloader without offset", value: `[{"type": "bootloader"}]`, want: "The bootloader needs an offset"},
+		{name: "data without label", value: `[{"type": "data", "offset": 4096}]`, want: "Data partitions need a label"},
+		{name: "invalid label", value: `[{"label": "my partition", "type": "data"}]`, want: `Invalid partition label "my partition"`},
+		{name: "reserved label", value: `[{"label": "firmware", "type": "data"}]`, want: `Invalid partition label "firmware"`},
+		{name: "duplicate label", value: `[{"label": "nvs", "type": "data"}, {"label": "nvs", "type": "data"}]`, want: `Duplicate partition "nvs"`},
+		{name: "second bootloader", value: `[{"type": "bootloader", "offset": 4096}, {"label": "boot2", "type": "bootloader", "offset": 8192}]`, want: `Duplicate partition "boot2"`},
+		{name: "negative offset", value: `[{"label": "nvs", "type": "data", "offset": -4096}]`, want: `Offset of partition "nvs" is out of range`},
+		{name: "offset beyond 4 GiB", value: `[{"label": "nvs", "type": "data", "offset": 4294967296}]`, want: `Offset of partition "nvs" is out of range`},
+		{name: "unaligned data", value: `[{"label": "nvs", "type": "data", "offset": 36865}]`, want: `Offset of partition "nvs" must be a multiple of 0x1000`},
+	}
+
+	for _, tt := range tests {
+		_, err := parseBundlePartitions(tt.value)
+		w := httptest.NewRecorder()
+		writeUploadError(w, err)
+		if err == nil || strings.TrimSpace(w.Body.String()) != tt.want {
+			t.Errorf("%s: parseBundlePartitions() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestValidateBundle(t *testing.T) {
+	table := &parttable.Table{Partitions: otaLayout}
+
+	// bundle returns a bootloader, the table and a spiffs image of
+	// spiffsSize at spiffsOffset
+	bundle := func(spiffsOffset *int64, spiffsSize int64) []bundlePart {
+		return []bundlePart{
+			{Label: PartBootloader, Type: PartBootloader, Offset: offset(0x1000), Staged: &stagedImage{Size: 0x6000}},
+			{Label: PartPartitionTable, Type: PartPartitionTable, Offset: offset(0x8000), Staged: &stagedImage{Size: parttable.MaxSize}, table: table},
+			{Label: "spiffs", Type: PartData, Offset: spiffsOffset, Staged: &stagedImage{Size: spiffsSize}},
+		}
+	}
+
+	// Data partitions without an offset are placed from the table
+	parts := bundle(nil, 0x1000)
+	if err := validateBundle(&stagedImage{Size: 0x100000}, parts); err != nil {
+		t.Fatalf("validateBundle: %v", err)
+	}
+	if parts[2].Offset == nil || *parts[2].Offset != 0x290000 {
+		t.Errorf("spiffs offset = %v, want 0x290000", parts[2].Offset)
+	}
+
+	tests := []struct {
+		name    string
+		appSize int64
+		parts   []bundlePart
+		want    string
+	}{
+		{name: "app larger than a slot", appSize: 0x140001, parts: bundle(nil, 0x1000),
+			want: `The app image (1310721 bytes) does not fit OTA partition "app0" (1310720 bytes)`},
+		{name: "offset differs from the table", appSize: 0x1000, parts: bundle(offset(0x280000), 0x1000),
+			want: `Partition "spiffs" is at offset 0x290000 in the partition table, not 0x280000`},
+		{name: "data larger than its partition", appSize: 0x1000, parts: bundle(nil, 0x160001),
+			want: `The image of partition "spiffs" (1441793 bytes) exceeds its 1441792 bytes`},
+		{name: "data not in the table", appSize: 0x1000,
+			parts: append(bundle(nil, 0x1000), bundlePart{Label: "fonts", Type: PartData, Staged: &stagedImage{Size: 1}}),
+			want:  `Partition "fonts" is not in the partition table`},
+		{name: "data over an app partition", appSize: 0x1000,
+			parts: append(bundle(nil, 0x1000), bundlePart{Label: "app1", Type: PartData, Staged: &stagedImage{Size: 1}}),
+			want:  `Partition "app1" is an app partition`},
+		{name: "no OTA slots", appSize: 0x1000,
+			parts: []bundlePart{{Label: PartPartitionTable, Type: PartPartitionTable, Offset: offset(0x8000), Staged: &stagedImage{Size: 1},
+				table: &parttable.Table{Partitions: otaLayout[:2]}}},
+			want: "The partition table has no OTA app partitions"},
+		// Without a table only the fixed offsets are checked
+		{name: "overlapping images", appSize: 0x1000,
+			parts: []bundlePart{
+				{Label: PartBootloader, Type: PartBootloader, Offset: offset(0x1000), Staged: &stagedImage{Size: 0x8000}},
+				{Label: PartPartitionTable, Type: PartPartitionTable, Offset: offset(0x8000), Staged: &stagedImage{Size: 1}},
+			},
+			want: `Partitions "bootloader" and "partition_table" overlap`},
+	}
+
+	for _, tt := range tests {
+		err := validateBundle(&stagedImage{Size: tt.appSize}, tt.parts)
+		w := httptest.NewRecorder()
+		writeUploadError(w, err)
+		if err == nil || strings.TrimSpace(w.Body.String()) != tt.want {
+			t.Errorf("%s: validateBundle() error = %v, want %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestStagePartition(t *testing.T) {
+	h, _ := testHandler(t)
+	ctx := context.Background()
+
+	part := bundlePart{Label: PartPartitionTable, Type: PartPartitionTable}
+	staged, err := h.stagePartition(ctx, &part, bytes.NewReader(partitionTable(otaLayout)))
+	if err != nil {
+		t.Fatalf("stagePartition: %v", err)
+	}
+	if part.table == nil || len(part.table.OTASlots()) != 2 || staged.Size != parttable.MaxSize {
+		t.Errorf("staged table of %d bytes parsed as %+v", staged.Size, part.table)
+	}
+
+	// Rejected images leave no staging blob behind
+	for name, data := range map[string][]byte{"invalid table": bytes.Repeat([]byte{0x42}, 64), "empty": nil} {
+		h, _ := testHandler(t)
+		typ := PartPartitionTable
+		if data == nil {
+			typ = PartData
+		}
+		if _, err := h.stagePartition(ctx, &bundlePart{Label: "x", Type: typ}, bytes.NewReader(data)); err == nil {
+			t.Errorf("stagePartition() of %s succeeded", name)
+		}
+		if blobs := listBlobs(t, h, ""); len(blobs) != 0 {
+			t.Errorf("rejected %s left %v", name, blobs)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Release channels. Devices on beta or nightly also receive stable releases,
+// so a channel without its own newer build falls back to stable.
+const (
+	ChannelStable  = "stable"
+	ChannelBeta    = "beta"
+	ChannelNightly = "nightly"
+)
+
+func validChannel(channel string) bool {
+	switch channel {
+	case ChannelStable, ChannelBeta, ChannelNightly:
+		return true
+	}
+	return false
+}
+
+// ChannelDevice is a device with its release channel enrollment
+type ChannelDevice struct {
+	ID          string     `json:"id"`
+	GameCode    *string    `json:"game_code"`
+	FirmwareVer *string    `json:"firmware_ver"`
+	Channel     string     `json:"channel"`
+	LastSeen    *time.Time `json:"last_seen"`
+}
+
+type channelEnrollRequest struct {
+	DeviceIDs []string `json:"device_ids"`
+	Channel   string   `json:"channel"`
+}
+
+// DeviceChannels lists devices enrolled in a channel (GET) or moves devices
+// between channels (POST). Admin only.
+func (h *Handler) DeviceChannels(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listChannelDevices(w, r)
+	case http.MethodPost:
+		h.enrollDevices(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listChannelDevices(w http.ResponseWriter, r *http.Request) {
+	channel := r.URL.Query().Get("channel")
+	if channel != "" && !validChannel(channel) {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, game_code, firmware_ver, fota_channel, last_seen
+		FROM devices
+		WHERE ($1 = '' OR fota_channel = $1)
+		ORDER BY fota_channel, id
+	`, channel)
+	if err != nil {
+		log.Printf("Failed to query devices: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []ChannelDevice{}
+	for rows.Next() {
+		var d ChannelDevice
+		if err := rows.Scan(&d.ID, &d.GameCode, &d.FirmwareVer, &d.Channel, &d.LastSeen); err != nil {
+			log.Printf("Failed to scan device: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		devices = append(devices, d)
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (h *Handler) enrollDevices(w http.ResponseWriter, r *http.Request) {
+	var req channelEnrollRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if !validChannel(req.Channel) {
+		http.Error(w, "Channel must be one of stable, beta, nightly", http.StatusBadRequest)
+		return
+	}
+	if len(req.DeviceIDs) == 0 {
+		http.Error(w, "device_ids is required", http.StatusBadRequest)
+		return
+	}
+
+	// Devices that have never checked in yet are created so they pick up
+	// the channel on their first check
+	query := `
+		INSERT INTO devices (id, fota_channel)
+		SELECT unnest($1::varchar[]), $2
+		ON CONFLICT (id) DO UPDATE SET fota_channel = EXCLUDED.fota_channel
+	`
+
+	res, err := h.db.Exec(query, pq.Array(req.DeviceIDs), req.Channel)
+	if err != nil {
+		log.Printf("Failed to enroll devices in %s: %v", req.Channel, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	updated, _ := res.RowsAffected()
+	log.Printf("Moved %d devices to channel %s", updated, req.Channel)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"channel": req.Channel,
+		"updated": updated,
+	})
+}
+
+// deviceChannel returns the channel a device follows, stable for unknown devices
+func (h *Handler) deviceChannel(deviceID string) (string, error) {
+	if deviceID == "" {
+		return ChannelStable, nil
+	}
+
+	var channel string
+	err := h.db.QueryRow(`SELECT fota_channel FROM devices WHERE id = $1`, deviceID).Scan(&channel)
+	if err == sql.ErrNoRows {
+		return ChannelStable, nil
+	}
+	return channel, err
+}
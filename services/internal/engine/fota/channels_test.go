@@ -0,0 +1,139 @@
+package fota
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidChannel(t *testing.T) {
+	for _, channel := range []string{ChannelStable, ChannelBeta, ChannelNightly} {
+		if !validChannel(channel) {
+			t.Errorf("validChannel(%q) = false", channel)
+		}
+	}
+	for _, channel := range []string{"", "Stable", "alpha", "beta "} {
+		if validChannel(channel) {
+			t.Errorf("validChannel(%q) = true", channel)
+		}
+	}
+}
+
+func TestDeviceChannelsRequiresAdmin(t *testing.T) {
+	h, mock := testHandler(t)
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/fota/devices/channel?channel=beta", nil),
+		httptest.NewRequest(http.MethodPost, "/api/fota/devices/channel", strings.NewReader(`{"device_ids": ["stick-1"], "channel": "beta"}`)),
+	} {
+		r.Header.Set("X-API-Token", "wrong-token")
+		if w := serve(h.DeviceChannels, r); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a valid token = %d, want %d", r.Method, w.Code, http.StatusUnauthorized)
+		}
+	}
+	expectationsMet(t, mock)
+}
+
+func TestEnrollDevicesValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{"channel":`},
+		{"unknown channel", `{"device_ids": ["stick-1"], "channel": "alpha"}`},
+		{"no channel", `{"device_ids": ["stick-1"]}`},
+		{"no devices", `{"device_ids": [], "channel": "beta"}`},
+	}
+
+	for _, tt := range tests {
+		h, mock := testHandler(t)
+		if w := serve(h.DeviceChannels, adminRequest(http.MethodPost, "/api/fota/devices/channel", tt.body)); w.Code != http.StatusBadRequest {
+			t.Errorf("enroll with %s = %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+		expectationsMet(t, mock)
+	}
+}
+
+func TestEnrollDevices(t *testing.T) {
+	h, mock := testHandler(t)
+	mock.ExpectExec(`INSERT INTO devices \(id, fota_channel\)`).WithArgs(`{"stick-1","stick-2"}`, ChannelBeta).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	w := serve(h.DeviceChannels, adminRequest(http.MethodPost, "/api/fota/devices/channel", `{"device_ids": ["stick-1", "stick-2"], "channel": "beta"}`))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"updated":2`) {
+		t.Errorf("enroll = %d: %s", w.Code, w.Body)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestListChannelDevicesRejectsUnknownChannel(t *testing.T) {
+	h, mock := testHandler(t)
+	if w := serve(h.DeviceChannels, adminRequest(http.MethodGet, "/api/fota/devices/channel?channel=alpha", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("list of an unknown channel = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestDeviceChannel(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// Anonymous checks follow stable without a query
+	if channel, err := h.deviceChannel(""); err != nil || channel != ChannelStable {
+		t.Errorf("deviceChannel(\"\") = %q, %v", channel, err)
+	}
+
+	mock.ExpectQuery(`SELECT fota_channel FROM devices`).WithArgs("stick-1").
+		WillReturnRows(sqlmock.NewRows([]string{"fota_channel"}).AddRow(ChannelBeta))
+	if channel, err := h.deviceChannel("stick-1"); err != nil || channel != ChannelBeta {
+		t.Errorf("deviceChannel() of an enrolled device = %q, %v", channel, err)
+	}
+
+	mock.ExpectQuery(`SELECT fota_channel FROM devices`).WithArgs("stick-2").WillReturnError(sql.ErrNoRows)
+	if channel, err := h.deviceChannel("stick-2"); err != nil || channel != ChannelStable {
+		t.Errorf("deviceChannel() of an unknown device = %q, %v", channel, err)
+	}
+
+	expectationsMet(t, mock)
+}
+
+func TestActiveReleasesFollowChannel(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// A beta device sees beta and stable releases; rows that are not semver
+	// cannot be ordered and are skipped
+	mock.ExpectQuery(`channel IN \(\$3, 'stable'\)`).WithArgs(1, "m5stickc-plus", ChannelBeta).
+		WillReturnRows(releaseRows(
+			firmwareRelease{ID: 1, Version: "1.0.0", Channel: ChannelStable, RolloutPercent: 100},
+			firmwareRelease{ID: 2, Version: "1.1.0-beta.1", Channel: ChannelBeta, RolloutPercent: 100},
+			firmwareRelease{ID: 3, Version: "latest", Channel: ChannelBeta, RolloutPercent: 100},
+		))
+
+	releases, err := h.activeReleases(1, "m5stickc-plus", ChannelBeta)
+	if err != nil {
+		t.Fatalf("activeReleases: %v", err)
+	}
+	if len(releases) != 2 {
+		t.Fatalf("activeReleases() = %d releases, want 2", len(releases))
+	}
+	if newest := newestRelease(releases); newest.Version != "1.1.0-beta.1" {
+		t.Errorf("newest beta release = %s, want 1.1.0-beta.1", newest.Version)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestUploadChannel(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// The channel is validated before the game is looked up
+	for _, channel := range []string{"alpha", "Beta"} {
+		_, err := h.parseUploadMeta(map[string]string{"game": "crisp-games", "channel": channel})
+		if ue, ok := err.(*uploadError); !ok || ue.Status != http.StatusBadRequest {
+			t.Errorf("parseUploadMeta() with channel %q error = %v, want a 400", channel, err)
+		}
+	}
+	expectationsMet(t, mock)
+}
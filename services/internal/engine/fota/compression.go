@@ -0,0 +1,262 @@
+package fota
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Content encodings of compressed images. deflate is a zlib stream, as in
+// HTTP, which the ROM's miniz inflater on ESP32 chips reads directly.
+const (
+	EncodingGzip    = "gzip"
+	EncodingDeflate = "deflate"
+)
+
+// compressedPrefix holds compressed images, named by release and image
+// digest so a re-upload never overwrites a copy that is still served
+const compressedPrefix = "_compressed/"
+
+// encoding is a way releases are compressed, with its blob name extension
+type encoding struct {
+	Name      string
+	Extension string
+	Compress  func(io.Writer) (io.WriteCloser, error)
+	Inflate   func(io.Reader) (io.ReadCloser, error)
+}
+
+// encodings are made for every release
+var encodings = []encoding{
+	{
+		Name:      EncodingGzip,
+		Extension: ".gz",
+		Compress:  func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, gzip.BestCompression) },
+		Inflate:   func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+	{
+		Name:      EncodingDeflate,
+		Extension: ".zz",
+		Compress:  func(w io.Writer) (io.WriteCloser, error) { return zlib.NewWriterLevel(w, zlib.BestCompression) },
+		Inflate:   zlib.NewReader,
+	},
+}
+
+// CompressionInfo describes the compressed copy of the image a device
+// downloads instead of the plain one; the response's FileSize, Checksum and
+// SHA256 still describe the inflated image
+type CompressionInfo struct {
+	Encoding    string `json:"encoding"`
+	DownloadURL string `json:"download_url"`
+	FileSize    int64  `json:"file_size"`
+	Checksum    string `json:"checksum"`
+	SHA256      string `json:"sha256"`
+}
+
+// compressedImage is a stored firmware_compressed row
+type compressedImage struct {
+	Encoding string
+	BlobName string
+	FileSize int64
+	Checksum string
+	SHA256   string
+}
+
+func lookupEncoding(name string) (encoding, bool) {
+	for _, enc := range encodings {
+		if enc.Name == name {
+			return enc, true
+		}
+	}
+	return encoding{}, false
+}
+
+// knownEncoding reports whether releases are compressed with an encoding
+func knownEncoding(name string) bool {
+	_, ok := lookupEncoding(name)
+	return ok
+}
+
+// parseEncodings reads the comma-separated encodings a device can inflate,
+// dropping unknown ones. "none" yields an empty, non-nil list.
+func parseEncodings(list string) []string {
+	parsed := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if knownEncoding(name) {
+			parsed = append(parsed, name)
+		}
+	}
+	return parsed
+}
+
+// acceptedEncodings reads an Accept-Encoding header into the known
+// encodings it accepts. Encodings given q=0 are left out.
+func acceptedEncodings(header string) []string {
+	var accepted []string
+	for _, item := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !knownEncoding(name) {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted = append(accepted, name)
+	}
+	return accepted
+}
+
+// compressImage returns the image in an encoding and verifies that it
+// inflates back to the image
+func compressImage(image []byte, enc encoding) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := enc.Compress(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(image); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	r, err := enc.Inflate(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Never advertise a copy that does not inflate to the image exactly
+	if inflated, err := io.ReadAll(r); err != nil || !bytes.Equal(inflated, image) {
+		return nil, fmt.Errorf("%s verification failed", enc.Name)
+	}
+	return buf.Bytes(), nil
+}
+
+// compressRelease stores the compressed copies of a release's image that
+// are smaller than the image. It runs in the background after an upload;
+// devices get the plain image until it is done.
+func (h *Handler) compressRelease(firmwareID int64, blobName string) {
+	ctx := context.Background()
+
+	image, err := h.readBlob(ctx, blobName)
+	if err != nil {
+		log.Printf("Failed to read firmware %d for compression: %v", firmwareID, err)
+		return
+	}
+	digest := fmt.Sprintf("%x", sha256.Sum256(image))
+
+	for _, enc := range encodings {
+		compressed, err := compressImage(image, enc)
+		if err != nil {
+			log.Printf("Failed to compress firmware %d with %s: %v", firmwareID, enc.Name, err)
+			continue
+		}
+		if len(compressed) >= len(image) {
+			log.Printf("Skipping %s copy of firmware %d: no smaller than the image", enc.Name, firmwareID)
+			continue
+		}
+		if err := h.storeCompressed(ctx, firmwareID, enc, digest, compressed); err != nil {
+			log.Printf("Failed to store %s copy of firmware %d: %v", enc.Name, firmwareID, err)
+			continue
+		}
+		log.Printf("Firmware %d compressed with %s: %d bytes (image %d bytes)", firmwareID, enc.Name, len(compressed), len(image))
+	}
+}
+
+func (h *Handler) storeCompressed(ctx context.Context, firmwareID int64, enc encoding, imageDigest string, compressed []byte) error {
+	blobName := fmt.Sprintf("%s%d/%s%s", compressedPrefix, firmwareID, imageDigest, enc.Extension)
+	if _, err := h.storage.Upload(ctx, blobName, bytes.NewReader(compressed), "application/octet-stream"); err != nil {
+		return err
+	}
+
+	// The release may have been re-uploaded meanwhile; the copy is then
+	// dropped instead of recorded
+	res, err := h.db.Exec(`
+		INSERT INTO firmware_compressed (firmware_id, encoding, blob_name, file_size, checksum, sha256)
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE EXISTS (SELECT 1 FROM firmwares WHERE id = $1 AND sha256 = $7)
+		ON CONFLICT (firmware_id, encoding) DO UPDATE
+		SET blob_name = EXCLUDED.blob_name,
+			file_size = EXCLUDED.file_size,
+			checksum = EXCLUDED.checksum,
+			sha256 = EXCLUDED.sha256,
+			created_at = NOW()
+	`, firmwareID, enc.Name, blobName, len(compressed),
+		fmt.Sprintf("%x", md5.Sum(compressed)), fmt.Sprintf("%x", sha256.Sum256(compressed)), imageDigest)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = fmt.Errorf("release changed during compression")
+		}
+	}
+	if err != nil {
+		h.deleteBlobs(ctx, []string{blobName})
+		return err
+	}
+	return nil
+}
+
+// dropCompressed deletes the compressed copies of a release whose image
+// was replaced
+func (h *Handler) dropCompressed(ctx context.Context, firmwareID int64) error {
+	rows, err := h.db.Query(`DELETE FROM firmware_compressed WHERE firmware_id = $1 RETURNING blob_name`, firmwareID)
+	if err != nil {
+		return err
+	}
+
+	var blobs []string
+	for rows.Next() {
+		var blobName string
+		if err := rows.Scan(&blobName); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, blobName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	h.deleteBlobs(ctx, blobs)
+	return nil
+}
+
+// pickCompressed returns the smallest compressed copy of a release in one
+// of the given encodings, or nil
+func (h *Handler) pickCompressed(firmwareID int64, accepted []string) (*compressedImage, error) {
+	if len(accepted) == 0 {
+		return nil, nil
+	}
+
+	var c compressedImage
+	err := h.db.QueryRow(`
+		SELECT encoding, blob_name, file_size, checksum, sha256
+		FROM firmware_compressed
+		WHERE firmware_id = $1 AND encoding = ANY($2)
+		ORDER BY file_size, encoding
+		LIMIT 1
+	`, firmwareID, pq.Array(accepted)).Scan(&c.Encoding, &c.BlobName, &c.FileSize, &c.Checksum, &c.SHA256)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
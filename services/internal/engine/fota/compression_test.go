@@ -0,0 +1,112 @@
+package fota
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestParseEncodings(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"gzip", []string{"gzip"}},
+		{"gzip,deflate", []string{"gzip", "deflate"}},
+		{" Deflate , GZIP ", []string{"deflate", "gzip"}},
+		{"br,gzip,zstd", []string{"gzip"}},
+		{"none", []string{}},
+		{"", []string{}},
+	}
+
+	for _, tt := range tests {
+		got := parseEncodings(tt.list)
+		if got == nil || fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("parseEncodings(%q) = %#v, want %#v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptedEncodings(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"gzip", []string{"gzip"}},
+		{"gzip, deflate, br", []string{"gzip", "deflate"}},
+		{"deflate;q=0.5, gzip;q=1.0", []string{"deflate", "gzip"}},
+		{"gzip;q=0, deflate", []string{"deflate"}},
+		{"GZIP; q=0.8", []string{"gzip"}},
+		{"identity", nil},
+		{"*", nil},
+	}
+
+	for _, tt := range tests {
+		if got := acceptedEncodings(tt.header); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("acceptedEncodings(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestCompressImage(t *testing.T) {
+	random := make([]byte, 16<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	images := []struct {
+		name    string
+		image   []byte
+		smaller bool
+	}{
+		{name: "empty", image: []byte{}},
+		{name: "padded image", image: append(bytes.Repeat([]byte{0xE9, 0x05, 0x02, 0x20}, 4096), bytes.Repeat([]byte{0xFF}, 32<<10)...), smaller: true},
+		{name: "random", image: random},
+	}
+
+	for _, enc := range encodings {
+		for _, tt := range images {
+			t.Run(enc.Name+"/"+tt.name, func(t *testing.T) {
+				compressed, err := compressImage(tt.image, enc)
+				if err != nil {
+					t.Fatalf("compressImage: %v", err)
+				}
+				if tt.smaller && len(compressed) >= len(tt.image) {
+					t.Errorf("compressed to %d bytes from %d", len(compressed), len(tt.image))
+				}
+
+				r, err := enc.Inflate(bytes.NewReader(compressed))
+				if err != nil {
+					t.Fatalf("Inflate: %v", err)
+				}
+				defer r.Close()
+				inflated, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("Inflate: %v", err)
+				}
+				if !bytes.Equal(inflated, tt.image) {
+					t.Errorf("inflated %d bytes that differ from the %d byte image", len(inflated), len(tt.image))
+				}
+			})
+		}
+	}
+}
+
+func TestEncodingsAreDistinct(t *testing.T) {
+	names := make(map[string]bool)
+	extensions := make(map[string]bool)
+	for _, enc := range encodings {
+		if names[enc.Name] || extensions[enc.Extension] {
+			t.Errorf("encoding %s reuses a name or extension", enc.Name)
+		}
+		names[enc.Name], extensions[enc.Extension] = true, true
+
+		if got, ok := lookupEncoding(enc.Name); !ok || got.Name != enc.Name {
+			t.Errorf("lookupEncoding(%q) = %q, %v", enc.Name, got.Name, ok)
+		}
+	}
+	if knownEncoding("identity") {
+		t.Errorf("identity is not a compressed encoding")
+	}
+}
@@ -0,0 +1,549 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/encimg"
+)
+
+// encryptedPrefix holds esp_encrypted_img artifacts, named by their own
+// SHA-256. Every artifact uses a fresh AES key, so none are ever shared.
+const encryptedPrefix = "_encrypted/"
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+var errKeyIDTaken = errors.New("key ID already in use")
+
+// EncryptionKey is an RSA-3072 public key used to encrypt releases for the
+// devices of a board or a group
+type EncryptionKey struct {
+	KeyID       string    `json:"key_id"`
+	Board       string    `json:"board,omitempty"`
+	Group       string    `json:"group,omitempty"`
+	PublicKey   string    `json:"public_key"`
+	Fingerprint string    `json:"fingerprint"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// EncryptionInfo describes the encrypted artifact a device downloads
+// instead of the plain image. A channel announcement only sets Format.
+type EncryptionInfo struct {
+	Format   string `json:"format"`
+	KeyID    string `json:"key_id,omitempty"`
+	FileSize int64  `json:"file_size,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+}
+
+// encryptedArtifact is a stored firmware_encrypted row
+type encryptedArtifact struct {
+	KeyID    string
+	BlobName string
+	FileSize int64
+	SHA256   string
+}
+
+// EncryptionKeys lists (GET), sets (PUT) or deletes (DELETE ?key_id=) the
+// encryption keys of boards and groups. Admin only.
+func (h *Handler) EncryptionKeys(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listEncryptionKeys(w, r)
+	case http.MethodPut:
+		h.saveEncryptionKey(w, r)
+	case http.MethodDelete:
+		h.deleteEncryptionKey(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listEncryptionKeys(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT k.key_id, COALESCE(b.code, ''), COALESCE(g.name, ''), k.public_key, k.fingerprint, k.created_at
+		FROM encryption_keys k
+		LEFT JOIN boards b ON b.id = k.board_id
+		LEFT JOIN device_groups g ON g.id = k.group_id
+		ORDER BY k.key_id
+	`)
+	if err != nil {
+		log.Printf("Failed to query encryption keys: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []EncryptionKey{}
+	for rows.Next() {
+		var k EncryptionKey
+		if err := rows.Scan(&k.KeyID, &k.Board, &k.Group, &k.PublicKey, &k.Fingerprint, &k.CreatedAt); err != nil {
+			log.Printf("Failed to scan encryption key: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, k)
+	}
+
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// saveEncryptionKey sets the key of a board or group. Replacing a key drops
+// the artifacts made with the old one, and every release uploaded with
+// encrypt=true is encrypted for the new key in the background.
+func (h *Handler) saveEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	var k EncryptionKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if !keyIDPattern.MatchString(k.KeyID) {
+		http.Error(w, "key_id must be 1-64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if (k.Board == "") == (k.Group == "") {
+		http.Error(w, "Exactly one of board or group is required", http.StatusBadRequest)
+		return
+	}
+
+	pub, err := encimg.ParsePublicKey([]byte(k.PublicKey))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("public_key must be a PEM RSA-%d public key: %v", encimg.KeyBits, err), http.StatusBadRequest)
+		return
+	}
+	k.Fingerprint = encimg.Fingerprint(pub)
+
+	var boardID, groupID sql.NullInt64
+	if k.Board != "" {
+		board, err := h.lookupBoard(k.Board)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown board", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to query board %s: %v", k.Board, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		boardID = sql.NullInt64{Int64: board.ID, Valid: true}
+	} else {
+		id, err := h.lookupGroup(k.Group)
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		}
+		groupID = sql.NullInt64{Int64: id, Valid: true}
+	}
+
+	keyRowID, staleBlobs, err := h.replaceEncryptionKey(k, boardID, groupID)
+	if err == errKeyIDTaken {
+		http.Error(w, "key_id is already used for another board or group", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save encryption key %s: %v", k.KeyID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.deleteBlobs(context.Background(), staleBlobs)
+	log.Printf("Encryption key %s set for board %q group %q (%d stale artifacts dropped)", k.KeyID, k.Board, k.Group, len(staleBlobs))
+
+	go h.encryptReleasesForKey(keyRowID)
+
+	err = h.db.QueryRow(`SELECT created_at FROM encryption_keys WHERE id = $1`, keyRowID).Scan(&k.CreatedAt)
+	if err != nil {
+		log.Printf("Failed to query encryption key %s: %v", k.KeyID, err)
+	}
+	writeJSON(w, http.StatusOK, k)
+}
+
+// replaceEncryptionKey stores the key of a board or group, replacing the
+// previous one, and returns the blobs of artifacts made with the old key
+func (h *Handler) replaceEncryptionKey(k EncryptionKey, boardID, groupID sql.NullInt64) (int64, []string, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	var keyRowID int64
+	err = tx.QueryRow(`
+		SELECT id FROM encryption_keys
+		WHERE ($1::INTEGER IS NOT NULL AND board_id = $1) OR ($2::INTEGER IS NOT NULL AND group_id = $2)
+		FOR UPDATE
+	`, boardID, groupID).Scan(&keyRowID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, nil, err
+	}
+
+	var taken bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM encryption_keys WHERE key_id = $1 AND id <> $2)`, k.KeyID, keyRowID).Scan(&taken)
+	if err != nil {
+		return 0, nil, err
+	}
+	if taken {
+		return 0, nil, errKeyIDTaken
+	}
+
+	var staleBlobs []string
+	if keyRowID != 0 {
+		var rows *sql.Rows
+		rows, err = tx.Query(`DELETE FROM firmware_encrypted WHERE encryption_key_id = $1 RETURNING blob_name`, keyRowID)
+		if err != nil {
+			return 0, nil, err
+		}
+		for rows.Next() {
+			var blobName string
+			if err := rows.Scan(&blobName); err != nil {
+				rows.Close()
+				return 0, nil, err
+			}
+			staleBlobs = append(staleBlobs, blobName)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, nil, err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE encryption_keys SET key_id = $2, public_key = $3, fingerprint = $4, created_at = NOW() WHERE id = $1
+		`, keyRowID, k.KeyID, k.PublicKey, k.Fingerprint)
+	} else {
+		err = tx.QueryRow(`
+			INSERT INTO encryption_keys (key_id, board_id, group_id, public_key, fingerprint)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id
+		`, k.KeyID, boardID, groupID, k.PublicKey, k.Fingerprint).Scan(&keyRowID)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return keyRowID, staleBlobs, tx.Commit()
+}
+
+func (h *Handler) deleteEncryptionKey(w http.ResponseWriter, r *http.Request) {
+	keyID := r.URL.Query().Get("key_id")
+
+	rows, err := h.db.Query(`
+		DELETE FROM firmware_encrypted
+		WHERE encryption_key_id = (SELECT id FROM encryption_keys WHERE key_id = $1)
+		RETURNING blob_name
+	`, keyID)
+	if err != nil {
+		log.Printf("Failed to delete artifacts of encryption key %s: %v", keyID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	var blobs []string
+	for rows.Next() {
+		var blobName string
+		if err := rows.Scan(&blobName); err == nil {
+			blobs = append(blobs, blobName)
+		}
+	}
+	rows.Close()
+
+	res, err := h.db.Exec(`DELETE FROM encryption_keys WHERE key_id = $1`, keyID)
+	if err != nil {
+		log.Printf("Failed to delete encryption key %s: %v", keyID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Unknown encryption key", http.StatusNotFound)
+		return
+	}
+
+	h.deleteBlobs(context.Background(), blobs)
+	log.Printf("Encryption key %s deleted with %d artifacts", keyID, len(blobs))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":    "deleted",
+		"key_id":    keyID,
+		"artifacts": len(blobs),
+	})
+}
+
+func (h *Handler) deleteBlobs(ctx context.Context, blobs []string) {
+	for _, blobName := range blobs {
+		if err := h.storage.Delete(ctx, blobName); err != nil {
+			log.Printf("Failed to delete blob %s: %v", blobName, err)
+		}
+	}
+}
+
+// encryptRelease makes the missing artifacts of a release: one for its
+// board's key and one for every group key. It runs in the background after
+// an upload or a key change; the release is not offered until it is done.
+// Once every key has its artifact the plain image is deleted, leaving the
+// escrow copy to encrypt the release for keys set later.
+func (h *Handler) encryptRelease(firmwareID int64) {
+	ctx := context.Background()
+
+	var blobName, digest, escrowBlob string
+	var plainDeleted bool
+	err := h.db.QueryRow(`
+		SELECT blob_name, COALESCE(sha256, ''), plain_deleted, COALESCE(escrow_blob_name, '')
+		FROM firmwares WHERE id = $1 AND encrypt
+	`, firmwareID).Scan(&blobName, &digest, &plainDeleted, &escrowBlob)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to query firmware %d for encryption: %v", firmwareID, err)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT k.id, k.key_id, k.public_key
+		FROM encryption_keys k
+		WHERE (k.board_id = (SELECT board_id FROM firmwares WHERE id = $1) OR k.group_id IS NOT NULL)
+			AND NOT EXISTS (SELECT 1 FROM firmware_encrypted e WHERE e.firmware_id = $1 AND e.encryption_key_id = k.id)
+		ORDER BY k.id
+	`, firmwareID)
+	if err != nil {
+		log.Printf("Failed to query encryption keys for firmware %d: %v", firmwareID, err)
+		return
+	}
+
+	type pendingKey struct {
+		ID        int64
+		KeyID     string
+		PublicKey string
+	}
+	var pending []pendingKey
+	for rows.Next() {
+		var k pendingKey
+		if err := rows.Scan(&k.ID, &k.KeyID, &k.PublicKey); err != nil {
+			log.Printf("Failed to scan encryption key: %v", err)
+			rows.Close()
+			return
+		}
+		pending = append(pending, k)
+	}
+	rows.Close()
+
+	if len(pending) == 0 && escrowBlob != "" {
+		if err := h.deletePlainImage(ctx, firmwareID, blobName); err != nil {
+			log.Printf("Failed to delete plain image of firmware %d: %v", firmwareID, err)
+		}
+		return
+	}
+
+	var image []byte
+	if plainDeleted {
+		image, err = h.readEscrow(ctx, escrowBlob, digest)
+	} else {
+		image, err = h.readBlob(ctx, blobName)
+	}
+	if err != nil {
+		log.Printf("Failed to read firmware %d for encryption: %v", firmwareID, err)
+		return
+	}
+
+	complete := true
+	for _, k := range pending {
+		if err := h.storeEncrypted(ctx, firmwareID, k.ID, k.PublicKey, image); err != nil {
+			log.Printf("Failed to encrypt firmware %d for key %s: %v", firmwareID, k.KeyID, err)
+			complete = false
+			continue
+		}
+		log.Printf("Firmware %d encrypted for key %s", firmwareID, k.KeyID)
+	}
+
+	// The plain image stays until the next attempt when a key is missing
+	// its artifact
+	if !complete || plainDeleted {
+		return
+	}
+	if escrowBlob == "" {
+		if err := h.storeEscrow(ctx, firmwareID, image); err != nil {
+			log.Printf("Failed to store escrow copy of firmware %d: %v", firmwareID, err)
+			return
+		}
+	}
+	if err := h.deletePlainImage(ctx, firmwareID, blobName); err != nil {
+		log.Printf("Failed to delete plain image of firmware %d: %v", firmwareID, err)
+	}
+}
+
+// deletePlainImage drops an encrypt release's reference to its plain image
+// once it has an escrow copy and every key has its artifact, deleting the
+// blob unless another release still uses it
+func (h *Handler) deletePlainImage(ctx context.Context, firmwareID int64, blobName string) error {
+	res, err := h.db.Exec(`
+		UPDATE firmwares f SET plain_deleted = TRUE
+		WHERE f.id = $1 AND f.encrypt AND f.blob_name = $2 AND NOT f.plain_deleted
+			AND f.escrow_blob_name IS NOT NULL
+			AND EXISTS (SELECT 1 FROM firmware_encrypted WHERE firmware_id = f.id)
+			AND NOT EXISTS (
+				SELECT 1 FROM encryption_keys k
+				WHERE (k.board_id = f.board_id OR k.group_id IS NOT NULL)
+					AND NOT EXISTS (SELECT 1 FROM firmware_encrypted e WHERE e.firmware_id = f.id AND e.encryption_key_id = k.id)
+			)
+	`, firmwareID, blobName)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	deleted, err := h.releaseBlob(ctx, blobName)
+	if err != nil {
+		return err
+	}
+	if deleted {
+		log.Printf("Plain image of firmware %d deleted", firmwareID)
+	}
+	return nil
+}
+
+func (h *Handler) storeEncrypted(ctx context.Context, firmwareID, keyRowID int64, publicKey string, image []byte) error {
+	pub, err := encimg.ParsePublicKey([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+
+	artifact, err := encimg.Encrypt(image, pub)
+	if err != nil {
+		return err
+	}
+
+	digest := fmt.Sprintf("%x", sha256.Sum256(artifact))
+	blobName := encryptedPrefix + digest + ".bin"
+	if _, err := h.storage.Upload(ctx, blobName, bytes.NewReader(artifact), "application/octet-stream"); err != nil {
+		return err
+	}
+
+	// The key or the release may have been replaced meanwhile; the
+	// artifact is then dropped instead of recorded
+	res, err := h.db.Exec(`
+		INSERT INTO firmware_encrypted (firmware_id, encryption_key_id, blob_name, file_size, sha256)
+		SELECT $1, $2, $3, $4, $5
+		WHERE EXISTS (SELECT 1 FROM encryption_keys WHERE id = $2 AND public_key = $6)
+			AND EXISTS (SELECT 1 FROM firmwares WHERE id = $1 AND encrypt AND sha256 = $7)
+		ON CONFLICT (firmware_id, encryption_key_id) DO NOTHING
+	`, firmwareID, keyRowID, blobName, len(artifact), digest, publicKey, fmt.Sprintf("%x", sha256.Sum256(image)))
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = fmt.Errorf("key or release changed during encryption")
+		}
+	}
+	if err != nil {
+		h.deleteBlobs(ctx, []string{blobName})
+		return err
+	}
+	return nil
+}
+
+// encryptReleasesForKey encrypts every release uploaded with encrypt=true
+// that the key applies to
+func (h *Handler) encryptReleasesForKey(keyRowID int64) {
+	rows, err := h.db.Query(`
+		SELECT f.id
+		FROM firmwares f, encryption_keys k
+		WHERE k.id = $1 AND f.encrypt AND (k.group_id IS NOT NULL OR f.board_id = k.board_id)
+		ORDER BY f.id
+	`, keyRowID)
+	if err != nil {
+		log.Printf("Failed to query releases for encryption key %d: %v", keyRowID, err)
+		return
+	}
+
+	var firmwareIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			firmwareIDs = append(firmwareIDs, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range firmwareIDs {
+		h.encryptRelease(id)
+		h.notifyRelease(id)
+	}
+}
+
+// dropEncrypted deletes the artifacts of a release whose image was replaced
+func (h *Handler) dropEncrypted(ctx context.Context, firmwareID int64) error {
+	rows, err := h.db.Query(`DELETE FROM firmware_encrypted WHERE firmware_id = $1 RETURNING blob_name`, firmwareID)
+	if err != nil {
+		return err
+	}
+
+	var blobs []string
+	for rows.Next() {
+		var blobName string
+		if err := rows.Scan(&blobName); err != nil {
+			rows.Close()
+			return err
+		}
+		blobs = append(blobs, blobName)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	h.deleteBlobs(ctx, blobs)
+	return nil
+}
+
+// deviceArtifact picks the artifact a device can decrypt: made with the key
+// of one of its groups, else with its board's key. It returns nil when the
+// release has none for the device yet.
+func (h *Handler) deviceArtifact(firmwareID int64, deviceID string) (*encryptedArtifact, error) {
+	var a encryptedArtifact
+	err := h.db.QueryRow(`
+		SELECT k.key_id, e.blob_name, e.file_size, e.sha256
+		FROM firmware_encrypted e
+		JOIN encryption_keys k ON k.id = e.encryption_key_id
+		WHERE e.firmware_id = $1
+			AND (k.group_id IN (SELECT group_id FROM device_group_members WHERE device_id = $2)
+				OR k.board_id = (SELECT board_id FROM firmwares WHERE id = $1))
+		ORDER BY k.group_id IS NULL, k.group_id
+		LIMIT 1
+	`, firmwareID, deviceID).Scan(&a.KeyID, &a.BlobName, &a.FileSize, &a.SHA256)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// lookupArtifact returns the artifact of a release made with a key, or nil
+func (h *Handler) lookupArtifact(firmwareID int64, keyID string) (*encryptedArtifact, error) {
+	a := encryptedArtifact{KeyID: keyID}
+	err := h.db.QueryRow(`
+		SELECT e.blob_name, e.file_size, e.sha256
+		FROM firmware_encrypted e
+		JOIN encryption_keys k ON k.id = e.encryption_key_id
+		WHERE e.firmware_id = $1 AND k.key_id = $2
+	`, firmwareID, keyID).Scan(&a.BlobName, &a.FileSize, &a.SHA256)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
@@ -0,0 +1,220 @@
+package fota
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/encimg"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKeyPEM  string
+)
+
+// devicePublicKey returns the PEM of an RSA-3072 key shared by the tests,
+// as generating one takes a while
+func devicePublicKey(t *testing.T) string {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, encimg.KeyBits)
+		if err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testKeyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	})
+	return testKeyPEM
+}
+
+// blobArg matches a blob name under prefix and remembers it
+type blobArg struct {
+	prefix string
+	name   string
+}
+
+func (a *blobArg) Match(v driver.Value) bool {
+	s, ok := v.(string)
+	a.name = s
+	return ok && strings.HasPrefix(s, a.prefix)
+}
+
+const (
+	testPlainBlob  = "_sha256/plain.bin"
+	testEscrowBlob = "_escrow/sealed.bin"
+)
+
+func encryptTestImage() ([]byte, string) {
+	image := bytes.Repeat([]byte{0xE9, 0x05, 0x02, 0x20}, 1024)
+	return image, fmt.Sprintf("%x", sha256.Sum256(image))
+}
+
+func escrowHandler(t *testing.T) (*Handler, sqlmock.Sqlmock) {
+	t.Helper()
+	h, mock := testHandler(t)
+	escrow, err := newEscrow(strings.Repeat("5a", 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.escrow = escrow
+	return h, mock
+}
+
+func expectRelease(mock sqlmock.Sqlmock, digest string, plainDeleted bool, escrowBlob string) {
+	var escrow driver.Value = ""
+	if escrowBlob != "" {
+		escrow = escrowBlob
+	}
+	mock.ExpectQuery(`SELECT blob_name, COALESCE\(sha256, ''\), plain_deleted`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"blob_name", "sha256", "plain_deleted", "escrow_blob_name"}).
+			AddRow(testPlainBlob, digest, plainDeleted, escrow))
+}
+
+func TestEncryptReleaseAfterKeyRotation(t *testing.T) {
+	h, mock := escrowHandler(t)
+	image, digest := encryptTestImage()
+	publicKey := devicePublicKey(t)
+
+	// The plain image is gone; only the escrow copy is left
+	sealed, err := h.sealEscrow(image, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putBlob(t, h, testEscrowBlob, sealed)
+
+	// The rotated key has no artifact yet
+	expectRelease(mock, digest, true, testEscrowBlob)
+	mock.ExpectQuery(`FROM encryption_keys k`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_id", "public_key"}).AddRow(7, "stick-2026", publicKey))
+	artifact := &blobArg{prefix: encryptedPrefix}
+	mock.ExpectExec(`INSERT INTO firmware_encrypted`).
+		WithArgs(1, 7, artifact, encimg.HeaderSize+len(image), sqlmock.AnyArg(), publicKey, digest).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	h.encryptRelease(1)
+	expectationsMet(t, mock)
+
+	if !blobExists(t, h, artifact.name) {
+		t.Errorf("artifact %q was not stored", artifact.name)
+	}
+	if !blobExists(t, h, testEscrowBlob) {
+		t.Errorf("escrow copy was deleted")
+	}
+}
+
+func TestEncryptReleaseReplacesPlainImage(t *testing.T) {
+	h, mock := escrowHandler(t)
+	image, digest := encryptTestImage()
+	publicKey := devicePublicKey(t)
+	putBlob(t, h, testPlainBlob, image)
+
+	expectRelease(mock, digest, false, "")
+	mock.ExpectQuery(`FROM encryption_keys k`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_id", "public_key"}).AddRow(7, "stick-2025", publicKey))
+	mock.ExpectExec(`INSERT INTO firmware_encrypted`).WillReturnResult(sqlmock.NewResult(0, 1))
+	escrow := &blobArg{prefix: escrowPrefix}
+	mock.ExpectExec(`UPDATE firmwares SET escrow_blob_name`).WithArgs(1, escrow, digest).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE firmwares f SET plain_deleted = TRUE`).WithArgs(1, testPlainBlob).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	expectReleaseBlob(mock, testPlainBlob, false)
+
+	h.encryptRelease(1)
+	expectationsMet(t, mock)
+
+	if blobExists(t, h, testPlainBlob) {
+		t.Errorf("plain image was kept")
+	}
+	sealed, err := h.readBlob(t.Context(), escrow.name)
+	if err != nil {
+		t.Fatalf("escrow copy: %v", err)
+	}
+	if bytes.Contains(sealed, image[:64]) {
+		t.Errorf("escrow copy holds the plain image")
+	}
+	if opened, err := h.openEscrow(sealed, digest); err != nil || !bytes.Equal(opened, image) {
+		t.Errorf("openEscrow() = %d bytes, %v; want the image", len(opened), err)
+	}
+}
+
+func TestEncryptReleaseKeepsPlainImageOnFailure(t *testing.T) {
+	h, mock := escrowHandler(t)
+	image, digest := encryptTestImage()
+	publicKey := devicePublicKey(t)
+	putBlob(t, h, testPlainBlob, image)
+
+	// The group key cannot be used, so the release still needs the plain
+	// image for the next attempt
+	expectRelease(mock, digest, false, "")
+	mock.ExpectQuery(`FROM encryption_keys k`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "key_id", "public_key"}).
+			AddRow(7, "stick-2025", publicKey).
+			AddRow(8, "testers", "not a key"))
+	mock.ExpectExec(`INSERT INTO firmware_encrypted`).WithArgs(1, 7, sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), publicKey, digest).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	h.encryptRelease(1)
+	expectationsMet(t, mock)
+
+	if !blobExists(t, h, testPlainBlob) {
+		t.Errorf("plain image was deleted with a key missing its artifact")
+	}
+	if escrows := listBlobs(t, h, escrowPrefix); len(escrows) != 0 {
+		t.Errorf("escrow copies %v stored with a key missing its artifact", escrows)
+	}
+}
+
+func TestEscrow(t *testing.T) {
+	h, _ := escrowHandler(t)
+	image, digest := encryptTestImage()
+
+	sealed, err := h.sealEscrow(image, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(image)+h.escrow.NonceSize()+h.escrow.Overhead() {
+		t.Errorf("escrow copy is %d bytes for a %d byte image", len(sealed), len(image))
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)/2] ^= 0x01
+	other, _ := newEscrow(strings.Repeat("a5", 32))
+
+	tests := []struct {
+		name   string
+		h      *Handler
+		sealed []byte
+		digest string
+	}{
+		{name: "other image", h: h, sealed: sealed, digest: strings.Repeat("0", 64)},
+		{name: "tampered", h: h, sealed: tampered, digest: digest},
+		{name: "truncated", h: h, sealed: sealed[:8], digest: digest},
+		{name: "other key", h: &Handler{escrow: other}, sealed: sealed, digest: digest},
+		{name: "no key", h: &Handler{}, sealed: sealed, digest: digest},
+	}
+	for _, tt := range tests {
+		if _, err := tt.h.openEscrow(tt.sealed, tt.digest); err == nil {
+			t.Errorf("openEscrow() of %s succeeded", tt.name)
+		}
+	}
+
+	for _, key := range []string{"", "5a5a", strings.Repeat("zz", 32), strings.Repeat("5a", 33)} {
+		if _, err := newEscrow(key); err == nil {
+			t.Errorf("newEscrow(%q) accepted the key", key)
+		}
+	}
+}
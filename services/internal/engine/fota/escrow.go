@@ -0,0 +1,92 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// escrowPrefix holds the escrow copies of encrypt releases, named by their
+// own SHA-256. A copy is the plain image sealed with FOTA_ESCROW_KEY
+// (AES-256-GCM, the nonce first), so releases whose plain image is deleted
+// can still be encrypted for keys set later.
+const escrowPrefix = "_escrow/"
+
+// newEscrow parses a hex AES-256 key
+func newEscrow(hexKey string) (cipher.AEAD, error) {
+	key, err := hex.DecodeString(hexKey)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes in hex, e.g. openssl rand -hex 32")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealEscrow seals an image, binding the copy to the image's SHA-256
+func (h *Handler) sealEscrow(image []byte, digest string) ([]byte, error) {
+	nonce := make([]byte, h.escrow.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return h.escrow.Seal(nonce, nonce, image, []byte(digest)), nil
+}
+
+// openEscrow returns the image sealed in an escrow copy
+func (h *Handler) openEscrow(sealed []byte, digest string) ([]byte, error) {
+	if h.escrow == nil {
+		return nil, errors.New("FOTA_ESCROW_KEY is not set")
+	}
+	size := h.escrow.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("escrow copy is truncated")
+	}
+	return h.escrow.Open(nil, sealed[:size], sealed[size:], []byte(digest))
+}
+
+// storeEscrow stores the escrow copy of a release's image and records it,
+// unless the release was replaced meanwhile
+func (h *Handler) storeEscrow(ctx context.Context, firmwareID int64, image []byte) error {
+	digest := fmt.Sprintf("%x", sha256.Sum256(image))
+	sealed, err := h.sealEscrow(image, digest)
+	if err != nil {
+		return err
+	}
+
+	blobName := fmt.Sprintf("%s%x.bin", escrowPrefix, sha256.Sum256(sealed))
+	if _, err := h.storage.Upload(ctx, blobName, bytes.NewReader(sealed), "application/octet-stream"); err != nil {
+		return err
+	}
+
+	res, err := h.db.Exec(`
+		UPDATE firmwares SET escrow_blob_name = $2
+		WHERE id = $1 AND encrypt AND sha256 = $3 AND escrow_blob_name IS NULL
+	`, firmwareID, blobName, digest)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			err = fmt.Errorf("release changed during escrow")
+		}
+	}
+	if err != nil {
+		h.deleteBlobs(ctx, []string{blobName})
+		return err
+	}
+	return nil
+}
+
+// readEscrow returns the image of a release from its escrow copy
+func (h *Handler) readEscrow(ctx context.Context, blobName, digest string) ([]byte, error) {
+	sealed, err := h.readBlob(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	return h.openEscrow(sealed, digest)
+}
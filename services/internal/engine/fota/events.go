@@ -0,0 +1,274 @@
+package fota
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Event types and outcomes recorded in fota_events
+const (
+	EventCheck    = "check"
+	EventDownload = "download"
+
+	OutcomeCompleted = "completed"
+	OutcomeAborted   = "aborted"
+	// OutcomeIssued records a storage-signed URL handed out by a check. The
+	// device downloads from storage, so the engine never sees the transfer.
+	OutcomeIssued = "issued"
+)
+
+// fotaEvent is one audited check or download
+type fotaEvent struct {
+	Type          string
+	DeviceID      string
+	GameID        int64
+	FirmwareID    int64
+	Board         string
+	FromVersion   string
+	ToVersion     string
+	Outcome       string
+	IsPatch       bool
+	Partition     string
+	Encoding      string
+	BytesServed   int64
+	BytesExpected int64
+	Duration      time.Duration
+	ClientIP      string
+}
+
+// maxEventVersion is the width of the audit log's version columns
+const maxEventVersion = 64
+
+// maxDeviceIDLength is the width of the device ID columns
+const maxDeviceIDLength = 50
+
+// validDeviceID rejects device IDs no device row can hold
+func validDeviceID(deviceID string) bool {
+	return utf8.RuneCountInString(deviceID) <= maxDeviceIDLength
+}
+
+// recordEvent writes an audit row. It runs in the background so devices
+// never wait on the audit log, and a failure only loses the row.
+func (h *Handler) recordEvent(ev fotaEvent) {
+	// Versions reported by devices are not validated; a long one is cut
+	// rather than losing the row
+	ev.FromVersion = truncateVersion(ev.FromVersion)
+	ev.ToVersion = truncateVersion(ev.ToVersion)
+
+	_, err := h.db.Exec(`
+		INSERT INTO fota_events (event_type, device_id, game_id, firmware_id, board_code, from_version, to_version,
+			outcome, is_patch, partition_label, content_encoding, bytes_served, bytes_expected, duration_ms, client_ip)
+		VALUES ($1, NULLIF($2, ''), $3, NULLIF($4, 0), NULLIF($5, ''), NULLIF($6, ''), NULLIF($7, ''),
+			$8, $9, NULLIF($10, ''), NULLIF($11, ''), $12, $13, $14, NULLIF($15, ''))
+	`, ev.Type, ev.DeviceID, ev.GameID, ev.FirmwareID, ev.Board, ev.FromVersion, ev.ToVersion,
+		ev.Outcome, ev.IsPatch, ev.Partition, ev.Encoding, ev.BytesServed, ev.BytesExpected, ev.Duration.Milliseconds(), ev.ClientIP)
+	if err != nil {
+		log.Printf("Failed to record %s event for device %s: %v", ev.Type, ev.DeviceID, err)
+	}
+}
+
+func truncateVersion(version string) string {
+	if runes := []rune(version); len(runes) > maxEventVersion {
+		return string(runes[:maxEventVersion])
+	}
+	return version
+}
+
+// clientIP returns the address of the device. X-Forwarded-For is only
+// honoured when the request comes from a trusted proxy; its hops are then
+// walked from the nearest, skipping the other trusted proxies.
+func (h *Handler) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !h.trustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if net.ParseIP(hop) == nil {
+			return host
+		}
+		if !h.trustedProxy(hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+func (h *Handler) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range h.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs and addresses
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// countingWriter counts the body bytes written to a download response
+type countingWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+// ReleaseStats aggregates the audit log of one release
+type ReleaseStats struct {
+	Game    string `json:"game"`
+	Board   string `json:"board"`
+	Version string `json:"version"`
+	Channel string `json:"channel"`
+	// DevicesChecked counts unique devices that were offered the release
+	DevicesChecked int `json:"devices_checked"`
+	// Downloads count the app image; PartitionDownloads the other images of
+	// a bundle. CompressedDownloads are app image downloads served
+	// compressed.
+	// DirectDownloads counts devices handed a storage-signed URL. They are
+	// included in DownloadsStarted, but their transfers are not seen, so
+	// CompletionRate and MedianTransferMS only cover downloads the engine
+	// served.
+	DownloadsStarted    int     `json:"downloads_started"`
+	DirectDownloads     int     `json:"direct_downloads"`
+	DownloadsCompleted  int     `json:"downloads_completed"`
+	PatchDownloads      int     `json:"patch_downloads"`
+	PartitionDownloads  int     `json:"partition_downloads"`
+	CompressedDownloads int     `json:"compressed_downloads"`
+	BytesServed         int64   `json:"bytes_served"`
+	CompletionRate      float64 `json:"completion_rate"`
+	// MedianTransferMS is the median duration of completed downloads
+	MedianTransferMS *float64 `json:"median_transfer_ms"`
+}
+
+// StatsFilter narrows QueryReleaseStats; empty fields match everything
+type StatsFilter struct {
+	Game    string
+	Board   string
+	Version string
+}
+
+// QueryReleaseStats aggregates fota_events per release, newest release
+// first. It is shared by the admin API and the portal.
+func QueryReleaseStats(db *sql.DB, filter StatsFilter) ([]ReleaseStats, error) {
+	rows, err := db.Query(`
+		SELECT g.code, b.code, f.version, f.channel,
+			COUNT(DISTINCT e.device_id) FILTER (WHERE e.event_type = 'check'),
+			COUNT(e.id) FILTER (WHERE e.event_type = 'download' AND e.partition_label IS NULL AND e.outcome <> 'issued'),
+			COUNT(DISTINCT e.device_id) FILTER (WHERE e.event_type = 'download' AND e.outcome = 'issued'),
+			COUNT(e.id) FILTER (WHERE e.event_type = 'download' AND e.partition_label IS NULL AND e.outcome = 'completed'),
+			COUNT(e.id) FILTER (WHERE e.event_type = 'download' AND e.is_patch),
+			COUNT(e.id) FILTER (WHERE e.event_type = 'download' AND e.partition_label IS NOT NULL),
+			COUNT(e.id) FILTER (WHERE e.event_type = 'download' AND e.content_encoding IS NOT NULL),
+			COALESCE(SUM(e.bytes_served) FILTER (WHERE e.event_type = 'download'), 0),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY e.duration_ms)
+				FILTER (WHERE e.event_type = 'download' AND e.partition_label IS NULL AND e.outcome = 'completed')
+		FROM firmwares f
+		JOIN games g ON g.id = f.game_id
+		JOIN boards b ON b.id = f.board_id
+		LEFT JOIN fota_events e ON e.firmware_id = f.id
+		WHERE ($1 = '' OR g.code = $1) AND ($2 = '' OR b.code = $2) AND ($3 = '' OR f.version = $3)
+		GROUP BY f.id, g.code, b.code
+		ORDER BY f.created_at DESC
+	`, filter.Game, filter.Board, filter.Version)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := []ReleaseStats{}
+	for rows.Next() {
+		var s ReleaseStats
+		err := rows.Scan(&s.Game, &s.Board, &s.Version, &s.Channel,
+			&s.DevicesChecked, &s.DownloadsStarted, &s.DirectDownloads, &s.DownloadsCompleted, &s.PatchDownloads, &s.PartitionDownloads, &s.CompressedDownloads,
+			&s.BytesServed, &s.MedianTransferMS)
+		if err != nil {
+			return nil, err
+		}
+		if s.DownloadsStarted > 0 {
+			s.CompletionRate = float64(s.DownloadsCompleted) / float64(s.DownloadsStarted)
+		}
+		s.DownloadsStarted += s.DirectDownloads
+		stats = append(stats, s)
+	}
+	return stats, rows.Err()
+}
+
+// ReleaseStatistics reports per-release check and download aggregates,
+// optionally narrowed by game, board and version. Admin only.
+func (h *Handler) ReleaseStatistics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	filter := StatsFilter{
+		Game:    r.URL.Query().Get("game"),
+		Board:   r.URL.Query().Get("board"),
+		Version: r.URL.Query().Get("version"),
+	}
+	if v, err := ParseVersion(filter.Version); err == nil {
+		filter.Version = v.String()
+	}
+
+	stats, err := QueryReleaseStats(h.db, filter)
+	if err != nil {
+		log.Printf("Failed to query release statistics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, stats)
+}
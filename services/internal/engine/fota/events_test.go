@@ -0,0 +1,108 @@
+package fota
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies("10.244.0.0/16, 192.0.2.1, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Handler{trustedProxies: proxies}
+
+	tests := []struct {
+		name       string
+		handler    *Handler
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		{name: "direct", handler: h, remoteAddr: "203.0.113.7:4242", want: "203.0.113.7"},
+		{name: "spoofed header", handler: h, remoteAddr: "203.0.113.7:4242", forwarded: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "no trusted proxies", handler: &Handler{}, remoteAddr: "10.244.1.5:4242", forwarded: []string{"198.51.100.1"}, want: "10.244.1.5"},
+		{name: "ingress", handler: h, remoteAddr: "10.244.1.5:4242", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed first hop", handler: h, remoteAddr: "10.244.1.5:4242", forwarded: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "proxy chain", handler: h, remoteAddr: "10.244.1.5:4242", forwarded: []string{"198.51.100.1, 192.0.2.1"}, want: "198.51.100.1"},
+		{name: "repeated headers", handler: h, remoteAddr: "10.244.1.5:4242", forwarded: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "only proxies", handler: h, remoteAddr: "10.244.1.5:4242", forwarded: []string{"192.0.2.1"}, want: "192.0.2.1"},
+		{name: "garbage hop", handler: h, remoteAddr: "10.244.1.5:4242", forwarded: []string{"not-an-ip"}, want: "10.244.1.5"},
+		{name: "IPv6", handler: h, remoteAddr: "[2001:db8::1]:4242", forwarded: []string{"2001:db9::7"}, want: "2001:db9::7"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/fota/check", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := tt.handler.clientIP(r); got != tt.want {
+			t.Errorf("clientIP() for %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	for _, list := range []string{"", "10.0.0.0/8", "10.0.0.1,::1", " 10.0.0.0/8 , fd00::/8 "} {
+		if _, err := parseTrustedProxies(list); err != nil {
+			t.Errorf("parseTrustedProxies(%q): %v", list, err)
+		}
+	}
+	for _, list := range []string{"ingress", "10.0.0.0/33", "10.0.0.1,nope"} {
+		if _, err := parseTrustedProxies(list); err == nil {
+			t.Errorf("parseTrustedProxies(%q) accepted the list", list)
+		}
+	}
+}
+
+func TestDeviceIDLength(t *testing.T) {
+	h, mock := testHandler(t)
+	long := strings.Repeat("x", maxDeviceIDLength+1)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		target  string
+	}{
+		{name: "check", handler: h.CheckUpdate, target: "/api/fota/check?game=crisp-games&device_id=" + long},
+		{name: "download", handler: h.DownloadBin,
+			target: h.engineDownloadURL(downloadParams("crisp-games", "m5stickc-plus", "1.4.0", "", long), time.Now().Add(time.Hour))},
+	}
+
+	// Rejected before the database is touched
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s answered %d for a %d character device_id, want 400", tt.name, w.Code, len(long))
+		}
+	}
+	expectationsMet(t, mock)
+
+	if !validDeviceID(strings.Repeat("é", maxDeviceIDLength)) {
+		t.Errorf("validDeviceID() counts bytes instead of characters")
+	}
+}
+
+func TestDirectDownload(t *testing.T) {
+	h := &Handler{urlSecret: []byte("test-secret")}
+	engine := h.engineDownloadURL(downloadParams("crisp-games", "m5stickc-plus", "1.4.0", "", ""), time.Now().Add(time.Hour))
+
+	tests := []struct {
+		link string
+		want bool
+	}{
+		{engine, false},
+		{"https://account.blob.core.windows.net/firmware/_sha256/abc.bin?sig=x", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := directDownload(tt.link); got != tt.want {
+			t.Errorf("directDownload(%q) = %v, want %v", tt.link, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,978 @@
+package fota
+
+import (
+	"context"
+	"crypto/cipher"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/core"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/delta"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/encimg"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/signing"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/storage"
+	"github.com/lib/pq"
+)
+
+type Handler struct {
+	db              *sql.DB
+	storage         storage.Storage
+	adminAPIToken   string
+	signer          *signing.Signer
+	manifestTTL     time.Duration
+	maxFirmwareSize int64
+	urlSecret       []byte
+	urlTTL          time.Duration
+	notifier        Notifier
+	notifyDevices   bool
+	// trustedProxies may set X-Forwarded-For
+	trustedProxies []*net.IPNet
+	// maxChunkSize and uploadSessionTTL bound resumable uploads
+	maxChunkSize     int64
+	uploadSessionTTL time.Duration
+	// escrow seals the escrow copies of encrypt releases; nil disables
+	// encrypted uploads
+	escrow cipher.AEAD
+}
+
+type CheckUpdateResponse struct {
+	Status      string `json:"status"`
+	Version     string `json:"version"`
+	DownloadURL string `json:"download_url"`
+	// DownloadExpiresAt is the Unix time after which the download URLs in
+	// this response stop working
+	DownloadExpiresAt int64 `json:"download_expires_at,omitempty"`
+	FileSize          int64 `json:"file_size"`
+	// Checksum is the MD5 of the image, kept for devices that only verify MD5
+	Checksum    string `json:"checksum"`
+	SHA256      string `json:"sha256,omitempty"`
+	Description string `json:"description"`
+	Channel     string `json:"channel,omitempty"`
+	Board       string `json:"board,omitempty"`
+	// Pinned is set when the release was chosen by a device or group pin
+	Pinned bool `json:"pinned,omitempty"`
+	// RetryAfter is set with no_update when the device is outside the update
+	// windows of its groups: seconds until the next window opens
+	RetryAfter int64 `json:"retry_after,omitempty"`
+	// Mandatory is set when the device's build is below the game's minimum
+	// supported version or recalled; MandatoryReason says which
+	Mandatory       bool   `json:"mandatory,omitempty"`
+	MandatoryReason string `json:"mandatory_reason,omitempty"`
+	// Patch is set when a binary patch from the device's current version
+	// exists; devices that cannot apply it use DownloadURL instead
+	Patch *PatchInfo `json:"patch,omitempty"`
+	// Encryption is set when DownloadURL serves an esp_encrypted_img
+	// artifact; FileSize, Checksum and SHA256 still describe the decrypted
+	// image
+	Encryption *EncryptionInfo `json:"encryption,omitempty"`
+	// Compression is set when the device reported encodings it can inflate
+	// and the image is stored in one of them: a download of the compressed
+	// copy, as an alternative to DownloadURL
+	Compression *CompressionInfo `json:"compression,omitempty"`
+	// Partitions is set for bundle releases: the app image, described as
+	// above, followed by the release's other images. Devices skip images
+	// whose SHA-256 matches what they already have.
+	Partitions []PartitionInfo `json:"partitions,omitempty"`
+	// Signature is the Ed25519 signature of the image's raw SHA-256 digest
+	// made at upload with the key SigningKeyID
+	Signature    string `json:"signature,omitempty"`
+	SigningKeyID string `json:"signing_key_id,omitempty"`
+	// Manifest is the signed update description, set when a signing key is
+	// configured and the release has a SHA-256 digest
+	Manifest *SignedManifest `json:"manifest,omitempty"`
+
+	// firmwareID is the offered release, for the audit log
+	firmwareID int64
+}
+
+// NewHandler creates the FOTA handler. notifier may be nil to disable push
+// notifications.
+func NewHandler(db *sql.DB, stor storage.Storage, notifier Notifier, config *core.Config) (*Handler, error) {
+	manifestTTL, err := time.ParseDuration(config.ManifestTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FOTA_MANIFEST_TTL: %w", err)
+	}
+
+	maxFirmwareSize, err := strconv.ParseInt(config.MaxFirmwareSize, 10, 64)
+	if err != nil || maxFirmwareSize <= 0 {
+		return nil, fmt.Errorf("invalid FOTA_MAX_FIRMWARE_SIZE %q", config.MaxFirmwareSize)
+	}
+
+	urlTTL, err := time.ParseDuration(config.DownloadURLTTL)
+	if err != nil || urlTTL <= 0 {
+		return nil, fmt.Errorf("invalid DOWNLOAD_URL_TTL %q", config.DownloadURLTTL)
+	}
+
+	maxChunkSize, err := strconv.ParseInt(config.UploadChunkSize, 10, 64)
+	if err != nil || maxChunkSize <= 0 {
+		return nil, fmt.Errorf("invalid FOTA_UPLOAD_CHUNK_SIZE %q", config.UploadChunkSize)
+	}
+
+	uploadSessionTTL, err := time.ParseDuration(config.UploadSessionTTL)
+	if err != nil || uploadSessionTTL <= 0 {
+		return nil, fmt.Errorf("invalid FOTA_UPLOAD_SESSION_TTL %q", config.UploadSessionTTL)
+	}
+
+	// Every replica has to verify the URLs any other one signed
+	if config.DownloadURLSecret == "" {
+		return nil, fmt.Errorf("DOWNLOAD_URL_SECRET is required: set the same random value on every engine replica")
+	}
+
+	trustedProxies, err := parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+
+	h := &Handler{
+		db:               db,
+		storage:          stor,
+		adminAPIToken:    config.AdminAPIToken,
+		manifestTTL:      manifestTTL,
+		maxFirmwareSize:  maxFirmwareSize,
+		urlSecret:        []byte(config.DownloadURLSecret),
+		urlTTL:           urlTTL,
+		notifier:         notifier,
+		notifyDevices:    config.NotifyDevices == "true",
+		trustedProxies:   trustedProxies,
+		maxChunkSize:     maxChunkSize,
+		uploadSessionTTL: uploadSessionTTL,
+	}
+
+	if config.EscrowKey != "" {
+		h.escrow, err = newEscrow(config.EscrowKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FOTA_ESCROW_KEY: %w", err)
+		}
+	}
+
+	if config.SigningKey == "" {
+		log.Printf("Warning: FOTA_SIGNING_KEY not configured, firmware and manifests will not be signed!")
+	} else {
+		h.signer, err = signing.NewSigner(config.SigningKeyID, config.SigningKey, config.VerificationKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid FOTA signing configuration: %w", err)
+		}
+	}
+
+	return h, nil
+}
+
+// firmwareRelease is an active firmware row with its parsed semver
+type firmwareRelease struct {
+	ID             int64
+	Version        string
+	SemVer         Version
+	Channel        string
+	BlobName       string
+	BlobURL        string
+	Description    string
+	FileSize       int64
+	Checksum       string
+	SHA256         string
+	RolloutPercent int
+	RolloutPaused  bool
+	IsPromoted     bool
+	MinChipRev     *int
+	MaxChipRev     *int
+	FlashSizeMB    *int
+	Encrypt        bool
+	Signature      string
+	SigningKeyID   string
+}
+
+// releaseColumns are the firmwares columns scanned by scanRelease
+const releaseColumns = `id, version, channel, blob_name, blob_url, COALESCE(description, ''), file_size, checksum,
+	COALESCE(sha256, ''), rollout_percent, rollout_paused, is_promoted, min_chip_rev, max_chip_rev, flash_size_mb, encrypt,
+	COALESCE(signature, ''), COALESCE(signing_key_id, '')`
+
+// publishedNow restricts firmwares rows to releases inside their publication
+// window
+const publishedNow = `(publish_at IS NULL OR publish_at <= NOW()) AND (unpublish_at IS NULL OR unpublish_at > NOW())`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanRelease(row rowScanner) (firmwareRelease, error) {
+	var rel firmwareRelease
+	err := row.Scan(&rel.ID, &rel.Version, &rel.Channel, &rel.BlobName, &rel.BlobURL, &rel.Description, &rel.FileSize, &rel.Checksum,
+		&rel.SHA256, &rel.RolloutPercent, &rel.RolloutPaused, &rel.IsPromoted, &rel.MinChipRev, &rel.MaxChipRev, &rel.FlashSizeMB, &rel.Encrypt,
+		&rel.Signature, &rel.SigningKeyID)
+	return rel, err
+}
+
+// activeReleases loads the active, published, unrecalled firmware releases of a game
+// built for a board and visible on a channel, i.e. the channel's own
+// releases plus stable ones. Rows whose version is not valid semver are skipped since they
+// cannot be ordered.
+func (h *Handler) activeReleases(gameID int64, board, channel string) ([]firmwareRelease, error) {
+	query := `
+		SELECT ` + releaseColumns + `
+		FROM firmwares
+		WHERE game_id = $1 AND board_id = (SELECT id FROM boards WHERE code = $2)
+			AND is_active = TRUE AND NOT is_recalled AND channel IN ($3, 'stable') AND ` + publishedNow + `
+	`
+
+	rows, err := h.db.Query(query, gameID, board, channel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var releases []firmwareRelease
+	for rows.Next() {
+		rel, err := scanRelease(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		rel.SemVer, err = ParseVersion(rel.Version)
+		if err != nil {
+			log.Printf("Skipping firmware with non-semver version %q: %v", rel.Version, err)
+			continue
+		}
+
+		releases = append(releases, rel)
+	}
+
+	return releases, rows.Err()
+}
+
+// newestRelease picks the release with the highest semver precedence
+func newestRelease(releases []firmwareRelease) *firmwareRelease {
+	var newest *firmwareRelease
+	for i := range releases {
+		if newest == nil || releases[i].SemVer.Compare(newest.SemVer) > 0 {
+			newest = &releases[i]
+		}
+	}
+	return newest
+}
+
+func (h *Handler) CheckUpdate(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	currentVersion := r.URL.Query().Get("current_version")
+	deviceID := r.URL.Query().Get("device_id")
+	allowDowngrade, _ := strconv.ParseBool(r.URL.Query().Get("allow_downgrade"))
+
+	log.Printf("FOTA check: device=%s, game=%s, current_version=%s", deviceID, r.URL.Query().Get("game"), currentVersion)
+
+	if !validDeviceID(deviceID) {
+		http.Error(w, fmt.Sprintf("device_id must be at most %d characters", maxDeviceIDLength), http.StatusBadRequest)
+		return
+	}
+
+	game, err := h.resolveGame(r.URL.Query().Get("game"), deviceID)
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	reported, err := parseHardware(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hw, err := h.withStoredHardware(reported, deviceID)
+	if err != nil {
+		log.Printf("Failed to query device hardware: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if deviceID != "" {
+		if err := h.touchDevice(deviceID, game.Code, currentVersion, reported); err != nil {
+			log.Printf("Failed to update device %s: %v", deviceID, err)
+		}
+	}
+
+	channel, err := h.deviceChannel(deviceID)
+	if err != nil {
+		log.Printf("Failed to query device channel: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := h.resolveUpdate(r.Context(), updateQuery{
+		Game:           game,
+		DeviceID:       deviceID,
+		CurrentVersion: currentVersion,
+		Hardware:       hw,
+		Channel:        channel,
+		AllowDowngrade: allowDowngrade,
+	})
+	if err != nil {
+		log.Printf("Failed to resolve update for device %s: %v", deviceID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if response.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.FormatInt(response.RetryAfter, 10))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+
+	go h.recordEvent(fotaEvent{
+		Type:        EventCheck,
+		DeviceID:    deviceID,
+		GameID:      game.ID,
+		FirmwareID:  response.firmwareID,
+		Board:       hw.Board,
+		FromVersion: currentVersion,
+		ToVersion:   response.Version,
+		Outcome:     response.Status,
+		Duration:    time.Since(start),
+		ClientIP:    h.clientIP(r),
+	})
+
+	// Storage serves storage-signed URLs directly, so the download is
+	// counted when its URL is handed out
+	if response.Status == "update_available" && directDownload(response.DownloadURL) {
+		go h.recordEvent(fotaEvent{
+			Type:          EventDownload,
+			DeviceID:      deviceID,
+			GameID:        game.ID,
+			FirmwareID:    response.firmwareID,
+			Board:         hw.Board,
+			FromVersion:   currentVersion,
+			ToVersion:     response.Version,
+			Outcome:       OutcomeIssued,
+			BytesExpected: response.FileSize,
+			ClientIP:      h.clientIP(r),
+		})
+	}
+
+	if response.Status == "update_available" {
+		log.Printf("Update available for device %s (%s/%s): %s -> %s", deviceID, game.Code, channel, currentVersion, response.Version)
+	}
+}
+
+// updateQuery is what resolveUpdate decides on: a device, or with an empty
+// DeviceID any device of the channel
+type updateQuery struct {
+	Game           gameRef
+	DeviceID       string
+	CurrentVersion string
+	Hardware       deviceHardware
+	Channel        string
+	AllowDowngrade bool
+	// Announce resolves for a channel announcement, which names encrypted
+	// releases without download URLs instead of skipping them
+	Announce bool
+	// Lookups is shared when resolving many devices of one game and board;
+	// nil queries everything afresh
+	Lookups *updateLookups
+}
+
+// resolveUpdate picks the release to offer and builds the response shared by
+// CheckUpdate and MQTT notifications
+func (h *Handler) resolveUpdate(ctx context.Context, q updateQuery) (CheckUpdateResponse, error) {
+	noUpdate := CheckUpdateResponse{Status: "no_update"}
+	deviceID, game, hw := q.DeviceID, q.Game, q.Hardware
+	lookups := q.Lookups
+	if lookups == nil {
+		lookups = h.newUpdateLookups()
+	}
+
+	support, err := lookups.checkSupport(game, hw.Board, q.CurrentVersion)
+	if err != nil {
+		return noUpdate, fmt.Errorf("failed to check support: %w", err)
+	}
+
+	// Update windows hold back every update, pinned ones included, but not
+	// one away from an unsupported or recalled build
+	if support.Supported {
+		allowed, retryAfter, err := lookups.updateAllowed(deviceID, time.Now())
+		if err != nil {
+			return noUpdate, fmt.Errorf("failed to query update windows: %w", err)
+		}
+		if !allowed {
+			noUpdate.RetryAfter = int64((retryAfter + time.Second - 1) / time.Second)
+			log.Printf("Device %s is outside its update windows, retry in %ds", deviceID, noUpdate.RetryAfter)
+			return noUpdate, nil
+		}
+	}
+
+	// A pin replaces channel, promotion and rollout selection entirely and
+	// may deliberately move the device to an older build
+	pin, err := lookups.devicePin(game.ID, deviceID, hw)
+	if err != nil {
+		return noUpdate, fmt.Errorf("failed to query pin: %w", err)
+	}
+
+	// A recalled build is left even when only older builds remain
+	allowDowngrade := q.AllowDowngrade || support.Reason == ReasonRecalled
+	var firmware *firmwareRelease
+	if pin != nil {
+		firmware = pin.Release
+		allowDowngrade = true
+		log.Printf("Device %s is pinned to %s %s by %s", deviceID, game.Code, pin.Version, pin.Source)
+	} else {
+		releases, err := lookups.activeReleases(game.ID, hw.Board, q.Channel)
+		if err != nil {
+			return noUpdate, fmt.Errorf("failed to query firmware: %w", err)
+		}
+
+		// Incompatible builds are dropped before promotion, so a promoted
+		// build the device cannot run falls back to the newest one it can
+		releases = compatibleReleases(releases, hw)
+		firmware = newestRelease(rolloutEligible(applyPromotions(releases), deviceID, game.Code))
+	}
+
+	if firmware == nil {
+		return noUpdate, nil
+	}
+
+	// Devices reporting an unparseable version are always offered the newest
+	// release, otherwise only a strictly newer one (or an explicit downgrade)
+	current, currentErr := ParseVersion(q.CurrentVersion)
+	if currentErr == nil {
+		cmp := firmware.SemVer.Compare(current)
+		if cmp == 0 || (cmp < 0 && !allowDowngrade) {
+			if cmp < 0 {
+				log.Printf("Refusing downgrade for device %s: %s -> %s", deviceID, q.CurrentVersion, firmware.Version)
+			}
+			return noUpdate, nil
+		}
+	} else if q.CurrentVersion != "" {
+		log.Printf("Device %s reported invalid version %q: %v", deviceID, q.CurrentVersion, currentErr)
+	}
+
+	response := CheckUpdateResponse{
+		Status:          "update_available",
+		Version:         firmware.Version,
+		FileSize:        firmware.FileSize,
+		Checksum:        firmware.Checksum,
+		SHA256:          firmware.SHA256,
+		Signature:       firmware.Signature,
+		SigningKeyID:    firmware.SigningKeyID,
+		Description:     firmware.Description,
+		Channel:         firmware.Channel,
+		Board:           hw.Board,
+		Pinned:          pin != nil,
+		Mandatory:       !support.Supported,
+		MandatoryReason: support.Reason,
+		firmwareID:      firmware.ID,
+	}
+
+	// A channel announcement cannot carry the artifact of any one device's
+	// key, so it names an encrypted release and devices check for theirs
+	if firmware.Encrypt && q.Announce {
+		response.Encryption = &EncryptionInfo{Format: encimg.Format}
+		return response, nil
+	}
+
+	// Encrypted releases are only ever served as the artifact for the
+	// device's key, with no patch since patches are not encrypted. Devices
+	// that cannot decrypt, or whose artifact is not built yet, are not
+	// offered the release.
+	var artifact *encryptedArtifact
+	if firmware.Encrypt {
+		if deviceID == "" || hw.EncryptedOTA == nil || !*hw.EncryptedOTA {
+			log.Printf("Not offering encrypted %s %s to device %s without encrypted OTA support", game.Code, firmware.Version, deviceID)
+			return noUpdate, nil
+		}
+		artifact, err = h.deviceArtifact(firmware.ID, deviceID)
+		if err != nil {
+			return noUpdate, fmt.Errorf("failed to query encrypted firmware: %w", err)
+		}
+		if artifact == nil {
+			log.Printf("No encrypted build of %s %s for device %s yet", game.Code, firmware.Version, deviceID)
+			return noUpdate, nil
+		}
+	}
+
+	expiresAt := time.Now().Add(h.urlTTL)
+
+	response.DownloadExpiresAt = expiresAt.Unix()
+	response.DownloadURL, err = h.signedDownloadURL(ctx, firmware.BlobName, downloadParams(game.Code, hw.Board, firmware.Version, "", deviceID), expiresAt)
+	if err != nil {
+		return noUpdate, fmt.Errorf("failed to sign download URL: %w", err)
+	}
+
+	if artifact != nil {
+		params := downloadParams(game.Code, hw.Board, firmware.Version, "", deviceID)
+		params.Set("key", artifact.KeyID)
+		response.DownloadURL, err = h.signedDownloadURL(ctx, artifact.BlobName, params, expiresAt)
+		if err != nil {
+			return noUpdate, fmt.Errorf("failed to sign download URL: %w", err)
+		}
+		response.Encryption = &EncryptionInfo{
+			Format:   encimg.Format,
+			KeyID:    artifact.KeyID,
+			FileSize: artifact.FileSize,
+			SHA256:   artifact.SHA256,
+		}
+	} else if currentErr == nil {
+		patch, err := lookups.lookupPatch(firmware.ID, current.String())
+		if err != nil {
+			log.Printf("Failed to query patch for device %s: %v", deviceID, err)
+		} else if patch != nil {
+			params := downloadParams(game.Code, hw.Board, firmware.Version, current.String(), deviceID)
+			patchURL, err := h.signedDownloadURL(ctx, patch.BlobName, params, expiresAt)
+			if err != nil {
+				log.Printf("Failed to sign patch URL for device %s: %v", deviceID, err)
+			} else {
+				response.Patch = &PatchInfo{
+					FromVersion:    current.String(),
+					Format:         delta.Format,
+					DownloadURL:    patchURL,
+					FileSize:       patch.FileSize,
+					Checksum:       patch.Checksum,
+					TargetChecksum: firmware.Checksum,
+				}
+			}
+		}
+	}
+
+	// Encrypted artifacts do not compress, so only the plain image has
+	// compressed copies
+	if artifact == nil {
+		compressed, err := lookups.pickCompressed(firmware.ID, hw.Encodings)
+		if err != nil {
+			log.Printf("Failed to query compressed firmware for device %s: %v", deviceID, err)
+		} else if compressed != nil {
+			params := downloadParams(game.Code, hw.Board, firmware.Version, "", deviceID)
+			params.Set("encoding", compressed.Encoding)
+			compressedURL, err := h.signedDownloadURL(ctx, compressed.BlobName, params, expiresAt)
+			if err != nil {
+				log.Printf("Failed to sign compressed download URL for device %s: %v", deviceID, err)
+			} else {
+				response.Compression = &CompressionInfo{
+					Encoding:    compressed.Encoding,
+					DownloadURL: compressedURL,
+					FileSize:    compressed.FileSize,
+					Checksum:    compressed.Checksum,
+					SHA256:      compressed.SHA256,
+				}
+			}
+		}
+	}
+
+	partitions, err := lookups.releasePartitions(firmware.ID)
+	if err != nil {
+		return noUpdate, fmt.Errorf("failed to query partitions: %w", err)
+	}
+	var manifestPartitions []ManifestPartition
+	if len(partitions) > 0 {
+		response.Partitions = append(response.Partitions, PartitionInfo{
+			Label:       PartApp,
+			Type:        PartApp,
+			FileSize:    firmware.FileSize,
+			Checksum:    firmware.Checksum,
+			SHA256:      firmware.SHA256,
+			DownloadURL: response.DownloadURL,
+		})
+	}
+	for _, p := range partitions {
+		info := p.info()
+		params := downloadParams(game.Code, hw.Board, firmware.Version, "", deviceID)
+		params.Set("partition", p.Label)
+		info.DownloadURL, err = h.signedDownloadURL(ctx, p.BlobName, params, expiresAt)
+		if err != nil {
+			return noUpdate, fmt.Errorf("failed to sign partition URL: %w", err)
+		}
+		response.Partitions = append(response.Partitions, info)
+		manifestPartitions = append(manifestPartitions, ManifestPartition{
+			Label:  p.Label,
+			Type:   p.Type,
+			Offset: p.Offset,
+			Size:   p.FileSize,
+			SHA256: p.SHA256,
+		})
+	}
+
+	if firmware.SHA256 != "" {
+		response.Manifest, err = h.signManifest(Manifest{
+			DeviceID:     deviceID,
+			Game:         game.Code,
+			Version:      firmware.Version,
+			Size:         firmware.FileSize,
+			SHA256:       firmware.SHA256,
+			Signature:    firmware.Signature,
+			SigningKeyID: firmware.SigningKeyID,
+			DownloadPath: response.DownloadURL,
+			Partitions:   manifestPartitions,
+		})
+		if err != nil {
+			return noUpdate, fmt.Errorf("failed to sign manifest: %w", err)
+		}
+	}
+
+	return response, nil
+}
+
+// touchDevice records the game, version and hardware a device reported
+// during a check, keeping earlier values for anything it left out
+func (h *Handler) touchDevice(deviceID, gameCode, currentVersion string, hw deviceHardware) error {
+	query := `
+		INSERT INTO devices (id, game_code, firmware_ver, board_code, chip_rev, flash_size_mb, supports_encrypted_ota, ota_encodings, last_seen)
+		VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE
+		SET game_code = EXCLUDED.game_code,
+			firmware_ver = COALESCE(EXCLUDED.firmware_ver, devices.firmware_ver),
+			board_code = COALESCE(EXCLUDED.board_code, devices.board_code),
+			chip_rev = COALESCE(EXCLUDED.chip_rev, devices.chip_rev),
+			flash_size_mb = COALESCE(EXCLUDED.flash_size_mb, devices.flash_size_mb),
+			supports_encrypted_ota = COALESCE(EXCLUDED.supports_encrypted_ota, devices.supports_encrypted_ota),
+			ota_encodings = COALESCE(EXCLUDED.ota_encodings, devices.ota_encodings),
+			last_seen = EXCLUDED.last_seen
+	`
+	_, err := h.db.Exec(query, deviceID, gameCode, currentVersion, hw.Board, hw.ChipRev, hw.FlashSizeMB, hw.EncryptedOTA, pq.Array(hw.Encodings), time.Now())
+	return err
+}
+
+// embeddedVersionMatches compares the version in esp_app_desc_t with the
+// release version, by semver precedence when the embedded one is semver
+func embeddedVersionMatches(embedded, version string) bool {
+	embeddedVer, err := ParseVersion(embedded)
+	if err != nil {
+		return embedded == version
+	}
+	releaseVer, err := ParseVersion(version)
+	return err == nil && embeddedVer.Compare(releaseVer) == 0
+}
+
+func (h *Handler) DownloadBin(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	version := r.URL.Query().Get("version")
+	deviceID := r.URL.Query().Get("device_id")
+	fromVersion := r.URL.Query().Get("from")
+	keyID := r.URL.Query().Get("key")
+	partitionLabel := r.URL.Query().Get("partition")
+	encodingName := r.URL.Query().Get("encoding")
+
+	log.Printf("FOTA download: device=%s, game=%s, version=%s", deviceID, r.URL.Query().Get("game"), version)
+
+	// Download URLs are only handed out by CheckUpdate, signed and short-lived
+	if !h.validDownloadSignature(r.URL.Query()) {
+		log.Printf("Rejected unsigned or expired download from device %s", deviceID)
+		http.Error(w, "Invalid or expired download URL", http.StatusForbidden)
+		return
+	}
+
+	if !validDeviceID(deviceID) {
+		http.Error(w, fmt.Sprintf("device_id must be at most %d characters", maxDeviceIDLength), http.StatusBadRequest)
+		return
+	}
+
+	game, err := h.resolveGame(r.URL.Query().Get("game"), deviceID)
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	board := r.URL.Query().Get("board")
+	if board == "" {
+		board = DefaultBoard
+	}
+
+	query := `
+		SELECT id, blob_name, blob_url, file_size, checksum, COALESCE(sha256, ''), encrypt
+		FROM firmwares
+		WHERE game_id = $1 AND version = $2 AND is_active = TRUE AND NOT is_recalled
+			AND board_id = (SELECT id FROM boards WHERE code = $3)
+	`
+
+	var firmwareID int64
+	var blobName, blobURL string
+	var fileSize int64
+	var checksum, sha256Hex string
+	var encrypt bool
+	err = h.db.QueryRow(query, game.ID, version, board).Scan(&firmwareID, &blobName, &blobURL, &fileSize, &checksum, &sha256Hex, &encrypt)
+
+	if err == sql.ErrNoRows {
+		log.Printf("Firmware %s version %s for %s not found in database", game.Code, version, board)
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Failed to query firmware: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The image of an encrypted release never leaves the engine in plain
+	// form, neither whole, compressed nor as a patch
+	if encrypt && keyID == "" && partitionLabel == "" {
+		http.Error(w, "Release is only served encrypted", http.StatusForbidden)
+		return
+	}
+
+	// X-Firmware-Checksum is the SHA-256 of the image, or its MD5 for
+	// releases not yet rehashed; X-Firmware-MD5 is always the MD5
+	imageChecksum := sha256Hex
+	if imageChecksum == "" {
+		imageChecksum = checksum
+	}
+
+	// Patch and compressed downloads serve their own blob, while
+	// X-Firmware-Checksum still describes the image the device ends up with
+	etag := `"` + imageChecksum + `"`
+	filename := game.Code + "_" + version + ".bin"
+	var contentEncoding string
+	if partitionLabel != "" {
+		partition, err := h.lookupPartition(firmwareID, partitionLabel)
+		if err != nil {
+			log.Printf("Failed to query partition: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if partition == nil {
+			http.Error(w, "Partition not found", http.StatusNotFound)
+			return
+		}
+
+		// Other images of a bundle are described by their own checksums
+		blobName = partition.BlobName
+		fileSize = partition.FileSize
+		checksum = partition.Checksum
+		imageChecksum = partition.SHA256
+		etag = `"` + partition.SHA256 + `"`
+		filename = game.Code + "_" + version + "_" + partition.Label + ".bin"
+		w.Header().Set("X-Partition-Label", partition.Label)
+		w.Header().Set("X-Partition-Type", partition.Type)
+		if partition.Offset != nil {
+			w.Header().Set("X-Partition-Offset", fmt.Sprintf("0x%x", *partition.Offset))
+		}
+	} else if keyID != "" {
+		artifact, err := h.lookupArtifact(firmwareID, keyID)
+		if err != nil {
+			log.Printf("Failed to query encrypted firmware: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if artifact == nil {
+			http.Error(w, "Encrypted firmware not found", http.StatusNotFound)
+			return
+		}
+
+		blobName = artifact.BlobName
+		fileSize = artifact.FileSize
+		etag = `"` + artifact.SHA256 + `"`
+		filename = game.Code + "_" + version + "_" + keyID + ".enc.bin"
+		w.Header().Set("X-Firmware-Encryption", encimg.Format)
+		w.Header().Set("X-Encryption-Key-ID", keyID)
+	} else if fromVersion != "" {
+		patch, err := h.lookupPatch(firmwareID, fromVersion)
+		if err != nil {
+			log.Printf("Failed to query patch: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if patch == nil {
+			http.Error(w, "Patch not found", http.StatusNotFound)
+			return
+		}
+
+		blobName = patch.BlobName
+		fileSize = patch.FileSize
+		etag = `"` + patch.Checksum + `"`
+		filename = game.Code + "_" + fromVersion + "_to_" + version + ".patch"
+		w.Header().Set("X-Patch-From", fromVersion)
+		w.Header().Set("X-Patch-Format", delta.Format)
+	} else if encodingName != "" {
+		// Devices that asked for the compressed copy in their check inflate
+		// it themselves, so it is served as is
+		compressed, err := h.pickCompressed(firmwareID, []string{encodingName})
+		if err != nil {
+			log.Printf("Failed to query compressed firmware: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if compressed == nil {
+			http.Error(w, "Compressed firmware not found", http.StatusNotFound)
+			return
+		}
+
+		enc, _ := lookupEncoding(compressed.Encoding)
+		contentEncoding = compressed.Encoding
+		blobName = compressed.BlobName
+		fileSize = compressed.FileSize
+		etag = `"` + compressed.SHA256 + `"`
+		filename += enc.Extension
+		w.Header().Set("X-Firmware-Encoding", compressed.Encoding)
+	} else {
+		// Other clients get a compressed copy through Accept-Encoding,
+		// falling back to the plain image
+		w.Header().Set("Vary", "Accept-Encoding")
+		compressed, err := h.pickCompressed(firmwareID, acceptedEncodings(r.Header.Get("Accept-Encoding")))
+		if err != nil {
+			log.Printf("Failed to query compressed firmware, serving the plain image: %v", err)
+		} else if compressed != nil {
+			contentEncoding = compressed.Encoding
+			blobName = compressed.BlobName
+			fileSize = compressed.FileSize
+			etag = `"` + compressed.SHA256 + `"`
+			w.Header().Set("Content-Encoding", compressed.Encoding)
+		}
+	}
+
+	// The signature is the credential, so browsers flashing from the
+	// portal may fetch images from any origin
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("X-Firmware-Version", version)
+	w.Header().Set("X-Firmware-Checksum", imageChecksum)
+	w.Header().Set("X-Firmware-MD5", checksum)
+
+	// Resume interrupted downloads with a single byte range, as long as the
+	// client still holds bytes of this exact image
+	span := byteRange{Start: 0, Length: fileSize}
+	status := http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && ifRangeMatches(r.Header.Get("If-Range"), etag) {
+		rng, err := parseRange(rangeHeader, fileSize)
+		switch err {
+		case nil:
+			span = rng
+			status = http.StatusPartialContent
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rng.Start, rng.Start+rng.Length-1, fileSize))
+		case errRangeNotSatisfiable:
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		default:
+			log.Printf("Ignoring unsupported Range header %q from device %s", rangeHeader, deviceID)
+		}
+	}
+
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", span.Length))
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	ctx := context.Background()
+	var reader io.ReadCloser
+	if status == http.StatusPartialContent {
+		reader, err = h.storage.DownloadRange(ctx, blobName, span.Start, span.Length)
+	} else {
+		reader, err = h.storage.Download(ctx, blobName)
+	}
+	if err != nil {
+		log.Printf("Failed to download firmware: %v", err)
+		w.Header().Del("Content-Range")
+		http.Error(w, "Failed to download firmware", http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	if status == http.StatusPartialContent {
+		log.Printf("Serving firmware %s bytes %d-%d/%d to device %s", version, span.Start, span.Start+span.Length-1, fileSize, deviceID)
+	} else {
+		log.Printf("Serving firmware %s (%d bytes) to device %s", version, fileSize, deviceID)
+	}
+
+	cw := &countingWriter{ResponseWriter: w}
+	cw.WriteHeader(status)
+	_, err = io.Copy(cw, reader)
+
+	event := fotaEvent{
+		Type:          EventDownload,
+		DeviceID:      deviceID,
+		GameID:        game.ID,
+		FirmwareID:    firmwareID,
+		Board:         board,
+		FromVersion:   fromVersion,
+		ToVersion:     version,
+		Outcome:       OutcomeCompleted,
+		IsPatch:       fromVersion != "",
+		Partition:     partitionLabel,
+		Encoding:      contentEncoding,
+		BytesServed:   cw.written,
+		BytesExpected: span.Length,
+		Duration:      time.Since(start),
+		ClientIP:      h.clientIP(r),
+	}
+	if err != nil || cw.written != span.Length {
+		event.Outcome = OutcomeAborted
+	}
+	go h.recordEvent(event)
+
+	if err != nil {
+		log.Printf("Failed to send firmware: %v", err)
+		return
+	}
+
+	log.Printf("Firmware %s successfully downloaded by device %s", version, deviceID)
+}
+
+// UploadBin uploads a release from a multipart form. The text fields (game,
+// version, board, channel, ...) must precede the "firmware" file part, which
+// is streamed into storage as it arrives. Admin only.
+func (h *Handler) UploadBin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	// Leave headroom for the text fields and multipart framing
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxFirmwareSize+1<<20)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected multipart/form-data", http.StatusBadRequest)
+		return
+	}
+
+	// Text fields must precede the firmware part so the image can be
+	// streamed straight into storage without buffering it
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			http.Error(w, "Firmware file is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			writeUploadError(w, badUpload("Failed to parse multipart form"))
+			return
+		}
+
+		if part.FormName() == "firmware" {
+			if err := checkFieldsBeforeImage(fields); err != nil {
+				writeUploadError(w, err)
+				return
+			}
+			meta, err := h.parseUploadMeta(fields)
+			if err != nil {
+				writeUploadError(w, err)
+				return
+			}
+
+			result, err := h.ingestFirmware(r.Context(), meta, part)
+			if err != nil {
+				writeUploadError(w, err)
+				return
+			}
+
+			writeJSON(w, http.StatusCreated, result)
+			return
+		}
+
+		value, err := readUploadField(part)
+		if err != nil {
+			writeUploadError(w, err)
+			return
+		}
+		fields[part.FormName()] = value
+	}
+}
@@ -0,0 +1,255 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/storage"
+)
+
+// testHandler returns a handler on a mocked database and a bucket in a
+// temporary directory
+func testHandler(t *testing.T) (*Handler, sqlmock.Sqlmock) {
+	t.Helper()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stor, err := storage.NewCloudStorage(context.Background(), "file://"+t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		stor.Close()
+	})
+
+	return &Handler{
+		db:               db,
+		storage:          stor,
+		adminAPIToken:    "test-token",
+		manifestTTL:      time.Hour,
+		maxFirmwareSize:  1 << 20,
+		urlSecret:        []byte("test-secret"),
+		urlTTL:           15 * time.Minute,
+		maxChunkSize:     1 << 20,
+		uploadSessionTTL: time.Hour,
+	}, mock
+}
+
+func putBlob(t *testing.T, h *Handler, blobName string, data []byte) {
+	t.Helper()
+	if _, err := h.storage.Upload(context.Background(), blobName, bytes.NewReader(data), "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func blobExists(t *testing.T, h *Handler, blobName string) bool {
+	t.Helper()
+	exists, err := h.storage.Exists(context.Background(), blobName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func listBlobs(t *testing.T, h *Handler, prefix string) []string {
+	t.Helper()
+	names, err := h.storage.List(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func expectationsMet(t *testing.T, mock sqlmock.Sqlmock) {
+	t.Helper()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+// adminRequest builds a request carrying the token testHandler accepts
+func adminRequest(method, target, body string) *http.Request {
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, r)
+	req.Header.Set("X-API-Token", "test-token")
+	return req
+}
+
+func serve(handler http.HandlerFunc, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// releaseRows returns firmwares rows in releaseColumns order
+func releaseRows(releases ...firmwareRelease) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "version", "channel", "blob_name", "blob_url", "description", "file_size", "checksum",
+		"sha256", "rollout_percent", "rollout_paused", "is_promoted", "min_chip_rev", "max_chip_rev", "flash_size_mb", "encrypt",
+		"signature", "signing_key_id"})
+	for _, rel := range releases {
+		rows.AddRow(rel.ID, rel.Version, rel.Channel, rel.BlobName, rel.BlobURL, rel.Description, rel.FileSize, rel.Checksum,
+			rel.SHA256, rel.RolloutPercent, rel.RolloutPaused, rel.IsPromoted, intValue(rel.MinChipRev), intValue(rel.MaxChipRev),
+			intValue(rel.FlashSizeMB), rel.Encrypt, rel.Signature, rel.SigningKeyID)
+	}
+	return rows
+}
+
+func intValue(p *int) driver.Value {
+	if p == nil {
+		return nil
+	}
+	return int64(*p)
+}
+
+func intPtr(v int) *int {
+	return &v
+}
+
+// appImage builds an ESP32 application image for 4 MB flash, as the
+// m5stickc-plus board expects, embedding version and padded with a data
+// segment of payload bytes
+func appImage(version string, payload int) []byte {
+	desc := make([]byte, 256)
+	binary.LittleEndian.PutUint32(desc[0:4], 0xABCD5432)
+	copy(desc[16:48], version)
+	copy(desc[48:80], "crisp-games")
+	copy(desc[80:96], "10:00:00")
+	copy(desc[96:112], "Jun 14 2025")
+	copy(desc[112:144], "v5.1.2")
+
+	var buf bytes.Buffer
+	hdr := make([]byte, 24)
+	hdr[0] = 0xE9
+	hdr[1] = 2
+	hdr[3] = 2 << 4
+	binary.LittleEndian.PutUint32(hdr[4:8], 0x40080000)
+	binary.LittleEndian.PutUint16(hdr[17:19], 399)
+	hdr[23] = 1
+	buf.Write(hdr)
+
+	checksum := byte(0xEF)
+	for i, data := range [][]byte{desc, bytes.Repeat([]byte{0xA5}, payload)} {
+		var seg [8]byte
+		binary.LittleEndian.PutUint32(seg[0:4], 0x3F400000+uint32(i)<<16)
+		binary.LittleEndian.PutUint32(seg[4:8], uint32(len(data)))
+		buf.Write(seg[:])
+		buf.Write(data)
+		for _, b := range data {
+			checksum ^= b
+		}
+	}
+	buf.Write(make([]byte, 15-buf.Len()%16))
+	buf.WriteByte(checksum)
+
+	digest := sha256.Sum256(buf.Bytes())
+	buf.Write(digest[:])
+	return buf.Bytes()
+}
+
+// testBoard is the m5stickc-plus row
+var testBoard = boardRef{ID: 1, Code: DefaultBoard, ChipID: 0, FlashSizeMB: 4}
+
+// expectReleaseBlob expects releaseBlob's reference check of blobName
+func expectReleaseBlob(mock sqlmock.Sqlmock, blobName string, referenced bool) {
+	mock.ExpectBegin()
+	mock.ExpectExec(`pg_advisory_xact_lock`).WithArgs(blobName).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT EXISTS`).WithArgs(blobName).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(referenced))
+	if referenced {
+		mock.ExpectRollback()
+	} else {
+		mock.ExpectCommit()
+	}
+}
+
+// expectFindRelease expects findRelease to resolve crisp-games version to ids
+func expectFindRelease(mock sqlmock.Sqlmock, version, board string, ids ...int64) {
+	rows := sqlmock.NewRows([]string{"id"})
+	for _, id := range ids {
+		rows.AddRow(id)
+	}
+	mock.ExpectQuery(`WHERE g.code = \$1 AND f.version = \$2`).WithArgs("crisp-games", version, board).WillReturnRows(rows)
+}
+
+// expectSupported expects checkSupport to find a device's valid version
+// supported: no minimum and not recalled
+func expectSupported(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT min_supported_version FROM games`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"min_supported_version"}).AddRow(nil))
+	mock.ExpectQuery(`AND is_recalled`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+}
+
+// expectNoWindows expects updateAllowed to find no update windows
+func expectNoWindows(mock sqlmock.Sqlmock, deviceID string) {
+	mock.ExpectQuery(`FROM update_windows`).WithArgs(deviceID).
+		WillReturnRows(sqlmock.NewRows([]string{"start_time", "end_time", "time_zone"}))
+}
+
+// expectPin expects devicePin to find a pin on the device itself, or on
+// group when set, and the pinned release to be rel
+func expectPin(mock sqlmock.Sqlmock, deviceID, version, group string, rel *firmwareRelease) {
+	pinned := deviceID
+	if group != "" {
+		pinned = ""
+	}
+	mock.ExpectQuery(`FROM firmware_pins p[\s\S]*ORDER BY \(p.device_id IS NOT NULL\) DESC, p.created_at DESC`).WithArgs(1, deviceID).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "device_id", "group"}).AddRow(version, pinned, group))
+	release := mock.ExpectQuery(`WHERE game_id = \$1 AND version = \$2 AND is_active = TRUE`).WithArgs(1, version, DefaultBoard)
+	if rel == nil {
+		release.WillReturnError(sql.ErrNoRows)
+	} else {
+		release.WillReturnRows(releaseRows(*rel))
+	}
+}
+
+func expectNoPin(mock sqlmock.Sqlmock, deviceID string) {
+	mock.ExpectQuery(`FROM firmware_pins p`).WithArgs(1, deviceID).WillReturnError(sql.ErrNoRows)
+}
+
+// expectOffer expects the lookups made once a release is offered to a device
+// reporting a valid version that sent no encodings
+func expectOffer(mock sqlmock.Sqlmock, firmwareID int64) {
+	mock.ExpectQuery(`FROM firmware_patches`).WithArgs(firmwareID, sqlmock.AnyArg()).WillReturnError(sql.ErrNoRows)
+	mock.ExpectQuery(`FROM firmware_partitions`).WithArgs(firmwareID).
+		WillReturnRows(sqlmock.NewRows([]string{"label", "part_type", "flash_offset", "blob_name", "file_size", "checksum", "sha256"}))
+}
+
+// testRelease is an active stable release of crisp-games for m5stickc-plus
+func testRelease(id int64, version string) firmwareRelease {
+	return firmwareRelease{
+		ID:             id,
+		Version:        version,
+		Channel:        ChannelStable,
+		BlobName:       "_sha256/" + version + ".bin",
+		FileSize:       1024,
+		Checksum:       "md5-" + version,
+		SHA256:         "sha256-" + version,
+		RolloutPercent: 100,
+	}
+}
+
+var testGame = gameRef{ID: 1, Code: "crisp-games"}
+
+// expectTestGame expects crisp-games to be looked up by code
+func expectTestGame(mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+}
@@ -0,0 +1,167 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Game codes end up in blob names and MQTT topics, so keep them URL-safe
+var gameCodePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,49}$`)
+
+var errGameRequired = errors.New("game is required")
+
+// Game is an entry of the firmware catalog
+type Game struct {
+	Code        string `json:"code"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	// MinSupportedVersion makes updates mandatory for older builds and
+	// rejects their scores; empty means every build is supported
+	MinSupportedVersion string    `json:"min_supported_version"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// gameRef identifies the game a FOTA request is scoped to
+type gameRef struct {
+	ID   int64
+	Code string
+}
+
+// lookupGame returns sql.ErrNoRows for unknown game codes
+func (h *Handler) lookupGame(code string) (gameRef, error) {
+	return lookupGame(h.db, code)
+}
+
+// resolveGame uses the explicit game code when given and otherwise falls back
+// to the game the device last reported running
+func (h *Handler) resolveGame(code, deviceID string) (gameRef, error) {
+	return resolveGame(h.db, code, deviceID)
+}
+
+func lookupGame(db *sql.DB, code string) (gameRef, error) {
+	game := gameRef{Code: code}
+	err := db.QueryRow(`SELECT id FROM games WHERE code = $1`, code).Scan(&game.ID)
+	return game, err
+}
+
+func resolveGame(db *sql.DB, code, deviceID string) (gameRef, error) {
+	if code == "" && deviceID != "" {
+		var stored sql.NullString
+		err := db.QueryRow(`SELECT game_code FROM devices WHERE id = $1`, deviceID).Scan(&stored)
+		if err != nil && err != sql.ErrNoRows {
+			return gameRef{}, err
+		}
+		code = stored.String
+	}
+
+	if code == "" {
+		return gameRef{}, errGameRequired
+	}
+
+	return lookupGame(db, code)
+}
+
+// writeGameError maps resolveGame errors to HTTP responses
+func writeGameError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errGameRequired):
+		http.Error(w, "Game is required", http.StatusBadRequest)
+	case err == sql.ErrNoRows:
+		http.Error(w, "Unknown game", http.StatusNotFound)
+	default:
+		log.Printf("Failed to resolve game: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// Games lists the catalog (GET) or creates/updates a game (POST, admin only)
+func (h *Handler) Games(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.listGames(w, r)
+	case http.MethodPost:
+		if !h.authorizeAdmin(w, r) {
+			return
+		}
+		h.saveGame(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listGames(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT code, title, COALESCE(description, ''), COALESCE(min_supported_version, ''), created_at
+		FROM games
+		ORDER BY code
+	`)
+	if err != nil {
+		log.Printf("Failed to query games: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	games := []Game{}
+	for rows.Next() {
+		var g Game
+		if err := rows.Scan(&g.Code, &g.Title, &g.Description, &g.MinSupportedVersion, &g.CreatedAt); err != nil {
+			log.Printf("Failed to scan game: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		games = append(games, g)
+	}
+
+	writeJSON(w, http.StatusOK, games)
+}
+
+func (h *Handler) saveGame(w http.ResponseWriter, r *http.Request) {
+	var g Game
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if !gameCodePattern.MatchString(g.Code) {
+		http.Error(w, "Game code must be 1-50 lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if g.Title == "" {
+		http.Error(w, "Title is required", http.StatusBadRequest)
+		return
+	}
+	if g.MinSupportedVersion != "" {
+		v, err := ParseVersion(g.MinSupportedVersion)
+		if err != nil {
+			http.Error(w, "min_supported_version must be a valid semantic version (e.g. 1.4.0)", http.StatusBadRequest)
+			return
+		}
+		g.MinSupportedVersion = v.String()
+	}
+
+	query := `
+		INSERT INTO games (code, title, description, min_supported_version)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (code) DO UPDATE
+		SET title = EXCLUDED.title,
+			description = EXCLUDED.description,
+			min_supported_version = EXCLUDED.min_supported_version
+		RETURNING created_at
+	`
+
+	if err := h.db.QueryRow(query, g.Code, g.Title, g.Description, g.MinSupportedVersion).Scan(&g.CreatedAt); err != nil {
+		log.Printf("Failed to save game %s: %v", g.Code, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Game %s saved", g.Code)
+
+	writeJSON(w, http.StatusOK, g)
+}
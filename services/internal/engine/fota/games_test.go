@@ -0,0 +1,147 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestResolveGame(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// An explicit game wins over the one the device reported
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("snake").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(2))
+	if game, err := h.resolveGame("snake", "stick-1"); err != nil || game != (gameRef{ID: 2, Code: "snake"}) {
+		t.Errorf("resolveGame(snake) = %+v, %v", game, err)
+	}
+
+	mock.ExpectQuery(`SELECT game_code FROM devices`).WithArgs("stick-1").
+		WillReturnRows(sqlmock.NewRows([]string{"game_code"}).AddRow("crisp-games"))
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	if game, err := h.resolveGame("", "stick-1"); err != nil || game != (gameRef{ID: 1, Code: "crisp-games"}) {
+		t.Errorf("resolveGame() of a known device = %+v, %v", game, err)
+	}
+
+	// Devices that never reported a game, and requests without a device,
+	// must name one
+	mock.ExpectQuery(`SELECT game_code FROM devices`).WithArgs("stick-2").WillReturnError(sql.ErrNoRows)
+	if _, err := h.resolveGame("", "stick-2"); !errors.Is(err, errGameRequired) {
+		t.Errorf("resolveGame() of an unknown device error = %v, want errGameRequired", err)
+	}
+	if _, err := h.resolveGame("", ""); !errors.Is(err, errGameRequired) {
+		t.Errorf("resolveGame() without device error = %v, want errGameRequired", err)
+	}
+
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("tetris").WillReturnError(sql.ErrNoRows)
+	if _, err := h.resolveGame("tetris", ""); err != sql.ErrNoRows {
+		t.Errorf("resolveGame(tetris) error = %v, want sql.ErrNoRows", err)
+	}
+
+	expectationsMet(t, mock)
+}
+
+func TestWriteGameError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{errGameRequired, http.StatusBadRequest},
+		{sql.ErrNoRows, http.StatusNotFound},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeGameError(w, tt.err)
+		if w.Code != tt.want {
+			t.Errorf("writeGameError(%v) = %d, want %d", tt.err, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCheckUpdateUnknownGame(t *testing.T) {
+	h, mock := testHandler(t)
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("tetris").WillReturnError(sql.ErrNoRows)
+
+	w := serve(h.CheckUpdate, httptest.NewRequest(http.MethodGet, "/api/fota/check?game=tetris&current_version=1.0.0", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("check of an unknown game = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestSaveGameRequiresAdmin(t *testing.T) {
+	h, mock := testHandler(t)
+	body := `{"code": "crisp-games", "title": "Crisp Games"}`
+
+	for _, token := range []string{"", "wrong-token"} {
+		r := httptest.NewRequest(http.MethodPost, "/api/fota/games", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("X-API-Token", token)
+		}
+		if w := serve(h.Games, r); w.Code != http.StatusUnauthorized {
+			t.Errorf("save with token %q = %d, want %d", token, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	// The bearer form is accepted too
+	mock.ExpectQuery(`INSERT INTO games`).WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	r := httptest.NewRequest(http.MethodPost, "/api/fota/games", strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer test-token")
+	if w := serve(h.Games, r); w.Code != http.StatusOK {
+		t.Errorf("save with a bearer token = %d, want %d", w.Code, http.StatusOK)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestSaveGameValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid JSON", `{"code":`},
+		{"no code", `{"title": "Crisp Games"}`},
+		{"uppercase code", `{"code": "Crisp", "title": "Crisp Games"}`},
+		{"code with a slash", `{"code": "crisp/games", "title": "Crisp Games"}`},
+		{"long code", `{"code": "` + strings.Repeat("a", 51) + `", "title": "Crisp Games"}`},
+		{"no title", `{"code": "crisp-games"}`},
+		{"invalid minimum version", `{"code": "crisp-games", "title": "Crisp Games", "min_supported_version": "latest"}`},
+	}
+
+	for _, tt := range tests {
+		h, mock := testHandler(t)
+		if w := serve(h.Games, adminRequest(http.MethodPost, "/api/fota/games", tt.body)); w.Code != http.StatusBadRequest {
+			t.Errorf("save with %s = %d, want %d", tt.name, w.Code, http.StatusBadRequest)
+		}
+		expectationsMet(t, mock)
+	}
+}
+
+func TestSaveGame(t *testing.T) {
+	h, mock := testHandler(t)
+	mock.ExpectQuery(`INSERT INTO games`).WithArgs("crisp-games", "Crisp Games", "", "1.4.0").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+
+	w := serve(h.Games, adminRequest(http.MethodPost, "/api/fota/games",
+		`{"code": "crisp-games", "title": "Crisp Games", "min_supported_version": "v1.4.0"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("save = %d: %s", w.Code, w.Body)
+	}
+	var g Game
+	if err := json.NewDecoder(w.Body).Decode(&g); err != nil {
+		t.Fatal(err)
+	}
+	if g.Code != "crisp-games" || g.MinSupportedVersion != "1.4.0" {
+		t.Errorf("saved game = %+v", g)
+	}
+	expectationsMet(t, mock)
+}
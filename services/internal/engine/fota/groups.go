@@ -0,0 +1,271 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// DeviceGroup is a named set of devices that pins and policies can target
+type DeviceGroup struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Members     int       `json:"members"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type groupMembersRequest struct {
+	Group     string   `json:"group"`
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// lookupGroup returns sql.ErrNoRows for unknown group names
+func (h *Handler) lookupGroup(name string) (int64, error) {
+	var id int64
+	err := h.db.QueryRow(`SELECT id FROM device_groups WHERE name = $1`, name).Scan(&id)
+	return id, err
+}
+
+// writeGroupError maps lookupGroup errors to HTTP responses
+func writeGroupError(w http.ResponseWriter, err error) {
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown group", http.StatusNotFound)
+		return
+	}
+	log.Printf("Failed to resolve group: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// Groups lists (GET), creates or updates (POST) and deletes (DELETE) device
+// groups. Admin only.
+func (h *Handler) Groups(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listGroups(w, r)
+	case http.MethodPost:
+		h.saveGroup(w, r)
+	case http.MethodDelete:
+		h.deleteGroup(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listGroups(w http.ResponseWriter, r *http.Request) {
+	rows, err := h.db.Query(`
+		SELECT g.name, COALESCE(g.description, ''), COUNT(m.device_id), g.created_at
+		FROM device_groups g
+		LEFT JOIN device_group_members m ON m.group_id = g.id
+		GROUP BY g.id
+		ORDER BY g.name
+	`)
+	if err != nil {
+		log.Printf("Failed to query groups: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	groups := []DeviceGroup{}
+	for rows.Next() {
+		var g DeviceGroup
+		if err := rows.Scan(&g.Name, &g.Description, &g.Members, &g.CreatedAt); err != nil {
+			log.Printf("Failed to scan group: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		groups = append(groups, g)
+	}
+
+	writeJSON(w, http.StatusOK, groups)
+}
+
+func (h *Handler) saveGroup(w http.ResponseWriter, r *http.Request) {
+	var g DeviceGroup
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	// Group names share the game code rules
+	if !gameCodePattern.MatchString(g.Name) {
+		http.Error(w, "Group name must be 1-50 lowercase letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+
+	query := `
+		INSERT INTO device_groups (name, description)
+		VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description
+		RETURNING created_at, (SELECT COUNT(*) FROM device_group_members m WHERE m.group_id = device_groups.id)
+	`
+
+	if err := h.db.QueryRow(query, g.Name, g.Description).Scan(&g.CreatedAt, &g.Members); err != nil {
+		log.Printf("Failed to save group %s: %v", g.Name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Device group %s saved", g.Name)
+
+	writeJSON(w, http.StatusOK, g)
+}
+
+func (h *Handler) deleteGroup(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Group name is required", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.db.Exec(`DELETE FROM device_groups WHERE name = $1`, name)
+	if err != nil {
+		log.Printf("Failed to delete group %s: %v", name, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Unknown group", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Device group %s deleted", name)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "name": name})
+}
+
+// GroupMembers lists (GET ?group=), adds (POST) or removes (DELETE) the
+// devices of a group. Admin only.
+func (h *Handler) GroupMembers(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listGroupMembers(w, r)
+	case http.MethodPost, http.MethodDelete:
+		h.updateGroupMembers(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listGroupMembers(w http.ResponseWriter, r *http.Request) {
+	groupID, err := h.lookupGroup(r.URL.Query().Get("group"))
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT d.id, d.game_code, d.firmware_ver, d.fota_channel, d.last_seen
+		FROM device_group_members m
+		JOIN devices d ON d.id = m.device_id
+		WHERE m.group_id = $1
+		ORDER BY d.id
+	`, groupID)
+	if err != nil {
+		log.Printf("Failed to query group members: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	devices := []ChannelDevice{}
+	for rows.Next() {
+		var d ChannelDevice
+		if err := rows.Scan(&d.ID, &d.GameCode, &d.FirmwareVer, &d.Channel, &d.LastSeen); err != nil {
+			log.Printf("Failed to scan device: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		devices = append(devices, d)
+	}
+
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (h *Handler) updateGroupMembers(w http.ResponseWriter, r *http.Request) {
+	var req groupMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.DeviceIDs) == 0 {
+		http.Error(w, "device_ids is required", http.StatusBadRequest)
+		return
+	}
+
+	groupID, err := h.lookupGroup(req.Group)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	var updated int64
+	if r.Method == http.MethodPost {
+		updated, err = h.addGroupMembers(groupID, req.DeviceIDs)
+	} else {
+		var res sql.Result
+		res, err = h.db.Exec(`
+			DELETE FROM device_group_members
+			WHERE group_id = $1 AND device_id = ANY($2)
+		`, groupID, pq.Array(req.DeviceIDs))
+		if err == nil {
+			updated, _ = res.RowsAffected()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to update members of group %s: %v", req.Group, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Updated %d members of group %s", updated, req.Group)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"group":   req.Group,
+		"updated": updated,
+	})
+}
+
+// addGroupMembers creates devices that have never checked in yet, so they
+// pick up the group's pins on their first check
+func (h *Handler) addGroupMembers(groupID int64, deviceIDs []string) (int64, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO devices (id)
+		SELECT unnest($1::varchar[])
+		ON CONFLICT (id) DO NOTHING
+	`, pq.Array(deviceIDs))
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO device_group_members (group_id, device_id)
+		SELECT $1, unnest($2::varchar[])
+		ON CONFLICT DO NOTHING
+	`, groupID, pq.Array(deviceIDs))
+	if err != nil {
+		return 0, err
+	}
+
+	added, _ := res.RowsAffected()
+	return added, tx.Commit()
+}
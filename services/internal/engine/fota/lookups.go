@@ -0,0 +1,196 @@
+package fota
+
+import (
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// updateLookups reads what resolveUpdate needs from the database for one
+// game and board, remembering each answer. Resolving many devices through
+// the same lookups queries every channel, support status and release once;
+// preload fetches the windows and pins of all of them in two queries.
+type updateLookups struct {
+	h *Handler
+
+	support    map[string]SupportStatus
+	releases   map[string][]firmwareRelease
+	pinned     map[string]*firmwareRelease
+	partitions map[int64][]firmwarePartition
+	patches    map[patchKey]*firmwarePatch
+	compressed map[compressedKey]*compressedImage
+
+	// windows and pins are nil until preloaded, after which a device
+	// missing from them has none
+	windows map[string][]UpdateWindow
+	pins    map[string]pinMatch
+}
+
+type patchKey struct {
+	FirmwareID  int64
+	FromVersion string
+}
+
+type compressedKey struct {
+	FirmwareID int64
+	Encodings  string
+}
+
+func (h *Handler) newUpdateLookups() *updateLookups {
+	return &updateLookups{
+		h:          h,
+		support:    make(map[string]SupportStatus),
+		releases:   make(map[string][]firmwareRelease),
+		pinned:     make(map[string]*firmwareRelease),
+		partitions: make(map[int64][]firmwarePartition),
+		patches:    make(map[patchKey]*firmwarePatch),
+		compressed: make(map[compressedKey]*compressedImage),
+	}
+}
+
+// preload fetches the update windows and pins of the given devices
+func (l *updateLookups) preload(gameID int64, deviceIDs []string) error {
+	rows, err := l.h.db.Query(`
+		SELECT m.device_id, w.start_time::text, w.end_time::text, w.time_zone
+		FROM update_windows w
+		JOIN device_group_members m ON m.group_id = w.group_id
+		WHERE m.device_id = ANY($1)
+	`, pq.Array(deviceIDs))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	windows := make(map[string][]UpdateWindow)
+	for rows.Next() {
+		var deviceID string
+		var uw UpdateWindow
+		if err := rows.Scan(&deviceID, &uw.Start, &uw.End, &uw.TimeZone); err != nil {
+			return err
+		}
+		windows[deviceID] = append(windows[deviceID], uw)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// The same precedence as lookupPin, per device
+	pinRows, err := l.h.db.Query(`
+		SELECT DISTINCT ON (d.id) d.id, p.version, COALESCE(p.device_id, ''), COALESCE(g.name, '')
+		FROM devices d
+		JOIN firmware_pins p ON p.game_id = $1
+			AND (p.device_id = d.id OR p.group_id IN (SELECT group_id FROM device_group_members WHERE device_id = d.id))
+		LEFT JOIN device_groups g ON g.id = p.group_id
+		WHERE d.id = ANY($2)
+		ORDER BY d.id, (p.device_id IS NOT NULL) DESC, p.created_at DESC
+	`, gameID, pq.Array(deviceIDs))
+	if err != nil {
+		return err
+	}
+	defer pinRows.Close()
+
+	pins := make(map[string]pinMatch)
+	for pinRows.Next() {
+		var deviceID, pinnedDevice, groupName string
+		var pin pinMatch
+		if err := pinRows.Scan(&deviceID, &pin.Version, &pinnedDevice, &groupName); err != nil {
+			return err
+		}
+		pin.Source = pinSource(pinnedDevice, groupName)
+		pins[deviceID] = pin
+	}
+	if err := pinRows.Err(); err != nil {
+		return err
+	}
+
+	l.windows, l.pins = windows, pins
+	return nil
+}
+
+func (l *updateLookups) checkSupport(game gameRef, board, version string) (SupportStatus, error) {
+	if status, ok := l.support[version]; ok {
+		return status, nil
+	}
+	status, err := checkSupport(l.h.db, game, board, version)
+	if err == nil {
+		l.support[version] = status
+	}
+	return status, err
+}
+
+func (l *updateLookups) updateAllowed(deviceID string, now time.Time) (bool, time.Duration, error) {
+	if l.windows == nil {
+		return l.h.updateAllowed(deviceID, now)
+	}
+	allowed, retryAfter := windowsAllow(l.windows[deviceID], now)
+	return allowed, retryAfter, nil
+}
+
+func (l *updateLookups) devicePin(gameID int64, deviceID string, hw deviceHardware) (*pinMatch, error) {
+	if l.pins == nil {
+		return l.h.devicePin(gameID, deviceID, hw)
+	}
+
+	pin, ok := l.pins[deviceID]
+	if !ok {
+		return nil, nil
+	}
+	rel, ok := l.pinned[pin.Version]
+	if !ok {
+		var err error
+		rel, err = l.h.pinnedRelease(gameID, pin.Version, hw.Board)
+		if err != nil {
+			return nil, err
+		}
+		l.pinned[pin.Version] = rel
+	}
+	pin.offer(rel, deviceID, hw)
+	return &pin, nil
+}
+
+func (l *updateLookups) activeReleases(gameID int64, board, channel string) ([]firmwareRelease, error) {
+	if releases, ok := l.releases[channel]; ok {
+		return releases, nil
+	}
+	releases, err := l.h.activeReleases(gameID, board, channel)
+	if err == nil {
+		l.releases[channel] = releases
+	}
+	return releases, err
+}
+
+func (l *updateLookups) lookupPatch(firmwareID int64, fromVersion string) (*firmwarePatch, error) {
+	key := patchKey{firmwareID, fromVersion}
+	if patch, ok := l.patches[key]; ok {
+		return patch, nil
+	}
+	patch, err := l.h.lookupPatch(firmwareID, fromVersion)
+	if err == nil {
+		l.patches[key] = patch
+	}
+	return patch, err
+}
+
+func (l *updateLookups) pickCompressed(firmwareID int64, accepted []string) (*compressedImage, error) {
+	key := compressedKey{firmwareID, strings.Join(accepted, ",")}
+	if c, ok := l.compressed[key]; ok {
+		return c, nil
+	}
+	c, err := l.h.pickCompressed(firmwareID, accepted)
+	if err == nil {
+		l.compressed[key] = c
+	}
+	return c, err
+}
+
+func (l *updateLookups) releasePartitions(firmwareID int64) ([]firmwarePartition, error) {
+	if partitions, ok := l.partitions[firmwareID]; ok {
+		return partitions, nil
+	}
+	partitions, err := l.h.releasePartitions(firmwareID)
+	if err == nil {
+		l.partitions[firmwareID] = partitions
+	}
+	return partitions, err
+}
@@ -0,0 +1,90 @@
+package fota
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/signing"
+)
+
+// Manifest describes the update a device is allowed to install. Devices
+// verify the signature with an embedded public key, then check the
+// downloaded image against Size and SHA256 before marking it bootable.
+type Manifest struct {
+	DeviceID string `json:"device_id,omitempty"`
+	Game     string `json:"game"`
+	Version  string `json:"version"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	// Signature is the upload-time signature of the image digest, as in the
+	// check response
+	Signature    string `json:"signature,omitempty"`
+	SigningKeyID string `json:"signing_key_id,omitempty"`
+	DownloadPath string `json:"download_path"`
+	// Partitions lists the other images of a bundle release
+	Partitions []ManifestPartition `json:"partitions,omitempty"`
+	ExpiresAt  int64               `json:"expires_at"`
+}
+
+// ManifestPartition pins the content of an image of a bundle release
+type ManifestPartition struct {
+	Label  string `json:"label"`
+	Type   string `json:"type"`
+	Offset *int64 `json:"offset,omitempty"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// SignedManifest carries the exact manifest bytes that were signed, so
+// devices never have to re-serialize JSON to verify it
+type SignedManifest struct {
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+}
+
+// signManifest returns nil when no signing key is configured
+func (h *Handler) signManifest(m Manifest) (*SignedManifest, error) {
+	if h.signer == nil {
+		return nil, nil
+	}
+
+	m.ExpiresAt = time.Now().Add(h.manifestTTL).Unix()
+
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	sig := h.signer.Sign(payload)
+	return &SignedManifest{
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: sig.Value,
+		KeyID:     sig.KeyID,
+		Algorithm: signing.Algorithm,
+	}, nil
+}
+
+// SigningKeys lists the public keys devices may use to verify manifests
+func (h *Handler) SigningKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.signer == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"active_key_id": "",
+			"keys":          []signing.PublicKey{},
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"active_key_id": h.signer.KeyID(),
+		"keys":          h.signer.PublicKeys(),
+	})
+}
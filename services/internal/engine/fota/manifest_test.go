@@ -0,0 +1,163 @@
+package fota
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/signing"
+)
+
+func testSigner(t *testing.T, keyID string, seed byte, verificationKeys string) *signing.Signer {
+	t.Helper()
+	s, err := signing.NewSigner(keyID, base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{seed}, ed25519.SeedSize)), verificationKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// verifyManifest checks a signed manifest the way devices do, against the
+// keys published by SigningKeys
+func verifyManifest(t *testing.T, h *Handler, sm *SignedManifest) (Manifest, bool) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	h.SigningKeys(w, httptest.NewRequest(http.MethodGet, "/api/fota/keys", nil))
+	var published struct {
+		Keys []signing.PublicKey `json:"keys"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&published); err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(sm.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(sm.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(payload, &m); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range published.Keys {
+		if k.ID != sm.KeyID {
+			continue
+		}
+		pub, _ := base64.StdEncoding.DecodeString(k.Key)
+		return m, ed25519.Verify(ed25519.PublicKey(pub), payload, sig)
+	}
+	return m, false
+}
+
+func TestSignManifest(t *testing.T) {
+	h := &Handler{manifestTTL: time.Hour, signer: testSigner(t, "2025", 1, "")}
+
+	sm, err := h.signManifest(Manifest{
+		DeviceID:     "stick-1",
+		Game:         "crisp-games",
+		Version:      "1.4.0",
+		Size:         1024,
+		SHA256:       strings.Repeat("ab", 32),
+		Signature:    "image-signature",
+		SigningKeyID: "2024",
+		DownloadPath: downloadPath + "?game=crisp-games",
+	})
+	if err != nil {
+		t.Fatalf("signManifest: %v", err)
+	}
+	if sm.KeyID != "2025" || sm.Algorithm != signing.Algorithm {
+		t.Errorf("manifest signed with %s/%s, want 2025/%s", sm.KeyID, sm.Algorithm, signing.Algorithm)
+	}
+
+	m, ok := verifyManifest(t, h, sm)
+	if !ok {
+		t.Fatalf("manifest signature does not verify")
+	}
+	if m.Version != "1.4.0" || m.DeviceID != "stick-1" || m.Signature != "image-signature" || m.SigningKeyID != "2024" {
+		t.Errorf("manifest = %+v", m)
+	}
+	if expires := time.Unix(m.ExpiresAt, 0); expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(time.Hour+time.Minute)) {
+		t.Errorf("manifest expires at %v, want in an hour", expires)
+	}
+}
+
+func TestSignManifestRejectsTampering(t *testing.T) {
+	h := &Handler{manifestTTL: time.Hour, signer: testSigner(t, "2025", 1, "")}
+	sm, err := h.signManifest(Manifest{Game: "crisp-games", Version: "1.4.0", Size: 1024, SHA256: strings.Repeat("ab", 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(sm.Payload)
+
+	tamper := func(change func(*SignedManifest)) *SignedManifest {
+		c := *sm
+		change(&c)
+		return &c
+	}
+	otherSig := testSigner(t, "2025", 2, "").Sign(payload)
+
+	tests := []struct {
+		name string
+		sm   *SignedManifest
+	}{
+		{name: "version", sm: tamper(func(c *SignedManifest) {
+			c.Payload = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(payload), "1.4.0", "1.5.0", 1)))
+		})},
+		{name: "size", sm: tamper(func(c *SignedManifest) {
+			c.Payload = base64.StdEncoding.EncodeToString([]byte(strings.Replace(string(payload), `"size":1024`, `"size":2048`, 1)))
+		})},
+		{name: "signature from another key", sm: tamper(func(c *SignedManifest) { c.Signature = otherSig.Value })},
+		{name: "unknown key ID", sm: tamper(func(c *SignedManifest) { c.KeyID = "2030" })},
+	}
+
+	for _, tt := range tests {
+		if _, ok := verifyManifest(t, h, tt.sm); ok {
+			t.Errorf("manifest with tampered %s verifies", tt.name)
+		}
+	}
+}
+
+func TestSignManifestAfterRotation(t *testing.T) {
+	old := &Handler{manifestTTL: time.Hour, signer: testSigner(t, "2024", 1, "")}
+	oldKey := old.signer.PublicKeys()[0]
+	h := &Handler{manifestTTL: time.Hour, signer: testSigner(t, "2025", 2, "2024:"+oldKey.Key)}
+
+	// Manifests signed before the rotation still verify while the old key
+	// is listed, and new ones are signed with the new key
+	before, err := old.signManifest(Manifest{Game: "crisp-games", Version: "1.3.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := verifyManifest(t, h, before); !ok {
+		t.Errorf("manifest signed with the retired key does not verify")
+	}
+
+	after, err := h.signManifest(Manifest{Game: "crisp-games", Version: "1.4.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.KeyID != "2025" {
+		t.Errorf("manifest signed with %s after rotation, want 2025", after.KeyID)
+	}
+	if _, ok := verifyManifest(t, h, after); !ok {
+		t.Errorf("manifest signed with the new key does not verify")
+	}
+}
+
+func TestSignManifestWithoutSigner(t *testing.T) {
+	sm, err := (&Handler{}).signManifest(Manifest{Game: "crisp-games", Version: "1.4.0"})
+	if sm != nil || err != nil {
+		t.Errorf("signManifest() without a signing key = %+v, %v; want nil", sm, err)
+	}
+}
@@ -0,0 +1,244 @@
+package fota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Notifier publishes messages to devices. The engine implements it over
+// MQTT; a nil Notifier disables push notifications.
+type Notifier interface {
+	Publish(topic string, payload []byte, retained bool) error
+}
+
+// ReleaseTopic is the retained topic announcing the release every device of
+// a game, board and channel gets
+func ReleaseTopic(gameCode, board, channel string) string {
+	return fmt.Sprintf("fota/%s/%s/%s", gameCode, board, channel)
+}
+
+// DeviceTopic carries update offers addressed to a single device
+func DeviceTopic(deviceID string) string {
+	return "devices/" + deviceID + "/fota"
+}
+
+// releaseTarget is where a release is offered
+type releaseTarget struct {
+	Game    gameRef
+	Board   string
+	Channel string
+}
+
+func (h *Handler) lookupReleaseTarget(firmwareID int64) (releaseTarget, error) {
+	var t releaseTarget
+	err := h.db.QueryRow(`
+		SELECT g.id, g.code, b.code, f.channel
+		FROM firmwares f
+		JOIN games g ON g.id = f.game_id
+		JOIN boards b ON b.id = f.board_id
+		WHERE f.id = $1
+	`, firmwareID).Scan(&t.Game.ID, &t.Game.Code, &t.Board, &t.Channel)
+	return t, err
+}
+
+// notifyRelease pushes the current state of a release's channels after it
+// became available or changed. It runs in the background; devices that miss
+// a notification still find the release on their next check.
+func (h *Handler) notifyRelease(firmwareID int64) {
+	if h.notifier == nil {
+		return
+	}
+
+	target, err := h.lookupReleaseTarget(firmwareID)
+	if err != nil {
+		log.Printf("Failed to query firmware %d for notification: %v", firmwareID, err)
+		return
+	}
+	h.notifyTarget(target)
+}
+
+// notifyTarget republishes the channels a release was offered on, also used
+// once the release itself is gone
+func (h *Handler) notifyTarget(target releaseTarget) {
+	if h.notifier == nil {
+		return
+	}
+	game, board, channel := target.Game, target.Board, target.Channel
+
+	// Stable releases are visible on every channel
+	channels := []string{channel}
+	if channel == ChannelStable {
+		channels = []string{ChannelStable, ChannelBeta, ChannelNightly}
+	}
+
+	// Every channel and device resolves from the same lookups, so each
+	// release list and support status is queried once
+	ctx := context.Background()
+	lookups := h.newUpdateLookups()
+	for _, ch := range channels {
+		h.publishChannel(ctx, lookups, game, board, ch)
+	}
+
+	if h.notifyDevices {
+		h.publishDevices(ctx, lookups, game, board)
+	}
+}
+
+// publishChannel retains the response a device without pins, windows or a
+// rollout bucket would get from a check, in the same shape. Rollouts below
+// 100% are therefore not announced here, and a no_update payload replaces a
+// withdrawn announcement. The download URLs expire at download_expires_at,
+// long before a retained message does; after that devices check for fresh
+// ones. Encrypted releases are announced without URLs, since each device
+// downloads the artifact for its own key.
+func (h *Handler) publishChannel(ctx context.Context, lookups *updateLookups, game gameRef, board, channel string) {
+	response, err := h.resolveUpdate(ctx, updateQuery{
+		Game:     game,
+		Hardware: deviceHardware{Board: board},
+		Channel:  channel,
+		Announce: true,
+		Lookups:  lookups,
+	})
+	if err != nil {
+		log.Printf("Failed to resolve %s/%s/%s for notification: %v", game.Code, board, channel, err)
+		return
+	}
+
+	h.publish(ReleaseTopic(game.Code, board, channel), response, true)
+}
+
+// publishDevices offers the update to each known device of the game and
+// board that would get one from a check right now. Windows and pins are
+// fetched for all devices at once and the rest is shared through lookups,
+// leaving per-device queries only for encrypted artifacts.
+func (h *Handler) publishDevices(ctx context.Context, lookups *updateLookups, game gameRef, board string) {
+	rows, err := h.db.Query(`
+		SELECT id, COALESCE(firmware_ver, ''), fota_channel, chip_rev, flash_size_mb, supports_encrypted_ota, ota_encodings
+		FROM devices
+		WHERE game_code = $1 AND COALESCE(board_code, $3) = $2
+	`, game.Code, board, DefaultBoard)
+	if err != nil {
+		log.Printf("Failed to query devices of %s for notification: %v", game.Code, err)
+		return
+	}
+
+	type device struct {
+		ID             string
+		CurrentVersion string
+		Channel        string
+		Hardware       deviceHardware
+	}
+	var devices []device
+	var deviceIDs []string
+	for rows.Next() {
+		d := device{Hardware: deviceHardware{Board: board}}
+		if err := rows.Scan(&d.ID, &d.CurrentVersion, &d.Channel, &d.Hardware.ChipRev, &d.Hardware.FlashSizeMB, &d.Hardware.EncryptedOTA, pq.Array(&d.Hardware.Encodings)); err != nil {
+			log.Printf("Failed to scan device: %v", err)
+			continue
+		}
+		devices = append(devices, d)
+		deviceIDs = append(deviceIDs, d.ID)
+	}
+	rows.Close()
+
+	if len(devices) == 0 {
+		return
+	}
+	if err := lookups.preload(game.ID, deviceIDs); err != nil {
+		log.Printf("Failed to query windows and pins of %s for notification: %v", game.Code, err)
+		return
+	}
+
+	notified := 0
+	for _, d := range devices {
+		response, err := h.resolveUpdate(ctx, updateQuery{
+			Game:           game,
+			DeviceID:       d.ID,
+			CurrentVersion: d.CurrentVersion,
+			Hardware:       d.Hardware,
+			Channel:        d.Channel,
+			Lookups:        lookups,
+		})
+		if err != nil {
+			log.Printf("Failed to resolve update for device %s: %v", d.ID, err)
+			continue
+		}
+		if response.Status != "update_available" {
+			continue
+		}
+		if h.publish(DeviceTopic(d.ID), response, false) {
+			notified++
+		}
+	}
+
+	log.Printf("Notified %d of %d devices of %s/%s", notified, len(devices), game.Code, board)
+}
+
+func (h *Handler) publish(topic string, message any, retained bool) bool {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Failed to encode notification for %s: %v", topic, err)
+		return false
+	}
+	if err := h.notifier.Publish(topic, payload, retained); err != nil {
+		log.Printf("Failed to publish to %s: %v", topic, err)
+		return false
+	}
+	return true
+}
+
+// AnnounceScheduledReleases notifies the channels of releases whose
+// publish_at or unpublish_at passed, checking every interval until ctx is
+// cancelled. Safe to run on every replica: each change is claimed once.
+func (h *Handler) AnnounceScheduledReleases(ctx context.Context, interval time.Duration) {
+	if h.notifier == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.announceScheduledReleases()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handler) announceScheduledReleases() {
+	rows, err := h.db.Query(`
+		UPDATE firmwares
+		SET schedule_announced_at = NOW()
+		WHERE (publish_at <= NOW() AND publish_at > COALESCE(schedule_announced_at, '-infinity'))
+			OR (unpublish_at <= NOW() AND unpublish_at > COALESCE(schedule_announced_at, '-infinity'))
+		RETURNING id
+	`)
+	if err != nil {
+		log.Printf("Failed to claim scheduled releases: %v", err)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		h.notifyRelease(id)
+	}
+	if len(ids) > 0 {
+		log.Printf("Announced %d scheduled release changes", len(ids))
+	}
+}
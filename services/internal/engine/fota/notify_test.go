@@ -0,0 +1,192 @@
+package fota
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/encimg"
+)
+
+type notification struct {
+	Topic    string
+	Response CheckUpdateResponse
+	Retained bool
+}
+
+// fakeNotifier records what the handler publishes
+type fakeNotifier struct {
+	published []notification
+}
+
+func (n *fakeNotifier) Publish(topic string, payload []byte, retained bool) error {
+	var response CheckUpdateResponse
+	if err := json.Unmarshal(payload, &response); err != nil {
+		return err
+	}
+	n.published = append(n.published, notification{Topic: topic, Response: response, Retained: retained})
+	return nil
+}
+
+func notifyingHandler(t *testing.T) (*Handler, sqlmock.Sqlmock, *fakeNotifier) {
+	t.Helper()
+	h, mock := testHandler(t)
+	notifier := &fakeNotifier{}
+	h.notifier = notifier
+	return h, mock, notifier
+}
+
+func expectChannelReleases(mock sqlmock.Sqlmock, channel string, releases ...firmwareRelease) {
+	mock.ExpectQuery(`channel IN \(\$3, 'stable'\)`).WithArgs(1, DefaultBoard, channel).
+		WillReturnRows(releaseRows(releases...))
+}
+
+func expectNoPartitions(mock sqlmock.Sqlmock, firmwareID int64) {
+	mock.ExpectQuery(`FROM firmware_partitions`).WithArgs(firmwareID).
+		WillReturnRows(sqlmock.NewRows([]string{"label", "part_type", "flash_offset", "blob_name", "file_size", "checksum", "sha256"}))
+}
+
+func TestPublishChannel(t *testing.T) {
+	encrypted := testRelease(2, "1.1.0")
+	encrypted.Encrypt = true
+
+	tests := []struct {
+		name     string
+		releases []firmwareRelease
+		check    func(t *testing.T, response CheckUpdateResponse)
+	}{
+		{
+			name:     "plain release",
+			releases: []firmwareRelease{testRelease(1, "1.0.0"), testRelease(2, "1.1.0")},
+			check: func(t *testing.T, response CheckUpdateResponse) {
+				if response.Status != "update_available" || response.Version != "1.1.0" || response.SHA256 != "sha256-1.1.0" {
+					t.Errorf("announcement = %s %s %s, want update_available 1.1.0 with its sha256", response.Status, response.Version, response.SHA256)
+				}
+				if response.DownloadURL == "" || response.DownloadExpiresAt <= time.Now().Unix() {
+					t.Errorf("announcement URL = %q expiring %d, want a signed URL", response.DownloadURL, response.DownloadExpiresAt)
+				}
+			},
+		},
+		{
+			// Named without a URL, since each device has its own artifact
+			name:     "encrypted release",
+			releases: []firmwareRelease{encrypted},
+			check: func(t *testing.T, response CheckUpdateResponse) {
+				if response.Status != "update_available" || response.Version != "1.1.0" {
+					t.Errorf("announcement = %s %s, want update_available 1.1.0", response.Status, response.Version)
+				}
+				if response.DownloadURL != "" || response.Encryption == nil || response.Encryption.Format != encimg.Format {
+					t.Errorf("announcement URL = %q encryption %+v, want no URL and the %s format", response.DownloadURL, response.Encryption, encimg.Format)
+				}
+			},
+		},
+		{
+			name: "withdrawn release",
+			check: func(t *testing.T, response CheckUpdateResponse) {
+				if response.Status != "no_update" || response.DownloadURL != "" {
+					t.Errorf("announcement = %+v, want no_update", response)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock, notifier := notifyingHandler(t)
+			expectChannelReleases(mock, ChannelBeta, tt.releases...)
+			if len(tt.releases) > 0 && !tt.releases[0].Encrypt {
+				expectNoPartitions(mock, 2)
+			}
+
+			h.publishChannel(context.Background(), h.newUpdateLookups(), testGame, DefaultBoard, ChannelBeta)
+
+			if len(notifier.published) != 1 {
+				t.Fatalf("published %d messages, want 1", len(notifier.published))
+			}
+			n := notifier.published[0]
+			if n.Topic != "fota/crisp-games/m5stickc-plus/beta" || !n.Retained {
+				t.Errorf("published to %s retained=%t, want the retained beta topic", n.Topic, n.Retained)
+			}
+			tt.check(t, n.Response)
+			expectationsMet(t, mock)
+		})
+	}
+}
+
+func TestNotifyTargetStable(t *testing.T) {
+	h, mock, notifier := notifyingHandler(t)
+
+	// Stable releases are visible on every channel; the partitions of the
+	// release are only looked up once
+	expectChannelReleases(mock, ChannelStable, testRelease(2, "1.1.0"))
+	expectNoPartitions(mock, 2)
+	expectChannelReleases(mock, ChannelBeta, testRelease(2, "1.1.0"))
+	expectChannelReleases(mock, ChannelNightly, testRelease(2, "1.1.0"))
+
+	h.notifyTarget(releaseTarget{Game: testGame, Board: DefaultBoard, Channel: ChannelStable})
+
+	var topics []string
+	for _, n := range notifier.published {
+		topics = append(topics, n.Topic)
+		if n.Response.Version != "1.1.0" {
+			t.Errorf("%s announced %q, want 1.1.0", n.Topic, n.Response.Version)
+		}
+	}
+	want := []string{"fota/crisp-games/m5stickc-plus/stable", "fota/crisp-games/m5stickc-plus/beta", "fota/crisp-games/m5stickc-plus/nightly"}
+	if len(topics) != len(want) {
+		t.Fatalf("published to %v, want %v", topics, want)
+	}
+	for i := range want {
+		if topics[i] != want[i] {
+			t.Errorf("published to %v, want %v", topics, want)
+			break
+		}
+	}
+	expectationsMet(t, mock)
+}
+
+func TestPublishDevices(t *testing.T) {
+	h, mock, notifier := notifyingHandler(t)
+
+	mock.ExpectQuery(`FROM devices\s+WHERE game_code = \$1`).WithArgs("crisp-games", DefaultBoard, DefaultBoard).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "firmware_ver", "fota_channel", "chip_rev", "flash_size_mb", "supports_encrypted_ota", "ota_encodings"}).
+			AddRow("stick-1", "1.0.0", ChannelStable, nil, nil, nil, nil).
+			AddRow("stick-2", "1.0.0", ChannelStable, nil, nil, nil, nil).
+			AddRow("stick-3", "1.0.0", ChannelStable, nil, nil, nil, nil).
+			AddRow("stick-4", "1.0.0", ChannelStable, nil, nil, nil, nil))
+
+	// Windows and pins of every device are read at once: stick-2 is
+	// outside its window and stick-3 is pinned to its current version
+	closed := time.Now().UTC().Add(2 * time.Hour)
+	devices := `{"stick-1","stick-2","stick-3","stick-4"}`
+	mock.ExpectQuery(`FROM update_windows[\s\S]*ANY\(\$1\)`).WithArgs(devices).
+		WillReturnRows(sqlmock.NewRows([]string{"device_id", "start_time", "end_time", "time_zone"}).
+			AddRow("stick-2", closed.Format("15:04"), closed.Add(time.Minute).Format("15:04"), "UTC"))
+	mock.ExpectQuery(`DISTINCT ON \(d.id\)`).WithArgs(1, devices).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "version", "device_id", "group"}).
+			AddRow("stick-3", "1.0.0", "stick-3", ""))
+
+	// The rest is looked up once and shared by stick-1 and stick-4
+	expectSupported(mock)
+	expectChannelReleases(mock, ChannelStable, testRelease(1, "1.0.0"), testRelease(2, "1.1.0"))
+	expectOffer(mock, 2)
+	mock.ExpectQuery(`WHERE game_id = \$1 AND version = \$2 AND is_active = TRUE`).WithArgs(1, "1.0.0", DefaultBoard).
+		WillReturnRows(releaseRows(testRelease(1, "1.0.0")))
+
+	h.publishDevices(context.Background(), h.newUpdateLookups(), testGame, DefaultBoard)
+
+	var topics []string
+	for _, n := range notifier.published {
+		topics = append(topics, n.Topic)
+		if n.Retained || n.Response.Version != "1.1.0" || n.Response.DownloadURL == "" {
+			t.Errorf("%s got %s retained=%t, want an unretained offer of 1.1.0", n.Topic, n.Response.Version, n.Retained)
+		}
+	}
+	if len(topics) != 2 || topics[0] != "devices/stick-1/fota" || topics[1] != "devices/stick-4/fota" {
+		t.Errorf("published to %v, want stick-1 and stick-4", topics)
+	}
+	expectationsMet(t, mock)
+}
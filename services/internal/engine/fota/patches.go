@@ -0,0 +1,235 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/delta"
+)
+
+// maxPatchBases is how many earlier versions get a patch to each new release
+const maxPatchBases = 3
+
+// PatchInfo advertises a binary patch from the device's current version
+type PatchInfo struct {
+	FromVersion    string `json:"from_version"`
+	Format         string `json:"format"`
+	DownloadURL    string `json:"download_url"`
+	FileSize       int64  `json:"file_size"`
+	Checksum       string `json:"checksum"`
+	TargetChecksum string `json:"target_checksum"`
+}
+
+// firmwarePatch is a stored patch row
+type firmwarePatch struct {
+	BlobName string
+	FileSize int64
+	Checksum string
+}
+
+// lookupPatch returns the patch from fromVersion to a firmware, or nil
+func (h *Handler) lookupPatch(firmwareID int64, fromVersion string) (*firmwarePatch, error) {
+	var patch firmwarePatch
+	err := h.db.QueryRow(`
+		SELECT blob_name, file_size, checksum
+		FROM firmware_patches
+		WHERE firmware_id = $1 AND from_version = $2
+	`, firmwareID, fromVersion).Scan(&patch.BlobName, &patch.FileSize, &patch.Checksum)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &patch, nil
+}
+
+// invalidatePatches drops every patch to or from a version of a game's
+// build for a board, used when that build is replaced by a re-upload
+func (h *Handler) invalidatePatches(ctx context.Context, gameID, boardID int64, version string) error {
+	rows, err := h.db.Query(`
+		DELETE FROM firmware_patches p
+		USING firmwares f
+		WHERE f.id = p.firmware_id AND f.game_id = $1 AND f.board_id = $2
+			AND (f.version = $3 OR p.from_version = $3)
+		RETURNING p.blob_name
+	`, gameID, boardID, version)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var blobs []string
+	for rows.Next() {
+		var blobName string
+		if err := rows.Scan(&blobName); err != nil {
+			return err
+		}
+		blobs = append(blobs, blobName)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, blobName := range blobs {
+		if err := h.storage.Delete(ctx, blobName); err != nil {
+			log.Printf("Failed to delete stale patch %s: %v", blobName, err)
+		}
+	}
+
+	return nil
+}
+
+// generatePatches builds patches to a new release from the most recent
+// earlier versions of the same game on the same board. It runs in the
+// background after an upload; failures only cost devices the full download.
+func (h *Handler) generatePatches(gameCode string, board boardRef, gameID, firmwareID int64, version, blobName string) {
+	ctx := context.Background()
+
+	target, err := ParseVersion(version)
+	if err != nil {
+		return
+	}
+
+	// Patches from encrypted releases would reveal their plain image
+	rows, err := h.db.Query(`SELECT version, blob_name FROM firmwares WHERE game_id = $1 AND board_id = $2 AND id <> $3 AND NOT encrypt`, gameID, board.ID, firmwareID)
+	if err != nil {
+		log.Printf("Failed to query patch bases for %s %s: %v", gameCode, version, err)
+		return
+	}
+
+	type base struct {
+		Version  string
+		SemVer   Version
+		BlobName string
+	}
+	var bases []base
+	for rows.Next() {
+		var b base
+		if err := rows.Scan(&b.Version, &b.BlobName); err != nil {
+			log.Printf("Failed to scan patch base: %v", err)
+			continue
+		}
+		if b.SemVer, err = ParseVersion(b.Version); err != nil || b.SemVer.Compare(target) >= 0 {
+			continue
+		}
+		bases = append(bases, b)
+	}
+	rows.Close()
+
+	sort.Slice(bases, func(i, j int) bool { return bases[i].SemVer.Compare(bases[j].SemVer) > 0 })
+	if len(bases) > maxPatchBases {
+		bases = bases[:maxPatchBases]
+	}
+	if len(bases) == 0 {
+		return
+	}
+
+	newImage, err := h.readBlob(ctx, blobName)
+	if err != nil {
+		log.Printf("Failed to read %s for patch generation: %v", blobName, err)
+		return
+	}
+
+	for _, b := range bases {
+		if err := h.generatePatch(ctx, gameCode, board, gameID, firmwareID, b.Version, b.BlobName, version, blobName, newImage); err != nil {
+			log.Printf("Failed to generate patch %s %s -> %s: %v", gameCode, b.Version, version, err)
+		}
+	}
+}
+
+func (h *Handler) generatePatch(ctx context.Context, gameCode string, board boardRef, gameID, firmwareID int64, fromVersion, fromBlob, version, blobName string, newImage []byte) error {
+	oldImage, err := h.readBlob(ctx, fromBlob)
+	if err != nil {
+		return err
+	}
+
+	patch, err := delta.Diff(oldImage, newImage)
+	if err != nil {
+		return err
+	}
+
+	// Never advertise a patch that does not reproduce the image exactly
+	if rebuilt, err := delta.Patch(oldImage, patch); err != nil || !bytes.Equal(rebuilt, newImage) {
+		return fmt.Errorf("patch verification failed")
+	}
+
+	if len(patch) >= len(newImage) {
+		log.Printf("Skipping patch %s %s -> %s: no smaller than the full image", gameCode, fromVersion, version)
+		return nil
+	}
+
+	// Named by content so dropping a stale patch never deletes the blob of
+	// one generated for a re-upload
+	patchBlob := fmt.Sprintf("%s/%s/patches/%s_to_%s_%x.patch", gameCode, board.Code, fromVersion, version, sha256.Sum256(patch))
+	if _, err := h.storage.Upload(ctx, patchBlob, bytes.NewReader(patch), "application/octet-stream"); err != nil {
+		return err
+	}
+
+	if err := h.recordPatch(gameID, board.ID, firmwareID, fromVersion, fromBlob, blobName, patchBlob, patch); err != nil {
+		h.storage.Delete(ctx, patchBlob)
+		return err
+	}
+
+	log.Printf("Patch %s %s -> %s stored: %d bytes (full image %d bytes)", gameCode, fromVersion, version, len(patch), len(newImage))
+	return nil
+}
+
+// recordPatch stores a patch row if neither image changed since the patch
+// was made. The rows stay locked until the insert commits, so a re-upload
+// of either waits and then invalidates the patch.
+func (h *Handler) recordPatch(gameID, boardID, firmwareID int64, fromVersion, fromBlob, blobName, patchBlob string, patch []byte) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var currentBlob, currentFromBlob string
+	err = tx.QueryRow(`SELECT blob_name FROM firmwares WHERE id = $1 FOR SHARE`, firmwareID).Scan(&currentBlob)
+	if err == nil {
+		err = tx.QueryRow(`
+			SELECT blob_name FROM firmwares
+			WHERE game_id = $1 AND board_id = $2 AND version = $3 AND NOT encrypt
+			FOR SHARE
+		`, gameID, boardID, fromVersion).Scan(&currentFromBlob)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == sql.ErrNoRows || currentBlob != blobName || currentFromBlob != fromBlob {
+		return fmt.Errorf("release changed during patch generation")
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO firmware_patches (firmware_id, from_version, blob_name, file_size, checksum)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (firmware_id, from_version) DO UPDATE
+		SET blob_name = EXCLUDED.blob_name,
+			file_size = EXCLUDED.file_size,
+			checksum = EXCLUDED.checksum,
+			created_at = NOW()
+	`, firmwareID, fromVersion, patchBlob, len(patch), fmt.Sprintf("%x", md5.Sum(patch)))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (h *Handler) readBlob(ctx context.Context, blobName string) ([]byte, error) {
+	reader, err := h.storage.Download(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(reader)
+}
@@ -0,0 +1,294 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Pin holds a device, or every device of a group, on an exact version
+type Pin struct {
+	Game      string    `json:"game"`
+	Version   string    `json:"version"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// pinMatch is the pin that applies to a device. Release is nil when the
+// pinned version is missing, deactivated, unpublished, recalled or has no
+// build the device can run, in which case the device stays on its current build.
+type pinMatch struct {
+	Version string
+	Source  string
+	Release *firmwareRelease
+}
+
+// devicePin returns the pin for a device, or nil. A pin on the device itself
+// wins over group pins, and among group pins the most recent one wins.
+func (h *Handler) devicePin(gameID int64, deviceID string, hw deviceHardware) (*pinMatch, error) {
+	if deviceID == "" {
+		return nil, nil
+	}
+
+	pin, err := h.lookupPin(gameID, deviceID)
+	if pin == nil || err != nil {
+		return pin, err
+	}
+	rel, err := h.pinnedRelease(gameID, pin.Version, hw.Board)
+	if err != nil {
+		return nil, err
+	}
+	pin.offer(rel, deviceID, hw)
+	return pin, nil
+}
+
+// lookupPin returns the pin that applies to a device, without its release
+func (h *Handler) lookupPin(gameID int64, deviceID string) (*pinMatch, error) {
+	var pin pinMatch
+	var pinnedDevice, groupName string
+	err := h.db.QueryRow(`
+		SELECT p.version, COALESCE(p.device_id, ''), COALESCE(g.name, '')
+		FROM firmware_pins p
+		LEFT JOIN device_groups g ON g.id = p.group_id
+		WHERE p.game_id = $1
+			AND (p.device_id = $2 OR p.group_id IN (SELECT group_id FROM device_group_members WHERE device_id = $2))
+		ORDER BY (p.device_id IS NOT NULL) DESC, p.created_at DESC
+		LIMIT 1
+	`, gameID, deviceID).Scan(&pin.Version, &pinnedDevice, &groupName)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pin.Source = pinSource(pinnedDevice, groupName)
+	return &pin, nil
+}
+
+func pinSource(pinnedDevice, groupName string) string {
+	if pinnedDevice != "" {
+		return "device pin"
+	}
+	return "group " + groupName
+}
+
+// pinnedRelease returns the active, published release a pin names, or nil
+func (h *Handler) pinnedRelease(gameID int64, version, board string) (*firmwareRelease, error) {
+	rel, err := scanRelease(h.db.QueryRow(`
+		SELECT `+releaseColumns+`
+		FROM firmwares
+		WHERE game_id = $1 AND version = $2 AND is_active = TRUE AND NOT is_recalled
+			AND board_id = (SELECT id FROM boards WHERE code = $3) AND `+publishedNow+`
+	`, gameID, version, board))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rel.SemVer, _ = ParseVersion(rel.Version)
+	return &rel, nil
+}
+
+// offer sets the pinned release when the device can run it. A pin without
+// one holds the device on its current build.
+func (pin *pinMatch) offer(rel *firmwareRelease, deviceID string, hw deviceHardware) {
+	if rel == nil {
+		log.Printf("Pinned version %s for device %s is not an active, published release for %s", pin.Version, deviceID, hw.Board)
+		return
+	}
+	if !hw.compatible(*rel) {
+		log.Printf("Pinned version %s is not compatible with device %s", pin.Version, deviceID)
+		return
+	}
+	pin.Release = rel
+}
+
+// Pins lists (GET ?game=), creates or replaces (POST) and removes (DELETE)
+// version pins. Admin only.
+func (h *Handler) Pins(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listPins(w, r)
+	case http.MethodPost:
+		h.savePin(w, r)
+	case http.MethodDelete:
+		h.deletePin(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listPins(w http.ResponseWriter, r *http.Request) {
+	game, err := h.resolveGame(r.URL.Query().Get("game"), "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT p.version, COALESCE(p.device_id, ''), COALESCE(g.name, ''), COALESCE(p.reason, ''), p.created_at
+		FROM firmware_pins p
+		LEFT JOIN device_groups g ON g.id = p.group_id
+		WHERE p.game_id = $1
+		ORDER BY p.created_at DESC
+	`, game.ID)
+	if err != nil {
+		log.Printf("Failed to query pins of %s: %v", game.Code, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	pins := []Pin{}
+	for rows.Next() {
+		p := Pin{Game: game.Code}
+		if err := rows.Scan(&p.Version, &p.DeviceID, &p.Group, &p.Reason, &p.CreatedAt); err != nil {
+			log.Printf("Failed to scan pin: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		pins = append(pins, p)
+	}
+
+	writeJSON(w, http.StatusOK, pins)
+}
+
+func (h *Handler) savePin(w http.ResponseWriter, r *http.Request) {
+	var p Pin
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	if (p.DeviceID == "") == (p.Group == "") {
+		http.Error(w, "Exactly one of device_id and group is required", http.StatusBadRequest)
+		return
+	}
+
+	game, err := h.resolveGame(p.Game, "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	semver, err := ParseVersion(p.Version)
+	if err != nil {
+		http.Error(w, "Version must be a valid semantic version (e.g. 1.2.0)", http.StatusBadRequest)
+		return
+	}
+	p.Version = semver.String()
+
+	var exists bool
+	err = h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM firmwares WHERE game_id = $1 AND version = $2)`, game.ID, p.Version).Scan(&exists)
+	if err != nil {
+		log.Printf("Failed to query firmware %s %s: %v", game.Code, p.Version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+
+	if p.DeviceID != "" {
+		err = h.pinDevice(game.ID, p.DeviceID, p.Version, p.Reason, &p.CreatedAt)
+	} else {
+		var groupID int64
+		groupID, err = h.lookupGroup(p.Group)
+		if err != nil {
+			writeGroupError(w, err)
+			return
+		}
+		err = h.db.QueryRow(`
+			INSERT INTO firmware_pins (game_id, group_id, version, reason)
+			VALUES ($1, $2, $3, NULLIF($4, ''))
+			ON CONFLICT (game_id, group_id) DO UPDATE
+			SET version = EXCLUDED.version,
+				reason = EXCLUDED.reason,
+				created_at = NOW()
+			RETURNING created_at
+		`, game.ID, groupID, p.Version, p.Reason).Scan(&p.CreatedAt)
+	}
+	if err != nil {
+		log.Printf("Failed to save pin for %s %s: %v", game.Code, p.Version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Pinned %s%s to %s %s", p.DeviceID, p.Group, game.Code, p.Version)
+
+	p.Game = game.Code
+	writeJSON(w, http.StatusOK, p)
+}
+
+// pinDevice creates the device if it has never checked in yet
+func (h *Handler) pinDevice(gameID int64, deviceID, version, reason string, createdAt *time.Time) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO devices (id) VALUES ($1) ON CONFLICT (id) DO NOTHING`, deviceID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO firmware_pins (game_id, device_id, version, reason)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (game_id, device_id) DO UPDATE
+		SET version = EXCLUDED.version,
+			reason = EXCLUDED.reason,
+			created_at = NOW()
+		RETURNING created_at
+	`, gameID, deviceID, version, reason).Scan(createdAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (h *Handler) deletePin(w http.ResponseWriter, r *http.Request) {
+	game, err := h.resolveGame(r.URL.Query().Get("game"), "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	deviceID := r.URL.Query().Get("device_id")
+	group := r.URL.Query().Get("group")
+	if (deviceID == "") == (group == "") {
+		http.Error(w, "Exactly one of device_id and group is required", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.db.Exec(`
+		DELETE FROM firmware_pins p
+		WHERE p.game_id = $1
+			AND (p.device_id = $2 OR p.group_id = (SELECT id FROM device_groups WHERE name = $3))
+	`, game.ID, deviceID, group)
+	if err != nil {
+		log.Printf("Failed to delete pin: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Pin not found", http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Unpinned %s%s from %s", deviceID, group, game.Code)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+}
@@ -0,0 +1,201 @@
+package fota
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestResolveUpdatePinDowngrades(t *testing.T) {
+	h, mock := testHandler(t)
+	pinned := testRelease(3, "1.0.0")
+
+	// The pin is served before any channel, promotion or rollout logic,
+	// even though the device runs a newer build
+	expectSupported(mock)
+	expectNoWindows(mock, "stick-1")
+	expectPin(mock, "stick-1", "1.0.0", "", &pinned)
+	expectOffer(mock, 3)
+
+	response, err := h.resolveUpdate(context.Background(), updateQuery{
+		Game:           testGame,
+		DeviceID:       "stick-1",
+		CurrentVersion: "1.2.0",
+		Hardware:       deviceHardware{Board: DefaultBoard},
+		Channel:        ChannelStable,
+	})
+	if err != nil {
+		t.Fatalf("resolveUpdate: %v", err)
+	}
+	if response.Status != "update_available" || response.Version != "1.0.0" || !response.Pinned {
+		t.Errorf("resolveUpdate() = %s %s pinned=%t, want a pinned update to 1.0.0", response.Status, response.Version, response.Pinned)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestResolveUpdatePinHoldsDevice(t *testing.T) {
+	tests := []struct {
+		name    string
+		current string
+		group   string
+		release *firmwareRelease
+	}{
+		// A group pin on the running version keeps the device there while
+		// newer releases exist
+		{name: "on the pinned version", current: "1.0.0", group: "demo-units", release: &firmwareRelease{ID: 3, Version: "1.0.0", Channel: ChannelStable}},
+		// A pinned version that is gone does not fall back to the newest
+		// release
+		{name: "pinned version unavailable", current: "1.1.0", release: nil},
+		{name: "pinned build incompatible", current: "1.1.0", release: &firmwareRelease{ID: 3, Version: "1.0.0", Channel: ChannelStable, FlashSizeMB: intPtr(16)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := testHandler(t)
+			expectSupported(mock)
+			expectNoWindows(mock, "stick-1")
+			expectPin(mock, "stick-1", "1.0.0", tt.group, tt.release)
+
+			response, err := h.resolveUpdate(context.Background(), updateQuery{
+				Game:           testGame,
+				DeviceID:       "stick-1",
+				CurrentVersion: tt.current,
+				Hardware:       deviceHardware{Board: DefaultBoard, FlashSizeMB: intPtr(4)},
+				Channel:        ChannelStable,
+			})
+			if err != nil {
+				t.Fatalf("resolveUpdate: %v", err)
+			}
+			if response.Status != "no_update" {
+				t.Errorf("resolveUpdate() = %s %s, want no_update", response.Status, response.Version)
+			}
+			expectationsMet(t, mock)
+		})
+	}
+}
+
+func TestDevicePinSource(t *testing.T) {
+	h, mock := testHandler(t)
+	rel := testRelease(3, "1.0.0")
+
+	expectPin(mock, "stick-1", "1.0.0", "", &rel)
+	expectPin(mock, "stick-1", "1.0.0", "demo-units", &rel)
+	for _, want := range []string{"device pin", "group demo-units"} {
+		pin, err := h.devicePin(1, "stick-1", deviceHardware{Board: DefaultBoard})
+		if err != nil || pin == nil || pin.Source != want || pin.Release == nil || pin.Release.SemVer.String() != "1.0.0" {
+			t.Errorf("devicePin() = %+v, %v; want a %s on 1.0.0", pin, err, want)
+		}
+	}
+
+	// Anonymous checks are never pinned
+	if pin, err := h.devicePin(1, "", deviceHardware{Board: DefaultBoard}); pin != nil || err != nil {
+		t.Errorf("devicePin() without device = %+v, %v", pin, err)
+	}
+
+	expectNoPin(mock, "stick-2")
+	if pin, err := h.devicePin(1, "stick-2", deviceHardware{Board: DefaultBoard}); pin != nil || err != nil {
+		t.Errorf("devicePin() of an unpinned device = %+v, %v", pin, err)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestPinsAndGroupsRequireAdmin(t *testing.T) {
+	h, mock := testHandler(t)
+
+	for _, tt := range []struct {
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		{h.Pins, http.MethodGet, "/api/fota/pins?game=crisp-games"},
+		{h.Pins, http.MethodPost, "/api/fota/pins"},
+		{h.Pins, http.MethodDelete, "/api/fota/pins?game=crisp-games&device_id=stick-1"},
+		{h.Groups, http.MethodPost, "/api/fota/groups"},
+		{h.Groups, http.MethodDelete, "/api/fota/groups?name=demo-units"},
+		{h.GroupMembers, http.MethodPost, "/api/fota/groups/members"},
+	} {
+		r := adminRequest(tt.method, tt.target, `{}`)
+		r.Header.Set("X-API-Token", "wrong-token")
+		if w := serve(tt.handler, r); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a valid token = %d, want %d", tt.method, tt.target, w.Code, http.StatusUnauthorized)
+		}
+	}
+	expectationsMet(t, mock)
+}
+
+func TestSavePinValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		expect func(sqlmock.Sqlmock)
+		want   int
+	}{
+		{name: "device and group", body: `{"game": "crisp-games", "version": "1.0.0", "device_id": "stick-1", "group": "demo-units"}`, want: http.StatusBadRequest},
+		{name: "neither device nor group", body: `{"game": "crisp-games", "version": "1.0.0"}`, want: http.StatusBadRequest},
+		{name: "invalid version", body: `{"game": "crisp-games", "version": "latest", "device_id": "stick-1"}`, want: http.StatusBadRequest,
+			expect: expectTestGame},
+		{name: "unknown release", body: `{"game": "crisp-games", "version": "2.0.0", "device_id": "stick-1"}`, want: http.StatusNotFound,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectTestGame(mock)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM firmwares`).WithArgs(1, "2.0.0").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+			}},
+		{name: "unknown group", body: `{"game": "crisp-games", "version": "1.0.0", "group": "nobody"}`, want: http.StatusNotFound,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectTestGame(mock)
+				mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM firmwares`).WithArgs(1, "1.0.0").
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+				mock.ExpectQuery(`SELECT id FROM device_groups`).WithArgs("nobody").WillReturnError(sql.ErrNoRows)
+			}},
+	}
+
+	for _, tt := range tests {
+		h, mock := testHandler(t)
+		if tt.expect != nil {
+			tt.expect(mock)
+		}
+		if w := serve(h.Pins, adminRequest(http.MethodPost, "/api/fota/pins", tt.body)); w.Code != tt.want {
+			t.Errorf("pin with %s = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		expectationsMet(t, mock)
+	}
+}
+
+func TestSavePinOnDevice(t *testing.T) {
+	h, mock := testHandler(t)
+	expectTestGame(mock)
+	mock.ExpectQuery(`SELECT EXISTS \(SELECT 1 FROM firmwares`).WithArgs(1, "0.9.0").
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	// Devices that never checked in are created so the pin applies on their
+	// first check
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO devices \(id\) VALUES \(\$1\) ON CONFLICT \(id\) DO NOTHING`).WithArgs("stick-9").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO firmware_pins \(game_id, device_id, version, reason\)`).WithArgs(1, "stick-9", "0.9.0", "support ticket").
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectCommit()
+
+	w := serve(h.Pins, adminRequest(http.MethodPost, "/api/fota/pins",
+		`{"game": "crisp-games", "version": "v0.9.0", "device_id": "stick-9", "reason": "support ticket"}`))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"version":"0.9.0"`) {
+		t.Errorf("pin = %d: %s", w.Code, w.Body)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestSaveGroupValidation(t *testing.T) {
+	h, mock := testHandler(t)
+	for _, name := range []string{"", "Demo Units", "demo/units", strings.Repeat("g", 51)} {
+		body := `{"name": "` + name + `"}`
+		if w := serve(h.Groups, adminRequest(http.MethodPost, "/api/fota/groups", body)); w.Code != http.StatusBadRequest {
+			t.Errorf("group named %q = %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+	expectationsMet(t, mock)
+}
@@ -0,0 +1,76 @@
+package fota
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errRangeNotSatisfiable = errors.New("range not satisfiable")
+	errRangeUnsupported    = errors.New("unsupported range")
+)
+
+// byteRange is a single resolved byte range of a file
+type byteRange struct {
+	Start  int64
+	Length int64
+}
+
+// parseRange resolves a Range header against a file size. Only a single
+// byte range is supported; multi-range and malformed headers return
+// errRangeUnsupported so the caller can fall back to a full response.
+func parseRange(header string, size int64) (byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return byteRange{}, errRangeUnsupported
+	}
+
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return byteRange{}, errRangeUnsupported
+	}
+
+	// Suffix range: "bytes=-500" is the last 500 bytes
+	if first == "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return byteRange{}, errRangeUnsupported
+		}
+		if n == 0 || size == 0 {
+			return byteRange{}, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return byteRange{Start: size - n, Length: n}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, errRangeUnsupported
+	}
+	if start >= size {
+		return byteRange{}, errRangeNotSatisfiable
+	}
+
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return byteRange{}, errRangeUnsupported
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+
+	return byteRange{Start: start, Length: end - start + 1}, nil
+}
+
+// ifRangeMatches reports whether a Range request should be honoured given
+// its If-Range precondition. Only strong ETag matches are accepted; dates and
+// weak validators fall back to sending the whole file.
+func ifRangeMatches(ifRange, etag string) bool {
+	return ifRange == "" || ifRange == etag
+}
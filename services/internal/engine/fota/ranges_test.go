@@ -0,0 +1,73 @@
+package fota
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		want   byteRange
+		err    error
+	}{
+		{header: "bytes=0-99", size: 1000, want: byteRange{Start: 0, Length: 100}},
+		{header: "bytes=100-199", size: 1000, want: byteRange{Start: 100, Length: 100}},
+		{header: "bytes=500-", size: 1000, want: byteRange{Start: 500, Length: 500}},
+		{header: "bytes=999-999", size: 1000, want: byteRange{Start: 999, Length: 1}},
+		{header: "bytes= 0-9 ", size: 1000, want: byteRange{Start: 0, Length: 10}},
+
+		// The end is clamped to the file
+		{header: "bytes=900-5000", size: 1000, want: byteRange{Start: 900, Length: 100}},
+
+		// Suffix ranges
+		{header: "bytes=-100", size: 1000, want: byteRange{Start: 900, Length: 100}},
+		{header: "bytes=-5000", size: 1000, want: byteRange{Start: 0, Length: 1000}},
+		{header: "bytes=-0", size: 1000, err: errRangeNotSatisfiable},
+		{header: "bytes=-10", size: 0, err: errRangeNotSatisfiable},
+
+		// Starting past the end
+		{header: "bytes=1000-", size: 1000, err: errRangeNotSatisfiable},
+		{header: "bytes=0-", size: 0, err: errRangeNotSatisfiable},
+
+		// Everything else falls back to a full response
+		{header: "", size: 1000, err: errRangeUnsupported},
+		{header: "items=0-99", size: 1000, err: errRangeUnsupported},
+		{header: "bytes=0-99,200-299", size: 1000, err: errRangeUnsupported},
+		{header: "bytes=100", size: 1000, err: errRangeUnsupported},
+		{header: "bytes=200-100", size: 1000, err: errRangeUnsupported},
+		{header: "bytes=a-b", size: 1000, err: errRangeUnsupported},
+		{header: "bytes=-1-5", size: 1000, err: errRangeUnsupported},
+		{header: "bytes=--5", size: 1000, err: errRangeUnsupported},
+	}
+
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, tt.size)
+		if err != tt.err {
+			t.Errorf("parseRange(%q, %d) error = %v, want %v", tt.header, tt.size, err, tt.err)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseRange(%q, %d) = %+v, want %+v", tt.header, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	const etag = `"d41d8cd98f00b204e9800998ecf8427e"`
+
+	tests := []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{etag, true},
+		{`"0123456789abcdef0123456789abcdef"`, false},
+		{"W/" + etag, false},
+		{"Sat, 14 Jun 2025 10:00:00 GMT", false},
+	}
+
+	for _, tt := range tests {
+		if got := ifRangeMatches(tt.ifRange, etag); got != tt.want {
+			t.Errorf("ifRangeMatches(%q) = %v, want %v", tt.ifRange, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package fota
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Release is a firmware row as listed by the release management API
+type Release struct {
+	Game           string     `json:"game"`
+	Board          string     `json:"board"`
+	Version        string     `json:"version"`
+	Channel        string     `json:"channel"`
+	Description    string     `json:"description"`
+	IsActive       bool       `json:"is_active"`
+	IsPromoted     bool       `json:"is_promoted"`
+	IsRecalled     bool       `json:"is_recalled"`
+	RecallReason   *string    `json:"recall_reason"`
+	RolloutPercent int        `json:"rollout_percent"`
+	RolloutPaused  bool       `json:"rollout_paused"`
+	PublishAt      *time.Time `json:"publish_at"`
+	UnpublishAt    *time.Time `json:"unpublish_at"`
+	FileSize       int64      `json:"file_size"`
+	Checksum       string     `json:"checksum"`
+	SHA256         *string    `json:"sha256"`
+	SigningKeyID   *string    `json:"signing_key_id"`
+	BlobName       string     `json:"blob_name"`
+	ChipID         *int       `json:"chip_id"`
+	FlashSizeMB    *int       `json:"flash_size_mb"`
+	AppVersion     *string    `json:"app_version"`
+	IDFVersion     *string    `json:"idf_version"`
+	AppBuildDate   *string    `json:"app_build_date"`
+	Patches        int        `json:"patches"`
+	Encrypt        bool       `json:"encrypt"`
+	// EncryptedFor lists the keys the release has been encrypted for
+	EncryptedFor []string `json:"encrypted_for"`
+	// Partitions lists the labels of a bundle's images besides the app
+	Partitions []string `json:"partitions"`
+	// CompressedAs lists the encodings the image is also stored in
+	CompressedAs []string  `json:"compressed_as"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// applyPromotions narrows each channel's releases to its promoted release,
+// if it has one, so an operator can pin "latest" below the newest upload.
+// The releases passed in are all built for the same board.
+func applyPromotions(releases []firmwareRelease) []firmwareRelease {
+	promoted := make(map[string]bool)
+	for _, rel := range releases {
+		if rel.IsPromoted {
+			promoted[rel.Channel] = true
+		}
+	}
+
+	var visible []firmwareRelease
+	for _, rel := range releases {
+		if promoted[rel.Channel] && !rel.IsPromoted {
+			continue
+		}
+		visible = append(visible, rel)
+	}
+	return visible
+}
+
+// Releases lists the releases of a game (GET) or deletes a release together
+// with its blob and patches (DELETE). Admin only.
+func (h *Handler) Releases(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listReleases(w, r)
+	case http.MethodDelete:
+		h.deleteRelease(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listReleases(w http.ResponseWriter, r *http.Request) {
+	game, err := h.resolveGame(r.URL.Query().Get("game"), "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	channel := r.URL.Query().Get("channel")
+	if channel != "" && !validChannel(channel) {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+	board := r.URL.Query().Get("board")
+
+	rows, err := h.db.Query(`
+		SELECT b.code, f.version, f.channel, COALESCE(f.description, ''), COALESCE(f.is_active, FALSE), f.is_promoted,
+			f.is_recalled, f.recall_reason, f.rollout_percent, f.rollout_paused, f.publish_at, f.unpublish_at, f.file_size, f.checksum, f.sha256, f.signing_key_id, f.blob_name,
+			f.chip_id, f.flash_size_mb, f.app_version, f.idf_version, f.app_build_date,
+			(SELECT COUNT(*) FROM firmware_patches p WHERE p.firmware_id = f.id), f.encrypt,
+			ARRAY(SELECT k.key_id FROM firmware_encrypted e JOIN encryption_keys k ON k.id = e.encryption_key_id
+				WHERE e.firmware_id = f.id ORDER BY k.key_id),
+			ARRAY(SELECT p.label FROM firmware_partitions p WHERE p.firmware_id = f.id ORDER BY p.flash_offset NULLS LAST, p.label),
+			ARRAY(SELECT c.encoding FROM firmware_compressed c WHERE c.firmware_id = f.id ORDER BY c.encoding), f.created_at
+		FROM firmwares f
+		JOIN boards b ON b.id = f.board_id
+		WHERE f.game_id = $1 AND ($2 = '' OR f.channel = $2) AND ($3 = '' OR b.code = $3)
+		ORDER BY f.created_at DESC
+	`, game.ID, channel, board)
+	if err != nil {
+		log.Printf("Failed to query releases of %s: %v", game.Code, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	releases := []Release{}
+	for rows.Next() {
+		rel := Release{Game: game.Code}
+		err := rows.Scan(&rel.Board, &rel.Version, &rel.Channel, &rel.Description, &rel.IsActive, &rel.IsPromoted,
+			&rel.IsRecalled, &rel.RecallReason, &rel.RolloutPercent, &rel.RolloutPaused, &rel.PublishAt, &rel.UnpublishAt, &rel.FileSize, &rel.Checksum, &rel.SHA256, &rel.SigningKeyID, &rel.BlobName,
+			&rel.ChipID, &rel.FlashSizeMB, &rel.AppVersion, &rel.IDFVersion, &rel.AppBuildDate,
+			&rel.Patches, &rel.Encrypt, pq.Array(&rel.EncryptedFor), pq.Array(&rel.Partitions), pq.Array(&rel.CompressedAs), &rel.CreatedAt)
+		if err != nil {
+			log.Printf("Failed to scan release: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		releases = append(releases, rel)
+	}
+
+	writeJSON(w, http.StatusOK, releases)
+}
+
+// DeactivateRelease stops offering a release to devices. A promoted release
+// loses its promotion so its channel falls back to the newest release.
+func (h *Handler) DeactivateRelease(w http.ResponseWriter, r *http.Request) {
+	h.updateRelease(w, r, `UPDATE firmwares SET is_active = FALSE, is_promoted = FALSE WHERE id = $1`)
+}
+
+// ReactivateRelease offers a deactivated release to devices again
+func (h *Handler) ReactivateRelease(w http.ResponseWriter, r *http.Request) {
+	h.updateRelease(w, r, `UPDATE firmwares SET is_active = TRUE WHERE id = $1`)
+}
+
+// PromoteRelease makes a release the latest of its channel on its board even
+// when newer releases exist, replacing any previously promoted release
+func (h *Handler) PromoteRelease(w http.ResponseWriter, r *http.Request) {
+	h.updateRelease(w, r, `
+		UPDATE firmwares SET is_promoted = FALSE
+		WHERE is_promoted AND id <> $1
+			AND (game_id, board_id, channel) = (SELECT game_id, board_id, channel FROM firmwares WHERE id = $1)
+	`, `UPDATE firmwares SET is_promoted = TRUE, is_active = TRUE WHERE id = $1`)
+}
+
+// UnpromoteRelease returns the release's channel to serving its newest release
+func (h *Handler) UnpromoteRelease(w http.ResponseWriter, r *http.Request) {
+	h.updateRelease(w, r, `UPDATE firmwares SET is_promoted = FALSE WHERE id = $1`)
+}
+
+type scheduleRequest struct {
+	releaseRequest
+	PublishAt   string `json:"publish_at"`
+	UnpublishAt string `json:"unpublish_at"`
+}
+
+// parseSchedule parses optional RFC 3339 publication bounds
+func parseSchedule(publishAt, unpublishAt string) (*time.Time, *time.Time, error) {
+	var bounds [2]*time.Time
+	for i, s := range []string{publishAt, unpublishAt} {
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("publish_at and unpublish_at must be RFC 3339 timestamps (e.g. 2025-06-14T10:00:00Z)")
+		}
+		bounds[i] = &t
+	}
+
+	if bounds[0] != nil && bounds[1] != nil && !bounds[1].After(*bounds[0]) {
+		return nil, nil, fmt.Errorf("unpublish_at must be after publish_at")
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// ScheduleRelease sets when a release goes live and when it stops being
+// offered. Omitted bounds are cleared. Admin only.
+func (h *Handler) ScheduleRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req scheduleRequest
+	firmwareID, ok := h.decodeReleaseRequest(w, r, &req, &req.releaseRequest)
+	if !ok {
+		return
+	}
+
+	publishAt, unpublishAt, err := parseSchedule(req.PublishAt, req.UnpublishAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = h.db.Exec(`UPDATE firmwares SET publish_at = $2, unpublish_at = $3 WHERE id = $1`, firmwareID, publishAt, unpublishAt)
+	if err != nil {
+		log.Printf("Failed to schedule release %s %s: %v", req.Game, req.Version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Release %s %s scheduled: publish_at=%v unpublish_at=%v", req.Game, req.Version, publishAt, unpublishAt)
+
+	go h.notifyRelease(firmwareID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"game":         req.Game,
+		"version":      req.Version,
+		"publish_at":   publishAt,
+		"unpublish_at": unpublishAt,
+	})
+}
+
+// updateRelease runs queries in one transaction against the release named in
+// the request body and responds with the updated release. Admin only.
+func (h *Handler) updateRelease(w http.ResponseWriter, r *http.Request, queries ...string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req releaseRequest
+	firmwareID, ok := h.decodeReleaseRequest(w, r, &req, &req)
+	if !ok {
+		return
+	}
+
+	if err := h.execRelease(firmwareID, queries); err != nil {
+		log.Printf("Failed to update release %s %s: %v", req.Game, req.Version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var rel Release
+	err := h.db.QueryRow(`
+		SELECT g.code, b.code, f.version, f.channel, COALESCE(f.is_active, FALSE), f.is_promoted, f.is_recalled
+		FROM firmwares f
+		JOIN games g ON g.id = f.game_id
+		JOIN boards b ON b.id = f.board_id
+		WHERE f.id = $1
+	`, firmwareID).Scan(&rel.Game, &rel.Board, &rel.Version, &rel.Channel, &rel.IsActive, &rel.IsPromoted, &rel.IsRecalled)
+	if err != nil {
+		log.Printf("Failed to query release %d: %v", firmwareID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Release %s %s for %s (%s): active=%t promoted=%t", rel.Game, rel.Version, rel.Board, rel.Channel, rel.IsActive, rel.IsPromoted)
+
+	go h.notifyRelease(firmwareID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"game":        rel.Game,
+		"board":       rel.Board,
+		"version":     rel.Version,
+		"channel":     rel.Channel,
+		"is_active":   rel.IsActive,
+		"is_promoted": rel.IsPromoted,
+		"is_recalled": rel.IsRecalled,
+	})
+}
+
+func (h *Handler) execRelease(firmwareID int64, queries []string) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query, firmwareID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (h *Handler) deleteRelease(w http.ResponseWriter, r *http.Request) {
+	game, err := h.resolveGame(r.URL.Query().Get("game"), "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	version := r.URL.Query().Get("version")
+	if version == "" {
+		http.Error(w, "Version is required", http.StatusBadRequest)
+		return
+	}
+	if v, err := ParseVersion(version); err == nil {
+		version = v.String()
+	}
+	board := r.URL.Query().Get("board")
+
+	firmwareID, err := h.findRelease(game.Code, version, board)
+	if err != nil {
+		writeReleaseError(w, err)
+		return
+	}
+
+	target, err := h.lookupReleaseTarget(firmwareID)
+	if err != nil {
+		log.Printf("Failed to query release %s %s: %v", game.Code, version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	blobs, err := h.deleteReleaseRows(firmwareID)
+	if err != nil {
+		log.Printf("Failed to delete release %s %s: %v", game.Code, version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// Shared blobs stay, and one that fails to delete is left as an orphan
+	ctx := context.Background()
+	deleted := []string{}
+	seen := make(map[string]bool)
+	for _, blobName := range blobs {
+		if seen[blobName] {
+			continue
+		}
+		seen[blobName] = true
+
+		ok, err := h.releaseBlob(ctx, blobName)
+		if err != nil {
+			log.Printf("Failed to delete blob %s: %v", blobName, err)
+		}
+		if ok {
+			deleted = append(deleted, blobName)
+		}
+	}
+
+	log.Printf("Deleted release %s %s (%d blobs)", game.Code, version, len(deleted))
+
+	go h.notifyTarget(target)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":        "deleted",
+		"game":          game.Code,
+		"version":       version,
+		"deleted_blobs": deleted,
+	})
+}
+
+// deleteReleaseRows deletes a release, every patch to or from it, its
+// encrypted artifacts, escrow copy, compressed copies and partitions, and
+// returns the blobs they referenced
+func (h *Handler) deleteReleaseRows(firmwareID int64) ([]string, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		DELETE FROM firmware_patches p
+		USING firmwares f, firmwares target
+		WHERE target.id = $1 AND f.id = p.firmware_id
+			AND f.game_id = target.game_id AND f.board_id = target.board_id
+			AND (f.id = target.id OR p.from_version = target.version)
+		RETURNING p.blob_name
+	`, firmwareID)
+	if err != nil {
+		return nil, err
+	}
+
+	var blobs []string
+	for rows.Next() {
+		var patchBlob string
+		if err := rows.Scan(&patchBlob); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		blobs = append(blobs, patchBlob)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM firmware_encrypted WHERE firmware_id = $1 RETURNING blob_name`,
+		`DELETE FROM firmware_partitions WHERE firmware_id = $1 RETURNING blob_name`,
+		`DELETE FROM firmware_compressed WHERE firmware_id = $1 RETURNING blob_name`,
+	} {
+		rows, err = tx.Query(query, firmwareID)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var blob string
+			if err := rows.Scan(&blob); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			blobs = append(blobs, blob)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	var blobName, escrowBlob string
+	err = tx.QueryRow(`
+		DELETE FROM firmwares WHERE id = $1 RETURNING blob_name, COALESCE(escrow_blob_name, '')
+	`, firmwareID).Scan(&blobName, &escrowBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs = append([]string{blobName}, blobs...)
+	if escrowBlob != "" {
+		blobs = append(blobs, escrowBlob)
+	}
+	return blobs, tx.Commit()
+}
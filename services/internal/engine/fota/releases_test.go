@@ -0,0 +1,226 @@
+package fota
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestApplyPromotions(t *testing.T) {
+	releases := []firmwareRelease{
+		{Version: "1.0.0", Channel: ChannelStable, IsPromoted: true},
+		{Version: "1.1.0", Channel: ChannelStable},
+		{Version: "1.2.0-beta.1", Channel: ChannelBeta},
+		{Version: "1.2.0-beta.2", Channel: ChannelBeta},
+	}
+
+	// Promotion narrows stable to its promoted release and leaves beta alone
+	var got []string
+	for _, rel := range applyPromotions(releases) {
+		got = append(got, rel.Version)
+	}
+	if want := "1.0.0,1.2.0-beta.1,1.2.0-beta.2"; strings.Join(got, ",") != want {
+		t.Errorf("applyPromotions() = %v, want %s", got, want)
+	}
+}
+
+func TestReleaseAdminRequiresAuth(t *testing.T) {
+	h, mock := testHandler(t)
+	body := `{"game": "crisp-games", "version": "1.0.0"}`
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+	}{
+		{"list", h.Releases, http.MethodGet, "/api/fota/releases?game=crisp-games"},
+		{"delete", h.Releases, http.MethodDelete, "/api/fota/releases?game=crisp-games&version=1.0.0"},
+		{"deactivate", h.DeactivateRelease, http.MethodPost, "/api/fota/releases/deactivate"},
+		{"reactivate", h.ReactivateRelease, http.MethodPost, "/api/fota/releases/reactivate"},
+		{"promote", h.PromoteRelease, http.MethodPost, "/api/fota/releases/promote"},
+		{"unpromote", h.UnpromoteRelease, http.MethodPost, "/api/fota/releases/unpromote"},
+	}
+
+	for _, tt := range tests {
+		r := adminRequest(tt.method, tt.target, body)
+		r.Header.Del("X-API-Token")
+		if w := serve(tt.handler, r); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a token = %d, want %d", tt.name, w.Code, http.StatusUnauthorized)
+		}
+	}
+	expectationsMet(t, mock)
+}
+
+func expectUpdatedRelease(mock sqlmock.Sqlmock, id int64, active, promoted bool) {
+	mock.ExpectQuery(`SELECT g.code, b.code, f.version`).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"game", "board", "version", "channel", "is_active", "is_promoted", "is_recalled"}).
+			AddRow("crisp-games", DefaultBoard, "1.0.0", ChannelStable, active, promoted, false))
+}
+
+func TestPromoteRelease(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// The previous promotion of the channel is cleared in the same
+	// transaction, and promoting reactivates the release
+	expectFindRelease(mock, "1.0.0", "", 5)
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE firmwares SET is_promoted = FALSE\s+WHERE is_promoted AND id <> \$1`).WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE firmwares SET is_promoted = TRUE, is_active = TRUE WHERE id = \$1`).WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUpdatedRelease(mock, 5, true, true)
+
+	w := serve(h.PromoteRelease, adminRequest(http.MethodPost, "/api/fota/releases/promote", `{"game": "crisp-games", "version": "v1.0.0"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("promote = %d: %s", w.Code, w.Body)
+	}
+	var got map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["is_promoted"] != true || got["is_active"] != true {
+		t.Errorf("promoted release = %v", got)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestDeactivateRelease(t *testing.T) {
+	h, mock := testHandler(t)
+
+	expectFindRelease(mock, "1.0.0", DefaultBoard, 5)
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE firmwares SET is_active = FALSE, is_promoted = FALSE WHERE id = \$1`).WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUpdatedRelease(mock, 5, false, false)
+
+	w := serve(h.DeactivateRelease, adminRequest(http.MethodPost, "/api/fota/releases/deactivate",
+		`{"game": "crisp-games", "board": "m5stickc-plus", "version": "1.0.0"}`))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"is_active":false`) {
+		t.Errorf("deactivate = %d: %s", w.Code, w.Body)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestUpdateReleaseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		ids    []int64
+		lookup bool
+		want   int
+	}{
+		{name: "invalid JSON", body: `{"game":`, want: http.StatusBadRequest},
+		{name: "no version", body: `{"game": "crisp-games"}`, want: http.StatusBadRequest},
+		{name: "unknown release", body: `{"game": "crisp-games", "version": "1.0.0"}`, lookup: true, want: http.StatusNotFound},
+		{name: "several boards", body: `{"game": "crisp-games", "version": "1.0.0"}`, ids: []int64{5, 6}, lookup: true, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		h, mock := testHandler(t)
+		if tt.lookup {
+			expectFindRelease(mock, "1.0.0", "", tt.ids...)
+		}
+		if w := serve(h.DeactivateRelease, adminRequest(http.MethodPost, "/api/fota/releases/deactivate", tt.body)); w.Code != tt.want {
+			t.Errorf("deactivate with %s = %d, want %d", tt.name, w.Code, tt.want)
+		}
+		expectationsMet(t, mock)
+	}
+
+	h, mock := testHandler(t)
+	if w := serve(h.DeactivateRelease, adminRequest(http.MethodGet, "/api/fota/releases/deactivate", "")); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET deactivate = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestListReleases(t *testing.T) {
+	h, mock := testHandler(t)
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`FROM firmwares f`).WithArgs(1, ChannelBeta, "").
+		WillReturnRows(sqlmock.NewRows([]string{"board", "version", "channel", "description", "is_active", "is_promoted",
+			"is_recalled", "recall_reason", "rollout_percent", "rollout_paused", "publish_at", "unpublish_at", "file_size", "checksum", "sha256", "signing_key_id", "blob_name",
+			"chip_id", "flash_size_mb", "app_version", "idf_version", "app_build_date", "patches", "encrypt", "encrypted_for", "partitions", "compressed_as", "created_at"}).
+			AddRow(DefaultBoard, "1.1.0-beta.1", ChannelBeta, "", true, false,
+				false, nil, 100, false, nil, nil, 1024, "abc", nil, nil, "_sha256/a.bin",
+				0, 4, "1.1.0-beta.1", "v5.1.2", nil, 1, false, "{}", "{bootloader}", "{gzip}", time.Now()))
+
+	w := serve(h.Releases, adminRequest(http.MethodGet, "/api/fota/releases?game=crisp-games&channel=beta", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("list = %d: %s", w.Code, w.Body)
+	}
+	var releases []Release
+	if err := json.NewDecoder(w.Body).Decode(&releases); err != nil {
+		t.Fatal(err)
+	}
+	if len(releases) != 1 || releases[0].Game != "crisp-games" || releases[0].Patches != 1 ||
+		strings.Join(releases[0].Partitions, ",") != "bootloader" || strings.Join(releases[0].CompressedAs, ",") != "gzip" {
+		t.Errorf("releases = %+v", releases)
+	}
+
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	if w := serve(h.Releases, adminRequest(http.MethodGet, "/api/fota/releases?game=crisp-games&channel=alpha", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("list of an unknown channel = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestDeleteRelease(t *testing.T) {
+	h, mock := testHandler(t)
+	const (
+		image  = "_sha256/image.bin"
+		shared = "_sha256/shared.bin"
+		patch  = "_patches/patch.bin"
+		escrow = "_escrow/image.bin"
+	)
+	for _, name := range []string{image, shared, patch, escrow} {
+		putBlob(t, h, name, []byte(name))
+	}
+
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	expectFindRelease(mock, "1.0.0", "", 5)
+	mock.ExpectQuery(`SELECT g.id, g.code, b.code, f.channel`).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "code", "board", "channel"}).AddRow(1, "crisp-games", DefaultBoard, ChannelStable))
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`DELETE FROM firmware_patches`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"blob_name"}).AddRow(patch))
+	mock.ExpectQuery(`DELETE FROM firmware_encrypted`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"blob_name"}))
+	mock.ExpectQuery(`DELETE FROM firmware_partitions`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"blob_name"}).AddRow(shared))
+	mock.ExpectQuery(`DELETE FROM firmware_compressed`).WithArgs(5).WillReturnRows(sqlmock.NewRows([]string{"blob_name"}))
+	mock.ExpectQuery(`DELETE FROM firmwares WHERE id = \$1`).WithArgs(5).
+		WillReturnRows(sqlmock.NewRows([]string{"blob_name", "escrow_blob_name"}).AddRow(image, escrow))
+	mock.ExpectCommit()
+
+	// Another release still uses the shared partition image
+	expectReleaseBlob(mock, image, false)
+	expectReleaseBlob(mock, patch, false)
+	expectReleaseBlob(mock, shared, true)
+	expectReleaseBlob(mock, escrow, false)
+
+	w := serve(h.Releases, adminRequest(http.MethodDelete, "/api/fota/releases?game=crisp-games&version=1.0.0", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete = %d: %s", w.Code, w.Body)
+	}
+	var got struct {
+		DeletedBlobs []string `json:"deleted_blobs"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if want := image + "," + patch + "," + escrow; strings.Join(got.DeletedBlobs, ",") != want {
+		t.Errorf("deleted blobs = %v, want %s", got.DeletedBlobs, want)
+	}
+	if left := listBlobs(t, h, ""); strings.Join(left, ",") != shared {
+		t.Errorf("blobs left = %v, want %s", left, shared)
+	}
+	expectationsMet(t, mock)
+}
@@ -0,0 +1,370 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Update outcomes reported by devices. rolled_back is sent after the
+// ESP-IDF bootloader reverted an installed image that failed to validate.
+const (
+	UpdateDownloading = "downloading"
+	UpdateInstalled   = "installed"
+	UpdateFailed      = "failed"
+	UpdateRolledBack  = "rolled_back"
+)
+
+// ErrInvalidReport is returned for reports devices must fix before resending
+var ErrInvalidReport = errors.New("invalid update report")
+
+// UpdateReport is the payload devices send over HTTP or MQTT
+type UpdateReport struct {
+	DeviceID    string `json:"device_id"`
+	Game        string `json:"game"`
+	Version     string `json:"version"`
+	FromVersion string `json:"from_version"`
+	Status      string `json:"status"`
+	// ErrorCode is the esp_err_t of a failed update
+	ErrorCode    *int   `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+}
+
+// UpdateAttempt is one entry of a device's update history
+type UpdateAttempt struct {
+	ID            int64      `json:"id"`
+	Game          string     `json:"game"`
+	FromVersion   *string    `json:"from_version"`
+	TargetVersion string     `json:"target_version"`
+	Status        string     `json:"status"`
+	ErrorCode     *int       `json:"error_code"`
+	ErrorMessage  *string    `json:"error_message"`
+	StartedAt     time.Time  `json:"started_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+// ReleaseOutcomes aggregates the reported attempts of a release
+type ReleaseOutcomes struct {
+	Board       string   `json:"board"`
+	Version     string   `json:"version"`
+	Channel     string   `json:"channel"`
+	Devices     int      `json:"devices"`
+	Attempts    int      `json:"attempts"`
+	InProgress  int      `json:"in_progress"`
+	Installed   int      `json:"installed"`
+	Failed      int      `json:"failed"`
+	RolledBack  int      `json:"rolled_back"`
+	SuccessRate *float64 `json:"success_rate"`
+	FailureRate *float64 `json:"failure_rate"`
+}
+
+func validUpdateStatus(status string) bool {
+	switch status {
+	case UpdateDownloading, UpdateInstalled, UpdateFailed, UpdateRolledBack:
+		return true
+	}
+	return false
+}
+
+// RecordUpdateReport stores a device's update outcome. A downloading report
+// opens a new attempt unless one is already open; later reports for the same
+// target version complete it, and rolled_back may follow installed once the
+// device reboots.
+// Confirmed installs and rollbacks update the device's firmware version.
+func RecordUpdateReport(db *sql.DB, report UpdateReport) error {
+	if report.DeviceID == "" {
+		return fmt.Errorf("%w: device_id is required", ErrInvalidReport)
+	}
+	if !validDeviceID(report.DeviceID) {
+		return fmt.Errorf("%w: device_id must be at most %d characters", ErrInvalidReport, maxDeviceIDLength)
+	}
+	if report.Version == "" {
+		return fmt.Errorf("%w: version is required", ErrInvalidReport)
+	}
+	if !validUpdateStatus(report.Status) {
+		return fmt.Errorf("%w: status must be one of downloading, installed, failed, rolled_back", ErrInvalidReport)
+	}
+
+	// Match release rows, which store normalized semver
+	target, err := ParseVersion(report.Version)
+	if err != nil {
+		return fmt.Errorf("%w: version must be a semantic version of at most %d characters", ErrInvalidReport, MaxVersionLength)
+	}
+	version := target.String()
+
+	var fromVersion sql.NullString
+	if report.FromVersion != "" {
+		from, err := ParseVersion(report.FromVersion)
+		if err != nil {
+			return fmt.Errorf("%w: from_version must be a semantic version of at most %d characters", ErrInvalidReport, MaxVersionLength)
+		}
+		fromVersion = sql.NullString{String: from.String(), Valid: true}
+	}
+
+	game, err := resolveGame(db, report.Game, report.DeviceID)
+	if errors.Is(err, errGameRequired) || err == sql.ErrNoRows {
+		return fmt.Errorf("%w: unknown game", ErrInvalidReport)
+	}
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		INSERT INTO devices (id, game_code, last_seen)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (id) DO UPDATE SET game_code = EXCLUDED.game_code, last_seen = EXCLUDED.last_seen
+	`, report.DeviceID, game.Code)
+	if err != nil {
+		return fmt.Errorf("failed to upsert device: %w", err)
+	}
+
+	// Prefer the build for the board the device last reported
+	var firmwareID sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT f.id
+		FROM firmwares f
+		JOIN boards b ON b.id = f.board_id
+		WHERE f.game_id = $1 AND f.version = $2
+		ORDER BY b.code = COALESCE((SELECT board_code FROM devices WHERE id = $3), $4) DESC, f.id
+		LIMIT 1
+	`, game.ID, version, report.DeviceID, DefaultBoard).Scan(&firmwareID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	var attemptID int64
+	var latestStatus string
+	err = tx.QueryRow(`
+		SELECT id, status
+		FROM update_attempts
+		WHERE device_id = $1 AND game_id = $2 AND target_version = $3
+		ORDER BY started_at DESC, id DESC
+		LIMIT 1
+		FOR UPDATE
+	`, report.DeviceID, game.ID, version).Scan(&attemptID, &latestStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	continues := err == nil &&
+		(latestStatus == UpdateDownloading ||
+			latestStatus == UpdateInstalled && report.Status == UpdateRolledBack)
+
+	if continues {
+		_, err = tx.Exec(`
+			UPDATE update_attempts
+			SET status = $2,
+				error_code = $3,
+				error_message = NULLIF($4, ''),
+				from_version = COALESCE($5, from_version),
+				firmware_id = COALESCE(firmware_id, $6),
+				updated_at = NOW(),
+				finished_at = CASE WHEN $2 = 'downloading' THEN NULL ELSE NOW() END
+			WHERE id = $1
+		`, attemptID, report.Status, report.ErrorCode, report.ErrorMessage, fromVersion, firmwareID)
+	} else {
+		_, err = tx.Exec(`
+			INSERT INTO update_attempts (device_id, game_id, firmware_id, from_version, target_version, status,
+				error_code, error_message, finished_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), CASE WHEN $6 = 'downloading' THEN NULL ELSE NOW() END)
+		`, report.DeviceID, game.ID, firmwareID, fromVersion, version, report.Status,
+			report.ErrorCode, report.ErrorMessage)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record update attempt: %w", err)
+	}
+
+	switch report.Status {
+	case UpdateInstalled:
+		_, err = tx.Exec(`UPDATE devices SET firmware_ver = $2 WHERE id = $1`, report.DeviceID, version)
+	case UpdateRolledBack:
+		if fromVersion.Valid {
+			_, err = tx.Exec(`UPDATE devices SET firmware_ver = $2 WHERE id = $1`, report.DeviceID, fromVersion.String)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update device firmware version: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if report.ErrorCode != nil {
+		log.Printf("Device %s reported %s for %s %s (error %d: %s)", report.DeviceID, report.Status, game.Code, version,
+			*report.ErrorCode, report.ErrorMessage)
+	} else {
+		log.Printf("Device %s reported %s for %s %s", report.DeviceID, report.Status, game.Code, version)
+	}
+
+	return nil
+}
+
+// ReportUpdate receives an update outcome from a device
+func (h *Handler) ReportUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var report UpdateReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	err := RecordUpdateReport(h.db, report)
+	if errors.Is(err, ErrInvalidReport) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record update report from %s: %v", report.DeviceID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "recorded"})
+}
+
+// DeviceUpdateHistory lists a device's update attempts, newest first. Admin only.
+func (h *Handler) DeviceUpdateHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "Device ID is required", http.StatusBadRequest)
+		return
+	}
+
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	rows, err := h.db.Query(`
+		SELECT a.id, g.code, a.from_version, a.target_version, a.status, a.error_code, a.error_message,
+			a.started_at, a.updated_at, a.finished_at
+		FROM update_attempts a
+		JOIN games g ON g.id = a.game_id
+		WHERE a.device_id = $1
+		ORDER BY a.started_at DESC, a.id DESC
+		LIMIT $2
+	`, deviceID, limit)
+	if err != nil {
+		log.Printf("Failed to query update history of %s: %v", deviceID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attempts := []UpdateAttempt{}
+	for rows.Next() {
+		var a UpdateAttempt
+		err := rows.Scan(&a.ID, &a.Game, &a.FromVersion, &a.TargetVersion, &a.Status, &a.ErrorCode, &a.ErrorMessage,
+			&a.StartedAt, &a.UpdatedAt, &a.FinishedAt)
+		if err != nil {
+			log.Printf("Failed to scan update attempt: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		attempts = append(attempts, a)
+	}
+
+	writeJSON(w, http.StatusOK, attempts)
+}
+
+// UpdateOutcomes reports success and failure rates per release of a game,
+// optionally narrowed to one version or board. Admin only.
+func (h *Handler) UpdateOutcomes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	version := r.URL.Query().Get("version")
+	if version != "" {
+		v, err := ParseVersion(version)
+		if err != nil {
+			http.Error(w, "version must be a valid semantic version (e.g. 1.4.0)", http.StatusBadRequest)
+			return
+		}
+		version = v.String()
+	}
+
+	game, err := h.resolveGame(r.URL.Query().Get("game"), "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT b.code, f.version, f.channel,
+			COUNT(DISTINCT a.device_id),
+			COUNT(a.id),
+			COUNT(a.id) FILTER (WHERE a.status = 'downloading'),
+			COUNT(a.id) FILTER (WHERE a.status = 'installed'),
+			COUNT(a.id) FILTER (WHERE a.status = 'failed'),
+			COUNT(a.id) FILTER (WHERE a.status = 'rolled_back')
+		FROM firmwares f
+		JOIN boards b ON b.id = f.board_id
+		LEFT JOIN update_attempts a ON a.firmware_id = f.id
+		WHERE f.game_id = $1 AND ($2 = '' OR f.version = $2) AND ($3 = '' OR b.code = $3)
+		GROUP BY f.id, b.code
+		ORDER BY f.created_at DESC
+	`, game.ID, version, r.URL.Query().Get("board"))
+	if err != nil {
+		log.Printf("Failed to query update outcomes for %s: %v", game.Code, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	outcomes := []ReleaseOutcomes{}
+	for rows.Next() {
+		var o ReleaseOutcomes
+		err := rows.Scan(&o.Board, &o.Version, &o.Channel, &o.Devices, &o.Attempts, &o.InProgress, &o.Installed, &o.Failed, &o.RolledBack)
+		if err != nil {
+			log.Printf("Failed to scan update outcomes: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		// Rates only count finished attempts
+		if finished := o.Installed + o.Failed + o.RolledBack; finished > 0 {
+			success := float64(o.Installed) / float64(finished)
+			failure := 1 - success
+			o.SuccessRate = &success
+			o.FailureRate = &failure
+		}
+		outcomes = append(outcomes, o)
+	}
+
+	writeJSON(w, http.StatusOK, outcomes)
+}
@@ -0,0 +1,162 @@
+package fota
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidUpdateStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{UpdateDownloading, true},
+		{UpdateInstalled, true},
+		{UpdateFailed, true},
+		{UpdateRolledBack, true},
+		{"", false},
+		{"Installed", false},
+		{"rollback", false},
+	}
+
+	for _, tt := range tests {
+		if got := validUpdateStatus(tt.status); got != tt.want {
+			t.Errorf("validUpdateStatus(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRecordUpdateReportValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		report UpdateReport
+	}{
+		{name: "no device", report: UpdateReport{Version: "1.4.0", Status: UpdateInstalled}},
+		{name: "no version", report: UpdateReport{DeviceID: "stick-1", Status: UpdateInstalled}},
+		{name: "no status", report: UpdateReport{DeviceID: "stick-1", Version: "1.4.0"}},
+		{name: "unknown status", report: UpdateReport{DeviceID: "stick-1", Version: "1.4.0", Status: "done"}},
+		{name: "long device ID", report: UpdateReport{DeviceID: strings.Repeat("s", 51), Version: "1.4.0", Status: UpdateInstalled}},
+		{name: "invalid version", report: UpdateReport{DeviceID: "stick-1", Version: "latest", Status: UpdateInstalled}},
+		{name: "long version", report: UpdateReport{DeviceID: "stick-1", Version: "1.4.0-" + strings.Repeat("a", 64), Status: UpdateInstalled}},
+		{name: "invalid from version", report: UpdateReport{DeviceID: "stick-1", Version: "1.4.0", FromVersion: "old", Status: UpdateInstalled}},
+		{name: "long from version", report: UpdateReport{DeviceID: "stick-1", Version: "1.4.0", FromVersion: "1.3.0+" + strings.Repeat("b", 64), Status: UpdateRolledBack}},
+	}
+
+	// Invalid reports are rejected before the database is touched
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RecordUpdateReport(nil, tt.report); !errors.Is(err, ErrInvalidReport) {
+				t.Errorf("RecordUpdateReport() error = %v, want ErrInvalidReport", err)
+			}
+		})
+	}
+}
+
+// expectReport expects a report for stick-1 on crisp-games up to the
+// attempt lookup, which finds latestStatus or nothing when it is empty
+func expectReport(mock sqlmock.Sqlmock, version, latestStatus string) {
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO devices`).WithArgs("stick-1", "crisp-games").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`SELECT f.id`).WithArgs(1, version, "stick-1", DefaultBoard).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(10))
+	attempt := mock.ExpectQuery(`FROM update_attempts`).WithArgs("stick-1", 1, version)
+	if latestStatus == "" {
+		attempt.WillReturnError(sql.ErrNoRows)
+	} else {
+		attempt.WillReturnRows(sqlmock.NewRows([]string{"id", "status"}).AddRow(20, latestStatus))
+	}
+}
+
+func TestRecordUpdateReportNormalizesVersions(t *testing.T) {
+	h, mock := testHandler(t)
+
+	expectReport(mock, "1.4.0", "")
+	mock.ExpectExec(`INSERT INTO update_attempts`).
+		WithArgs("stick-1", 1, sqlmock.AnyArg(), "1.3.0", "1.4.0", UpdateInstalled, nil, "").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE devices SET firmware_ver`).WithArgs("stick-1", "1.4.0").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := RecordUpdateReport(h.db, UpdateReport{DeviceID: "stick-1", Game: "crisp-games", Version: "v1.4.0", FromVersion: "v1.3.0", Status: UpdateInstalled})
+	if err != nil {
+		t.Fatalf("RecordUpdateReport: %v", err)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestRecordUpdateReportRolledBack(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// The rollback closes the installed attempt and restores the version the
+	// bootloader went back to
+	expectReport(mock, "1.4.0", UpdateInstalled)
+	mock.ExpectExec(`UPDATE update_attempts`).WithArgs(20, UpdateRolledBack, nil, "", "1.3.0", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`UPDATE devices SET firmware_ver`).WithArgs("stick-1", "1.3.0").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := RecordUpdateReport(h.db, UpdateReport{DeviceID: "stick-1", Game: "crisp-games", Version: "1.4.0", FromVersion: "v1.3.0", Status: UpdateRolledBack})
+	if err != nil {
+		t.Fatalf("RecordUpdateReport: %v", err)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestRecordUpdateReportRolledBackWithoutFromVersion(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// Without from_version the device's version is left alone
+	expectReport(mock, "1.4.0", UpdateInstalled)
+	mock.ExpectExec(`UPDATE update_attempts`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := RecordUpdateReport(h.db, UpdateReport{DeviceID: "stick-1", Game: "crisp-games", Version: "1.4.0", Status: UpdateRolledBack})
+	if err != nil {
+		t.Fatalf("RecordUpdateReport: %v", err)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestReportUpdateRejectsLongVersion(t *testing.T) {
+	h, mock := testHandler(t)
+	report, _ := json.Marshal(UpdateReport{DeviceID: "stick-1", Game: "crisp-games", Version: "1.4.0-" + strings.Repeat("a", 200), Status: UpdateInstalled})
+
+	if w := serve(h.ReportUpdate, adminRequest(http.MethodPost, "/api/fota/report", string(report))); w.Code != http.StatusBadRequest {
+		t.Errorf("report of a %d character version = %d, want %d", 206, w.Code, http.StatusBadRequest)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestUpdateOutcomesNormalizesVersion(t *testing.T) {
+	h, mock := testHandler(t)
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("crisp-games").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
+	mock.ExpectQuery(`FROM firmwares f`).WithArgs(1, "1.4.0", "").
+		WillReturnRows(sqlmock.NewRows([]string{"board", "version", "channel", "devices", "attempts", "in_progress", "installed", "failed", "rolled_back"}).
+			AddRow(DefaultBoard, "1.4.0", ChannelStable, 4, 4, 0, 3, 0, 1))
+
+	w := serve(h.UpdateOutcomes, adminRequest(http.MethodGet, "/api/fota/report/outcomes?game=crisp-games&version=v1.4.0", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("outcomes = %d: %s", w.Code, w.Body)
+	}
+	var outcomes []ReleaseOutcomes
+	if err := json.NewDecoder(w.Body).Decode(&outcomes); err != nil {
+		t.Fatal(err)
+	}
+	if len(outcomes) != 1 || outcomes[0].SuccessRate == nil || *outcomes[0].SuccessRate != 0.75 {
+		t.Errorf("outcomes = %+v, want a 75%% success rate", outcomes)
+	}
+	expectationsMet(t, mock)
+
+	if w := serve(h.UpdateOutcomes, adminRequest(http.MethodGet, "/api/fota/report/outcomes?game=crisp-games&version=latest", "")); w.Code != http.StatusBadRequest {
+		t.Errorf("outcomes of an invalid version = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
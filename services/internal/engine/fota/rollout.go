@@ -0,0 +1,128 @@
+package fota
+
+import (
+	"hash/fnv"
+	"log"
+	"net/http"
+)
+
+// RolloutStatus is the rollout state of a release returned by admin endpoints
+type RolloutStatus struct {
+	Game           string `json:"game"`
+	Version        string `json:"version"`
+	RolloutPercent int    `json:"rollout_percent"`
+	RolloutPaused  bool   `json:"rollout_paused"`
+}
+
+type rampRequest struct {
+	releaseRequest
+	Percent *int `json:"percent"`
+}
+
+// inRollout reports whether a device falls inside the rollout percentage of
+// a release. The bucket is a stable hash of the device ID salted with the
+// release, so ramping 5% -> 20% keeps the original 5% and each release
+// samples a different slice of the fleet.
+func inRollout(deviceID, gameCode, version string, percent int) bool {
+	if percent >= 100 {
+		return true
+	}
+	if percent <= 0 || deviceID == "" {
+		return false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(gameCode + "/" + version + "/" + deviceID))
+	return int(hash.Sum32()%100) < percent
+}
+
+// rolloutEligible filters releases down to those the device may receive
+func rolloutEligible(releases []firmwareRelease, deviceID, gameCode string) []firmwareRelease {
+	var eligible []firmwareRelease
+	for _, rel := range releases {
+		if rel.RolloutPaused || !inRollout(deviceID, gameCode, rel.Version, rel.RolloutPercent) {
+			continue
+		}
+		eligible = append(eligible, rel)
+	}
+	return eligible
+}
+
+// RampRollout sets the rollout percentage of a release. Admin only.
+func (h *Handler) RampRollout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req rampRequest
+	firmwareID, ok := h.decodeReleaseRequest(w, r, &req, &req.releaseRequest)
+	if !ok {
+		return
+	}
+
+	if req.Percent == nil || *req.Percent < 0 || *req.Percent > 100 {
+		http.Error(w, "percent must be between 0 and 100", http.StatusBadRequest)
+		return
+	}
+
+	h.updateRollout(w, firmwareID, `UPDATE firmwares SET rollout_percent = $2 WHERE id = $1`, *req.Percent)
+}
+
+// PauseRollout stops a release from reaching any further devices. Admin only.
+func (h *Handler) PauseRollout(w http.ResponseWriter, r *http.Request) {
+	h.setRolloutPaused(w, r, true)
+}
+
+// ResumeRollout resumes a paused release at its current percentage. Admin only.
+func (h *Handler) ResumeRollout(w http.ResponseWriter, r *http.Request) {
+	h.setRolloutPaused(w, r, false)
+}
+
+func (h *Handler) setRolloutPaused(w http.ResponseWriter, r *http.Request, paused bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req releaseRequest
+	firmwareID, ok := h.decodeReleaseRequest(w, r, &req, &req)
+	if !ok {
+		return
+	}
+
+	h.updateRollout(w, firmwareID, `UPDATE firmwares SET rollout_paused = $2 WHERE id = $1`, paused)
+}
+
+func (h *Handler) updateRollout(w http.ResponseWriter, firmwareID int64, query string, value interface{}) {
+	if _, err := h.db.Exec(query, firmwareID, value); err != nil {
+		log.Printf("Failed to update rollout of firmware %d: %v", firmwareID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var status RolloutStatus
+	err := h.db.QueryRow(`
+		SELECT g.code, f.version, f.rollout_percent, f.rollout_paused
+		FROM firmwares f
+		JOIN games g ON g.id = f.game_id
+		WHERE f.id = $1
+	`, firmwareID).Scan(&status.Game, &status.Version, &status.RolloutPercent, &status.RolloutPaused)
+	if err != nil {
+		log.Printf("Failed to query rollout of firmware %d: %v", firmwareID, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Rollout of %s %s: %d%% (paused=%t)", status.Game, status.Version, status.RolloutPercent, status.RolloutPaused)
+
+	go h.notifyRelease(firmwareID)
+
+	writeJSON(w, http.StatusOK, status)
+}
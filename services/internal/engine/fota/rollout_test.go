@@ -0,0 +1,109 @@
+package fota
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestInRolloutBounds(t *testing.T) {
+	tests := []struct {
+		deviceID string
+		percent  int
+		want     bool
+	}{
+		{"stick-1", 100, true},
+		{"stick-1", 150, true},
+		{"", 100, true},
+		{"stick-1", 0, false},
+		{"stick-1", -5, false},
+		{"", 50, false},
+	}
+
+	for _, tt := range tests {
+		if got := inRollout(tt.deviceID, "crisp-games", "1.0.0", tt.percent); got != tt.want {
+			t.Errorf("inRollout(%q, %d%%) = %v, want %v", tt.deviceID, tt.percent, got, tt.want)
+		}
+	}
+}
+
+func TestInRolloutBuckets(t *testing.T) {
+	const devices = 10000
+
+	for _, percent := range []int{1, 5, 20, 50, 99} {
+		in := 0
+		for i := 0; i < devices; i++ {
+			if inRollout(fmt.Sprintf("stick-%d", i), "crisp-games", "1.0.0", percent) {
+				in++
+			}
+		}
+		// Within two points of the target share of the fleet
+		got := float64(in) * 100 / devices
+		if got < float64(percent)-2 || got > float64(percent)+2 {
+			t.Errorf("%d%% rollout reached %.2f%% of devices", percent, got)
+		}
+	}
+}
+
+func TestInRolloutRampKeepsDevices(t *testing.T) {
+	ramp := []int{1, 5, 20, 50, 100}
+
+	for i := 0; i < 1000; i++ {
+		deviceID := fmt.Sprintf("stick-%d", i)
+		wasIn := false
+		for _, percent := range ramp {
+			in := inRollout(deviceID, "crisp-games", "1.0.0", percent)
+			if wasIn && !in {
+				t.Fatalf("device %s left the rollout when ramping to %d%%", deviceID, percent)
+			}
+			wasIn = in
+		}
+	}
+}
+
+func TestInRolloutSaltedByRelease(t *testing.T) {
+	releases := []struct {
+		gameCode, version string
+	}{
+		{"crisp-games", "1.1.0"},
+		{"crisp-games", "1.2.0"},
+		{"snake", "1.1.0"},
+	}
+
+	// Each release samples its own half of the same devices
+	var samples []string
+	for _, rel := range releases {
+		sample := ""
+		for i := 0; i < 64; i++ {
+			if inRollout(fmt.Sprintf("stick-%d", i), rel.gameCode, rel.version, 50) {
+				sample += "1"
+			} else {
+				sample += "0"
+			}
+		}
+		for _, other := range samples {
+			if sample == other {
+				t.Errorf("%s %s samples the same devices as another release", rel.gameCode, rel.version)
+			}
+		}
+		samples = append(samples, sample)
+	}
+}
+
+func TestRolloutEligible(t *testing.T) {
+	releases := []firmwareRelease{
+		{Version: "1.0.0", RolloutPercent: 100},
+		{Version: "1.1.0", RolloutPercent: 100, RolloutPaused: true},
+		{Version: "1.2.0", RolloutPercent: 0},
+		{Version: "1.3.0", RolloutPercent: 100},
+	}
+
+	eligible := rolloutEligible(releases, "stick-1", "crisp-games")
+
+	var got []string
+	for _, rel := range eligible {
+		got = append(got, rel.Version)
+	}
+	if fmt.Sprint(got) != "[1.0.0 1.3.0]" {
+		t.Errorf("rolloutEligible() = %v, want [1.0.0 1.3.0]", got)
+	}
+}
@@ -0,0 +1,191 @@
+package fota
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed Semantic Versioning 2.0.0 version string
+type Version struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	PreRelease []string
+	Build      []string
+}
+
+// MaxVersionLength is the width of the version columns
+const MaxVersionLength = 64
+
+// ParseVersion parses a semver string such as "1.4.0", "1.5.0-beta.2" or
+// "2.0.0-rc.1+build.42". A single leading "v" is tolerated. Versions longer
+// than MaxVersionLength are rejected.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+
+	raw := strings.TrimPrefix(s, "v")
+	if raw == "" {
+		return v, fmt.Errorf("invalid version %q: empty", s)
+	}
+	if len(raw) > MaxVersionLength {
+		return v, fmt.Errorf("invalid version %q: longer than %d characters", s, MaxVersionLength)
+	}
+
+	if i := strings.IndexByte(raw, '+'); i >= 0 {
+		build, err := parseIdentifiers(raw[i+1:], false)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q: build metadata: %w", s, err)
+		}
+		v.Build = build
+		raw = raw[:i]
+	}
+
+	if i := strings.IndexByte(raw, '-'); i >= 0 {
+		pre, err := parseIdentifiers(raw[i+1:], true)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q: pre-release: %w", s, err)
+		}
+		v.PreRelease = pre
+		raw = raw[:i]
+	}
+
+	core := strings.Split(raw, ".")
+	if len(core) != 3 {
+		return v, fmt.Errorf("invalid version %q: expected MAJOR.MINOR.PATCH", s)
+	}
+
+	nums := make([]uint64, 3)
+	for i, part := range core {
+		n, err := parseNumeric(part)
+		if err != nil {
+			return v, fmt.Errorf("invalid version %q: %w", s, err)
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+
+	return v, nil
+}
+
+func parseIdentifiers(s string, preRelease bool) ([]string, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty identifier list")
+	}
+
+	ids := strings.Split(s, ".")
+	for _, id := range ids {
+		if id == "" {
+			return nil, fmt.Errorf("empty identifier")
+		}
+		for _, c := range id {
+			if !(c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')) {
+				return nil, fmt.Errorf("invalid character %q in identifier %q", c, id)
+			}
+		}
+		// Numeric pre-release identifiers must not have leading zeros
+		if preRelease && isNumeric(id) && len(id) > 1 && id[0] == '0' {
+			return nil, fmt.Errorf("leading zero in numeric identifier %q", id)
+		}
+	}
+
+	return ids, nil
+}
+
+func parseNumeric(s string) (uint64, error) {
+	if s == "" || !isNumeric(s) {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	if len(s) > 1 && s[0] == '0' {
+		return 0, fmt.Errorf("leading zero in %q", s)
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func isNumeric(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// String formats the version back into its canonical semver form
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.PreRelease) > 0 {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+	if len(v.Build) > 0 {
+		s += "+" + strings.Join(v.Build, ".")
+	}
+	return s
+}
+
+// IsPreRelease reports whether the version carries a pre-release suffix
+func (v Version) IsPreRelease() bool {
+	return len(v.PreRelease) > 0
+}
+
+// Compare returns -1, 0 or 1 following semver precedence rules.
+// Build metadata is ignored, so "1.0.0+a" and "1.0.0+b" compare equal.
+func (v Version) Compare(o Version) int {
+	if c := compareUint(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+
+	// A version without pre-release has higher precedence than one with it
+	switch {
+	case len(v.PreRelease) == 0 && len(o.PreRelease) == 0:
+		return 0
+	case len(v.PreRelease) == 0:
+		return 1
+	case len(o.PreRelease) == 0:
+		return -1
+	}
+
+	for i := 0; i < len(v.PreRelease) && i < len(o.PreRelease); i++ {
+		if c := compareIdentifier(v.PreRelease[i], o.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareUint(uint64(len(v.PreRelease)), uint64(len(o.PreRelease)))
+}
+
+func compareIdentifier(a, b string) int {
+	aNum, bNum := isNumeric(a), isNumeric(b)
+
+	switch {
+	case aNum && bNum:
+		// Compare by length first so arbitrarily long numbers work
+		if len(a) != len(b) {
+			return compareUint(uint64(len(a)), uint64(len(b)))
+		}
+		return strings.Compare(a, b)
+	case aNum:
+		return -1
+	case bNum:
+		return 1
+	default:
+		return strings.Compare(a, b)
+	}
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,131 @@
+package fota
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "1.4.0", want: "1.4.0"},
+		{in: "v1.4.0", want: "1.4.0"},
+		{in: "0.0.0", want: "0.0.0"},
+		{in: "1.5.0-beta.2", want: "1.5.0-beta.2"},
+		{in: "2.0.0-rc.1+build.42", want: "2.0.0-rc.1+build.42"},
+		{in: "1.0.0+20250614", want: "1.0.0+20250614"},
+		{in: "1.0.0-x-y.z--", want: "1.0.0-x-y.z--"},
+		{in: "1.0.0+001", want: "1.0.0+001"},
+		{in: "18446744073709551615.0.0", want: "18446744073709551615.0.0"},
+		{in: "v1.0.0-" + strings.Repeat("a", 58), want: "1.0.0-" + strings.Repeat("a", 58)},
+
+		{in: "", wantErr: true},
+		{in: "1.0.0-" + strings.Repeat("a", 59), wantErr: true},
+		{in: "v", wantErr: true},
+		{in: "vv1.0.0", wantErr: true},
+		{in: "1.0", wantErr: true},
+		{in: "1.0.0.0", wantErr: true},
+		{in: "01.0.0", wantErr: true},
+		{in: "1.a.0", wantErr: true},
+		{in: "-1.0.0", wantErr: true},
+		{in: "1.0.0-", wantErr: true},
+		{in: "1.0.0+", wantErr: true},
+		{in: "1.0.0-beta..1", wantErr: true},
+		{in: "1.0.0-beta.01", wantErr: true},
+		{in: "1.0.0-beta_1", wantErr: true},
+		{in: "18446744073709551616.0.0", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseVersion(%q) = %s, want error", tt.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseVersion(%q): %v", tt.in, err)
+			continue
+		}
+		if got := v.String(); got != tt.want {
+			t.Errorf("ParseVersion(%q).String() = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0.0", "2.0.0", -1},
+		{"2.1.0", "2.0.9", 1},
+		{"1.0.10", "1.0.9", 1},
+		{"v1.2.3", "1.2.3", 0},
+
+		// Pre-releases sort below their release
+		{"1.0.0-alpha", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-rc.1", "0.9.9", 1},
+
+		// The precedence chain from the semver specification
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta", "1.0.0-beta.2", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+
+		// Numeric identifiers compare by value, however long
+		{"1.0.0-1", "1.0.0-a", -1},
+		{"1.0.0-99999999999999999999", "1.0.0-100000000000000000000", -1},
+
+		// Build metadata is ignored
+		{"1.0.0+a", "1.0.0+b", 0},
+		{"1.0.0-rc.1+a", "1.0.0-rc.1", 0},
+	}
+
+	for _, tt := range tests {
+		a, err := ParseVersion(tt.a)
+		if err != nil {
+			t.Fatalf("ParseVersion(%q): %v", tt.a, err)
+		}
+		b, err := ParseVersion(tt.b)
+		if err != nil {
+			t.Fatalf("ParseVersion(%q): %v", tt.b, err)
+		}
+		if got := a.Compare(b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := b.Compare(a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestVersionIsPreRelease(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"1.0.0", false},
+		{"1.0.0+build.1", false},
+		{"1.0.0-beta", true},
+		{"1.0.0-0.3.7+build", true},
+	}
+
+	for _, tt := range tests {
+		v, err := ParseVersion(tt.in)
+		if err != nil {
+			t.Fatalf("ParseVersion(%q): %v", tt.in, err)
+		}
+		if got := v.IsPreRelease(); got != tt.want {
+			t.Errorf("ParseVersion(%q).IsPreRelease() = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package fota
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/storage"
+)
+
+// uploadsPrefix holds chunk blobs. Game codes cannot start with '_', so it
+// never collides with release blobs.
+const uploadsPrefix = "_uploads/"
+
+// UploadSession is the state of a resumable upload returned to clients
+type UploadSession struct {
+	ID           string    `json:"id"`
+	Game         string    `json:"game"`
+	Board        string    `json:"board"`
+	Version      string    `json:"version"`
+	Channel      string    `json:"channel"`
+	Offset       int64     `json:"offset"`
+	MaxChunkSize int64     `json:"max_chunk_size"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// uploadSessionRequest carries the same metadata as the UploadBin form fields
+type uploadSessionRequest struct {
+	Game           string `json:"game"`
+	Board          string `json:"board"`
+	Version        string `json:"version"`
+	Description    string `json:"description"`
+	Channel        string `json:"channel"`
+	RolloutPercent *int   `json:"rollout_percent"`
+	PublishAt      string `json:"publish_at"`
+	UnpublishAt    string `json:"unpublish_at"`
+	Encrypt        bool   `json:"encrypt"`
+}
+
+type finalizeRequest struct {
+	ID     string `json:"id"`
+	SHA256 string `json:"sha256"`
+}
+
+var errSessionNotFound = errors.New("upload session not found")
+
+// UploadSessions creates (POST), inspects (GET ?id=) or aborts (DELETE ?id=)
+// resumable upload sessions. Admin only.
+func (h *Handler) UploadSessions(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		h.createUploadSession(w, r)
+	case http.MethodGet:
+		session, err := h.lookupUploadSession(r.URL.Query().Get("id"))
+		if err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, session)
+	case http.MethodDelete:
+		h.abortUploadSession(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSessionError(w http.ResponseWriter, err error) {
+	if err == errSessionNotFound {
+		http.Error(w, "Upload session not found or expired", http.StatusNotFound)
+		return
+	}
+	log.Printf("Failed to query upload session: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+func (h *Handler) createUploadSession(w http.ResponseWriter, r *http.Request) {
+	var req uploadSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	fields := map[string]string{
+		"game":         req.Game,
+		"board":        req.Board,
+		"version":      req.Version,
+		"description":  req.Description,
+		"channel":      req.Channel,
+		"publish_at":   req.PublishAt,
+		"unpublish_at": req.UnpublishAt,
+		"encrypt":      strconv.FormatBool(req.Encrypt),
+	}
+	if req.RolloutPercent != nil {
+		fields["rollout_percent"] = strconv.Itoa(*req.RolloutPercent)
+	}
+
+	// Validate up front so a CI job learns about a bad version before
+	// sending the image
+	meta, err := h.parseUploadMeta(fields)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		log.Printf("Failed to generate upload session ID: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(idBytes)
+
+	_, err = h.db.Exec(`
+		INSERT INTO upload_sessions (id, game_id, board_id, version, channel, description, rollout_percent,
+			publish_at, unpublish_at, encrypt, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, $9, $10, NOW() + make_interval(secs => $11))
+	`, id, meta.Game.ID, meta.Board.ID, meta.Version, meta.Channel, meta.Description, meta.RolloutPercent,
+		meta.PublishAt, meta.UnpublishAt, meta.Encrypt, h.uploadSessionTTL.Seconds())
+	if err != nil {
+		log.Printf("Failed to create upload session: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Upload session %s created for %s %s (%s)", id, meta.Game.Code, meta.Version, meta.Board.Code)
+
+	session, err := h.lookupUploadSession(id)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, session)
+}
+
+// lookupUploadSession returns errSessionNotFound for unknown and expired sessions
+func (h *Handler) lookupUploadSession(id string) (*UploadSession, error) {
+	session := UploadSession{ID: id, MaxChunkSize: h.maxChunkSize}
+	err := h.db.QueryRow(`
+		SELECT g.code, b.code, s.version, s.channel, s.received, s.expires_at
+		FROM upload_sessions s
+		JOIN games g ON g.id = s.game_id
+		JOIN boards b ON b.id = s.board_id
+		WHERE s.id = $1 AND s.expires_at > NOW()
+	`, id).Scan(&session.Game, &session.Board, &session.Version, &session.Channel, &session.Offset, &session.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// UploadChunk appends the request body to a session at ?offset=, which must
+// equal the bytes received so far. A client that lost a response asks the
+// session for its offset and resumes from there. Admin only.
+func (h *Handler) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.lookupUploadSession(id)
+	if err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		http.Error(w, fmt.Sprintf("Expected offset %d", session.Offset), http.StatusConflict)
+		return
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Printf("Failed to generate chunk name: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	// The suffix keeps a concurrent retry of the same chunk from
+	// overwriting the blob of the one that wins
+	blobName := fmt.Sprintf("%s%s/%020d-%s", uploadsPrefix, id, offset, hex.EncodeToString(suffix))
+
+	body := &countingReader{r: http.MaxBytesReader(w, r.Body, h.maxChunkSize)}
+	ctx := r.Context()
+	if _, err := h.storage.Upload(ctx, blobName, body, "application/octet-stream"); err != nil {
+		var maxBytes *http.MaxBytesError
+		if errors.As(err, &maxBytes) {
+			http.Error(w, fmt.Sprintf("Chunks may not exceed %d bytes", h.maxChunkSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Printf("Failed to store chunk of session %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	status, message := h.appendChunk(id, offset, body.n, blobName)
+	if status != http.StatusOK {
+		if err := h.storage.Delete(context.Background(), blobName); err != nil {
+			log.Printf("Failed to delete rejected chunk %s: %v", blobName, err)
+		}
+		if status == http.StatusConflict {
+			if current, err := h.lookupUploadSession(id); err == nil {
+				w.Header().Set("Upload-Offset", strconv.FormatInt(current.Offset, 10))
+			}
+		}
+		http.Error(w, message, status)
+		return
+	}
+
+	session.Offset = offset + body.n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	writeJSON(w, http.StatusOK, session)
+}
+
+// appendChunk records a stored chunk if the session is still at offset
+func (h *Handler) appendChunk(id string, offset, size int64, blobName string) (int, string) {
+	if size == 0 {
+		return http.StatusBadRequest, "Chunk is empty"
+	}
+	if offset+size > h.maxFirmwareSize {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("Firmware image exceeds the maximum size of %d bytes", h.maxFirmwareSize)
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		log.Printf("Failed to record chunk of session %s: %v", id, err)
+		return http.StatusInternalServerError, "Internal server error"
+	}
+	defer tx.Rollback()
+
+	// Every chunk extends the session's lifetime
+	res, err := tx.Exec(`
+		UPDATE upload_sessions
+		SET received = received + $3, updated_at = NOW(), expires_at = NOW() + make_interval(secs => $4)
+		WHERE id = $1 AND received = $2 AND status = 'open' AND expires_at > NOW()
+	`, id, offset, size, h.uploadSessionTTL.Seconds())
+	if err == nil {
+		if n, _ := res.RowsAffected(); n == 0 {
+			return http.StatusConflict, "Session moved on or is being finalized"
+		}
+		_, err = tx.Exec(`
+			INSERT INTO upload_chunks (session_id, chunk_offset, size, blob_name)
+			VALUES ($1, $2, $3, $4)
+		`, id, offset, size, blobName)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Failed to record chunk of session %s: %v", id, err)
+		return http.StatusInternalServerError, "Internal server error"
+	}
+	return http.StatusOK, ""
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// FinalizeUpload assembles a session's chunks and ingests them exactly like
+// UploadBin, after checking the image against the SHA-256 the client
+// computed. Admin only.
+func (h *Handler) FinalizeUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req finalizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if len(req.SHA256) != 64 {
+		http.Error(w, "sha256 must be the hex SHA-256 of the whole image", http.StatusBadRequest)
+		return
+	}
+
+	meta, blobs, err := h.claimUploadSession(req.ID)
+	if err != nil {
+		if err == errSessionNotFound {
+			http.Error(w, "Upload session not found, expired or already being finalized", http.StatusNotFound)
+			return
+		}
+		writeSessionError(w, err)
+		return
+	}
+	if len(blobs) == 0 {
+		h.releaseUploadSession(req.ID)
+		http.Error(w, "No chunks uploaded", http.StatusBadRequest)
+		return
+	}
+	meta.ExpectedSHA256 = strings.ToLower(req.SHA256)
+
+	src := &chunkReader{ctx: r.Context(), storage: h.storage, blobs: blobs}
+	defer src.Close()
+
+	result, err := h.ingestFirmware(r.Context(), meta, src)
+	if err != nil {
+		// The chunks stay so the finalize can be retried, e.g. after a
+		// storage error or with a corrected digest
+		h.releaseUploadSession(req.ID)
+		writeUploadError(w, err)
+		return
+	}
+
+	h.deleteUploadSession(context.Background(), req.ID)
+	log.Printf("Upload session %s finalized as %s %s", req.ID, result.Game, result.Version)
+
+	writeJSON(w, http.StatusCreated, result)
+}
+
+// claimUploadSession moves an open session to finalizing so concurrent
+// finalize requests cannot ingest it twice, and returns its metadata and
+// chunk blobs in order. The claim extends the session so the collector
+// cannot delete its chunks while they are ingested.
+func (h *Handler) claimUploadSession(id string) (uploadMeta, []string, error) {
+	var meta uploadMeta
+	var description sql.NullString
+	err := h.db.QueryRow(`
+		UPDATE upload_sessions s
+		SET status = 'finalizing', updated_at = NOW(), expires_at = NOW() + make_interval(secs => $2)
+		FROM games g, boards b
+		WHERE s.id = $1 AND s.status = 'open' AND s.expires_at > NOW()
+			AND g.id = s.game_id AND b.id = s.board_id
+		RETURNING g.id, g.code, b.id, b.code, b.chip_id, b.flash_size_mb,
+			s.version, s.channel, s.description, s.rollout_percent, s.publish_at, s.unpublish_at, s.encrypt
+	`, id, h.uploadSessionTTL.Seconds()).Scan(&meta.Game.ID, &meta.Game.Code, &meta.Board.ID, &meta.Board.Code, &meta.Board.ChipID, &meta.Board.FlashSizeMB,
+		&meta.Version, &meta.Channel, &description, &meta.RolloutPercent, &meta.PublishAt, &meta.UnpublishAt, &meta.Encrypt)
+	if err == sql.ErrNoRows {
+		return meta, nil, errSessionNotFound
+	}
+	if err != nil {
+		return meta, nil, err
+	}
+	meta.Description = description.String
+
+	rows, err := h.db.Query(`SELECT blob_name FROM upload_chunks WHERE session_id = $1 ORDER BY chunk_offset`, id)
+	if err != nil {
+		h.releaseUploadSession(id)
+		return meta, nil, err
+	}
+	defer rows.Close()
+
+	var blobs []string
+	for rows.Next() {
+		var blobName string
+		if err := rows.Scan(&blobName); err != nil {
+			h.releaseUploadSession(id)
+			return meta, nil, err
+		}
+		blobs = append(blobs, blobName)
+	}
+	return meta, blobs, rows.Err()
+}
+
+// releaseUploadSession reopens a session after a failed finalize
+func (h *Handler) releaseUploadSession(id string) {
+	if _, err := h.db.Exec(`UPDATE upload_sessions SET status = 'open', updated_at = NOW() WHERE id = $1`, id); err != nil {
+		log.Printf("Failed to reopen upload session %s: %v", id, err)
+	}
+}
+
+// abortUploadSession deletes an open session. One being finalized is left
+// to its finalize request, which would otherwise lose its chunks midway.
+func (h *Handler) abortUploadSession(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+
+	// The chunk rows go with the session, but RETURNING still sees them
+	var blobs []string
+	err := h.db.QueryRow(`
+		DELETE FROM upload_sessions s
+		WHERE s.id = $1 AND s.status = 'open' AND s.expires_at > NOW()
+		RETURNING ARRAY(SELECT blob_name FROM upload_chunks WHERE session_id = s.id)
+	`, id).Scan(pq.Array(&blobs))
+	if err == sql.ErrNoRows {
+		if _, err := h.lookupUploadSession(id); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+		http.Error(w, "Upload session is being finalized", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to delete upload session %s: %v", id, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	h.deleteChunkBlobs(r.Context(), blobs)
+	log.Printf("Upload session %s aborted", id)
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "id": id})
+}
+
+// deleteUploadSession removes a session and its chunk blobs
+func (h *Handler) deleteUploadSession(ctx context.Context, id string) {
+	rows, err := h.db.Query(`DELETE FROM upload_chunks WHERE session_id = $1 RETURNING blob_name`, id)
+	if err != nil {
+		log.Printf("Failed to delete chunks of upload session %s: %v", id, err)
+		return
+	}
+
+	var blobs []string
+	for rows.Next() {
+		var blobName string
+		if err := rows.Scan(&blobName); err == nil {
+			blobs = append(blobs, blobName)
+		}
+	}
+	rows.Close()
+
+	if _, err := h.db.Exec(`DELETE FROM upload_sessions WHERE id = $1`, id); err != nil {
+		log.Printf("Failed to delete upload session %s: %v", id, err)
+	}
+
+	h.deleteChunkBlobs(ctx, blobs)
+}
+
+func (h *Handler) deleteChunkBlobs(ctx context.Context, blobs []string) {
+	for _, blobName := range blobs {
+		if err := h.storage.Delete(ctx, blobName); err != nil {
+			log.Printf("Failed to delete chunk %s: %v", blobName, err)
+		}
+	}
+}
+
+// chunkReader reads chunk blobs back to back, opening each one lazily
+type chunkReader struct {
+	ctx     context.Context
+	storage storage.Storage
+	blobs   []string
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.blobs) == 0 {
+				return 0, io.EOF
+			}
+			reader, err := cr.storage.Download(cr.ctx, cr.blobs[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to read chunk %s: %w", cr.blobs[0], err)
+			}
+			cr.current = reader
+			cr.blobs = cr.blobs[1:]
+		}
+
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (cr *chunkReader) Close() error {
+	if cr.current != nil {
+		return cr.current.Close()
+	}
+	return nil
+}
+
+// CollectUploadSessions deletes expired sessions and orphaned chunk blobs
+// every interval until ctx is cancelled. Safe to run on every replica.
+func (h *Handler) CollectUploadSessions(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		h.collectUploadSessions(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Handler) collectUploadSessions(ctx context.Context) {
+	rows, err := h.db.Query(`SELECT id FROM upload_sessions WHERE expires_at <= NOW()`)
+	if err != nil {
+		log.Printf("Failed to query expired upload sessions: %v", err)
+		return
+	}
+	var expired []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			expired = append(expired, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range expired {
+		h.deleteUploadSession(ctx, id)
+	}
+	if len(expired) > 0 {
+		log.Printf("Collected %d expired upload sessions", len(expired))
+	}
+
+	// Chunks whose session row is gone, e.g. after a crash between storing
+	// a chunk and recording it
+	blobs, err := h.storage.List(ctx, uploadsPrefix)
+	if err != nil {
+		log.Printf("Failed to list upload chunks: %v", err)
+		return
+	}
+	for _, blobName := range blobs {
+		id, _, _ := strings.Cut(strings.TrimPrefix(blobName, uploadsPrefix), "/")
+
+		var recorded bool
+		err := h.db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM upload_chunks WHERE blob_name = $1)
+				OR EXISTS (SELECT 1 FROM upload_sessions WHERE id = $2 AND expires_at > NOW())
+		`, blobName, id).Scan(&recorded)
+		if err != nil || recorded {
+			continue
+		}
+		if err := h.storage.Delete(ctx, blobName); err != nil {
+			log.Printf("Failed to delete orphaned chunk %s: %v", blobName, err)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package fota
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// expectSession expects lookupUploadSession to find session id at offset
+func expectSession(mock sqlmock.Sqlmock, id string, offset int64) {
+	mock.ExpectQuery(`FROM upload_sessions s`).WithArgs(id).
+		WillReturnRows(sqlmock.NewRows([]string{"game", "board", "version", "channel", "received", "expires_at"}).
+			AddRow("crisp-games", DefaultBoard, "1.1.0", ChannelStable, offset, time.Now().Add(time.Hour)))
+}
+
+func chunkRequest(id, offset, body string) *http.Request {
+	return adminRequest(http.MethodPut, "/api/fota/uploads/chunk?id="+id+"&offset="+offset, body)
+}
+
+func TestUploadSessionsRequireAdmin(t *testing.T) {
+	h, _ := testHandler(t)
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		r       *http.Request
+	}{
+		{name: "sessions", handler: h.UploadSessions, r: adminRequest(http.MethodGet, "/api/fota/uploads?id=abc", "")},
+		{name: "chunk", handler: h.UploadChunk, r: chunkRequest("abc", "0", "data")},
+		{name: "finalize", handler: h.FinalizeUpload, r: adminRequest(http.MethodPost, "/api/fota/uploads/finalize", `{}`)},
+	}
+
+	for _, tt := range tests {
+		tt.r.Header.Del("X-API-Token")
+		if w := serve(tt.handler, tt.r); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s without a token = %d, want %d", tt.name, w.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestUploadChunk(t *testing.T) {
+	h, mock := testHandler(t)
+
+	expectSession(mock, "abc", 4)
+	mock.ExpectBegin()
+	mock.ExpectExec(`SET received = received \+ \$3`).WithArgs("abc", 4, 6, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO upload_chunks`).WithArgs("abc", 4, 6, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	w := serve(h.UploadChunk, chunkRequest("abc", "4", "second"))
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("chunk = %d offset %q: %s", w.Code, w.Header().Get("Upload-Offset"), w.Body)
+	}
+	if blobs := listBlobs(t, h, uploadsPrefix+"abc/"); len(blobs) != 1 {
+		t.Errorf("chunk blobs = %v, want one", blobs)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestUploadChunkOffsetConflict(t *testing.T) {
+	t.Run("stale offset", func(t *testing.T) {
+		h, mock := testHandler(t)
+
+		// A client that lost a response is told where to resume, and the
+		// chunk is not stored
+		expectSession(mock, "abc", 4)
+
+		w := serve(h.UploadChunk, chunkRequest("abc", "0", "first"))
+		if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "4" {
+			t.Errorf("chunk = %d offset %q, want %d at 4", w.Code, w.Header().Get("Upload-Offset"), http.StatusConflict)
+		}
+		if blobs := listBlobs(t, h, uploadsPrefix); len(blobs) != 0 {
+			t.Errorf("chunk blobs = %v, want none", blobs)
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("concurrent chunk", func(t *testing.T) {
+		h, mock := testHandler(t)
+
+		// Another request appended at the same offset between the lookup
+		// and the update: the stored chunk is dropped again
+		expectSession(mock, "abc", 4)
+		mock.ExpectBegin()
+		mock.ExpectExec(`SET received = received \+ \$3`).WithArgs("abc", 4, 6, sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectRollback()
+		expectSession(mock, "abc", 10)
+
+		w := serve(h.UploadChunk, chunkRequest("abc", "4", "second"))
+		if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "10" {
+			t.Errorf("chunk = %d offset %q, want %d at 10", w.Code, w.Header().Get("Upload-Offset"), http.StatusConflict)
+		}
+		if blobs := listBlobs(t, h, uploadsPrefix); len(blobs) != 0 {
+			t.Errorf("chunk blobs = %v, want none", blobs)
+		}
+		expectationsMet(t, mock)
+	})
+}
+
+func TestUploadChunkRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset string
+		body   string
+		want   int
+	}{
+		{name: "negative offset", offset: "-1", body: "data", want: http.StatusBadRequest},
+		{name: "missing offset", offset: "", body: "data", want: http.StatusBadRequest},
+		{name: "empty chunk", offset: "0", body: "", want: http.StatusBadRequest},
+		{name: "chunk too large", offset: "0", body: strings.Repeat("x", 1<<20+1), want: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := testHandler(t)
+			if tt.offset == "0" {
+				expectSession(mock, "abc", 0)
+			}
+
+			w := serve(h.UploadChunk, chunkRequest("abc", tt.offset, tt.body))
+			if w.Code != tt.want {
+				t.Errorf("chunk = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if blobs := listBlobs(t, h, uploadsPrefix); len(blobs) != 0 {
+				t.Errorf("chunk blobs = %v, want none", blobs)
+			}
+			expectationsMet(t, mock)
+		})
+	}
+}
+
+func TestUploadChunkUnknownSession(t *testing.T) {
+	h, mock := testHandler(t)
+	mock.ExpectQuery(`FROM upload_sessions s`).WithArgs("gone").WillReturnError(sql.ErrNoRows)
+
+	if w := serve(h.UploadChunk, chunkRequest("gone", "0", "data")); w.Code != http.StatusNotFound {
+		t.Errorf("chunk = %d, want %d", w.Code, http.StatusNotFound)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestAbortUploadSession(t *testing.T) {
+	abort := func(h *Handler) int {
+		return serve(h.UploadSessions, adminRequest(http.MethodDelete, "/api/fota/uploads?id=abc", "")).Code
+	}
+
+	t.Run("open", func(t *testing.T) {
+		h, mock := testHandler(t)
+		putBlob(t, h, uploadsPrefix+"abc/0", []byte("chunk"))
+		mock.ExpectQuery(`DELETE FROM upload_sessions s\s+WHERE s.id = \$1 AND s.status = 'open'`).WithArgs("abc").
+			WillReturnRows(sqlmock.NewRows([]string{"blobs"}).AddRow(`{_uploads/abc/0}`))
+
+		if code := abort(h); code != http.StatusOK {
+			t.Errorf("abort = %d, want %d", code, http.StatusOK)
+		}
+		if blobExists(t, h, uploadsPrefix+"abc/0") {
+			t.Error("chunk blob kept after abort")
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("finalizing", func(t *testing.T) {
+		h, mock := testHandler(t)
+		putBlob(t, h, uploadsPrefix+"abc/0", []byte("chunk"))
+
+		// The finalize request still reads the chunks
+		mock.ExpectQuery(`DELETE FROM upload_sessions s`).WithArgs("abc").WillReturnError(sql.ErrNoRows)
+		expectSession(mock, "abc", 5)
+
+		if code := abort(h); code != http.StatusConflict {
+			t.Errorf("abort = %d, want %d", code, http.StatusConflict)
+		}
+		if !blobExists(t, h, uploadsPrefix+"abc/0") {
+			t.Error("chunk blob of a finalizing session deleted")
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		h, mock := testHandler(t)
+		mock.ExpectQuery(`DELETE FROM upload_sessions s`).WithArgs("abc").WillReturnError(sql.ErrNoRows)
+		mock.ExpectQuery(`FROM upload_sessions s`).WithArgs("abc").WillReturnError(sql.ErrNoRows)
+
+		if code := abort(h); code != http.StatusNotFound {
+			t.Errorf("abort = %d, want %d", code, http.StatusNotFound)
+		}
+		expectationsMet(t, mock)
+	})
+}
+
+func TestFinalizeUploadWithoutChunks(t *testing.T) {
+	h, mock := testHandler(t)
+	digest := strings.Repeat("0", 64)
+
+	// An empty session is reopened so chunks can still be sent
+	mock.ExpectQuery(`SET status = 'finalizing'`).WithArgs("abc", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"game_id", "game", "board_id", "board", "chip_id", "flash_size_mb",
+			"version", "channel", "description", "rollout_percent", "publish_at", "unpublish_at", "encrypt"}).
+			AddRow(1, "crisp-games", 1, DefaultBoard, 0, 4, "1.1.0", ChannelStable, nil, 100, nil, nil, false))
+	mock.ExpectQuery(`SELECT blob_name FROM upload_chunks`).WithArgs("abc").
+		WillReturnRows(sqlmock.NewRows([]string{"blob_name"}))
+	mock.ExpectExec(`UPDATE upload_sessions SET status = 'open'`).WithArgs("abc").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := serve(h.FinalizeUpload, adminRequest(http.MethodPost, "/api/fota/uploads/finalize", `{"id": "abc", "sha256": "`+digest+`"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("finalize = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestChunkReader(t *testing.T) {
+	h, _ := testHandler(t)
+	putBlob(t, h, uploadsPrefix+"abc/0", []byte("firm"))
+	putBlob(t, h, uploadsPrefix+"abc/1", []byte{})
+	putBlob(t, h, uploadsPrefix+"abc/2", []byte("ware"))
+
+	cr := &chunkReader{ctx: context.Background(), storage: h.storage,
+		blobs: []string{uploadsPrefix + "abc/0", uploadsPrefix + "abc/1", uploadsPrefix + "abc/2"}}
+	defer cr.Close()
+
+	got, err := io.ReadAll(cr)
+	if err != nil || string(got) != "firmware" {
+		t.Errorf("chunkReader read %q, %v; want firmware", got, err)
+	}
+}
@@ -0,0 +1,142 @@
+package fota
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// Reasons a build is unsupported, reported as mandatory_reason in check
+// responses and in score rejections
+const (
+	ReasonBelowMinimum = "below_minimum_version"
+	ReasonRecalled     = "recalled"
+)
+
+// SupportStatus tells whether a build may still be used. Builds whose
+// version cannot be parsed or that are unknown to the catalog are supported.
+type SupportStatus struct {
+	Supported           bool   `json:"supported"`
+	Reason              string `json:"reason,omitempty"`
+	MinSupportedVersion string `json:"min_supported_version,omitempty"`
+}
+
+// checkSupport evaluates a game's minimum supported version and the recall
+// flag of the board's build of version
+func checkSupport(db *sql.DB, game gameRef, board, version string) (SupportStatus, error) {
+	status := SupportStatus{Supported: true}
+
+	current, err := ParseVersion(version)
+	if err != nil {
+		return status, nil
+	}
+
+	var minVersion sql.NullString
+	err = db.QueryRow(`SELECT min_supported_version FROM games WHERE id = $1`, game.ID).Scan(&minVersion)
+	if err != nil {
+		return status, err
+	}
+	status.MinSupportedVersion = minVersion.String
+
+	if minVersion.Valid {
+		if min, err := ParseVersion(minVersion.String); err == nil && current.Compare(min) < 0 {
+			status.Supported = false
+			status.Reason = ReasonBelowMinimum
+			return status, nil
+		}
+	}
+
+	var recalled bool
+	err = db.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM firmwares
+			WHERE game_id = $1 AND version = $2 AND is_recalled
+				AND board_id = (SELECT id FROM boards WHERE code = $3)
+		)
+	`, game.ID, current.String(), board).Scan(&recalled)
+	if err != nil {
+		return status, err
+	}
+	if recalled {
+		status.Supported = false
+		status.Reason = ReasonRecalled
+	}
+
+	return status, nil
+}
+
+// CheckFirmwareSupport tells whether a device's build is still supported.
+// The game and version are the ones the device last reported to FOTA, never
+// what it claims elsewhere; devices and games the engine does not know are
+// supported.
+func CheckFirmwareSupport(db *sql.DB, deviceID string) (SupportStatus, error) {
+	game, err := resolveGame(db, "", deviceID)
+	if errors.Is(err, errGameRequired) || err == sql.ErrNoRows {
+		return SupportStatus{Supported: true}, nil
+	}
+	if err != nil {
+		return SupportStatus{}, err
+	}
+
+	var version, board sql.NullString
+	err = db.QueryRow(`SELECT firmware_ver, board_code FROM devices WHERE id = $1`, deviceID).Scan(&version, &board)
+	if err != nil && err != sql.ErrNoRows {
+		return SupportStatus{}, err
+	}
+	if !board.Valid {
+		board.String = DefaultBoard
+	}
+
+	return checkSupport(db, game, board.String, version.String)
+}
+
+type recallRequest struct {
+	releaseRequest
+	Reason string `json:"reason"`
+}
+
+// RecallRelease withdraws a release: it is no longer offered or downloadable,
+// and devices running it are told to update. Admin only.
+func (h *Handler) RecallRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	var req recallRequest
+	firmwareID, ok := h.decodeReleaseRequest(w, r, &req, &req.releaseRequest)
+	if !ok {
+		return
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE firmwares
+		SET is_recalled = TRUE, recall_reason = NULLIF($2, ''), recalled_at = NOW(), is_promoted = FALSE
+		WHERE id = $1
+	`, firmwareID, req.Reason)
+	if err != nil {
+		log.Printf("Failed to recall release %s %s: %v", req.Game, req.Version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Release %s %s recalled: %s", req.Game, req.Version, req.Reason)
+
+	go h.notifyRelease(firmwareID)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"game":          req.Game,
+		"version":       req.Version,
+		"is_recalled":   true,
+		"recall_reason": req.Reason,
+	})
+}
+
+// UnrecallRelease lifts a recall made by mistake. Admin only.
+func (h *Handler) UnrecallRelease(w http.ResponseWriter, r *http.Request) {
+	h.updateRelease(w, r, `UPDATE firmwares SET is_recalled = FALSE, recall_reason = NULL, recalled_at = NULL WHERE id = $1`)
+}
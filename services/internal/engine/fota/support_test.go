@@ -0,0 +1,195 @@
+package fota
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func expectMinVersion(mock sqlmock.Sqlmock, min interface{}) {
+	mock.ExpectQuery(`SELECT min_supported_version FROM games`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"min_supported_version"}).AddRow(min))
+}
+
+func expectRecalled(mock sqlmock.Sqlmock, version string, recalled bool) {
+	mock.ExpectQuery(`AND is_recalled`).WithArgs(1, version, DefaultBoard).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(recalled))
+}
+
+func TestCheckSupport(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		expect  func(mock sqlmock.Sqlmock)
+		want    SupportStatus
+	}{
+		// Unparseable builds cannot be compared, so they stay supported
+		// without a lookup
+		{name: "invalid version", version: "dev-build", want: SupportStatus{Supported: true}},
+		{
+			name:    "no minimum",
+			version: "1.0.0",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMinVersion(mock, nil)
+				expectRecalled(mock, "1.0.0", false)
+			},
+			want: SupportStatus{Supported: true},
+		},
+		{
+			name:    "at the minimum",
+			version: "v1.2.0",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMinVersion(mock, "1.2.0")
+				expectRecalled(mock, "1.2.0", false)
+			},
+			want: SupportStatus{Supported: true, MinSupportedVersion: "1.2.0"},
+		},
+		{
+			// The recall is not looked up once the build is too old
+			name:    "below the minimum",
+			version: "1.1.9",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMinVersion(mock, "1.2.0")
+			},
+			want: SupportStatus{Reason: ReasonBelowMinimum, MinSupportedVersion: "1.2.0"},
+		},
+		{
+			name:    "recalled",
+			version: "1.3.0",
+			expect: func(mock sqlmock.Sqlmock) {
+				expectMinVersion(mock, "1.2.0")
+				expectRecalled(mock, "1.3.0", true)
+			},
+			want: SupportStatus{Reason: ReasonRecalled, MinSupportedVersion: "1.2.0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := testHandler(t)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+
+			got, err := checkSupport(h.db, testGame, DefaultBoard, tt.version)
+			if err != nil {
+				t.Fatalf("checkSupport: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("checkSupport(%q) = %+v, want %+v", tt.version, got, tt.want)
+			}
+			expectationsMet(t, mock)
+		})
+	}
+}
+
+func TestCheckFirmwareSupport(t *testing.T) {
+	t.Run("unknown device", func(t *testing.T) {
+		h, mock := testHandler(t)
+		mock.ExpectQuery(`SELECT game_code FROM devices`).WithArgs("stick-9").WillReturnError(sql.ErrNoRows)
+
+		got, err := CheckFirmwareSupport(h.db, "stick-9")
+		if err != nil || !got.Supported {
+			t.Errorf("CheckFirmwareSupport() = %+v, %v; want supported", got, err)
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("recalled build", func(t *testing.T) {
+		h, mock := testHandler(t)
+		mock.ExpectQuery(`SELECT game_code FROM devices`).WithArgs("stick-1").
+			WillReturnRows(sqlmock.NewRows([]string{"game_code"}).AddRow("crisp-games"))
+		expectTestGame(mock)
+		// Devices without a stored board run the default one
+		mock.ExpectQuery(`SELECT firmware_ver, board_code FROM devices`).WithArgs("stick-1").
+			WillReturnRows(sqlmock.NewRows([]string{"firmware_ver", "board_code"}).AddRow("1.3.0", nil))
+		expectMinVersion(mock, nil)
+		expectRecalled(mock, "1.3.0", true)
+
+		got, err := CheckFirmwareSupport(h.db, "stick-1")
+		if err != nil || got.Supported || got.Reason != ReasonRecalled {
+			t.Errorf("CheckFirmwareSupport() = %+v, %v; want recalled", got, err)
+		}
+		expectationsMet(t, mock)
+	})
+}
+
+func TestResolveUpdateMandatory(t *testing.T) {
+	t.Run("below the minimum", func(t *testing.T) {
+		h, mock := testHandler(t)
+
+		// Update windows do not hold back an update away from an
+		// unsupported build
+		expectMinVersion(mock, "1.1.0")
+		expectNoPin(mock, "stick-1")
+		mock.ExpectQuery(`channel IN \(\$3, 'stable'\)`).WillReturnRows(releaseRows(testRelease(2, "1.1.0")))
+		expectOffer(mock, 2)
+
+		response, err := h.resolveUpdate(context.Background(), updateQuery{
+			Game:           testGame,
+			DeviceID:       "stick-1",
+			CurrentVersion: "1.0.0",
+			Hardware:       deviceHardware{Board: DefaultBoard},
+			Channel:        ChannelStable,
+		})
+		if err != nil {
+			t.Fatalf("resolveUpdate: %v", err)
+		}
+		if response.Version != "1.1.0" || !response.Mandatory || response.MandatoryReason != ReasonBelowMinimum {
+			t.Errorf("resolveUpdate() = %s mandatory=%t %q, want a mandatory update to 1.1.0", response.Version, response.Mandatory, response.MandatoryReason)
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("recalled", func(t *testing.T) {
+		h, mock := testHandler(t)
+
+		// A recalled build is left even when only an older one remains
+		expectMinVersion(mock, nil)
+		expectRecalled(mock, "1.1.0", true)
+		expectNoPin(mock, "stick-1")
+		mock.ExpectQuery(`channel IN \(\$3, 'stable'\)`).WillReturnRows(releaseRows(testRelease(1, "1.0.0")))
+		expectOffer(mock, 1)
+
+		response, err := h.resolveUpdate(context.Background(), updateQuery{
+			Game:           testGame,
+			DeviceID:       "stick-1",
+			CurrentVersion: "1.1.0",
+			Hardware:       deviceHardware{Board: DefaultBoard},
+			Channel:        ChannelStable,
+		})
+		if err != nil {
+			t.Fatalf("resolveUpdate: %v", err)
+		}
+		if response.Version != "1.0.0" || !response.Mandatory || response.MandatoryReason != ReasonRecalled {
+			t.Errorf("resolveUpdate() = %s mandatory=%t %q, want a mandatory downgrade to 1.0.0", response.Version, response.Mandatory, response.MandatoryReason)
+		}
+		expectationsMet(t, mock)
+	})
+}
+
+func TestRecallRelease(t *testing.T) {
+	h, mock := testHandler(t)
+
+	r := adminRequest(http.MethodPost, "/api/fota/releases/recall", `{"game": "crisp-games", "version": "1.0.0"}`)
+	r.Header.Del("X-API-Token")
+	if w := serve(h.RecallRelease, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("recall without token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// A recalled release also loses its promotion
+	expectFindRelease(mock, "1.0.0", "", 5)
+	mock.ExpectExec(`SET is_recalled = TRUE, recall_reason = NULLIF\(\$2, ''\), recalled_at = NOW\(\), is_promoted = FALSE`).
+		WithArgs(5, "bricks the display").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	w := serve(h.RecallRelease, adminRequest(http.MethodPost, "/api/fota/releases/recall",
+		`{"game": "crisp-games", "version": "v1.0.0", "reason": "bricks the display"}`))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"is_recalled":true`) {
+		t.Errorf("recall = %d: %s", w.Code, w.Body)
+	}
+	expectationsMet(t, mock)
+}
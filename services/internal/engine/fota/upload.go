@@ -0,0 +1,613 @@
+package fota
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/espimage"
+)
+
+// uploadError is an upload failure caused by the request rather than the server
+type uploadError struct {
+	Status  int
+	Message string
+}
+
+func (e *uploadError) Error() string {
+	return e.Message
+}
+
+func badUpload(format string, args ...interface{}) error {
+	return &uploadError{Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// writeUploadError maps ingest errors to HTTP responses
+func writeUploadError(w http.ResponseWriter, err error) {
+	var ue *uploadError
+	var maxBytes *http.MaxBytesError
+	switch {
+	case errors.As(err, &ue):
+		http.Error(w, ue.Message, ue.Status)
+	case errors.As(err, &maxBytes):
+		http.Error(w, "Firmware image too large", http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Failed to ingest firmware: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// uploadMeta describes a release being uploaded
+type uploadMeta struct {
+	Game           gameRef
+	Board          boardRef
+	Version        string
+	Description    string
+	Channel        string
+	RolloutPercent int
+	PublishAt      *time.Time
+	UnpublishAt    *time.Time
+	// Encrypt produces esp_encrypted_img artifacts for the board's and
+	// groups' encryption keys
+	Encrypt bool
+	// ExpectedSHA256 rejects the image when its digest differs, if set
+	ExpectedSHA256 string
+}
+
+// UploadResult is returned to admins after a successful upload
+type UploadResult struct {
+	Status         string          `json:"status"`
+	Game           string          `json:"game"`
+	Board          string          `json:"board"`
+	Version        string          `json:"version"`
+	Channel        string          `json:"channel"`
+	RolloutPercent int             `json:"rollout_percent"`
+	PublishAt      *time.Time      `json:"publish_at"`
+	UnpublishAt    *time.Time      `json:"unpublish_at"`
+	Encrypt        bool            `json:"encrypt"`
+	FileSize       int64           `json:"file_size"`
+	Checksum       string          `json:"checksum"`
+	SHA256         string          `json:"sha256"`
+	Signature      string          `json:"signature"`
+	SigningKeyID   string          `json:"signing_key_id"`
+	Description    string          `json:"description"`
+	BlobName       string          `json:"blob_name"`
+	BlobURL        string          `json:"blob_url"`
+	Image          *espimage.Image `json:"image"`
+	// Partitions lists the other images of a bundle upload
+	Partitions []PartitionInfo `json:"partitions,omitempty"`
+}
+
+// maxUploadFieldSize bounds each text field of a multipart upload
+const maxUploadFieldSize = 64 << 10
+
+// readUploadField reads a text field of a multipart upload
+func readUploadField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxUploadFieldSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(value) > maxUploadFieldSize {
+		return "", badUpload("Field %s exceeds %d KiB", part.FormName(), maxUploadFieldSize>>10)
+	}
+	return string(value), nil
+}
+
+// checkFieldsBeforeImage rejects a multipart upload whose first image arrived
+// before the required text fields, which streaming cannot read back
+func checkFieldsBeforeImage(fields map[string]string) error {
+	var missing []string
+	for _, name := range []string{"game", "version"} {
+		if fields[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+	if missing != nil {
+		return badUpload("metadata fields must precede the firmware part (missing %s)", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// parseUploadMeta validates the form fields of an upload
+func (h *Handler) parseUploadMeta(fields map[string]string) (uploadMeta, error) {
+	meta := uploadMeta{
+		Description:    fields["description"],
+		Channel:        fields["channel"],
+		RolloutPercent: 100,
+	}
+
+	if v := fields["rollout_percent"]; v != "" {
+		percent, err := strconv.Atoi(v)
+		if err != nil || percent < 0 || percent > 100 {
+			return meta, badUpload("rollout_percent must be between 0 and 100")
+		}
+		meta.RolloutPercent = percent
+	}
+
+	if v := fields["encrypt"]; v != "" {
+		encrypt, err := strconv.ParseBool(v)
+		if err != nil {
+			return meta, badUpload("encrypt must be true or false")
+		}
+		meta.Encrypt = encrypt
+	}
+	if meta.Encrypt && h.escrow == nil {
+		return meta, badUpload("encrypt=true needs FOTA_ESCROW_KEY to be set on the engine")
+	}
+
+	var err error
+	meta.PublishAt, meta.UnpublishAt, err = parseSchedule(fields["publish_at"], fields["unpublish_at"])
+	if err != nil {
+		return meta, badUpload("%v", err)
+	}
+
+	if meta.Channel == "" {
+		meta.Channel = ChannelStable
+	}
+	if !validChannel(meta.Channel) {
+		return meta, badUpload("Channel must be one of stable, beta, nightly")
+	}
+
+	if fields["game"] == "" {
+		return meta, badUpload("Game is required")
+	}
+
+	game, err := h.lookupGame(fields["game"])
+	if err == sql.ErrNoRows {
+		return meta, &uploadError{Status: http.StatusNotFound, Message: "Unknown game"}
+	}
+	if err != nil {
+		return meta, err
+	}
+	meta.Game = game
+
+	boardCode := fields["board"]
+	if boardCode == "" {
+		boardCode = DefaultBoard
+	}
+	board, err := h.lookupBoard(boardCode)
+	if err == sql.ErrNoRows {
+		return meta, &uploadError{Status: http.StatusNotFound, Message: "Unknown board"}
+	}
+	if err != nil {
+		return meta, err
+	}
+	meta.Board = board
+
+	if fields["version"] == "" {
+		return meta, badUpload("Version is required")
+	}
+
+	semver, err := ParseVersion(fields["version"])
+	if err != nil {
+		return meta, badUpload("Version must be a valid semantic version (e.g. 1.2.0)")
+	}
+	meta.Version = semver.String()
+
+	return meta, nil
+}
+
+// imageStream hashes and validates a firmware image while it is copied to
+// storage. Validation failures are returned from Read, which aborts the
+// storage write so no partial or invalid blob is ever committed.
+type imageStream struct {
+	src     io.Reader
+	pipe    *io.PipeWriter
+	parsed  chan parseResult
+	md5     hash.Hash
+	sha256  hash.Hash
+	size    int64
+	maxSize int64
+	version string
+	check   func(*espimage.Image) error
+
+	img *espimage.Image
+	err error
+}
+
+type parseResult struct {
+	img *espimage.Image
+	err error
+}
+
+// check runs on the parsed image once the whole stream has been read
+func newImageStream(src io.Reader, maxSize int64, version string, check func(*espimage.Image) error) *imageStream {
+	pr, pw := io.Pipe()
+	s := &imageStream{
+		pipe:    pw,
+		parsed:  make(chan parseResult, 1),
+		md5:     md5.New(),
+		sha256:  sha256.New(),
+		maxSize: maxSize,
+		version: version,
+		check:   check,
+	}
+	s.src = io.TeeReader(src, io.MultiWriter(s.md5, s.sha256, pw))
+
+	go func() {
+		img, err := espimage.Parse(pr)
+		if err == nil {
+			// Keep consuming so trailing bytes are counted, not blocked on
+			_, err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(err)
+		s.parsed <- parseResult{img: img, err: err}
+	}()
+
+	return s
+}
+
+func (s *imageStream) Read(p []byte) (int, error) {
+	n, err := s.src.Read(p)
+	s.size += int64(n)
+
+	if s.size > s.maxSize {
+		s.err = &uploadError{
+			Status:  http.StatusRequestEntityTooLarge,
+			Message: fmt.Sprintf("Firmware image exceeds the maximum size of %d bytes", s.maxSize),
+		}
+		return n, s.err
+	}
+
+	if err == io.EOF {
+		s.pipe.Close()
+		res := <-s.parsed
+		switch {
+		case res.err != nil:
+			s.err = badUpload("%v", res.err)
+		case res.img.Size != s.size:
+			s.err = badUpload("Unexpected %d bytes after the end of the image", s.size-res.img.Size)
+		case !embeddedVersionMatches(res.img.Version, s.version):
+			s.err = badUpload("Image version %q does not match version %q", res.img.Version, s.version)
+		case s.check != nil:
+			if err := s.check(res.img); err != nil {
+				s.err = badUpload("%v", err)
+			}
+		}
+		if s.err != nil {
+			return n, s.err
+		}
+		s.img = res.img
+	} else if errors.Is(err, espimage.ErrInvalidImage) {
+		// The parser closes the pipe with its error, surfacing it here
+		s.err = badUpload("%v", err)
+		return n, s.err
+	}
+
+	return n, err
+}
+
+// Close stops the parser goroutine if the stream was abandoned early
+func (s *imageStream) Close() error {
+	return s.pipe.CloseWithError(io.ErrUnexpectedEOF)
+}
+
+// stagedImage is an uploaded image copied to a staging blob and hashed,
+// waiting to be recorded under its content address
+type stagedImage struct {
+	BlobName string
+	Size     int64
+	MD5      string
+	SHA256   string
+	Digest   []byte
+	// Image is set for application images
+	Image *espimage.Image
+}
+
+// deleteStaged removes a staging blob once its content has been recorded or
+// the upload failed
+func (h *Handler) deleteStaged(staged *stagedImage) {
+	if err := h.storage.Delete(context.Background(), staged.BlobName); err != nil {
+		log.Printf("Failed to clean up staged upload %s: %v", staged.BlobName, err)
+	}
+}
+
+// ingestFirmware streams an image into storage while validating it and
+// records the release. Nothing is left behind in storage when it fails.
+func (h *Handler) ingestFirmware(ctx context.Context, meta uploadMeta, src io.Reader) (*UploadResult, error) {
+	app, err := h.stageFirmware(ctx, meta, src)
+	if err != nil {
+		return nil, err
+	}
+	defer h.deleteStaged(app)
+
+	return h.publishRelease(ctx, meta, app, nil)
+}
+
+// stageFirmware streams an application image into a staging blob while
+// validating it. No blob is left behind when it fails.
+func (h *Handler) stageFirmware(ctx context.Context, meta uploadMeta, src io.Reader) (*stagedImage, error) {
+	var stream *imageStream
+	check := func(img *espimage.Image) error {
+		if err := meta.Board.checkImage(img); err != nil {
+			return err
+		}
+		if meta.ExpectedSHA256 != "" {
+			if digest := fmt.Sprintf("%x", stream.sha256.Sum(nil)); !strings.EqualFold(digest, meta.ExpectedSHA256) {
+				return fmt.Errorf("image SHA-256 %s does not match the expected %s", digest, meta.ExpectedSHA256)
+			}
+		}
+		return nil
+	}
+	stream = newImageStream(src, h.maxFirmwareSize, meta.Version, check)
+	defer stream.Close()
+
+	stagingBlob, err := stagingBlobName()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = h.storage.Upload(ctx, stagingBlob, stream, "application/octet-stream")
+	if stream.err != nil {
+		log.Printf("Rejected firmware %s %s for %s: %v", meta.Game.Code, meta.Version, meta.Board.Code, stream.err)
+		return nil, stream.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	digest := stream.sha256.Sum(nil)
+	return &stagedImage{
+		BlobName: stagingBlob,
+		Size:     stream.size,
+		MD5:      fmt.Sprintf("%x", stream.md5.Sum(nil)),
+		SHA256:   fmt.Sprintf("%x", digest),
+		Digest:   digest,
+		Image:    stream.img,
+	}, nil
+}
+
+// publishRelease records a staged application image, and the other images
+// of a bundle if any, as a release and starts its background work
+func (h *Handler) publishRelease(ctx context.Context, meta uploadMeta, app *stagedImage, parts []bundlePart) (*UploadResult, error) {
+	// The image signature covers the raw SHA-256 digest
+	var signature, signingKeyID sql.NullString
+	if h.signer != nil {
+		sig := h.signer.Sign(app.Digest)
+		signature = sql.NullString{String: sig.Value, Valid: true}
+		signingKeyID = sql.NullString{String: sig.KeyID, Valid: true}
+	}
+
+	rec, err := h.recordFirmware(ctx, meta, app, parts, signature, signingKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Firmware stored: %s, size=%d, sha256=%s", rec.BlobName, app.Size, app.SHA256)
+
+	// A re-upload with other bytes leaves the previous images unreferenced
+	for _, blobName := range rec.Replaced {
+		if _, err := h.releaseBlob(ctx, blobName); err != nil {
+			log.Printf("Failed to delete replaced blob %s: %v", blobName, err)
+		}
+	}
+
+	// A re-upload replaces the image, so patches to or from it and its
+	// encrypted and compressed copies are stale
+	if err := h.invalidatePatches(ctx, meta.Game.ID, meta.Board.ID, meta.Version); err != nil {
+		log.Printf("Failed to invalidate patches for %s %s: %v", meta.Game.Code, meta.Version, err)
+	}
+	if err := h.dropEncrypted(ctx, rec.FirmwareID); err != nil {
+		log.Printf("Failed to drop encrypted artifacts of %s %s: %v", meta.Game.Code, meta.Version, err)
+	}
+	if err := h.dropCompressed(ctx, rec.FirmwareID); err != nil {
+		log.Printf("Failed to drop compressed copies of %s %s: %v", meta.Game.Code, meta.Version, err)
+	}
+	// Notify once the patches, copies and artifacts exist so devices are
+	// offered them right away. Patches and compressed copies would give the
+	// plain image away, so encrypt releases only get artifacts.
+	go func() {
+		if meta.Encrypt {
+			h.encryptRelease(rec.FirmwareID)
+		} else {
+			h.generatePatches(meta.Game.Code, meta.Board, meta.Game.ID, rec.FirmwareID, meta.Version, rec.BlobName)
+			h.compressRelease(rec.FirmwareID, rec.BlobName)
+		}
+		h.notifyRelease(rec.FirmwareID)
+	}()
+
+	var partitions []PartitionInfo
+	for _, part := range parts {
+		partitions = append(partitions, part.info())
+	}
+
+	return &UploadResult{
+		Status:         "success",
+		Game:           meta.Game.Code,
+		Board:          meta.Board.Code,
+		Version:        meta.Version,
+		Channel:        meta.Channel,
+		RolloutPercent: meta.RolloutPercent,
+		PublishAt:      meta.PublishAt,
+		UnpublishAt:    meta.UnpublishAt,
+		Encrypt:        meta.Encrypt,
+		FileSize:       app.Size,
+		Checksum:       app.MD5,
+		SHA256:         app.SHA256,
+		Signature:      signature.String,
+		SigningKeyID:   signingKeyID.String,
+		Description:    meta.Description,
+		BlobName:       rec.BlobName,
+		BlobURL:        rec.BlobURL,
+		Image:          app.Image,
+		Partitions:     partitions,
+	}, nil
+}
+
+// recordedFirmware is the outcome of recordFirmware
+type recordedFirmware struct {
+	FirmwareID int64
+	BlobName   string
+	BlobURL    string
+	// Replaced lists the blobs a re-upload stopped referencing
+	Replaced []string
+}
+
+// recordFirmware stores the staged images under their content addresses and
+// upserts the release row, replacing its partitions, in one transaction
+// holding the blobs' locks
+func (h *Handler) recordFirmware(ctx context.Context, meta uploadMeta, app *stagedImage, parts []bundlePart,
+	signature, signingKeyID sql.NullString) (*recordedFirmware, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Locks are taken in name order so two bundles sharing images cannot
+	// deadlock
+	staged := map[string]*stagedImage{contentBlobName(app.SHA256): app}
+	for _, part := range parts {
+		staged[contentBlobName(part.Staged.SHA256)] = part.Staged
+	}
+	names := make([]string, 0, len(staged))
+	for name := range staged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	urls := make(map[string]string, len(names))
+	var stored []string
+	fail := func(err error) (*recordedFirmware, error) {
+		// Content blobs copied for this upload alone are dropped again once
+		// the locks are released
+		tx.Rollback()
+		for _, blobName := range stored {
+			if _, delErr := h.releaseBlob(ctx, blobName); delErr != nil {
+				log.Printf("Failed to clean up blob %s: %v", blobName, delErr)
+			}
+		}
+		return nil, fmt.Errorf("failed to save firmware info to database: %w", err)
+	}
+
+	for _, name := range names {
+		if err := lockBlob(tx, name); err != nil {
+			return fail(err)
+		}
+		blobName, blobURL, err := h.storeContent(ctx, staged[name].BlobName, staged[name].SHA256)
+		if err != nil {
+			return fail(err)
+		}
+		stored = append(stored, blobName)
+		urls[blobName] = blobURL
+	}
+
+	rec := &recordedFirmware{BlobName: contentBlobName(app.SHA256)}
+	rec.BlobURL = urls[rec.BlobName]
+
+	var previousBlob, previousEscrow string
+	err = tx.QueryRow(`
+		SELECT blob_name, COALESCE(escrow_blob_name, '') FROM firmwares WHERE game_id = $1 AND board_id = $2 AND version = $3 FOR UPDATE
+	`, meta.Game.ID, meta.Board.ID, meta.Version).Scan(&previousBlob, &previousEscrow)
+	if err != nil && err != sql.ErrNoRows {
+		return fail(err)
+	}
+
+	query := `
+		INSERT INTO firmwares (game_id, board_id, version, channel, blob_name, blob_url, description, file_size, checksum,
+			sha256, signature, signing_key_id, rollout_percent,
+			chip_id, min_chip_rev, max_chip_rev, flash_size_mb,
+			app_project_name, app_version, idf_version, app_build_date, app_elf_sha256, publish_at, unpublish_at, encrypt, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, TRUE)
+		ON CONFLICT (game_id, board_id, version) DO UPDATE
+		SET channel = EXCLUDED.channel,
+			rollout_percent = EXCLUDED.rollout_percent,
+			rollout_paused = FALSE,
+			blob_name = EXCLUDED.blob_name,
+			blob_url = EXCLUDED.blob_url,
+			description = EXCLUDED.description,
+			file_size = EXCLUDED.file_size,
+			checksum = EXCLUDED.checksum,
+			sha256 = EXCLUDED.sha256,
+			signature = EXCLUDED.signature,
+			signing_key_id = EXCLUDED.signing_key_id,
+			chip_id = EXCLUDED.chip_id,
+			min_chip_rev = EXCLUDED.min_chip_rev,
+			max_chip_rev = EXCLUDED.max_chip_rev,
+			flash_size_mb = EXCLUDED.flash_size_mb,
+			app_project_name = EXCLUDED.app_project_name,
+			app_version = EXCLUDED.app_version,
+			idf_version = EXCLUDED.idf_version,
+			app_build_date = EXCLUDED.app_build_date,
+			app_elf_sha256 = EXCLUDED.app_elf_sha256,
+			publish_at = EXCLUDED.publish_at,
+			unpublish_at = EXCLUDED.unpublish_at,
+			encrypt = EXCLUDED.encrypt,
+			plain_deleted = FALSE,
+			escrow_blob_name = NULL,
+			is_active = EXCLUDED.is_active,
+			is_promoted = firmwares.is_promoted AND firmwares.channel = EXCLUDED.channel,
+			created_at = NOW()
+		RETURNING id
+	`
+
+	img := app.Image
+	err = tx.QueryRow(query, meta.Game.ID, meta.Board.ID, meta.Version, meta.Channel, rec.BlobName, rec.BlobURL, meta.Description, app.Size, app.MD5,
+		app.SHA256, signature, signingKeyID, meta.RolloutPercent,
+		img.ChipID, img.MinChipRevFull, img.MaxChipRevFull, img.FlashSizeMB,
+		img.ProjectName, img.Version, img.IDFVersion, img.BuildDate+" "+img.BuildTime, img.ELFSHA256,
+		meta.PublishAt, meta.UnpublishAt, meta.Encrypt).Scan(&rec.FirmwareID)
+	if err != nil {
+		return fail(err)
+	}
+
+	// A re-upload, bundle or not, replaces every partition of the release
+	previousParts, err := tx.Query(`DELETE FROM firmware_partitions WHERE firmware_id = $1 RETURNING blob_name`, rec.FirmwareID)
+	if err != nil {
+		return fail(err)
+	}
+	var replaced []string
+	if previousBlob != "" {
+		replaced = append(replaced, previousBlob)
+	}
+	if previousEscrow != "" {
+		replaced = append(replaced, previousEscrow)
+	}
+	for previousParts.Next() {
+		var blobName string
+		if err := previousParts.Scan(&blobName); err != nil {
+			previousParts.Close()
+			return fail(err)
+		}
+		replaced = append(replaced, blobName)
+	}
+	previousParts.Close()
+	if err := previousParts.Err(); err != nil {
+		return fail(err)
+	}
+
+	for _, part := range parts {
+		_, err := tx.Exec(`
+			INSERT INTO firmware_partitions (firmware_id, label, part_type, flash_offset, blob_name, file_size, checksum, sha256)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		`, rec.FirmwareID, part.Label, part.Type, part.Offset, contentBlobName(part.Staged.SHA256), part.Staged.Size, part.Staged.MD5, part.Staged.SHA256)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, blobName := range replaced {
+		if _, current := urls[blobName]; !current && !seen[blobName] {
+			seen[blobName] = true
+			rec.Replaced = append(rec.Replaced, blobName)
+		}
+	}
+	return rec, nil
+}
@@ -0,0 +1,194 @@
+package fota
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// formPart is a multipart form part; parts with a file name are files
+type formPart struct {
+	name     string
+	fileName string
+	data     []byte
+}
+
+func field(name, value string) formPart {
+	return formPart{name: name, data: []byte(value)}
+}
+
+func file(name string, data []byte) formPart {
+	return formPart{name: name, fileName: name + ".bin", data: data}
+}
+
+// uploadRequest builds an admin multipart request sending parts in order
+func uploadRequest(t *testing.T, target string, parts ...formPart) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		var err error
+		if p.fileName != "" {
+			w, ferr := mw.CreateFormFile(p.name, p.fileName)
+			if ferr != nil {
+				t.Fatal(ferr)
+			}
+			_, err = w.Write(p.data)
+		} else {
+			err = mw.WriteField(p.name, string(p.data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := adminRequest(http.MethodPost, target, body.String())
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUploadBinRequiresAdmin(t *testing.T) {
+	h, mock := testHandler(t)
+	r := uploadRequest(t, "/api/fota/upload", field("game", "crisp-games"), field("version", "1.0.0"), file("firmware", appImage("1.0.0", 64)))
+	r.Header.Set("X-API-Token", "wrong-token")
+
+	if w := serve(h.UploadBin, r); w.Code != http.StatusUnauthorized {
+		t.Errorf("upload without a valid token = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if blobs := listBlobs(t, h, ""); len(blobs) != 0 {
+		t.Errorf("rejected upload stored %v", blobs)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestUploadBinRejectsForm(t *testing.T) {
+	image := appImage("1.0.0", 64)
+	tests := []struct {
+		name  string
+		parts []formPart
+		want  string
+	}{
+		{
+			name:  "firmware first",
+			parts: []formPart{file("firmware", image), field("game", "crisp-games"), field("version", "1.0.0")},
+			want:  "metadata fields must precede the firmware part (missing game, version)",
+		},
+		{
+			name:  "version after firmware",
+			parts: []formPart{field("game", "crisp-games"), file("firmware", image), field("version", "1.0.0")},
+			want:  "metadata fields must precede the firmware part (missing version)",
+		},
+		{
+			name:  "oversized field",
+			parts: []formPart{field("game", "crisp-games"), field("description", strings.Repeat("x", maxUploadFieldSize+1))},
+			want:  "Field description exceeds 64 KiB",
+		},
+		{
+			name:  "no firmware",
+			parts: []formPart{field("game", "crisp-games"), field("version", "1.0.0")},
+			want:  "Firmware file is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := testHandler(t)
+			w := serve(h.UploadBin, uploadRequest(t, "/api/fota/upload", tt.parts...))
+			if w.Code != http.StatusBadRequest || strings.TrimSpace(w.Body.String()) != tt.want {
+				t.Errorf("upload = %d %q, want 400 %q", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+			if blobs := listBlobs(t, h, ""); len(blobs) != 0 {
+				t.Errorf("rejected upload stored %v", blobs)
+			}
+			expectationsMet(t, mock)
+		})
+	}
+}
+
+func TestUploadBinAcceptsFullSizeField(t *testing.T) {
+	h, mock := testHandler(t)
+
+	// A field of exactly the limit passes and the upload goes on to look up
+	// the game
+	mock.ExpectQuery(`SELECT id FROM games WHERE code = \$1`).WithArgs("tetris").WillReturnError(sql.ErrNoRows)
+	w := serve(h.UploadBin, uploadRequest(t, "/api/fota/upload", field("game", "tetris"), field("version", "1.0.0"),
+		field("description", strings.Repeat("x", maxUploadFieldSize)), file("firmware", appImage("1.0.0", 64))))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("upload with a %d byte field = %d %s, want %d", maxUploadFieldSize, w.Code, w.Body, http.StatusNotFound)
+	}
+	expectationsMet(t, mock)
+}
+
+func TestStageFirmware(t *testing.T) {
+	h, _ := testHandler(t)
+	image := appImage("1.2.0", 4096)
+
+	staged, err := h.stageFirmware(context.Background(), uploadMeta{Board: testBoard, Version: "1.2.0"}, bytes.NewReader(image))
+	if err != nil {
+		t.Fatalf("stageFirmware: %v", err)
+	}
+	if !strings.HasPrefix(staged.BlobName, stagingPrefix) || staged.Size != int64(len(image)) {
+		t.Errorf("staged %s of %d bytes, want %d bytes under %s", staged.BlobName, staged.Size, len(image), stagingPrefix)
+	}
+	if digest := fmt.Sprintf("%x", sha256.Sum256(image)); staged.SHA256 != digest {
+		t.Errorf("staged SHA-256 = %s, want %s", staged.SHA256, digest)
+	}
+	if staged.Image == nil || staged.Image.Version != "1.2.0" || staged.Image.FlashSizeMB != 4 {
+		t.Errorf("staged image = %+v", staged.Image)
+	}
+
+	stored, err := h.readBlob(context.Background(), staged.BlobName)
+	if err != nil || !bytes.Equal(stored, image) {
+		t.Errorf("staged blob holds %d bytes, %v; want the image", len(stored), err)
+	}
+}
+
+func TestStageFirmwareRejects(t *testing.T) {
+	image := appImage("1.2.0", 4096)
+	corrupt := bytes.Clone(image)
+	corrupt[100] ^= 0xFF
+
+	tests := []struct {
+		name       string
+		meta       uploadMeta
+		data       []byte
+		maxSize    int64
+		wantStatus int
+	}{
+		{"too large", uploadMeta{Board: testBoard, Version: "1.2.0"}, image, 1024, http.StatusRequestEntityTooLarge},
+		{"not an image", uploadMeta{Board: testBoard, Version: "1.2.0"}, bytes.Repeat([]byte{0x42}, 4096), 1 << 20, http.StatusBadRequest},
+		{"corrupt", uploadMeta{Board: testBoard, Version: "1.2.0"}, corrupt, 1 << 20, http.StatusBadRequest},
+		{"trailing bytes", uploadMeta{Board: testBoard, Version: "1.2.0"}, append(bytes.Clone(image), 0, 0, 0), 1 << 20, http.StatusBadRequest},
+		{"version mismatch", uploadMeta{Board: testBoard, Version: "1.3.0"}, image, 1 << 20, http.StatusBadRequest},
+		{"other chip", uploadMeta{Board: boardRef{Code: "m5stickc-plus2", ChipID: 9, FlashSizeMB: 8}, Version: "1.2.0"}, image, 1 << 20, http.StatusBadRequest},
+		{"smaller flash", uploadMeta{Board: boardRef{Code: "tiny", FlashSizeMB: 2}, Version: "1.2.0"}, image, 1 << 20, http.StatusBadRequest},
+		{"expected digest", uploadMeta{Board: testBoard, Version: "1.2.0", ExpectedSHA256: strings.Repeat("0", 64)}, image, 1 << 20, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := testHandler(t)
+			h.maxFirmwareSize = tt.maxSize
+
+			_, err := h.stageFirmware(context.Background(), tt.meta, bytes.NewReader(tt.data))
+			w := httptest.NewRecorder()
+			writeUploadError(w, err)
+			if err == nil || w.Code != tt.wantStatus {
+				t.Errorf("stageFirmware() error = %v (%d), want %d", err, w.Code, tt.wantStatus)
+			}
+			if blobs := listBlobs(t, h, ""); len(blobs) != 0 {
+				t.Errorf("rejected image left %v", blobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package fota
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadParams(t *testing.T) {
+	tests := []struct {
+		name                string
+		fromVersion, device string
+		want                string
+	}{
+		{name: "image", want: "board=m5stickc-plus&game=crisp-games&version=1.4.0"},
+		{name: "patch", fromVersion: "1.3.0", want: "board=m5stickc-plus&from=1.3.0&game=crisp-games&version=1.4.0"},
+		{name: "device", device: "stick-1", want: "board=m5stickc-plus&device_id=stick-1&game=crisp-games&version=1.4.0"},
+	}
+
+	for _, tt := range tests {
+		got := downloadParams("crisp-games", "m5stickc-plus", "1.4.0", tt.fromVersion, tt.device).Encode()
+		if got != tt.want {
+			t.Errorf("downloadParams() for %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDownloadSignature(t *testing.T) {
+	h := &Handler{urlSecret: []byte("test-secret")}
+	other := &Handler{urlSecret: []byte("other-secret")}
+
+	signed := func(expiresAt time.Time) url.Values {
+		link := h.engineDownloadURL(downloadParams("crisp-games", "m5stickc-plus", "1.4.0", "", "stick-1"), expiresAt)
+		if !strings.HasPrefix(link, downloadPath+"?") {
+			t.Fatalf("engineDownloadURL() = %q, want a %s URL", link, downloadPath)
+		}
+		params, err := url.ParseQuery(strings.TrimPrefix(link, downloadPath+"?"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return params
+	}
+	clone := func(params url.Values) url.Values {
+		changed := url.Values{}
+		for k, v := range params {
+			changed[k] = v
+		}
+		return changed
+	}
+	with := func(params url.Values, key, value string) url.Values {
+		changed := clone(params)
+		changed.Set(key, value)
+		return changed
+	}
+	without := func(params url.Values, key string) url.Values {
+		changed := clone(params)
+		changed.Del(key)
+		return changed
+	}
+
+	valid := signed(time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name    string
+		handler *Handler
+		params  url.Values
+		want    bool
+	}{
+		{name: "valid", handler: h, params: valid, want: true},
+		{name: "other replica with the same secret", handler: &Handler{urlSecret: []byte("test-secret")}, params: valid, want: true},
+		{name: "other secret", handler: other, params: valid},
+		{name: "expired", handler: h, params: signed(time.Now().Add(-time.Minute))},
+		{name: "extended expiry", handler: h, params: with(valid, "expires", strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10))},
+		{name: "other version", handler: h, params: with(valid, "version", "1.5.0")},
+		{name: "other device", handler: h, params: with(valid, "device_id", "stick-2")},
+		{name: "added parameter", handler: h, params: with(valid, "from", "1.3.0")},
+		{name: "no signature", handler: h, params: without(valid, "sig")},
+		{name: "malformed signature", handler: h, params: with(valid, "sig", "not-hex")},
+		{name: "no expiry", handler: h, params: without(valid, "expires")},
+	}
+
+	for _, tt := range tests {
+		if got := tt.handler.validDownloadSignature(tt.params); got != tt.want {
+			t.Errorf("validDownloadSignature() for %s = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
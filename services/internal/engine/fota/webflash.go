@@ -0,0 +1,254 @@
+package fota
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/espimage"
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/parttable"
+)
+
+// EspWebToolsManifest is an ESP Web Tools manifest, used to flash a blank
+// device over Web Serial from the browser
+type EspWebToolsManifest struct {
+	Name                  string             `json:"name"`
+	Version               string             `json:"version"`
+	NewInstallPromptErase bool               `json:"new_install_prompt_erase"`
+	Builds                []EspWebToolsBuild `json:"builds"`
+}
+
+type EspWebToolsBuild struct {
+	ChipFamily string            `json:"chipFamily"`
+	Parts      []EspWebToolsPart `json:"parts"`
+}
+
+type EspWebToolsPart struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+}
+
+// errNotInstallable is returned for encrypted releases and releases without
+// the images a blank device needs
+var errNotInstallable = errors.New("release cannot be installed on a blank device")
+
+// WebFlashManifest serves the ESP Web Tools manifest of an active
+// release (?game=&board=&version=, newest release of ?channel= when no
+// version is given). Only unencrypted bundle releases with a bootloader and
+// partition table can be flashed onto a blank device. The part paths are signed
+// engine download URLs, so browsers fetch every image from the engine.
+func (h *Handler) WebFlashManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The portal may be served from another origin than the engine
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	game, err := h.resolveGame(r.URL.Query().Get("game"), "")
+	if err != nil {
+		writeGameError(w, err)
+		return
+	}
+
+	boardCode := r.URL.Query().Get("board")
+	if boardCode == "" {
+		boardCode = DefaultBoard
+	}
+	board, err := h.lookupBoard(boardCode)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Unknown board", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to query board %s: %v", boardCode, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	channel := r.URL.Query().Get("channel")
+	if channel == "" {
+		channel = ChannelStable
+	}
+	if !validChannel(channel) {
+		http.Error(w, "Unknown channel", http.StatusBadRequest)
+		return
+	}
+
+	releases, err := h.activeReleases(game.ID, board.Code, channel)
+	if err != nil {
+		log.Printf("Failed to query firmware: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var release *firmwareRelease
+	if version := r.URL.Query().Get("version"); version != "" {
+		if v, err := ParseVersion(version); err == nil {
+			version = v.String()
+		}
+		for i := range releases {
+			if releases[i].Version == version {
+				release = &releases[i]
+			}
+		}
+	} else {
+		release = newestRelease(applyPromotions(releases))
+	}
+	if release == nil {
+		http.Error(w, "Firmware not found", http.StatusNotFound)
+		return
+	}
+
+	manifest, err := h.espWebToolsManifest(r.Context(), game, board, release)
+	if err == errNotInstallable {
+		http.Error(w, "Release is encrypted or has no bootloader and partition table to install on a blank device", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to build web flash manifest for %s %s: %v", game.Code, release.Version, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Web flash manifest: game=%s, board=%s, version=%s", game.Code, board.Code, release.Version)
+	writeJSON(w, http.StatusOK, manifest)
+}
+
+// espWebToolsManifest lays out a release's images at their flash offsets. The
+// app goes to the partition a device boots from with erased otadata.
+func (h *Handler) espWebToolsManifest(ctx context.Context, game gameRef, board boardRef, release *firmwareRelease) (*EspWebToolsManifest, error) {
+	// Browsers cannot flash an encrypted release's artifact
+	if release.Encrypt {
+		return nil, errNotInstallable
+	}
+
+	chipFamily := espimage.ChipName(uint16(board.ChipID))
+	if chipFamily == "" {
+		return nil, fmt.Errorf("unknown chip ID 0x%04X of board %s", board.ChipID, board.Code)
+	}
+
+	partitions, err := h.releasePartitions(release.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var bootloader, tableImage *firmwarePartition
+	for i := range partitions {
+		switch partitions[i].Type {
+		case PartBootloader:
+			bootloader = &partitions[i]
+		case PartPartitionTable:
+			tableImage = &partitions[i]
+		}
+	}
+	if bootloader == nil || tableImage == nil || bootloader.Offset == nil || tableImage.Offset == nil {
+		return nil, errNotInstallable
+	}
+
+	table, err := h.loadPartitionTable(ctx, tableImage.BlobName)
+	if err != nil {
+		return nil, err
+	}
+	bootApp, ok := table.BootApp()
+	if !ok || int64(bootApp.Size) < release.FileSize {
+		return nil, errNotInstallable
+	}
+
+	expiresAt := time.Now().Add(h.urlTTL)
+	params := func(partition string) url.Values {
+		p := downloadParams(game.Code, board.Code, release.Version, "", "")
+		if partition != "" {
+			p.Set("partition", partition)
+		}
+		return p
+	}
+
+	parts := []EspWebToolsPart{{Path: h.engineDownloadURL(params(""), expiresAt), Offset: int64(bootApp.Offset)}}
+	for _, p := range partitions {
+		if p.Offset == nil {
+			continue
+		}
+		parts = append(parts, EspWebToolsPart{Path: h.engineDownloadURL(params(p.Label), expiresAt), Offset: *p.Offset})
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Offset < parts[j].Offset })
+
+	var title string
+	if err := h.db.QueryRow(`SELECT title FROM games WHERE id = $1`, game.ID).Scan(&title); err != nil {
+		return nil, err
+	}
+
+	return &EspWebToolsManifest{
+		Name:    title,
+		Version: release.Version,
+		// A previous install may leave otadata pointing at another slot
+		NewInstallPromptErase: true,
+		Builds:                []EspWebToolsBuild{{ChipFamily: chipFamily, Parts: parts}},
+	}, nil
+}
+
+func (h *Handler) loadPartitionTable(ctx context.Context, blobName string) (*parttable.Table, error) {
+	reader, err := h.storage.Download(ctx, blobName)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, parttable.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	return parttable.Parse(data)
+}
+
+// InstallableRelease is an active stable release that can be flashed onto
+// a blank device from the browser
+type InstallableRelease struct {
+	Game        string
+	Title       string
+	Board       string
+	BoardName   string
+	Version     string
+	Description string
+	FileSize    int64
+	CreatedAt   time.Time
+}
+
+// QueryInstallableReleases lists the stable bundle releases that ship a
+// bootloader and partition table, newest first, optionally for one game.
+// It backs the portal's install page.
+func QueryInstallableReleases(db *sql.DB, game string) ([]InstallableRelease, error) {
+	rows, err := db.Query(`
+		SELECT g.code, g.title, b.code, b.name, f.version, COALESCE(f.description, ''), f.file_size, f.created_at
+		FROM firmwares f
+		JOIN games g ON g.id = f.game_id
+		JOIN boards b ON b.id = f.board_id
+		WHERE ($1 = '' OR g.code = $1)
+			AND f.is_active = TRUE AND NOT f.is_recalled AND NOT f.encrypt AND f.channel = 'stable' AND `+publishedNow+`
+			AND EXISTS (SELECT 1 FROM firmware_partitions p WHERE p.firmware_id = f.id AND p.part_type = 'bootloader')
+			AND EXISTS (SELECT 1 FROM firmware_partitions p WHERE p.firmware_id = f.id AND p.part_type = 'partition_table')
+		ORDER BY g.title, b.code, f.created_at DESC
+	`, game)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	releases := []InstallableRelease{}
+	for rows.Next() {
+		var rel InstallableRelease
+		if err := rows.Scan(&rel.Game, &rel.Title, &rel.Board, &rel.BoardName, &rel.Version, &rel.Description, &rel.FileSize, &rel.CreatedAt); err != nil {
+			return nil, err
+		}
+		releases = append(releases, rel)
+	}
+	return releases, rows.Err()
+}
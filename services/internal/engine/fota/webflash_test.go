@@ -0,0 +1,159 @@
+package fota
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/parttable"
+)
+
+// expectWebFlashRelease expects WebFlashManifest to find crisp-games for
+// m5stickc-plus and the stable releases
+func expectWebFlashRelease(mock sqlmock.Sqlmock, releases ...firmwareRelease) {
+	expectTestGame(mock)
+	mock.ExpectQuery(`SELECT id, chip_id, flash_size_mb FROM boards`).WithArgs(DefaultBoard).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "chip_id", "flash_size_mb"}).AddRow(1, 0, 4))
+	mock.ExpectQuery(`channel IN \(\$3, 'stable'\)`).WithArgs(1, DefaultBoard, ChannelStable).
+		WillReturnRows(releaseRows(releases...))
+}
+
+// expectBundlePartitions expects the bootloader, partition table and spiffs
+// image of a bundle release
+func expectBundlePartitions(mock sqlmock.Sqlmock, firmwareID int64, tableBlob string) {
+	mock.ExpectQuery(`FROM firmware_partitions`).WithArgs(firmwareID).
+		WillReturnRows(sqlmock.NewRows([]string{"label", "part_type", "flash_offset", "blob_name", "file_size", "checksum", "sha256"}).
+			AddRow(PartBootloader, PartBootloader, 0x1000, "_sha256/boot.bin", 0x6000, "md5-boot", "sha256-boot").
+			AddRow(PartPartitionTable, PartPartitionTable, 0x8000, tableBlob, parttable.MaxSize, "md5-table", "sha256-table").
+			AddRow("spiffs", PartData, 0x290000, "_sha256/spiffs.bin", 0x1000, "md5-spiffs", "sha256-spiffs"))
+}
+
+func TestWebFlashManifest(t *testing.T) {
+	h, mock := testHandler(t)
+	putBlob(t, h, "_sha256/table.bin", partitionTable(otaLayout))
+
+	expectWebFlashRelease(mock, testRelease(1, "1.0.0"), testRelease(2, "1.1.0"))
+	expectBundlePartitions(mock, 2, "_sha256/table.bin")
+	mock.ExpectQuery(`SELECT title FROM games`).WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"title"}).AddRow("Crisp Games"))
+
+	w := serve(h.WebFlashManifest, adminRequest(http.MethodGet, "/api/fota/webflash/manifest.json?game=crisp-games", ""))
+	if w.Code != http.StatusOK {
+		t.Fatalf("manifest = %d: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Error("manifest is not readable from the portal's origin")
+	}
+
+	var manifest EspWebToolsManifest
+	if err := json.NewDecoder(w.Body).Decode(&manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != "Crisp Games" || manifest.Version != "1.1.0" || !manifest.NewInstallPromptErase || len(manifest.Builds) != 1 {
+		t.Fatalf("manifest = %+v, want one build of Crisp Games 1.1.0", manifest)
+	}
+	build := manifest.Builds[0]
+	if build.ChipFamily != "ESP32" {
+		t.Errorf("chipFamily = %s, want ESP32", build.ChipFamily)
+	}
+
+	// The app goes to ota_0 and every image is a signed engine URL, in
+	// flash order
+	want := []struct {
+		offset    int64
+		partition string
+	}{{0x1000, PartBootloader}, {0x8000, PartPartitionTable}, {0x10000, ""}, {0x290000, "spiffs"}}
+	if len(build.Parts) != len(want) {
+		t.Fatalf("parts = %+v, want %d", build.Parts, len(want))
+	}
+	for i, part := range build.Parts {
+		link, err := url.Parse(part.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := link.Query()
+		if part.Offset != want[i].offset || q.Get("partition") != want[i].partition || q.Get("version") != "1.1.0" {
+			t.Errorf("part %d = %s at 0x%x, want partition %q at 0x%x", i, part.Path, part.Offset, want[i].partition, want[i].offset)
+		}
+		if link.Path != downloadPath || !h.validDownloadSignature(q) {
+			t.Errorf("part %d path %s is not a signed engine download URL", i, part.Path)
+		}
+	}
+	expectationsMet(t, mock)
+}
+
+func TestWebFlashManifestNotInstallable(t *testing.T) {
+	encrypted := testRelease(2, "1.1.0")
+	encrypted.Encrypt = true
+	large := testRelease(2, "1.1.0")
+	large.FileSize = 0x140001
+
+	tests := []struct {
+		name    string
+		release firmwareRelease
+		expect  func(mock sqlmock.Sqlmock)
+	}{
+		{name: "encrypted", release: encrypted},
+		{
+			name:    "plain release",
+			release: testRelease(2, "1.1.0"),
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`FROM firmware_partitions`).WithArgs(2).
+					WillReturnRows(sqlmock.NewRows([]string{"label", "part_type", "flash_offset", "blob_name", "file_size", "checksum", "sha256"}))
+			},
+		},
+		{
+			name:    "app larger than the boot slot",
+			release: large,
+			expect: func(mock sqlmock.Sqlmock) {
+				expectBundlePartitions(mock, 2, "_sha256/table.bin")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := testHandler(t)
+			putBlob(t, h, "_sha256/table.bin", partitionTable(otaLayout))
+			expectWebFlashRelease(mock, tt.release)
+			if tt.expect != nil {
+				tt.expect(mock)
+			}
+
+			w := serve(h.WebFlashManifest, adminRequest(http.MethodGet, "/api/fota/webflash/manifest.json?game=crisp-games", ""))
+			if w.Code != http.StatusConflict {
+				t.Errorf("manifest = %d, want %d: %s", w.Code, http.StatusConflict, w.Body)
+			}
+			expectationsMet(t, mock)
+		})
+	}
+}
+
+func TestWebFlashManifestRejects(t *testing.T) {
+	t.Run("unknown channel", func(t *testing.T) {
+		h, mock := testHandler(t)
+		expectTestGame(mock)
+		mock.ExpectQuery(`FROM boards`).WithArgs(DefaultBoard).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "chip_id", "flash_size_mb"}).AddRow(1, 0, 4))
+
+		w := serve(h.WebFlashManifest, adminRequest(http.MethodGet, "/api/fota/webflash/manifest.json?game=crisp-games&channel=canary", ""))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("manifest = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+		expectationsMet(t, mock)
+	})
+
+	t.Run("unknown version", func(t *testing.T) {
+		h, mock := testHandler(t)
+		expectWebFlashRelease(mock, testRelease(2, "1.1.0"))
+
+		w := serve(h.WebFlashManifest, adminRequest(http.MethodGet, "/api/fota/webflash/manifest.json?game=crisp-games&version=1.2.0", ""))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("manifest = %d, want %d", w.Code, http.StatusNotFound)
+		}
+		expectationsMet(t, mock)
+	})
+}
@@ -0,0 +1,266 @@
+package fota
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	// The engine image ships without a zoneinfo database
+	_ "time/tzdata"
+)
+
+// UpdateWindow is a daily time-of-day range in which the members of a group
+// may update. Start after End wraps past midnight, Start equal to End is the
+// whole day.
+type UpdateWindow struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	TimeZone string `json:"time_zone"`
+}
+
+type groupWindowsRequest struct {
+	Group   string         `json:"group"`
+	Windows []UpdateWindow `json:"windows"`
+}
+
+// timeOfDayLayout is the format of window bounds in requests and of TIME
+// values as returned by Postgres
+const timeOfDayLayout = "15:04"
+
+// parseTimeOfDay accepts HH:MM and HH:MM:SS and returns the offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse(timeOfDayLayout+":05", s)
+	if err != nil {
+		t, err = time.Parse(timeOfDayLayout, s)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second, nil
+}
+
+// openAt reports whether the window is open at now, and if not how long
+// until it opens
+func (uw UpdateWindow) openAt(now time.Time) (bool, time.Duration, error) {
+	loc, err := time.LoadLocation(uw.TimeZone)
+	if err != nil {
+		return false, 0, err
+	}
+	start, err := parseTimeOfDay(uw.Start)
+	if err != nil {
+		return false, 0, err
+	}
+	end, err := parseTimeOfDay(uw.End)
+	if err != nil {
+		return false, 0, err
+	}
+
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	sinceMidnight := local.Sub(midnight)
+
+	var open bool
+	switch {
+	case start == end:
+		open = true
+	case start < end:
+		open = sinceMidnight >= start && sinceMidnight < end
+	default:
+		open = sinceMidnight >= start || sinceMidnight < end
+	}
+	if open {
+		return true, 0, nil
+	}
+
+	// Build the next opening from the wall clock so DST changes are honoured
+	h, m, s := int(start/time.Hour), int(start%time.Hour/time.Minute), int(start%time.Minute/time.Second)
+	next := time.Date(local.Year(), local.Month(), local.Day(), h, m, s, 0, loc)
+	if !next.After(now) {
+		next = time.Date(local.Year(), local.Month(), local.Day()+1, h, m, s, 0, loc)
+	}
+	return false, next.Sub(now), nil
+}
+
+// updateAllowed checks the update windows of every group the device is in
+func (h *Handler) updateAllowed(deviceID string, now time.Time) (allowed bool, retryAfter time.Duration, err error) {
+	if deviceID == "" {
+		return true, 0, nil
+	}
+
+	windows, err := h.deviceWindows(deviceID)
+	if err != nil {
+		return false, 0, err
+	}
+	allowed, retryAfter = windowsAllow(windows, now)
+	return allowed, retryAfter, nil
+}
+
+// deviceWindows returns the update windows of every group the device is in
+func (h *Handler) deviceWindows(deviceID string) ([]UpdateWindow, error) {
+	rows, err := h.db.Query(`
+		SELECT w.start_time::text, w.end_time::text, w.time_zone
+		FROM update_windows w
+		JOIN device_group_members m ON m.group_id = w.group_id
+		WHERE m.device_id = $1
+	`, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var windows []UpdateWindow
+	for rows.Next() {
+		var uw UpdateWindow
+		if err := rows.Scan(&uw.Start, &uw.End, &uw.TimeZone); err != nil {
+			return nil, err
+		}
+		windows = append(windows, uw)
+	}
+	return windows, rows.Err()
+}
+
+// windowsAllow tells whether a device with the given windows may update.
+// Devices without windows may always update; otherwise any open window
+// allows it and retryAfter is the time until the first one opens.
+func windowsAllow(windows []UpdateWindow, now time.Time) (allowed bool, retryAfter time.Duration) {
+	allowed = true
+	for _, uw := range windows {
+		open, wait, err := uw.openAt(now)
+		if err != nil {
+			// Windows are validated on save, so this is a zone the runtime
+			// no longer knows; it must not lock devices out
+			log.Printf("Ignoring invalid update window %s-%s %s: %v", uw.Start, uw.End, uw.TimeZone, err)
+			continue
+		}
+		if open {
+			return true, 0
+		}
+		if allowed || wait < retryAfter {
+			retryAfter = wait
+		}
+		allowed = false
+	}
+	return allowed, retryAfter
+}
+
+// GroupWindows lists (GET ?group=) or replaces (PUT) the update windows of a
+// group. An empty list lifts the restriction. Admin only.
+func (h *Handler) GroupWindows(w http.ResponseWriter, r *http.Request) {
+	if !h.authorizeAdmin(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.listGroupWindows(w, r)
+	case http.MethodPut:
+		h.saveGroupWindows(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) listGroupWindows(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	groupID, err := h.lookupGroup(group)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	windows, err := h.groupWindows(groupID)
+	if err != nil {
+		log.Printf("Failed to query update windows of %s: %v", group, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, groupWindowsRequest{Group: group, Windows: windows})
+}
+
+func (h *Handler) groupWindows(groupID int64) ([]UpdateWindow, error) {
+	rows, err := h.db.Query(`
+		SELECT to_char(start_time, 'HH24:MI'), to_char(end_time, 'HH24:MI'), time_zone
+		FROM update_windows
+		WHERE group_id = $1
+		ORDER BY id
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	windows := []UpdateWindow{}
+	for rows.Next() {
+		var uw UpdateWindow
+		if err := rows.Scan(&uw.Start, &uw.End, &uw.TimeZone); err != nil {
+			return nil, err
+		}
+		windows = append(windows, uw)
+	}
+	return windows, rows.Err()
+}
+
+func (h *Handler) saveGroupWindows(w http.ResponseWriter, r *http.Request) {
+	var req groupWindowsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	for i := range req.Windows {
+		uw := &req.Windows[i]
+		if uw.TimeZone == "" {
+			uw.TimeZone = "UTC"
+		}
+		if _, _, err := uw.openAt(time.Now()); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid window %d: start and end must be HH:MM and time_zone an IANA zone such as Europe/Warsaw", i+1), http.StatusBadRequest)
+			return
+		}
+	}
+
+	groupID, err := h.lookupGroup(req.Group)
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	if err := h.replaceGroupWindows(groupID, req.Windows); err != nil {
+		log.Printf("Failed to save update windows of %s: %v", req.Group, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Group %s has %d update windows", req.Group, len(req.Windows))
+
+	if req.Windows == nil {
+		req.Windows = []UpdateWindow{}
+	}
+	writeJSON(w, http.StatusOK, req)
+}
+
+func (h *Handler) replaceGroupWindows(groupID int64, windows []UpdateWindow) error {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM update_windows WHERE group_id = $1`, groupID); err != nil {
+		return err
+	}
+
+	for _, uw := range windows {
+		_, err := tx.Exec(`
+			INSERT INTO update_windows (group_id, start_time, end_time, time_zone)
+			VALUES ($1, $2, $3, $4)
+		`, groupID, uw.Start, uw.End, uw.TimeZone)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,133 @@
+package fota
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimeOfDay(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "00:00", want: 0},
+		{in: "02:30", want: 2*time.Hour + 30*time.Minute},
+		{in: "23:59", want: 23*time.Hour + 59*time.Minute},
+		{in: "02:30:15", want: 2*time.Hour + 30*time.Minute + 15*time.Second},
+		{in: "2:30", want: 2*time.Hour + 30*time.Minute},
+
+		{in: "", wantErr: true},
+		{in: "24:00", wantErr: true},
+		{in: "12:60", wantErr: true},
+		{in: "noon", wantErr: true},
+		{in: "12:00 PM", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseTimeOfDay(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseTimeOfDay(%q) = %v, want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseTimeOfDay(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTimeOfDay(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateWindowOpenAt(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		now, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return now
+	}
+
+	tests := []struct {
+		name     string
+		window   UpdateWindow
+		now      string
+		wantOpen bool
+		wantWait time.Duration
+	}{
+		{name: "inside", window: UpdateWindow{"02:00", "06:00", "UTC"}, now: "2025-06-14T03:00:00Z", wantOpen: true},
+		{name: "at start", window: UpdateWindow{"02:00", "06:00", "UTC"}, now: "2025-06-14T02:00:00Z", wantOpen: true},
+		{name: "before start", window: UpdateWindow{"02:00", "06:00", "UTC"}, now: "2025-06-14T01:30:00Z", wantWait: 30 * time.Minute},
+		{name: "at end", window: UpdateWindow{"02:00", "06:00", "UTC"}, now: "2025-06-14T06:00:00Z", wantWait: 20 * time.Hour},
+		{name: "seconds", window: UpdateWindow{"02:00:30", "06:00:00", "UTC"}, now: "2025-06-14T02:00:00Z", wantWait: 30 * time.Second},
+
+		{name: "wrapping, before midnight", window: UpdateWindow{"22:00", "04:00", "UTC"}, now: "2025-06-14T23:00:00Z", wantOpen: true},
+		{name: "wrapping, after midnight", window: UpdateWindow{"22:00", "04:00", "UTC"}, now: "2025-06-14T03:59:00Z", wantOpen: true},
+		{name: "wrapping, at end", window: UpdateWindow{"22:00", "04:00", "UTC"}, now: "2025-06-14T04:00:00Z", wantWait: 18 * time.Hour},
+
+		{name: "whole day", window: UpdateWindow{"08:00", "08:00", "UTC"}, now: "2025-06-14T07:59:00Z", wantOpen: true},
+
+		// 01:00 UTC is 03:00 in Warsaw in summer, 21:30 the day before in New York
+		{name: "local time", window: UpdateWindow{"02:00", "06:00", "Europe/Warsaw"}, now: "2025-06-14T01:00:00Z", wantOpen: true},
+		{name: "local date", window: UpdateWindow{"22:00", "23:00", "America/New_York"}, now: "2025-06-15T01:30:00Z", wantWait: 30 * time.Minute},
+
+		// Clocks in Warsaw go from 02:00 to 03:00 on 2025-03-30, so the
+		// night is an hour shorter
+		{name: "daylight saving", window: UpdateWindow{"04:00", "05:00", "Europe/Warsaw"}, now: "2025-03-29T23:00:00Z", wantWait: 3 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			open, wait, err := tt.window.openAt(at(tt.now))
+			if err != nil {
+				t.Fatalf("openAt: %v", err)
+			}
+			if open != tt.wantOpen || wait != tt.wantWait {
+				t.Errorf("openAt(%s) = %v, %v; want %v, %v", tt.now, open, wait, tt.wantOpen, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestUpdateWindowOpenAtInvalid(t *testing.T) {
+	tests := []UpdateWindow{
+		{"02:00", "06:00", "Mars/Olympus_Mons"},
+		{"25:00", "06:00", "UTC"},
+		{"02:00", "noon", "UTC"},
+	}
+
+	for _, uw := range tests {
+		if _, _, err := uw.openAt(time.Now()); err == nil {
+			t.Errorf("openAt() with %+v succeeded, want error", uw)
+		}
+	}
+}
+
+func TestWindowsAllow(t *testing.T) {
+	now := time.Date(2025, 6, 14, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		windows     []UpdateWindow
+		wantAllowed bool
+		wantRetry   time.Duration
+	}{
+		{name: "no windows", wantAllowed: true},
+		{name: "one open", windows: []UpdateWindow{{"14:00", "15:00", "UTC"}, {"11:00", "13:00", "UTC"}}, wantAllowed: true},
+		{name: "all closed", windows: []UpdateWindow{{"15:00", "16:00", "UTC"}, {"13:00", "14:00", "UTC"}}, wantRetry: time.Hour},
+		// A window the runtime cannot evaluate must not lock devices out
+		{name: "only invalid", windows: []UpdateWindow{{"02:00", "06:00", "Mars/Olympus_Mons"}}, wantAllowed: true},
+		{name: "invalid and closed", windows: []UpdateWindow{{"02:00", "06:00", "Mars/Olympus_Mons"}, {"14:00", "15:00", "UTC"}}, wantRetry: 2 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		allowed, retryAfter := windowsAllow(tt.windows, now)
+		if allowed != tt.wantAllowed || retryAfter != tt.wantRetry {
+			t.Errorf("%s: windowsAllow() = %v, %v; want %v, %v", tt.name, allowed, retryAfter, tt.wantAllowed, tt.wantRetry)
+		}
+	}
+}
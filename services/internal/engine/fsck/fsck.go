@@ -0,0 +1,287 @@
+// Package fsck checks that the blobs referenced by the database exist in
+// storage with the recorded size and checksums, and finds blobs nothing
+// references.
+package fsck
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"time"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/storage"
+)
+
+// Issue kinds
+const (
+	KindMissing          = "missing"
+	KindSizeMismatch     = "size_mismatch"
+	KindChecksumMismatch = "checksum_mismatch"
+	KindOrphan           = "orphan"
+)
+
+// Options controls a run
+type Options struct {
+	// VerifyChecksums downloads every referenced blob and re-hashes it
+	VerifyChecksums bool
+	// DeleteOrphans removes unreferenced blobs last modified more than
+	// GracePeriod ago. Younger orphans are only reported, since an upload
+	// stores its blob before it records it.
+	DeleteOrphans bool
+	GracePeriod   time.Duration
+}
+
+// Issue is one inconsistency
+type Issue struct {
+	Kind     string `json:"kind"`
+	BlobName string `json:"blob_name"`
+	// Owner names the row referencing the blob, e.g. "firmware 12"
+	Owner   string     `json:"owner,omitempty"`
+	Detail  string     `json:"detail,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+	Deleted bool       `json:"deleted,omitempty"`
+}
+
+// Report summarizes a run
+type Report struct {
+	StartedAt      time.Time `json:"started_at"`
+	Duration       string    `json:"duration"`
+	References     int       `json:"references"`
+	Blobs          int       `json:"blobs"`
+	Verified       int       `json:"verified"`
+	OrphansDeleted int       `json:"orphans_deleted"`
+	Issues         []Issue   `json:"issues"`
+}
+
+// Problems counts issues that still need attention
+func (r *Report) Problems() int {
+	n := 0
+	for _, issue := range r.Issues {
+		if !issue.Deleted {
+			n++
+		}
+	}
+	return n
+}
+
+// escrowOverhead is the AES-GCM nonce and tag an escrow copy adds to the
+// image
+const escrowOverhead = 12 + 16
+
+// reference is a blob recorded in the database. Empty hashes are not
+// checked.
+type reference struct {
+	BlobName string
+	Owner    string
+	Size     int64
+	MD5      string
+	SHA256   string
+}
+
+// Run checks db against stor
+func Run(ctx context.Context, db *sql.DB, stor storage.Storage, opts Options) (*Report, error) {
+	report := &Report{StartedAt: time.Now().UTC(), Issues: []Issue{}}
+
+	// References are loaded before listing so a blob recorded in between is
+	// never reported as an orphan
+	refs, err := loadReferences(db)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load blob references: %w", err)
+	}
+	report.References = len(refs)
+
+	objects, err := stor.ListObjects(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	report.Blobs = len(objects)
+
+	stored := make(map[string]storage.ObjectInfo, len(objects))
+	for _, obj := range objects {
+		stored[obj.Key] = obj
+	}
+
+	referenced := make(map[string]bool, len(refs))
+	for _, ref := range refs {
+		referenced[ref.BlobName] = true
+
+		obj, ok := stored[ref.BlobName]
+		if !ok {
+			// The row may have been deleted together with its blob since
+			still, err := stillReferenced(db, ref.BlobName)
+			if err != nil {
+				return nil, err
+			}
+			if still {
+				report.Issues = append(report.Issues, Issue{Kind: KindMissing, BlobName: ref.BlobName, Owner: ref.Owner})
+			}
+			continue
+		}
+
+		if obj.Size != ref.Size {
+			report.Issues = append(report.Issues, Issue{
+				Kind:     KindSizeMismatch,
+				BlobName: ref.BlobName,
+				Owner:    ref.Owner,
+				Detail:   fmt.Sprintf("stored %d bytes, recorded %d", obj.Size, ref.Size),
+				ModTime:  &obj.ModTime,
+			})
+			continue
+		}
+
+		if opts.VerifyChecksums && (ref.MD5 != "" || ref.SHA256 != "") {
+			detail, err := verifyChecksums(ctx, stor, ref)
+			if err != nil {
+				return nil, err
+			}
+			report.Verified++
+			if detail != "" {
+				report.Issues = append(report.Issues, Issue{
+					Kind:     KindChecksumMismatch,
+					BlobName: ref.BlobName,
+					Owner:    ref.Owner,
+					Detail:   detail,
+					ModTime:  &obj.ModTime,
+				})
+			}
+		}
+	}
+
+	cutoff := time.Now().Add(-opts.GracePeriod)
+	for _, obj := range objects {
+		if referenced[obj.Key] {
+			continue
+		}
+
+		issue := Issue{Kind: KindOrphan, BlobName: obj.Key, ModTime: &obj.ModTime}
+		if opts.DeleteOrphans && obj.ModTime.Before(cutoff) {
+			deleted, still, err := deleteOrphan(ctx, db, stor, obj.Key)
+			if err != nil {
+				return nil, err
+			}
+			if still {
+				continue
+			}
+			if deleted {
+				issue.Deleted = true
+				report.OrphansDeleted++
+			}
+		}
+		report.Issues = append(report.Issues, issue)
+	}
+
+	report.Duration = time.Since(report.StartedAt).Round(time.Millisecond).String()
+	return report, nil
+}
+
+func loadReferences(db *sql.DB) ([]reference, error) {
+	rows, err := db.Query(`
+		SELECT blob_name, 'firmware ' || id, file_size, checksum, COALESCE(sha256, '') FROM firmwares WHERE NOT plain_deleted
+		UNION ALL
+		SELECT blob_name, 'patch ' || id, file_size, checksum, '' FROM firmware_patches
+		UNION ALL
+		SELECT blob_name, 'partition ' || label || ' of firmware ' || firmware_id, file_size, checksum, sha256 FROM firmware_partitions
+		UNION ALL
+		SELECT blob_name, 'upload session ' || session_id, size, '', '' FROM upload_chunks
+		UNION ALL
+		SELECT blob_name, 'encrypted firmware ' || firmware_id, file_size, '', sha256 FROM firmware_encrypted
+		UNION ALL
+		SELECT blob_name, encoding || ' firmware ' || firmware_id, file_size, checksum, sha256 FROM firmware_compressed
+		UNION ALL
+		SELECT escrow_blob_name, 'escrow of firmware ' || id, file_size + $1, '', '' FROM firmwares WHERE escrow_blob_name IS NOT NULL
+	`, escrowOverhead)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refs []reference
+	for rows.Next() {
+		var ref reference
+		if err := rows.Scan(&ref.BlobName, &ref.Owner, &ref.Size, &ref.MD5, &ref.SHA256); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// deleteOrphan deletes an unreferenced blob. It re-checks the references
+// under the blob's advisory lock, the one uploads hold while they record a
+// release against an existing content blob, so a blob recorded since the
+// references were loaded is never deleted. A failed delete is only logged.
+func deleteOrphan(ctx context.Context, db *sql.DB, stor storage.Storage, blobName string) (deleted, referenced bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, blobName); err != nil {
+		return false, false, err
+	}
+
+	referenced, err = stillReferenced(tx, blobName)
+	if err != nil || referenced {
+		return false, referenced, err
+	}
+
+	if err := stor.Delete(ctx, blobName); err != nil {
+		log.Printf("Failed to delete orphaned blob %s: %v", blobName, err)
+		return false, false, nil
+	}
+	return true, false, tx.Commit()
+}
+
+// queryRower is a *sql.DB or *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func stillReferenced(db queryRower, blobName string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM firmwares WHERE blob_name = $1 AND NOT plain_deleted)
+			OR EXISTS (SELECT 1 FROM firmware_patches WHERE blob_name = $1)
+			OR EXISTS (SELECT 1 FROM firmware_partitions WHERE blob_name = $1)
+			OR EXISTS (SELECT 1 FROM upload_chunks WHERE blob_name = $1)
+			OR EXISTS (SELECT 1 FROM firmware_encrypted WHERE blob_name = $1)
+			OR EXISTS (SELECT 1 FROM firmware_compressed WHERE blob_name = $1)
+			OR EXISTS (SELECT 1 FROM firmwares WHERE escrow_blob_name = $1)
+	`, blobName).Scan(&exists)
+	return exists, err
+}
+
+// verifyChecksums re-hashes a stored blob and describes any mismatch
+func verifyChecksums(ctx context.Context, stor storage.Storage, ref reference) (string, error) {
+	reader, err := stor.Download(ctx, ref.BlobName)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", ref.BlobName, err)
+	}
+	defer reader.Close()
+
+	md5Hash, sha256Hash := md5.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), reader); err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", ref.BlobName, err)
+	}
+
+	if detail := compareDigest("MD5", md5Hash, ref.MD5); detail != "" {
+		return detail, nil
+	}
+	return compareDigest("SHA-256", sha256Hash, ref.SHA256), nil
+}
+
+func compareDigest(name string, h hash.Hash, recorded string) string {
+	if recorded == "" {
+		return ""
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != recorded {
+		return fmt.Sprintf("%s of stored blob is %s, recorded %s", name, actual, recorded)
+	}
+	return ""
+}
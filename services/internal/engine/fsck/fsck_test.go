@@ -0,0 +1,217 @@
+package fsck
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/storage"
+)
+
+// bucket is a fileblob bucket in a temporary directory
+type bucket struct {
+	*storage.CloudStorage
+	dir string
+}
+
+func newBucket(t *testing.T) *bucket {
+	t.Helper()
+	dir := t.TempDir()
+	stor, err := storage.NewCloudStorage(context.Background(), "file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stor.Close() })
+	return &bucket{CloudStorage: stor, dir: dir}
+}
+
+// put stores a blob last modified age ago
+func (b *bucket) put(t *testing.T, key string, data []byte, age time.Duration) {
+	t.Helper()
+	if _, err := b.Upload(context.Background(), key, bytes.NewReader(data), "application/octet-stream"); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(b.dir, filepath.FromSlash(key)), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (b *bucket) keys(t *testing.T) []string {
+	t.Helper()
+	keys, err := b.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var referenceColumns = []string{"blob_name", "owner", "file_size", "checksum", "sha256"}
+
+func digests(data []byte) (string, string) {
+	return fmt.Sprintf("%x", md5.Sum(data)), fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+func issueKinds(report *Report) map[string]string {
+	kinds := make(map[string]string)
+	for _, issue := range report.Issues {
+		kind := issue.Kind
+		if issue.Deleted {
+			kind += " (deleted)"
+		}
+		kinds[issue.BlobName] = kind
+	}
+	return kinds
+}
+
+func expectStillReferenced(mock sqlmock.Sqlmock, blobName string, referenced bool) {
+	mock.ExpectQuery(`SELECT EXISTS`).WithArgs(blobName).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(referenced))
+}
+
+func TestRunDetectsIssues(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := newBucket(t)
+
+	image := []byte("crisp-games 1.4.0")
+	md5Hex, sha256Hex := digests(image)
+	b.put(t, "_sha256/good.bin", image, 0)
+	b.put(t, "_sha256/short.bin", image[:4], 0)
+	b.put(t, "_sha256/corrupt.bin", bytes.ToUpper(image), 0)
+	b.put(t, "_staging/orphan.bin", image, 100*time.Hour)
+
+	mock.ExpectQuery(`FROM firmwares WHERE NOT plain_deleted`).
+		WillReturnRows(sqlmock.NewRows(referenceColumns).
+			AddRow("_sha256/good.bin", "firmware 1", len(image), md5Hex, sha256Hex).
+			AddRow("_sha256/short.bin", "firmware 2", len(image), md5Hex, sha256Hex).
+			AddRow("_sha256/corrupt.bin", "firmware 3", len(image), md5Hex, sha256Hex).
+			AddRow("_sha256/missing.bin", "firmware 4", len(image), md5Hex, sha256Hex).
+			AddRow("_sha256/gone.bin", "firmware 5", len(image), md5Hex, sha256Hex))
+	// The row of gone.bin was deleted while the check ran
+	expectStillReferenced(mock, "_sha256/missing.bin", true)
+	expectStillReferenced(mock, "_sha256/gone.bin", false)
+
+	report, err := Run(context.Background(), db, b, Options{VerifyChecksums: true})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	want := map[string]string{
+		"_sha256/short.bin":   KindSizeMismatch,
+		"_sha256/corrupt.bin": KindChecksumMismatch,
+		"_sha256/missing.bin": KindMissing,
+		"_staging/orphan.bin": KindOrphan,
+	}
+	if got := issueKinds(report); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("issues = %v, want %v", got, want)
+	}
+	if report.References != 5 || report.Blobs != 4 || report.Verified != 2 || report.Problems() != 4 {
+		t.Errorf("report counts = %d references, %d blobs, %d verified, %d problems", report.References, report.Blobs, report.Verified, report.Problems())
+	}
+}
+
+func TestRunDeletesOrphans(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := newBucket(t)
+
+	image := []byte("crisp-games 1.4.0")
+	b.put(t, "_sha256/good.bin", image, 100*time.Hour)
+	b.put(t, "_staging/old.bin", image, 100*time.Hour)
+	b.put(t, "_sha256/recorded.bin", image, 100*time.Hour)
+	b.put(t, "_staging/young.bin", image, time.Hour)
+
+	mock.ExpectQuery(`FROM firmwares WHERE NOT plain_deleted`).
+		WillReturnRows(sqlmock.NewRows(referenceColumns).AddRow("_sha256/good.bin", "firmware 1", len(image), "", ""))
+
+	// recorded.bin was recorded by an upload after the references loaded
+	for _, orphan := range []struct {
+		name       string
+		referenced bool
+	}{{"_sha256/recorded.bin", true}, {"_staging/old.bin", false}} {
+		mock.ExpectBegin()
+		mock.ExpectExec(`pg_advisory_xact_lock`).WithArgs(orphan.name).WillReturnResult(sqlmock.NewResult(0, 0))
+		expectStillReferenced(mock, orphan.name, orphan.referenced)
+		if orphan.referenced {
+			mock.ExpectRollback()
+		} else {
+			mock.ExpectCommit()
+		}
+	}
+
+	report, err := Run(context.Background(), db, b, Options{DeleteOrphans: true, GracePeriod: 72 * time.Hour})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	want := map[string]string{
+		"_staging/old.bin":   KindOrphan + " (deleted)",
+		"_staging/young.bin": KindOrphan,
+	}
+	if got := issueKinds(report); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("issues = %v, want %v", got, want)
+	}
+	if report.OrphansDeleted != 1 || report.Problems() != 1 {
+		t.Errorf("deleted %d orphans with %d problems left, want 1 and 1", report.OrphansDeleted, report.Problems())
+	}
+
+	wantKeys := []string{"_sha256/good.bin", "_sha256/recorded.bin", "_staging/young.bin"}
+	if got := b.keys(t); fmt.Sprint(got) != fmt.Sprint(wantKeys) {
+		t.Errorf("blobs left = %v, want %v", got, wantKeys)
+	}
+}
+
+func TestRunDryRunNeverDeletes(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	b := newBucket(t)
+
+	for _, key := range []string{"_sha256/a.bin", "_sha256/b.bin", "_encrypted/c.bin", "_escrow/d.bin", "legacy/e.bin"} {
+		b.put(t, key, []byte(key), 1000*time.Hour)
+	}
+	before := b.keys(t)
+
+	// Nothing is referenced, and no transaction may be opened
+	mock.ExpectQuery(`FROM firmwares WHERE NOT plain_deleted`).WillReturnRows(sqlmock.NewRows(referenceColumns))
+
+	report, err := Run(context.Background(), db, b, Options{VerifyChecksums: true})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	if report.OrphansDeleted != 0 || report.Problems() != len(before) {
+		t.Errorf("dry run deleted %d orphans and reported %d problems, want 0 and %d", report.OrphansDeleted, report.Problems(), len(before))
+	}
+	if after := b.keys(t); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Errorf("dry run left %v, want %v", after, before)
+	}
+}
@@ -0,0 +1,159 @@
+package mqtt
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/fota"
+)
+
+type ScoreMessage struct {
+	Game  string `json:"game"`
+	Score int    `json:"score"`
+}
+
+// ScoreReply is published on devices/{id}/score/reply when a score is rejected
+type ScoreReply struct {
+	Status              string `json:"status"`
+	Game                string `json:"game"`
+	Score               int    `json:"score"`
+	Reason              string `json:"reason"`
+	MinSupportedVersion string `json:"min_supported_version,omitempty"`
+}
+
+func StartWorker(db *sql.DB, broker string) {
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	opts.SetClientID("engine-worker")
+	opts.SetAutoReconnect(true)
+	opts.SetCleanSession(false)
+
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		log.Fatal(token.Error())
+	}
+
+	log.Println("MQTT worker started")
+
+	// Shared subscription for load balancing across multiple workers
+	// Format: $share/group_name/topic
+	sharedTopic := "$share/engine-workers/devices/+/score"
+	if token := client.Subscribe(sharedTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		handleScoreMessage(db, client, msg)
+	}); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", sharedTopic, token.Error())
+	}
+
+	log.Printf("Subscribed to shared topic: %s", sharedTopic)
+
+	fotaTopic := "$share/engine-workers/devices/+/fota/status"
+	if token := client.Subscribe(fotaTopic, 1, func(client mqtt.Client, msg mqtt.Message) {
+		handleFotaStatusMessage(db, msg)
+	}); token.Wait() && token.Error() != nil {
+		log.Fatalf("Failed to subscribe to %s: %v", fotaTopic, token.Error())
+	}
+
+	log.Printf("Subscribed to shared topic: %s", fotaTopic)
+
+	select {} // Keep worker running
+}
+
+func handleScoreMessage(db *sql.DB, client mqtt.Client, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 3 {
+		log.Printf("Invalid topic format: %s", msg.Topic())
+		return
+	}
+
+	deviceID := parts[1]
+
+	var scoreMsg ScoreMessage
+	if err := json.Unmarshal(msg.Payload(), &scoreMsg); err != nil {
+		log.Printf("Failed to parse message from %s: %v", deviceID, err)
+		return
+	}
+
+	log.Printf("Device %s: game=%s, score=%d", deviceID, scoreMsg.Game, scoreMsg.Score)
+
+	deviceQuery := `
+		INSERT INTO devices (id, last_seen)
+		VALUES ($1, $2)
+		ON CONFLICT (id) DO UPDATE SET last_seen = $2
+	`
+	_, err := db.Exec(deviceQuery, deviceID, time.Now())
+	if err != nil {
+		log.Printf("Failed to upsert device %s: %v", deviceID, err)
+		return
+	}
+
+	// Old builds may be exploitable, keep their scores off the leaderboards.
+	// Score messages name a leaderboard, not the catalog game, and a device
+	// could claim any version in them, so the FOTA record decides.
+	support, err := fota.CheckFirmwareSupport(db, deviceID)
+	if err != nil {
+		log.Printf("Failed to check firmware support for device %s: %v", deviceID, err)
+	} else if !support.Supported {
+		log.Printf("Rejected score from device %s: %s", deviceID, support.Reason)
+		rejectScore(client, deviceID, scoreMsg, support)
+		return
+	}
+
+	scoreQuery := `
+        INSERT INTO game_scores (device_id, game_code, score, created_at)
+        VALUES ($1, $2, $3, $4)
+    `
+
+	_, err = db.Exec(scoreQuery, deviceID, scoreMsg.Game, scoreMsg.Score, time.Now())
+	if err != nil {
+		log.Printf("Failed to save score for device %s: %v", deviceID, err)
+		return
+	}
+
+	log.Printf("Score saved successfully for device %s", deviceID)
+}
+
+func rejectScore(client mqtt.Client, deviceID string, scoreMsg ScoreMessage, support fota.SupportStatus) {
+	payload, err := json.Marshal(ScoreReply{
+		Status:              "rejected",
+		Game:                scoreMsg.Game,
+		Score:               scoreMsg.Score,
+		Reason:              support.Reason,
+		MinSupportedVersion: support.MinSupportedVersion,
+	})
+	if err != nil {
+		log.Printf("Failed to encode score reply for device %s: %v", deviceID, err)
+		return
+	}
+
+	// Publishing from a message handler must not wait on the token, the
+	// client would deadlock with the default ordered delivery
+	client.Publish("devices/"+deviceID+"/score/reply", 1, false, payload)
+}
+
+// handleFotaStatusMessage records an update outcome published on
+// devices/{id}/fota/status, the MQTT equivalent of POST /api/fota/report
+func handleFotaStatusMessage(db *sql.DB, msg mqtt.Message) {
+	parts := strings.Split(msg.Topic(), "/")
+	if len(parts) != 4 {
+		log.Printf("Invalid topic format: %s", msg.Topic())
+		return
+	}
+
+	deviceID := parts[1]
+
+	var report fota.UpdateReport
+	if err := json.Unmarshal(msg.Payload(), &report); err != nil {
+		log.Printf("Failed to parse FOTA status from %s: %v", deviceID, err)
+		return
+	}
+	report.DeviceID = deviceID
+
+	if err := fota.RecordUpdateReport(db, report); err != nil {
+		log.Printf("Failed to record FOTA status from %s: %v", deviceID, err)
+	}
+}
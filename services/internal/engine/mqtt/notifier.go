@@ -0,0 +1,49 @@
+package mqtt
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// publishTimeout bounds how long a notification waits for the broker
+const publishTimeout = 10 * time.Second
+
+// Notifier publishes FOTA notifications on its own connection, so the HTTP
+// handlers never depend on the worker's subscriptions
+type Notifier struct {
+	client mqtt.Client
+}
+
+// NewNotifier connects in the background and keeps retrying, so the engine
+// starts serving HTTP even while the broker is unreachable
+func NewNotifier(broker string) *Notifier {
+	hostname, _ := os.Hostname()
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(broker)
+	// Replicas must not share a client ID or the broker keeps kicking them
+	opts.SetClientID("engine-notifier-" + hostname)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(func(mqtt.Client) {
+		log.Println("MQTT notifier connected")
+	})
+
+	client := mqtt.NewClient(opts)
+	client.Connect()
+
+	return &Notifier{client: client}
+}
+
+// Publish sends a QoS 1 message
+func (n *Notifier) Publish(topic string, payload []byte, retained bool) error {
+	token := n.client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		return fmt.Errorf("timed out publishing to %s", topic)
+	}
+	return token.Error()
+}
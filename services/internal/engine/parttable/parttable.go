@@ -0,0 +1,171 @@
+// Package parttable parses ESP-IDF binary partition tables (the
+// partition-table.bin produced by gen_esp32part.py), so the images of a
+// bundle can be checked against the table they ship with.
+package parttable
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// MaxSize is the flash space reserved for the table
+	MaxSize = 0xC00
+
+	entrySize = 32
+	labelSize = 16
+)
+
+var (
+	entryMagic = []byte{0xAA, 0x50}
+	md5Magic   = []byte{0xEB, 0xEB}
+)
+
+// Partition types
+const (
+	TypeApp  = 0x00
+	TypeData = 0x01
+)
+
+// App subtypes: the factory app and the OTA slots
+const (
+	SubtypeFactory = 0x00
+	SubtypeOTAMin  = 0x10
+	SubtypeOTAMax  = 0x1F
+)
+
+var ErrInvalidTable = errors.New("invalid partition table")
+
+// Partition is one entry of a table
+type Partition struct {
+	Label     string `json:"label"`
+	Type      uint8  `json:"type"`
+	Subtype   uint8  `json:"subtype"`
+	Offset    uint32 `json:"offset"`
+	Size      uint32 `json:"size"`
+	Encrypted bool   `json:"encrypted"`
+}
+
+// IsOTASlot reports whether p is an ota_N app partition
+func (p Partition) IsOTASlot() bool {
+	return p.Type == TypeApp && p.Subtype >= SubtypeOTAMin && p.Subtype <= SubtypeOTAMax
+}
+
+// Table is a parsed partition table
+type Table struct {
+	Partitions []Partition `json:"partitions"`
+	// HasMD5 is set when the table carries the MD5 entry checked by the
+	// bootloader
+	HasMD5 bool `json:"has_md5"`
+}
+
+// Find returns the partition with the given label
+func (t *Table) Find(label string) (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.Label == label {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// OTASlots returns the ota_N app partitions
+func (t *Table) OTASlots() []Partition {
+	var slots []Partition
+	for _, p := range t.Partitions {
+		if p.IsOTASlot() {
+			slots = append(slots, p)
+		}
+	}
+	return slots
+}
+
+// BootApp returns the app partition a freshly flashed device boots with
+// erased otadata: the factory partition, or ota_0 when there is none
+func (t *Table) BootApp() (Partition, bool) {
+	for _, p := range t.Partitions {
+		if p.Type == TypeApp && p.Subtype == SubtypeFactory {
+			return p, true
+		}
+	}
+	for _, p := range t.Partitions {
+		if p.Type == TypeApp && p.Subtype == SubtypeOTAMin {
+			return p, true
+		}
+	}
+	return Partition{}, false
+}
+
+// Parse reads a binary partition table, verifying the MD5 entry when
+// present. Entries end at the first erased (0xFF) entry.
+func Parse(data []byte) (*Table, error) {
+	if len(data) > MaxSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds the maximum of %d", ErrInvalidTable, len(data), MaxSize)
+	}
+
+	t := &Table{}
+	labels := make(map[string]bool)
+	for off := 0; off+entrySize <= len(data); off += entrySize {
+		entry := data[off : off+entrySize]
+
+		if bytes.Equal(entry, bytes.Repeat([]byte{0xFF}, entrySize)) {
+			return t, t.validate()
+		}
+
+		if bytes.Equal(entry[0:2], md5Magic) {
+			if sum := md5.Sum(data[:off]); !bytes.Equal(entry[16:32], sum[:]) {
+				return nil, fmt.Errorf("%w: MD5 mismatch", ErrInvalidTable)
+			}
+			t.HasMD5 = true
+			continue
+		}
+
+		if !bytes.Equal(entry[0:2], entryMagic) {
+			return nil, fmt.Errorf("%w: bad magic at entry %d", ErrInvalidTable, off/entrySize)
+		}
+
+		p := Partition{
+			Type:      entry[2],
+			Subtype:   entry[3],
+			Offset:    binary.LittleEndian.Uint32(entry[4:8]),
+			Size:      binary.LittleEndian.Uint32(entry[8:12]),
+			Label:     cString(entry[12 : 12+labelSize]),
+			Encrypted: binary.LittleEndian.Uint32(entry[28:32])&1 != 0,
+		}
+		if p.Label == "" {
+			return nil, fmt.Errorf("%w: entry %d has no label", ErrInvalidTable, off/entrySize)
+		}
+		if labels[p.Label] {
+			return nil, fmt.Errorf("%w: duplicate label %q", ErrInvalidTable, p.Label)
+		}
+		labels[p.Label] = true
+		t.Partitions = append(t.Partitions, p)
+	}
+
+	return nil, fmt.Errorf("%w: missing end marker", ErrInvalidTable)
+}
+
+// validate checks that partitions do not overlap
+func (t *Table) validate() error {
+	if len(t.Partitions) == 0 {
+		return fmt.Errorf("%w: no partitions", ErrInvalidTable)
+	}
+	for i, a := range t.Partitions {
+		for _, b := range t.Partitions[i+1:] {
+			if uint64(a.Offset) < uint64(b.Offset)+uint64(b.Size) && uint64(b.Offset) < uint64(a.Offset)+uint64(a.Size) {
+				return fmt.Errorf("%w: partitions %q and %q overlap", ErrInvalidTable, a.Label, b.Label)
+			}
+		}
+	}
+	return nil
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
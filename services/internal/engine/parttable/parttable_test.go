@@ -0,0 +1,192 @@
+package parttable
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func entry(p Partition) []byte {
+	e := make([]byte, entrySize)
+	copy(e[0:2], entryMagic)
+	e[2] = p.Type
+	e[3] = p.Subtype
+	binary.LittleEndian.PutUint32(e[4:8], p.Offset)
+	binary.LittleEndian.PutUint32(e[8:12], p.Size)
+	copy(e[12:12+labelSize], p.Label)
+	if p.Encrypted {
+		e[28] = 1
+	}
+	return e
+}
+
+// table encodes partitions the way gen_esp32part.py does, with the MD5
+// entry and the end marker padded to MaxSize
+func table(parts []Partition, withMD5 bool) []byte {
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(entry(p))
+	}
+	if withMD5 {
+		sum := md5.Sum(buf.Bytes())
+		e := bytes.Repeat([]byte{0xFF}, entrySize)
+		copy(e[0:2], md5Magic)
+		copy(e[16:32], sum[:])
+		buf.Write(e)
+	}
+	buf.Write(bytes.Repeat([]byte{0xFF}, MaxSize-buf.Len()))
+	return buf.Bytes()
+}
+
+// otaLayout is the two-slot layout of the M5StickC Plus builds
+var otaLayout = []Partition{
+	{Label: "nvs", Type: TypeData, Subtype: 0x02, Offset: 0x9000, Size: 0x5000},
+	{Label: "otadata", Type: TypeData, Subtype: 0x00, Offset: 0xE000, Size: 0x2000},
+	{Label: "app0", Type: TypeApp, Subtype: SubtypeOTAMin, Offset: 0x10000, Size: 0x140000},
+	{Label: "app1", Type: TypeApp, Subtype: SubtypeOTAMin + 1, Offset: 0x150000, Size: 0x140000},
+	{Label: "spiffs", Type: TypeData, Subtype: 0x82, Offset: 0x290000, Size: 0x160000, Encrypted: true},
+	{Label: "coredump", Type: TypeData, Subtype: 0x03, Offset: 0x3F0000, Size: 0x10000},
+}
+
+var factoryLayout = []Partition{
+	{Label: "nvs", Type: TypeData, Subtype: 0x02, Offset: 0x9000, Size: 0x6000},
+	{Label: "phy_init", Type: TypeData, Subtype: 0x01, Offset: 0xF000, Size: 0x1000},
+	{Label: "factory", Type: TypeApp, Subtype: SubtypeFactory, Offset: 0x10000, Size: 0x100000},
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []Partition
+		wantMD5 bool
+	}{
+		{name: "OTA layout with MD5", data: table(otaLayout, true), want: otaLayout, wantMD5: true},
+		{name: "OTA layout without MD5", data: table(otaLayout, false), want: otaLayout},
+		{name: "factory layout", data: table(factoryLayout, true), want: factoryLayout, wantMD5: true},
+		{name: "unpadded", data: table(factoryLayout, true)[:5*entrySize], want: factoryLayout, wantMD5: true},
+		{name: "full-length label", data: table([]Partition{{Label: "abcdefghijklmnop", Type: TypeApp, Offset: 0x10000, Size: 0x1000}}, false),
+			want: []Partition{{Label: "abcdefghijklmnop", Type: TypeApp, Offset: 0x10000, Size: 0x1000}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.data)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if !reflect.DeepEqual(got.Partitions, tt.want) {
+				t.Errorf("Partitions = %+v\nwant %+v", got.Partitions, tt.want)
+			}
+			if got.HasMD5 != tt.wantMD5 {
+				t.Errorf("HasMD5 = %v, want %v", got.HasMD5, tt.wantMD5)
+			}
+		})
+	}
+}
+
+func TestParseRejectsInvalidTables(t *testing.T) {
+	valid := table(otaLayout, true)
+
+	corrupt := func(offset int, b byte) []byte {
+		data := bytes.Clone(valid)
+		data[offset] = b
+		return data
+	}
+	overlapping := append([]Partition{}, otaLayout...)
+	overlapping[3].Offset = 0x140000
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "too large", data: append(bytes.Clone(valid), 0xFF), want: "exceeds the maximum"},
+		{name: "empty", data: nil, want: "missing end marker"},
+		{name: "no end marker", data: valid[:len(otaLayout)*entrySize], want: "missing end marker"},
+		{name: "no partitions", data: bytes.Repeat([]byte{0xFF}, MaxSize), want: "no partitions"},
+		{name: "bad magic", data: corrupt(2*entrySize, 0xAB), want: "bad magic at entry 2"},
+		{name: "MD5 mismatch", data: corrupt(entrySize+4, 0x01), want: "MD5 mismatch"},
+		{name: "no label", data: table([]Partition{{Type: TypeApp, Offset: 0x10000, Size: 0x1000}}, true), want: "entry 0 has no label"},
+		{name: "duplicate label", data: table(append(append([]Partition{}, factoryLayout...), Partition{Label: "nvs", Type: TypeData, Offset: 0x200000, Size: 0x1000}), true), want: `duplicate label "nvs"`},
+		{name: "overlap", data: table(overlapping, true), want: `"app0" and "app1" overlap`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if !errors.Is(err, ErrInvalidTable) {
+				t.Fatalf("Parse() error = %v, want ErrInvalidTable", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse() error = %q, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTableLookups(t *testing.T) {
+	ota, err := Parse(table(otaLayout, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	factory, err := Parse(table(factoryLayout, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p, ok := ota.Find("spiffs"); !ok || p.Offset != 0x290000 || !p.Encrypted {
+		t.Errorf(`Find("spiffs") = %+v, %v`, p, ok)
+	}
+	if _, ok := ota.Find("factory"); ok {
+		t.Errorf(`Find("factory") found a partition in a table without one`)
+	}
+
+	slots := ota.OTASlots()
+	if len(slots) != 2 || slots[0].Label != "app0" || slots[1].Label != "app1" {
+		t.Errorf("OTASlots() = %+v, want app0 and app1", slots)
+	}
+	if slots := factory.OTASlots(); len(slots) != 0 {
+		t.Errorf("OTASlots() of the factory layout = %+v, want none", slots)
+	}
+
+	tests := []struct {
+		name  string
+		table *Table
+		want  string
+	}{
+		{name: "ota_0 without factory", table: ota, want: "app0"},
+		{name: "factory", table: factory, want: "factory"},
+		{name: "factory before ota_0", table: &Table{Partitions: append(append([]Partition{}, otaLayout...), Partition{Label: "factory", Type: TypeApp, Subtype: SubtypeFactory})}, want: "factory"},
+		{name: "no app", table: &Table{Partitions: otaLayout[:2]}, want: ""},
+	}
+	for _, tt := range tests {
+		p, ok := tt.table.BootApp()
+		if ok != (tt.want != "") || p.Label != tt.want {
+			t.Errorf("BootApp() of %s = %q, %v; want %q", tt.name, p.Label, ok, tt.want)
+		}
+	}
+}
+
+func TestIsOTASlot(t *testing.T) {
+	tests := []struct {
+		p    Partition
+		want bool
+	}{
+		{Partition{Type: TypeApp, Subtype: SubtypeOTAMin}, true},
+		{Partition{Type: TypeApp, Subtype: SubtypeOTAMax}, true},
+		{Partition{Type: TypeApp, Subtype: SubtypeFactory}, false},
+		{Partition{Type: TypeApp, Subtype: 0x20}, false},
+		{Partition{Type: TypeData, Subtype: SubtypeOTAMin}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.p.IsOTASlot(); got != tt.want {
+			t.Errorf("IsOTASlot() of type %d subtype 0x%02X = %v, want %v", tt.p.Type, tt.p.Subtype, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Package signing signs firmware digests and update manifests with Ed25519
+// so devices can verify them against a public key embedded in the firmware.
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Algorithm names the signature scheme advertised to devices
+const Algorithm = "ed25519"
+
+// PublicKey is a verification key devices may trust
+type PublicKey struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"public_key"`
+}
+
+// Signature is a base64 Ed25519 signature with the ID of the key that made it
+type Signature struct {
+	KeyID string
+	Value string
+}
+
+// Signer holds the active signing key and every key devices may still be
+// verifying with, so the signing key can be rotated without bricking devices
+// that only embed an older public key
+type Signer struct {
+	keyID      string
+	privateKey ed25519.PrivateKey
+	keys       []PublicKey
+}
+
+// NewSigner creates a signer from a base64 Ed25519 seed (32 bytes) or full
+// private key (64 bytes). verificationKeys is a comma separated list of
+// "key-id:base64-public-key" entries kept active alongside the signing key.
+func NewSigner(keyID, privateKey, verificationKeys string) (*Signer, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("signing key ID is required")
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode signing key: %w", err)
+	}
+
+	var priv ed25519.PrivateKey
+	switch len(raw) {
+	case ed25519.SeedSize:
+		priv = ed25519.NewKeyFromSeed(raw)
+	case ed25519.PrivateKeySize:
+		// The second half is the public key; a mismatch would sign with one
+		// key while advertising another
+		priv = ed25519.NewKeyFromSeed(raw[:ed25519.SeedSize])
+		if !bytes.Equal(priv[ed25519.SeedSize:], raw[ed25519.SeedSize:]) {
+			return nil, fmt.Errorf("signing key's public half does not match its seed")
+		}
+	default:
+		return nil, fmt.Errorf("signing key must be %d or %d bytes, got %d", ed25519.SeedSize, ed25519.PrivateKeySize, len(raw))
+	}
+
+	s := &Signer{
+		keyID:      keyID,
+		privateKey: priv,
+		keys: []PublicKey{{
+			ID:        keyID,
+			Algorithm: Algorithm,
+			Key:       base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey)),
+		}},
+	}
+
+	for _, entry := range strings.Split(verificationKeys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, key, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("invalid verification key %q, expected key-id:base64-key", entry)
+		}
+		if id == keyID {
+			continue
+		}
+
+		pub, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid verification key %q", id)
+		}
+
+		s.keys = append(s.keys, PublicKey{ID: id, Algorithm: Algorithm, Key: key})
+	}
+
+	return s, nil
+}
+
+// KeyID returns the ID of the active signing key
+func (s *Signer) KeyID() string {
+	return s.keyID
+}
+
+// Sign signs message with the active key
+func (s *Signer) Sign(message []byte) Signature {
+	return Signature{
+		KeyID: s.keyID,
+		Value: base64.StdEncoding.EncodeToString(ed25519.Sign(s.privateKey, message)),
+	}
+}
+
+// PublicKeys returns every key devices may verify with, active key first
+func (s *Signer) PublicKeys() []PublicKey {
+	return s.keys
+}
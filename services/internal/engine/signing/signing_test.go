@@ -0,0 +1,150 @@
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func newKey(t *testing.T, seed byte) (ed25519.PrivateKey, string) {
+	t.Helper()
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	return priv, base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+}
+
+func verify(t *testing.T, key PublicKey, message []byte, sig Signature) bool {
+	t.Helper()
+	pub, err := base64.StdEncoding.DecodeString(key.Key)
+	if err != nil {
+		t.Fatalf("public key %s: %v", key.ID, err)
+	}
+	value, err := base64.StdEncoding.DecodeString(sig.Value)
+	if err != nil {
+		t.Fatalf("signature: %v", err)
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), message, value)
+}
+
+func TestNewSigner(t *testing.T) {
+	priv, pub := newKey(t, 1)
+	_, otherPub := newKey(t, 2)
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+	full := base64.StdEncoding.EncodeToString(priv)
+
+	// A full key whose second half belongs to another key
+	mismatched := append(bytes.Clone(priv.Seed()), ed25519.NewKeyFromSeed(bytes.Repeat([]byte{2}, ed25519.SeedSize)).Public().(ed25519.PublicKey)...)
+
+	tests := []struct {
+		name             string
+		keyID            string
+		privateKey       string
+		verificationKeys string
+		wantKeys         []string
+		wantErr          string
+	}{
+		{name: "seed", keyID: "k1", privateKey: seed, wantKeys: []string{"k1"}},
+		{name: "full private key", keyID: "k1", privateKey: full, wantKeys: []string{"k1"}},
+		{name: "verification keys", keyID: "k2", privateKey: seed, verificationKeys: " k1:" + otherPub + " , k0:" + otherPub + ",", wantKeys: []string{"k2", "k1", "k0"}},
+		{name: "active key listed again", keyID: "k1", privateKey: seed, verificationKeys: "k1:" + pub, wantKeys: []string{"k1"}},
+		{name: "no key ID", privateKey: seed, wantErr: "key ID is required"},
+		{name: "not base64", keyID: "k1", privateKey: "not base64!", wantErr: "failed to decode"},
+		{name: "wrong size", keyID: "k1", privateKey: base64.StdEncoding.EncodeToString(make([]byte, 48)), wantErr: "must be 32 or 64 bytes"},
+		{name: "mismatched public half", keyID: "k1", privateKey: base64.StdEncoding.EncodeToString(mismatched), wantErr: "does not match"},
+		{name: "verification key without ID", keyID: "k1", privateKey: seed, verificationKeys: otherPub, wantErr: "expected key-id:base64-key"},
+		{name: "empty verification key ID", keyID: "k1", privateKey: seed, verificationKeys: ":" + otherPub, wantErr: "expected key-id:base64-key"},
+		{name: "short verification key", keyID: "k1", privateKey: seed, verificationKeys: "k0:" + base64.StdEncoding.EncodeToString(make([]byte, 16)), wantErr: `invalid verification key "k0"`},
+		{name: "garbled verification key", keyID: "k1", privateKey: seed, verificationKeys: "k0:%%%", wantErr: `invalid verification key "k0"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewSigner(tt.keyID, tt.privateKey, tt.verificationKeys)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("NewSigner() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSigner: %v", err)
+			}
+
+			var ids []string
+			for _, k := range s.PublicKeys() {
+				ids = append(ids, k.ID)
+				if k.Algorithm != Algorithm {
+					t.Errorf("key %s algorithm = %q, want %q", k.ID, k.Algorithm, Algorithm)
+				}
+			}
+			if strings.Join(ids, ",") != strings.Join(tt.wantKeys, ",") {
+				t.Errorf("PublicKeys() = %v, want %v", ids, tt.wantKeys)
+			}
+			if s.KeyID() != tt.keyID {
+				t.Errorf("KeyID() = %q, want %q", s.KeyID(), tt.keyID)
+			}
+			if got := s.PublicKeys()[0].Key; got != pub {
+				t.Errorf("active public key = %s, want %s", got, pub)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	priv, _ := newKey(t, 1)
+	s, err := NewSigner("k1", base64.StdEncoding.EncodeToString(priv.Seed()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message := []byte(`{"game":"crisp-games","version":"1.4.0"}`)
+	sig := s.Sign(message)
+	if sig.KeyID != "k1" {
+		t.Errorf("Sign() key ID = %q, want k1", sig.KeyID)
+	}
+	if !verify(t, s.PublicKeys()[0], message, sig) {
+		t.Errorf("signature does not verify with the active key")
+	}
+
+	tampered := bytes.Replace(message, []byte("1.4.0"), []byte("1.5.0"), 1)
+	if verify(t, s.PublicKeys()[0], tampered, sig) {
+		t.Errorf("signature verifies a tampered message")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldPriv, oldPub := newKey(t, 1)
+	newPriv, _ := newKey(t, 2)
+
+	old, err := NewSigner("2024", base64.StdEncoding.EncodeToString(oldPriv.Seed()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := NewSigner("2025", base64.StdEncoding.EncodeToString(newPriv.Seed()), "2024:"+oldPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Devices embedding the old key still find it listed, but new
+	// signatures are made with, and only verify against, the new key
+	keys := rotated.PublicKeys()
+	if len(keys) != 2 || keys[0].ID != "2025" || keys[1].ID != "2024" || keys[1].Key != old.PublicKeys()[0].Key {
+		t.Fatalf("PublicKeys() after rotation = %+v", keys)
+	}
+
+	message := []byte("manifest")
+	sig := rotated.Sign(message)
+	if sig.KeyID != "2025" {
+		t.Errorf("Sign() key ID = %q, want 2025", sig.KeyID)
+	}
+	if !verify(t, keys[0], message, sig) {
+		t.Errorf("new signature does not verify with the new key")
+	}
+	if verify(t, keys[1], message, sig) {
+		t.Errorf("new signature verifies with the retired key")
+	}
+	if !verify(t, keys[1], message, old.Sign(message)) {
+		t.Errorf("old signature does not verify with the listed old key")
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/fota"
+	"github.com/gin-gonic/gin"
+)
+
+// FirmwareRelease is a release row of the firmware page, formatted for display
+type FirmwareRelease struct {
+	fota.ReleaseStats
+	CompletionPercent string
+	MedianTransfer    string
+	Served            string
+}
+
+func (h *Handler) ShowFirmware(c *gin.Context) {
+	game := c.Query("game")
+
+	stats, err := fota.QueryReleaseStats(h.db, fota.StatsFilter{Game: game})
+	if err != nil {
+		log.Printf("Failed to query release statistics: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	var releases []FirmwareRelease
+	for _, s := range stats {
+		rel := FirmwareRelease{
+			ReleaseStats:      s,
+			CompletionPercent: "-",
+			MedianTransfer:    "-",
+			Served:            formatBytes(s.BytesServed),
+		}
+		// Direct downloads from storage are never seen completing
+		if s.DownloadsStarted > s.DirectDownloads {
+			rel.CompletionPercent = fmt.Sprintf("%.0f%%", s.CompletionRate*100)
+		}
+		if s.MedianTransferMS != nil {
+			rel.MedianTransfer = fmt.Sprintf("%.1f s", *s.MedianTransferMS/1000)
+		}
+		releases = append(releases, rel)
+	}
+
+	c.HTML(http.StatusOK, "firmware.html", gin.H{
+		"releases": releases,
+		"game":     game,
+	})
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
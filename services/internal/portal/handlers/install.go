@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/TsybulkaM/M5StickCplus-multiplayer-crisp-games/internal/engine/fota"
+	"github.com/gin-gonic/gin"
+)
+
+// InstallRelease is a release row of the install page
+type InstallRelease struct {
+	fota.InstallableRelease
+	ManifestURL string
+	Size        string
+}
+
+// ShowInstall lists the releases that can be flashed onto a blank stick
+// over Web Serial with ESP Web Tools
+func (h *Handler) ShowInstall(c *gin.Context) {
+	game := c.Query("game")
+
+	installable, err := fota.QueryInstallableReleases(h.db, game)
+	if err != nil {
+		log.Printf("Failed to query installable releases: %v", err)
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{"error": err.Error()})
+		return
+	}
+
+	var releases []InstallRelease
+	for _, rel := range installable {
+		params := url.Values{}
+		params.Set("game", rel.Game)
+		params.Set("board", rel.Board)
+		params.Set("version", rel.Version)
+		releases = append(releases, InstallRelease{
+			InstallableRelease: rel,
+			ManifestURL:        h.engineURL + "/api/fota/webflash/manifest.json?" + params.Encode(),
+			Size:               formatBytes(rel.FileSize),
+		})
+	}
+
+	c.HTML(http.StatusOK, "install.html", gin.H{
+		"releases": releases,
+		"game":     game,
+	})
+}
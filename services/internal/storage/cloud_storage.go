@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
+	"time"
 
 	"gocloud.dev/blob"
 	_ "gocloud.dev/blob/azureblob" // Azure Blob Storage driver
 	_ "gocloud.dev/blob/fileblob"  // Local filesystem driver
+	"gocloud.dev/gcerrors"
 )
 
 // CloudStorage implements Storage interface using Go Cloud Development Kit
@@ -31,18 +34,24 @@ func NewCloudStorage(ctx context.Context, url string, baseURL string) (*CloudSto
 	}, nil
 }
 
-// Upload uploads a file to storage
+// Upload uploads a file to storage. If reading data fails the write is
+// aborted, leaving any existing blob under key untouched.
 func (s *CloudStorage) Upload(ctx context.Context, key string, data io.Reader, contentType string) (string, error) {
 	opts := &blob.WriterOptions{
 		ContentType: contentType,
 	}
 
-	w, err := s.bucket.NewWriter(ctx, key, opts)
+	// Canceling the writer's context before Close discards the partial blob
+	writeCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w, err := s.bucket.NewWriter(writeCtx, key, opts)
 	if err != nil {
 		return "", fmt.Errorf("failed to create writer: %w", err)
 	}
 
 	if _, err := io.Copy(w, data); err != nil {
+		cancel()
 		w.Close()
 		return "", fmt.Errorf("failed to write data: %w", err)
 	}
@@ -69,6 +78,16 @@ func (s *CloudStorage) Download(ctx context.Context, key string) (io.ReadCloser,
 	return reader, nil
 }
 
+// DownloadRange retrieves a byte range of a file without reading the bytes before it
+func (s *CloudStorage) DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	reader, err := s.bucket.NewRangeReader(ctx, key, offset, length, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create range reader: %w", err)
+	}
+
+	return reader, nil
+}
+
 // Delete removes a file from storage
 func (s *CloudStorage) Delete(ctx context.Context, key string) error {
 	if err := s.bucket.Delete(ctx, key); err != nil {
@@ -78,6 +97,39 @@ func (s *CloudStorage) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// Copy copies a file within the bucket, server-side where supported
+func (s *CloudStorage) Copy(ctx context.Context, dstKey, srcKey string) error {
+	if err := s.bucket.Copy(ctx, dstKey, srcKey, nil); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+// Exists reports whether a file exists
+func (s *CloudStorage) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := s.bucket.Exists(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s: %w", key, err)
+	}
+	return exists, nil
+}
+
+// SignedURL returns a time-limited download URL, e.g. an Azure SAS URL
+func (s *CloudStorage) SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	url, err := s.bucket.SignedURL(ctx, key, &blob.SignedURLOptions{
+		Expiry: expiry,
+		Method: http.MethodGet,
+	})
+	if gcerrors.Code(err) == gcerrors.Unimplemented {
+		return "", ErrSignedURLUnsupported
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to sign URL: %w", err)
+	}
+
+	return url, nil
+}
+
 // GetURL returns the public URL for a file
 func (s *CloudStorage) GetURL(ctx context.Context, key string) (string, error) {
 	if s.baseURL != "" {
@@ -91,7 +143,22 @@ func (s *CloudStorage) GetURL(ctx context.Context, key string) (string, error) {
 
 // List lists all files with the given prefix
 func (s *CloudStorage) List(ctx context.Context, prefix string) ([]string, error) {
-	var keys []string
+	objects, err := s.ListObjects(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		keys = append(keys, obj.Key)
+	}
+
+	return keys, nil
+}
+
+// ListObjects lists all files with the given prefix with their attributes
+func (s *CloudStorage) ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
 
 	iter := s.bucket.List(&blob.ListOptions{
 		Prefix: prefix,
@@ -105,11 +172,14 @@ func (s *CloudStorage) List(ctx context.Context, prefix string) ([]string, error
 		if err != nil {
 			return nil, fmt.Errorf("failed to list objects: %w", err)
 		}
+		if obj.IsDir {
+			continue
+		}
 
-		keys = append(keys, obj.Key)
+		objects = append(objects, ObjectInfo{Key: obj.Key, Size: obj.Size, ModTime: obj.ModTime})
 	}
 
-	return keys, nil
+	return objects, nil
 }
 
 // Close closes the storage connection
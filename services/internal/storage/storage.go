@@ -2,9 +2,22 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"io"
+	"time"
 )
 
+// ErrSignedURLUnsupported is returned by SignedURL when the backend cannot
+// issue signed URLs (e.g. the local filesystem)
+var ErrSignedURLUnsupported = errors.New("storage backend does not support signed URLs")
+
+// ObjectInfo describes a stored file
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
 // Storage is an interface for blob storage operations (firmware files)
 type Storage interface {
 	// Upload uploads a file to storage and returns the public URL
@@ -13,15 +26,33 @@ type Storage interface {
 	// Download retrieves a file from storage
 	Download(ctx context.Context, key string) (io.ReadCloser, error)
 
+	// DownloadRange retrieves length bytes of a file starting at offset.
+	// A negative length reads to the end of the file.
+	DownloadRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+
 	// Delete removes a file from storage
 	Delete(ctx context.Context, key string) error
 
+	// Copy copies a file within storage, replacing dstKey if it exists
+	Copy(ctx context.Context, dstKey, srcKey string) error
+
+	// Exists reports whether a file exists
+	Exists(ctx context.Context, key string) (bool, error)
+
 	// GetURL returns the public URL for a file
 	GetURL(ctx context.Context, key string) (string, error)
 
+	// SignedURL returns a URL granting read access to a file until expiry
+	// elapses, or ErrSignedURLUnsupported
+	SignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+
 	// List lists all files with the given prefix
 	List(ctx context.Context, prefix string) ([]string, error)
 
+	// ListObjects lists all files with the given prefix with their size and
+	// modification time
+	ListObjects(ctx context.Context, prefix string) ([]ObjectInfo, error)
+
 	// Close closes the storage connection
 	Close() error
 }
@@ -6,6 +6,7 @@ export MQTT_BROKER="tcp://localhost:1883"
 export STORAGE_TYPE="local"
 export LOCAL_STORAGE_PATH="./firmware_storage"
 export ADMIN_API_TOKEN="dev-token-12345"
+export DOWNLOAD_URL_SECRET="dev-download-secret"
 
 # Create storage directory if it doesn't exist
 mkdir -p ./firmware_storage
@@ -27,6 +28,7 @@ MQTT_BROKER="$MQTT_BROKER" \
 STORAGE_TYPE="$STORAGE_TYPE" \
 LOCAL_STORAGE_PATH="$LOCAL_STORAGE_PATH" \
 ADMIN_API_TOKEN="$ADMIN_API_TOKEN" \
+DOWNLOAD_URL_SECRET="$DOWNLOAD_URL_SECRET" \
 ./engine-app &
 ENGINE_PID=$!
 